@@ -0,0 +1,231 @@
+package contentstore
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access counts are the number of reads (Get() and CopyTo()) of each blob
+// and when it was last read. They're kept in memory and saved to a file when
+// the store is closed and, so that we don't lose all of them when the process
+// crashes, in the background after every accessFlushHits reads or
+// accessFlushInterval, whichever comes first. Reads never wait for saving.
+// They're approximate: reads since the last save are lost on crash.
+//
+// The file has a line for each blob: id, number of reads and time of the
+// last read in unix seconds (missing in files written by old versions).
+
+var (
+	errInvalidAccessFile = errors.New("invalid access counts file")
+	// first line in access counts file
+	accessHdr = "github.com/kjk/contentstore access 1.0"
+)
+
+const (
+	// how many reads between saving access counts
+	accessFlushHits = 64 * 1024
+	// max time between saving access counts, if there were reads
+	accessFlushInterval = 5 * time.Minute
+)
+
+type accessInfo struct {
+	hits int64
+	// unix seconds
+	lastRead int64
+}
+
+type accessCounts struct {
+	hits map[[20]byte]accessInfo
+	// reads since access counts were last saved
+	unflushed int
+	// unix seconds of the last save
+	lastFlush int64
+	// true if we're saving access counts in the background
+	flushing bool
+	// lets Close() wait for the save in the background
+	flushWg sync.WaitGroup
+}
+
+// WithAccessCounts makes the store count reads of each blob and remember
+// when it was last read. Use TopN() to find the most popular blobs and
+// LastRead() to find when a blob was last read
+func WithAccessCounts() Option {
+	return func(store *Store) {
+		store.access = &accessCounts{
+			hits:      make(map[[20]byte]accessInfo),
+			lastFlush: time.Now().Unix(),
+		}
+	}
+}
+
+// AccessCount is the number of reads of a blob
+type AccessCount struct {
+	Id   string
+	Hits int64
+}
+
+func accessFilePath(basePath string) string {
+	return basePath + "_access.txt"
+}
+
+func readAccessCounts(basePath string, hits map[[20]byte]accessInfo) error {
+	file, err := openFile(accessFilePath(basePath), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	recs, err := csvReader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 || len(recs[0]) != 1 || recs[0][0] != accessHdr {
+		return errInvalidAccessFile
+	}
+	for _, rec := range recs[1:] {
+		if len(rec) != 2 && len(rec) != 3 {
+			return errInvalidAccessFile
+		}
+		sha1, ok := sha1FromId(rec[0])
+		if !ok {
+			return errInvalidAccessFile
+		}
+		var ai accessInfo
+		if ai.hits, err = strconv.ParseInt(rec[1], 10, 64); err != nil {
+			return err
+		}
+		if len(rec) == 3 {
+			if ai.lastRead, err = strconv.ParseInt(rec[2], 10, 64); err != nil {
+				return err
+			}
+		}
+		hits[sha1] = ai
+	}
+	return nil
+}
+
+// writeAccessCounts atomically replaces access counts file
+func writeAccessCounts(basePath string, hits map[[20]byte]accessInfo) error {
+	return writeFileAtomically(accessFilePath(basePath), func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{accessHdr})
+		for sha1, ai := range hits {
+			csvWriter.Write([]string{fmt.Sprintf("%x", sha1[:]), strconv.FormatInt(ai.hits, 10), strconv.FormatInt(ai.lastRead, 10)})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	})
+}
+
+func copyHits(hits map[[20]byte]accessInfo) map[[20]byte]accessInfo {
+	res := make(map[[20]byte]accessInfo, len(hits))
+	for sha1, ai := range hits {
+		res[sha1] = ai
+	}
+	return res
+}
+
+// readAccessCounts loads access counts saved by previous runs
+func (store *Store) readAccessCounts() {
+	if store.access != nil {
+		// counts are approximate so it's fine if we can't read them
+		readAccessCounts(store.basePath, store.access.hits)
+	}
+}
+
+// countAccess records a read of the blob. Must be called with store locked
+func (store *Store) countAccess(sha1 [20]byte) {
+	ac := store.access
+	if ac == nil {
+		return
+	}
+	now := time.Now().Unix()
+	ai := ac.hits[sha1]
+	ai.hits++
+	ai.lastRead = now
+	ac.hits[sha1] = ai
+	ac.unflushed++
+	if ac.unflushed < accessFlushHits && now-ac.lastFlush < int64(accessFlushInterval/time.Second) {
+		return
+	}
+	if ac.flushing || store.readOnly {
+		return
+	}
+	select {
+	case <-store.closing:
+		// Close() saves them
+		return
+	default:
+	}
+	ac.unflushed = 0
+	ac.lastFlush = now
+	ac.flushing = true
+	hits := copyHits(ac.hits)
+	ac.flushWg.Add(1)
+	go func() {
+		defer ac.flushWg.Done()
+		// it's ok if we fail, we'll try again later
+		writeAccessCounts(store.basePath, hits)
+		store.Lock()
+		ac.flushing = false
+		store.Unlock()
+	}()
+}
+
+// TopN returns up to n most read blobs, the most read first. Returns nil
+// if the store wasn't opened with WithAccessCounts()
+func (store *Store) TopN(n int) []AccessCount {
+	store.Lock()
+	defer store.Unlock()
+	if store.access == nil {
+		return nil
+	}
+	var top []AccessCount
+	var sha1s [][20]byte
+	for sha1 := range store.access.hits {
+		sha1s = append(sha1s, sha1)
+	}
+	hits := store.access.hits
+	sort.Slice(sha1s, func(i, j int) bool {
+		a, b := sha1s[i], sha1s[j]
+		if hits[a].hits != hits[b].hits {
+			return hits[a].hits > hits[b].hits
+		}
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	if len(sha1s) > n {
+		sha1s = sha1s[:n]
+	}
+	for _, sha1 := range sha1s {
+		top = append(top, AccessCount{
+			Id:   fmt.Sprintf("%x", sha1[:]),
+			Hits: hits[sha1].hits,
+		})
+	}
+	return top
+}
+
+// LastRead returns when the blob was last read. It's zero if it wasn't read
+// or the store wasn't opened with WithAccessCounts()
+func (store *Store) LastRead(id string) time.Time {
+	sha1, ok := sha1FromId(id)
+	store.Lock()
+	defer store.Unlock()
+	if !ok || store.access == nil {
+		return time.Time{}
+	}
+	ai := store.access.hits[sha1]
+	if ai.lastRead == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ai.lastRead, 0)
+}
@@ -0,0 +1,185 @@
+package contentstore
+
+import (
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Admin page shows stats of the store, its segments, recent requests and
+// allows looking up blobs. It's meant for debugging so it's disabled
+// by default. Don't expose it to the internet.
+
+const (
+	adminPath = "/admin"
+	// how many recent requests we remember
+	maxRecentRequests = 100
+)
+
+// requestInfo describes a request served by Handler
+type requestInfo struct {
+	Time      time.Time
+	RequestId string
+	Method    string
+	Path      string
+	Status    int
+	Size      int64
+	Duration  time.Duration
+}
+
+// recentRequests is a ring buffer of recently served requests
+type recentRequests struct {
+	mu   sync.Mutex
+	reqs []requestInfo
+	next int
+}
+
+func (rr *recentRequests) add(ri requestInfo) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.reqs) < maxRecentRequests {
+		rr.reqs = append(rr.reqs, ri)
+		return
+	}
+	rr.reqs[rr.next] = ri
+	rr.next = (rr.next + 1) % maxRecentRequests
+}
+
+// newestFirst returns copy of remembered requests, newest first
+func (rr *recentRequests) newestFirst() []requestInfo {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	n := len(rr.reqs)
+	res := make([]requestInfo, n)
+	for i := 0; i < n; i++ {
+		res[i] = rr.reqs[(rr.next+n-1-i)%n]
+	}
+	return res
+}
+
+// statusRecorder remembers status and size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(d []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(d)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statser is implemented by stores that can report stats, like *Store
+type statser interface {
+	Stats() (Stats, error)
+}
+
+type adminPageData struct {
+	Health   error
+	Stats    *Stats
+	StatsErr error
+	LookupId string
+	Lookup   *BlobInfo
+	Recent   []requestInfo
+}
+
+var adminTmpl = template.Must(template.New("admin").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>contentstore admin</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 8px; text-align: right; }
+th { background-color: #eee; }
+</style>
+</head>
+<body>
+<h2>Lookup</h2>
+<form method="GET" action="/admin">
+<input name="id" size="44" value="{{.LookupId}}"> <input type="submit" value="Lookup">
+</form>
+{{if .LookupId}}
+{{if .Lookup}}
+<p><a href="/blobs/{{.Lookup.Id}}">{{.Lookup.Id}}</a>: {{.Lookup.Size}} bytes</p>
+{{else}}
+<p>{{.LookupId}} not found</p>
+{{end}}
+{{end}}
+
+<h2>Stats</h2>
+{{if .Health}}<p style="color: red">{{.Health}}</p>{{end}}
+{{with .Stats}}
+<table>
+<tr><td>blobs</td><td>{{.Blobs}}</td></tr>
+<tr><td>blobs size</td><td>{{.BlobsSize}}</td></tr>
+<tr><td>index size</td><td>{{.IndexSize}}</td></tr>
+<tr><td>segments size</td><td>{{.SegmentsSize}}</td></tr>
+<tr><td>dedup hits</td><td>{{.DedupHits}}</td></tr>
+<tr><td>dedup savings</td><td>{{.DedupSavedBytes}}</td></tr>
+</table>
+
+<h2>Segments</h2>
+<table>
+<tr><th>segment</th><th>blobs</th><th>blobs size</th><th>file size</th></tr>
+{{range .Segments}}
+<tr><td>{{.No}}</td><td>{{.Blobs}}</td><td>{{.BlobsSize}}</td><td>{{if .Missing}}missing{{else}}{{.FileSize}}{{end}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>{{if .StatsErr}}Failed to get stats: {{.StatsErr}}{{else}}Store doesn't provide stats{{end}}</p>
+{{end}}
+
+<h2>Recent requests</h2>
+<table>
+<tr><th>time</th><th>request id</th><th>method</th><th>path</th><th>status</th><th>size</th><th>duration</th></tr>
+{{range .Recent}}
+<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.RequestId}}</td><td>{{.Method}}</td><td style="text-align: left">{{.Path}}</td><td>{{.Status}}</td><td>{{.Size}}</td><td>{{.Duration}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	data := adminPageData{
+		LookupId: r.URL.Query().Get("id"),
+		Recent:   h.recent.newestFirst(),
+	}
+	if checker, ok := h.store.(healthChecker); ok {
+		data.Health = checker.Health()
+	}
+	if s, ok := h.store.(statser); ok {
+		stats, err := s.Stats()
+		if err == nil {
+			data.Stats = &stats
+		}
+		data.StatsErr = err
+	}
+	if data.LookupId != "" {
+		if info, err := h.store.Stat(data.LookupId); err == nil {
+			data.Lookup = &info
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	adminTmpl.Execute(w, &data)
+}
@@ -0,0 +1,246 @@
+package contentstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// To help applications migrate from sha1 to sha256 ids, a store opened with
+// WithSha256Ids() also finds blobs by hex sha256 of their content. Ids
+// returned by Put() are still sha1 so that references can be changed
+// gradually: Sha256Id() returns the new id of a blob and both ids work for
+// reading and deleting it.
+//
+// We keep a table of sha256 -> sha1 aliases in memory and in a file. The
+// writer goroutine appends aliases of new blobs to it when it commits them.
+// Aliases of deleted blobs are not removed: they don't find anything.
+// Aliases of blobs stored before the option was used (or lost in a crash)
+// are added by AddSha256Ids().
+//
+// Alias file has a header line followed by "<sha256> <sha1>" lines, in hex.
+
+var (
+	errNoSha256Ids = errors.New("store wasn't opened with WithSha256Ids()")
+	// first line in alias file
+	aliasHdr = "github.com/kjk/contentstore sha256 1.0"
+)
+
+type aliases struct {
+	// we don't use the store lock because writing the file is slow
+	mu sync.Mutex
+	m  map[[32]byte][20]byte
+	// size of the file we've read, so that read-only stores know it changed
+	size int64
+	// nil in read-only stores
+	file *os.File
+}
+
+// WithSha256Ids makes blobs also accessible by hex sha256 of their content
+func WithSha256Ids() Option {
+	return func(store *Store) {
+		store.aliases = &aliases{
+			m: make(map[[32]byte][20]byte),
+		}
+	}
+}
+
+func aliasFilePath(basePath string) string {
+	return basePath + "_sha256.txt"
+}
+
+// readAliases reads aliases from alias file, starting at offset from, and
+// returns the offset of the end of the last complete line. Lines that
+// can't be parsed (e.g. partially written before a crash) are skipped
+func readAliases(path string, from int64, m map[[32]byte][20]byte) (int64, error) {
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	offset := from
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(line))
+		before, after, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+		var sha256 [32]byte
+		var sha1 [20]byte
+		if !ok || hex.DecodedLen(len(before)) != len(sha256) || hex.DecodedLen(len(after)) != len(sha1) {
+			continue
+		}
+		_, err1 := hex.Decode(sha256[:], before)
+		_, err2 := hex.Decode(sha1[:], after)
+		if err1 == nil && err2 == nil {
+			m[sha256] = sha1
+		}
+	}
+}
+
+// openAliases reads alias file and, unless the store is read-only, opens it
+// for appending
+func (store *Store) openAliases() error {
+	a := store.aliases
+	if a == nil {
+		return nil
+	}
+	path := aliasFilePath(store.basePath)
+	size, err := readAliases(path, 0, a.m)
+	if err != nil || store.readOnly {
+		a.size = size
+		return err
+	}
+	file, err := openFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// drop partially written line
+	if size == 0 {
+		_, err = file.WriteString(aliasHdr + "\n")
+		size = int64(len(aliasHdr) + 1)
+	} else {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = size
+	return nil
+}
+
+// add saves aliases and adds them to the table
+func (a *aliases) add(sha256s [][32]byte, sha1s [][20]byte) error {
+	var buf bytes.Buffer
+	for i := range sha256s {
+		fmt.Fprintf(&buf, "%x %x\n", sha256s[i][:], sha1s[i][:])
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, err := a.file.Write(buf.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	for i := range sha256s {
+		a.m[sha256s[i]] = sha1s[i]
+	}
+	return nil
+}
+
+// findAlias returns sha1 of blob with a given sha256
+func (store *Store) findAlias(sha256 [32]byte) ([20]byte, bool) {
+	a := store.aliases
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sha1, ok := a.m[sha256]
+	if !ok && store.readOnly {
+		// the writer might have added it since we last looked
+		size, err := readAliases(aliasFilePath(store.basePath), a.size, a.m)
+		if err == nil && size > a.size {
+			a.size = size
+			sha1, ok = a.m[sha256]
+		}
+	}
+	return sha1, ok
+}
+
+// idToSha1 is like sha1FromId() but also accepts sha256 ids if the store
+// was opened with WithSha256Ids()
+func (store *Store) idToSha1(id string) ([20]byte, bool) {
+	var sha256 [32]byte
+	if store.aliases != nil && len(id) == hex.EncodedLen(len(sha256)) && isLowerCase(id) {
+		if _, err := hex.Decode(sha256[:], []byte(id)); err == nil {
+			return store.findAlias(sha256)
+		}
+	}
+	return sha1FromId(id)
+}
+
+// Sha256Id returns hex sha256 of the content of the blob, which can be used
+// as its id if the store was opened with WithSha256Ids()
+func (store *Store) Sha256Id(id string) (string, error) {
+	d, err := store.Get(id)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(d)), nil
+}
+
+// AddSha256Ids adds sha256 ids of blobs that don't have them, e.g. those
+// stored before the store was opened with WithSha256Ids(). It reads every
+// such blob and returns how many were added
+func (store *Store) AddSha256Ids() (int, error) {
+	a := store.aliases
+	if a == nil {
+		return 0, errNoSha256Ids
+	}
+	if store.readOnly {
+		return 0, errReadOnly
+	}
+	a.mu.Lock()
+	has := make(map[[20]byte]bool, len(a.m))
+	for _, sha1 := range a.m {
+		has[sha1] = true
+	}
+	a.mu.Unlock()
+	var sha256s [][32]byte
+	var sha1s [][20]byte
+	n := 0
+	flush := func() error {
+		err := a.add(sha256s, sha1s)
+		if err == nil {
+			err = a.file.Sync()
+		}
+		n += len(sha1s)
+		sha256s = sha256s[:0]
+		sha1s = sha1s[:0]
+		return err
+	}
+	err := store.ForEach(func(info BlobInfo) error {
+		sha1, _ := sha1FromId(info.Id)
+		if has[sha1] {
+			return nil
+		}
+		d, err := store.Get(info.Id)
+		if err == ErrNotFound {
+			// deleted since
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sha256s = append(sha256s, sha256.Sum256(d))
+		sha1s = append(sha1s, sha1)
+		if len(sha1s) >= maxWriteBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(sha1s) > 0 {
+		err = flush()
+	}
+	return n, err
+}
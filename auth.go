@@ -0,0 +1,64 @@
+package contentstore
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+)
+
+// Handler can require clients to authenticate with a bearer token
+// (Authorization: Bearer <token> header). Each token has a scope that
+// determines what it allows. We only keep sha256 of tokens so that the
+// time it takes to look them up doesn't tell anything about them.
+
+// Scope determines what a token allows
+type Scope int
+
+const (
+	// ScopeRead allows reading blobs
+	ScopeRead Scope = 1 << iota
+	// ScopeWrite allows storing and deleting blobs and, if enabled, viewing
+	// admin page
+	ScopeWrite
+)
+
+// SetTokens makes the handler require a token with the right scope for every
+// request. If tokens is empty, no authentication is required. Can be called
+// while serving requests
+func (h *Handler) SetTokens(tokens map[string]Scope) {
+	if len(tokens) == 0 {
+		h.tokens.Store(nil)
+		return
+	}
+	m := make(map[[32]byte]Scope, len(tokens))
+	for token, scope := range tokens {
+		m[sha256.Sum256([]byte(token))] = scope
+	}
+	h.tokens.Store(&m)
+}
+
+// authorize checks that the request has a token with scope. If it doesn't,
+// it sends an error to the client and returns false
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, scope Scope) bool {
+	tokens := h.tokens.Load()
+	if tokens == nil {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing token", http.StatusUnauthorized)
+		return false
+	}
+	tokenScope, ok := (*tokens)[sha256.Sum256([]byte(token))]
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+	if tokenScope&scope != scope {
+		http.Error(w, "token doesn't allow this", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,555 @@
+package contentstore
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// A backup copies files of the store to a directory (a backup set). A full
+// backup copies everything. An incremental backup only copies what changed
+// since an earlier backup, identified by its generation (numbered from 1).
+// That's cheap because the files mostly grow: sealed segments never change
+// (they're only removed, by GC() or compaction) and the current segment and
+// the index are only appended to. An incremental backup copies new segments,
+// what was appended to the segment that was current and the tail of the
+// index. If the index was rewritten by compaction (see compact.go) since
+// then, it's copied whole.
+//
+// The store remembers the state of its files at each generation in a small
+// file. A backup set has a manifest describing what's in it and which
+// segments existed. RestoreBackup() (or "contentstore restore") creates
+// a store from a full backup set and a chain of incremental sets that
+// follow it.
+//
+// Backups are taken while the store is used. They have the files as they
+// were when the backup started. Empty segments are not removed while
+// a backup runs.
+
+var (
+	errUnknownGeneration     = errors.New("unknown backup generation")
+	errInvalidBackupManifest = errors.New("invalid backup manifest")
+	errBackupChain           = errors.New("backup set doesn't follow the previous one")
+	errBackupExists          = errors.New("backup set already exists")
+	errStoreExists           = errors.New("store already exists")
+	errNoBackupSets          = errors.New("no backup sets to restore")
+	errInvalidBackupsFile    = errors.New("invalid backups file")
+	// first line in file with backup generations
+	backupsHdr = "github.com/kjk/contentstore backups 1.0"
+	// first line in manifest of backup set
+	backupManifestHdr = "github.com/kjk/contentstore backup 1.0"
+)
+
+const (
+	backupManifestName = "manifest.txt"
+	backupIndexName    = "index"
+)
+
+var (
+	// small files copied whole to every backup set, by suffix of their
+	// path. They're copied before taking the snapshot, so that blobs
+	// pointed to by refs are in it
+	backupFileSuffixes = []string{"_refs.txt", "_access.txt", "_key.txt"}
+	// like backupFileSuffixes but copied after taking the snapshot, so that
+	// they cover all blobs in it: the writer writes aliases before the index
+	backupFileSuffixesAfter = []string{"_sha256.txt"}
+)
+
+// BackupResult describes a backup set created by Backup() or
+// BackupIncremental()
+type BackupResult struct {
+	// generation of the backup set. Pass it to the next BackupIncremental()
+	Gen int
+	// generation the set is based on, 0 for a full backup
+	Since int
+	// number of files and bytes copied
+	Files int
+	Size  int64
+}
+
+// backupPoint is the state of store files at a backup generation
+type backupPoint struct {
+	gen int
+	// current segment and its size
+	nSegment    int
+	segmentSize int64
+	// size and crc32 of the index file
+	idxSize int64
+	idxCrc  uint32
+}
+
+func backupsFilePath(basePath string) string {
+	return basePath + "_backups.txt"
+}
+
+func readBackupPoints(path string) ([]backupPoint, error) {
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	recs, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 || len(recs[0]) != 1 || recs[0][0] != backupsHdr {
+		return nil, errInvalidBackupsFile
+	}
+	var res []backupPoint
+	for _, rec := range recs[1:] {
+		if len(rec) != 5 {
+			return nil, errInvalidBackupsFile
+		}
+		var p backupPoint
+		var crc uint64
+		p.gen, err = strconv.Atoi(rec[0])
+		if err == nil {
+			p.nSegment, err = strconv.Atoi(rec[1])
+		}
+		if err == nil {
+			p.segmentSize, err = strconv.ParseInt(rec[2], 10, 64)
+		}
+		if err == nil {
+			p.idxSize, err = strconv.ParseInt(rec[3], 10, 64)
+		}
+		if err == nil {
+			crc, err = strconv.ParseUint(rec[4], 10, 32)
+		}
+		if err != nil {
+			return nil, errInvalidBackupsFile
+		}
+		p.idxCrc = uint32(crc)
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func writeBackupPoints(path string, points []backupPoint) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{backupsHdr})
+		for _, p := range points {
+			csvWriter.Write([]string{
+				strconv.Itoa(p.gen),
+				strconv.Itoa(p.nSegment),
+				strconv.FormatInt(p.segmentSize, 10),
+				strconv.FormatInt(p.idxSize, 10),
+				strconv.FormatUint(uint64(p.idxCrc), 10),
+			})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	})
+}
+
+// backupSnapshot is what the writer gives to a backup: the state of files
+// after committing pending blobs and the index file as it was then
+type backupSnapshot struct {
+	point   backupPoint
+	idxFile *os.File
+}
+
+// takeBackupSnapshot fills snapshot. Only called by writer goroutine, after
+// commit()
+func (store *Store) takeBackupSnapshot(snapshot *backupSnapshot) error {
+	store.Lock()
+	defer store.Unlock()
+	if store.poisoned != nil {
+		return store.poisoned
+	}
+	// a new file so that rewriting the index doesn't affect the backup
+	file, err := openFile(idxFilePath(store.basePath), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	snapshot.idxFile = file
+	snapshot.point = backupPoint{
+		nSegment:    store.currSegmentNo,
+		segmentSize: int64(store.currSegmentSize),
+		idxSize:     store.idxOffset,
+		idxCrc:      store.idxCrc,
+	}
+	return nil
+}
+
+// backupFiles copies files of the store with given suffixes, that exist, to
+// directory dst and adds them to manifest and res
+func (store *Store) backupFiles(dst string, suffixes []string, manifest [][]string, res *BackupResult) ([][]string, error) {
+	for _, suffix := range suffixes {
+		d, err := os.ReadFile(store.basePath + suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = writeNewFile(filepath.Join(dst, suffix[1:]), d)
+		}
+		if err != nil {
+			return manifest, err
+		}
+		manifest = append(manifest, []string{"file", suffix[1:]})
+		res.Files++
+		res.Size += int64(len(d))
+	}
+	return manifest, nil
+}
+
+// Backup copies all files of the store to directory dst, which must not
+// have a backup set in it. It's the same as BackupIncremental(dst, 0)
+func (store *Store) Backup(dst string) (*BackupResult, error) {
+	return store.BackupIncremental(dst, 0)
+}
+
+// BackupIncremental copies files of the store that changed since backup with
+// generation sinceGen to directory dst, which must not have a backup set in
+// it. If sinceGen is 0, it copies all files
+func (store *Store) BackupIncremental(dst string, sinceGen int) (*BackupResult, error) {
+	if store.readOnly {
+		return nil, errReadOnly
+	}
+	if store.reuse != nil && sinceGen != 0 {
+		// it only copies what was appended to files
+		return nil, errSpaceReuseIncremental
+	}
+	store.backupMu.Lock()
+	defer store.backupMu.Unlock()
+	pointsPath := backupsFilePath(store.basePath)
+	points, err := readBackupPoints(pointsPath)
+	if err != nil {
+		return nil, err
+	}
+	var since *backupPoint
+	for i := range points {
+		if points[i].gen == sinceGen {
+			since = &points[i]
+		}
+	}
+	if since == nil && sinceGen != 0 {
+		return nil, errUnknownGeneration
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	manifestPath := filepath.Join(dst, backupManifestName)
+	if _, err = os.Stat(manifestPath); err == nil {
+		return nil, errBackupExists
+	}
+
+	res := &BackupResult{Gen: 1, Since: sinceGen}
+	if len(points) > 0 {
+		res.Gen = points[len(points)-1].gen + 1
+	}
+	manifest := [][]string{
+		{backupManifestHdr},
+		{"gen", strconv.Itoa(res.Gen)},
+		{"since", strconv.Itoa(sinceGen)},
+	}
+	// copied before taking the snapshot, so that blobs pointed to by refs
+	// are in it
+	if manifest, err = store.backupFiles(dst, backupFileSuffixes, manifest, res); err != nil {
+		return nil, err
+	}
+
+	snapshot := &backupSnapshot{}
+	req := &putRequest{
+		backup: snapshot,
+		done:   make(chan struct{}),
+	}
+	if err = store.send(req); err != nil {
+		return nil, err
+	}
+	if _, err = req.wait(); err != nil {
+		return nil, err
+	}
+	defer snapshot.idxFile.Close()
+	point := snapshot.point
+	point.gen = res.Gen
+	if manifest, err = store.backupFiles(dst, backupFileSuffixesAfter, manifest, res); err != nil {
+		return nil, err
+	}
+
+	// index
+	var idxOffset int64
+	if since != nil && since.idxSize <= point.idxSize {
+		crc, err := fileCrc(snapshot.idxFile, since.idxSize)
+		if err != nil {
+			return nil, err
+		}
+		if crc == since.idxCrc {
+			idxOffset = since.idxSize
+		}
+	}
+	err = copyFileRange(filepath.Join(dst, backupIndexName), snapshot.idxFile, idxOffset, point.idxSize)
+	if err != nil {
+		return nil, err
+	}
+	manifest = append(manifest, []string{"index", strconv.FormatInt(idxOffset, 10)})
+	res.Files++
+	res.Size += point.idxSize - idxOffset
+
+	// segments
+	for nSegment := 0; nSegment <= point.nSegment; nSegment++ {
+		file, err := openSegmentForRead(store.basePath, nSegment)
+		if err == errSegmentFileMissing && nSegment < point.nSegment {
+			// removed by GC() or compaction
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		size := point.segmentSize
+		if nSegment < point.nSegment {
+			var stat os.FileInfo
+			if stat, err = file.Stat(); err == nil {
+				size = stat.Size()
+			}
+		}
+		var offset int64
+		if since != nil && nSegment < since.nSegment {
+			// sealed, didn't change
+			offset = size
+		} else if since != nil && nSegment == since.nSegment {
+			offset = min(since.segmentSize, size)
+		}
+		name := fmt.Sprintf("segment_%d", nSegment)
+		manifest = append(manifest, []string{"live", strconv.Itoa(nSegment)})
+		if err == nil && (offset < size || nSegment == point.nSegment) {
+			err = copyFileRange(filepath.Join(dst, name), file, offset, size)
+			manifest = append(manifest, []string{"segment", strconv.Itoa(nSegment), strconv.FormatInt(offset, 10)})
+			res.Files++
+			res.Size += size - offset
+		}
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writeFileAtomically(manifestPath, func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.WriteAll(manifest)
+		return csvWriter.Error()
+	})
+	if err == nil {
+		err = syncDir(dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, writeBackupPoints(pointsPath, append(points, point))
+}
+
+// fileCrc returns crc32 of the first size bytes of file
+func fileCrc(file *os.File, size int64) (uint32, error) {
+	h := crc32.New(crcTable)
+	_, err := io.Copy(h, io.NewSectionReader(file, 0, size))
+	return h.Sum32(), err
+}
+
+// writeNewFile creates a file with content d and syncs it
+func writeNewFile(path string, d []byte) error {
+	file, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(d)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyFileRange creates a file at path with bytes of src from offset to end
+// and syncs it
+func copyFileRange(path string, src *os.File, offset, end int64) error {
+	file, err := openFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, io.NewSectionReader(src, offset, end-offset))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// backupManifest describes a backup set
+type backupManifest struct {
+	gen   int
+	since int
+	// offset in the original file of data in the set's copy of the index
+	idxOffset int64
+	// number of segment => offset in the original file of data in the
+	// set's copy of the segment
+	segments map[int]int64
+	live     map[int]bool
+	// names of files copied whole
+	files []string
+}
+
+func readBackupManifest(dir string) (*backupManifest, error) {
+	file, err := openFile(filepath.Join(dir, backupManifestName), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	recs, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 || len(recs[0]) != 1 || recs[0][0] != backupManifestHdr {
+		return nil, errInvalidBackupManifest
+	}
+	m := &backupManifest{
+		idxOffset: -1,
+		segments:  make(map[int]int64),
+		live:      make(map[int]bool),
+	}
+	for _, rec := range recs[1:] {
+		if len(rec) < 2 {
+			return nil, errInvalidBackupManifest
+		}
+		switch {
+		case rec[0] == "gen" && len(rec) == 2:
+			m.gen, err = strconv.Atoi(rec[1])
+		case rec[0] == "since" && len(rec) == 2:
+			m.since, err = strconv.Atoi(rec[1])
+		case rec[0] == "index" && len(rec) == 2:
+			m.idxOffset, err = strconv.ParseInt(rec[1], 10, 64)
+		case rec[0] == "live" && len(rec) == 2:
+			var n int
+			n, err = strconv.Atoi(rec[1])
+			m.live[n] = true
+		case rec[0] == "segment" && len(rec) == 3:
+			var n int
+			var offset int64
+			n, err = strconv.Atoi(rec[1])
+			if err == nil {
+				offset, err = strconv.ParseInt(rec[2], 10, 64)
+			}
+			m.segments[n] = offset
+		case rec[0] == "file" && len(rec) == 2 && filepath.Base(rec[1]) == rec[1]:
+			m.files = append(m.files, rec[1])
+		default:
+			err = errInvalidBackupManifest
+		}
+		if err != nil {
+			return nil, errInvalidBackupManifest
+		}
+	}
+	if m.gen <= 0 || m.idxOffset < 0 {
+		return nil, errInvalidBackupManifest
+	}
+	return m, nil
+}
+
+// appendFile appends content of file at src to file at dst, which must have
+// exactly offset bytes
+func appendFile(dst, src string, offset int64) error {
+	srcFile, err := openFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	file, err := openFile(dst, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err == nil && stat.Size() != offset {
+		err = errBackupChain
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(file, srcFile)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RestoreBackup creates a store at basePath from backup sets in directories
+// sets. The first one must be a full backup and each of the others must be
+// an incremental backup since the one before it. The store must not exist
+func RestoreBackup(basePath string, sets ...string) error {
+	if StoreExists(basePath) {
+		return errStoreExists
+	}
+	prevGen := 0
+	// segments that exist after applying sets so far
+	segments := make(map[int]bool)
+	for _, dir := range sets {
+		m, err := readBackupManifest(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		if m.since != prevGen {
+			return fmt.Errorf("%s: %w", dir, errBackupChain)
+		}
+		for _, name := range m.files {
+			d, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				err = writeFileAtomically(basePath+"_"+name, func(w io.Writer) error {
+					_, err := w.Write(d)
+					return err
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for nSegment, offset := range m.segments {
+			src := filepath.Join(dir, fmt.Sprintf("segment_%d", nSegment))
+			if err = appendFile(segmentFilePath(basePath, nSegment), src, offset); err != nil {
+				return fmt.Errorf("%s: %w", src, err)
+			}
+			segments[nSegment] = true
+		}
+		for nSegment := range segments {
+			if m.live[nSegment] {
+				continue
+			}
+			if err = os.Remove(segmentFilePath(basePath, nSegment)); err != nil {
+				return err
+			}
+			delete(segments, nSegment)
+		}
+		// the index is restored last so that the store doesn't exist until
+		// its segments do
+		idxPath := idxFilePath(basePath)
+		if m.idxOffset == 0 {
+			os.Remove(idxPath)
+		}
+		if err = appendFile(idxPath, filepath.Join(dir, backupIndexName), m.idxOffset); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+		prevGen = m.gen
+	}
+	if prevGen == 0 {
+		return errNoBackupSets
+	}
+	return syncDir(filepath.Dir(basePath))
+}
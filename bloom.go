@@ -0,0 +1,137 @@
+package contentstore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// BloomFilter is a compact summary of a set of blob ids. It can tell that
+// a blob is definitely not in the set or that it probably is. It's used to
+// find blobs that another store doesn't have without sending all ids (see
+// Store.SyncTo()). A filter for a million blobs with 1% false positives
+// takes 1.2 MB.
+//
+// Every filter uses a random seed, so blobs that are false positives in
+// one filter are most likely not false positives in the next one.
+
+var (
+	errInvalidBloomFilter = errors.New("invalid bloom filter")
+)
+
+const (
+	bloomFilterMagic = "csbf1"
+	// header: magic, seed, number of hash functions, number of bits
+	bloomFilterHdrSize = len(bloomFilterMagic) + 8 + 4 + 8
+	// more hashes make checking slower and don't help much
+	maxBloomHashes = 30
+)
+
+type BloomFilter struct {
+	seed  uint64
+	k     int
+	nBits uint64
+	bits  []uint64
+}
+
+// newBloomFilter returns an empty filter sized for n ids with
+// falsePositiveRate
+func newBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = defaultFalsePositiveRate
+	}
+	n = max(n, 1)
+	nBits := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(nBits / float64(n) * math.Ln2))
+	var seed [8]byte
+	rand.Read(seed[:])
+	nWords := (uint64(nBits) + 63) / 64
+	return &BloomFilter{
+		seed:  binary.LittleEndian.Uint64(seed[:]),
+		k:     min(max(k, 1), maxBloomHashes),
+		nBits: nWords * 64,
+		bits:  make([]uint64, nWords),
+	}
+}
+
+// mix64 is finalizer of splitmix64, which spreads bits of x
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// positions calls fn with positions of bits for sha1. sha1 is already
+// random so we only need to mix it with the seed. We use double hashing
+// to get k positions from two hashes
+func (f *BloomFilter) positions(sha1 [20]byte, fn func(pos uint64) bool) {
+	h1 := mix64(binary.LittleEndian.Uint64(sha1[0:8]) ^ f.seed)
+	h2 := mix64(binary.LittleEndian.Uint64(sha1[8:16])^f.seed) | 1
+	for i := 0; i < f.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % f.nBits) {
+			return
+		}
+	}
+}
+
+func (f *BloomFilter) add(sha1 [20]byte) {
+	f.positions(sha1, func(pos uint64) bool {
+		f.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+// MayContain returns false if blob with a given id is definitely not in
+// the set and true if it probably is
+func (f *BloomFilter) MayContain(id string) bool {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return false
+	}
+	res := true
+	f.positions(sha1, func(pos uint64) bool {
+		res = f.bits[pos/64]&(1<<(pos%64)) != 0
+		return res
+	})
+	return res
+}
+
+// MarshalBinary encodes the filter, e.g. to send it over the network
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	d := make([]byte, 0, bloomFilterHdrSize+8*len(f.bits))
+	d = append(d, bloomFilterMagic...)
+	d = binary.LittleEndian.AppendUint64(d, f.seed)
+	d = binary.LittleEndian.AppendUint32(d, uint32(f.k))
+	d = binary.LittleEndian.AppendUint64(d, f.nBits)
+	for _, w := range f.bits {
+		d = binary.LittleEndian.AppendUint64(d, w)
+	}
+	return d, nil
+}
+
+// UnmarshalBinary decodes filter encoded with MarshalBinary()
+func (f *BloomFilter) UnmarshalBinary(d []byte) error {
+	if len(d) < bloomFilterHdrSize || string(d[:len(bloomFilterMagic)]) != bloomFilterMagic {
+		return errInvalidBloomFilter
+	}
+	d = d[len(bloomFilterMagic):]
+	seed := binary.LittleEndian.Uint64(d)
+	k := binary.LittleEndian.Uint32(d[8:])
+	nBits := binary.LittleEndian.Uint64(d[12:])
+	d = d[20:]
+	if k < 1 || k > maxBloomHashes || nBits == 0 || nBits%64 != 0 || uint64(len(d)) != nBits/8 {
+		return errInvalidBloomFilter
+	}
+	f.seed = seed
+	f.k = int(k)
+	f.nBits = nBits
+	f.bits = make([]uint64, nBits/64)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(d[i*8:])
+	}
+	return nil
+}
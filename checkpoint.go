@@ -0,0 +1,140 @@
+package contentstore
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Checkpoint is a small file written when the store is closed. It records
+// information about the index that is expensive to re-compute when opening
+// the store. It's only a hint: if it's missing or stale we do the slow thing.
+//
+// It also tells if the store was closed cleanly. When we open the store for
+// writing, we replace it with one that says it wasn't, and Close() marks it
+// clean. If it's not clean when we open the store, the process crashed and
+// a corrupted record after the part of the index recorded in the checkpoint
+// is most likely one we were writing at the time, so it's discarded without
+// WithRecovery(). After a clean close, a corrupted record is always an error.
+
+var (
+	errInvalidCheckpoint = errors.New("invalid checkpoint file")
+	// first line in checkpoint file
+	checkpointHdr = "github.com/kjk/contentstore checkpoint 1.0"
+)
+
+type checkpoint struct {
+	// number of blobs in the index
+	nBlobs int
+	// dedup statistics, accumulated over the lifetime of the store
+	dedupHits       int
+	dedupSavedBytes int64
+	// size, number of records and crc32 of the index file. Since the index
+	// only grows, when we open the store it must start with exactly what it
+	// had when the checkpoint was written. If it doesn't, it was truncated or
+	// modified. 0 if not known
+	idxSize    int64
+	idxRecords int
+	idxCrc     uint32
+	// generation of the index (see journal.go)
+	idxGen int64
+	// true if written by Close()
+	clean bool
+}
+
+func checkpointFilePath(basePath string) string {
+	return basePath + "_checkpoint.txt"
+}
+
+func readCheckpoint(basePath string) (cp checkpoint, err error) {
+	file, err := openFile(checkpointFilePath(basePath), os.O_RDONLY, 0)
+	if err != nil {
+		return cp, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	recs, err := csvReader.ReadAll()
+	if err != nil {
+		return cp, err
+	}
+	if len(recs) == 0 || len(recs[0]) != 1 || recs[0][0] != checkpointHdr {
+		return cp, errInvalidCheckpoint
+	}
+	for _, rec := range recs[1:] {
+		if len(rec) != 2 {
+			return cp, errInvalidCheckpoint
+		}
+		// ignore values we don't know about
+		switch rec[0] {
+		case "blobs":
+			cp.nBlobs, err = strconv.Atoi(rec[1])
+		case "dedup_hits":
+			cp.dedupHits, err = strconv.Atoi(rec[1])
+		case "dedup_saved_bytes":
+			cp.dedupSavedBytes, err = strconv.ParseInt(rec[1], 10, 64)
+		case "index_size":
+			cp.idxSize, err = strconv.ParseInt(rec[1], 10, 64)
+		case "index_records":
+			cp.idxRecords, err = strconv.Atoi(rec[1])
+		case "index_generation":
+			cp.idxGen, err = strconv.ParseInt(rec[1], 10, 64)
+		case "index_crc32":
+			var crc uint64
+			crc, err = strconv.ParseUint(rec[1], 10, 32)
+			cp.idxCrc = uint32(crc)
+		case "clean":
+			cp.clean = rec[1] == "1"
+		}
+		if err != nil {
+			return cp, err
+		}
+	}
+	return cp, nil
+}
+
+// checkpoint returns the current checkpoint. Information about the index is
+// only included if withIndex is true and the index is in a known state.
+// Must be called with store locked
+func (store *Store) checkpoint(withIndex bool) checkpoint {
+	cp := checkpoint{
+		nBlobs:          store.index.count(),
+		dedupHits:       store.dedupHits,
+		dedupSavedBytes: store.dedupSavedBytes,
+	}
+	// if poisoned, we don't know what we wrote to the index
+	if withIndex && store.poisoned == nil {
+		cp.idxSize = store.idxOffset
+		cp.idxRecords = store.idxRecords
+		cp.idxCrc = store.idxCrc
+		cp.idxGen = store.idxGen
+	}
+	return cp
+}
+
+// writeCheckpoint atomically replaces checkpoint file
+func writeCheckpoint(basePath string, cp checkpoint) error {
+	return writeFileAtomically(checkpointFilePath(basePath), func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		recs := [][]string{
+			{checkpointHdr},
+			{"blobs", strconv.Itoa(cp.nBlobs)},
+			{"dedup_hits", strconv.Itoa(cp.dedupHits)},
+			{"dedup_saved_bytes", strconv.FormatInt(cp.dedupSavedBytes, 10)},
+		}
+		if cp.idxSize > 0 {
+			recs = append(recs,
+				[]string{"index_size", strconv.FormatInt(cp.idxSize, 10)},
+				[]string{"index_records", strconv.Itoa(cp.idxRecords)},
+				[]string{"index_crc32", strconv.FormatUint(uint64(cp.idxCrc), 10)},
+				[]string{"index_generation", strconv.FormatInt(cp.idxGen, 10)},
+			)
+		}
+		if cp.clean {
+			recs = append(recs, []string{"clean", "1"})
+		}
+		return csvWriter.WriteAll(recs)
+	})
+}
@@ -0,0 +1,103 @@
+package contentstore
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// Blobs can also be identified by multihash (https://multiformats.io/multihash/)
+// or CID (https://github.com/multiformats/cid), as used by IPFS. Since our ids
+// are sha1 hashes, they can be converted to and from those formats without
+// re-hashing the content:
+//   - multihash is <0x11 (sha1)><0x14 (20 bytes)><sha1>, which we write in hex
+//   - CID is version 1, codec raw (0x55) or git-raw (0x78) if the store was
+//     opened with WithGitObjects(), and the multihash, written in base32 with
+//     "b" prefix (multibase), e.g. bafkrc...
+//
+// Every function that takes an id also accepts multihash and CID.
+
+const (
+	multihashSha1 = 0x11
+	cidVersion1   = 1
+	cidCodecRaw   = 0x55
+	cidCodecGit   = 0x78
+	// multibase prefix of base32 lowercase without padding
+	multibaseBase32 = "b"
+)
+
+var (
+	cidEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func appendMultihash(d []byte, sha1 [20]byte) []byte {
+	d = append(d, multihashSha1, byte(len(sha1)))
+	return append(d, sha1[:]...)
+}
+
+// Multihash returns id as hex-encoded multihash
+func Multihash(id string) (string, error) {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return "", ErrInvalidId
+	}
+	return hex.EncodeToString(appendMultihash(nil, sha1)), nil
+}
+
+// HexId returns id, which can also be multihash or CID, as hex sha1, which
+// is how the store returns ids
+func HexId(id string) (string, error) {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return "", ErrInvalidId
+	}
+	return hex.EncodeToString(sha1[:]), nil
+}
+
+// CID returns id as CID version 1 in base32
+func (store *Store) CID(id string) (string, error) {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return "", ErrInvalidId
+	}
+	codec := byte(cidCodecRaw)
+	if store.gitObjects {
+		codec = cidCodecGit
+	}
+	d := appendMultihash([]byte{cidVersion1, codec}, sha1)
+	return multibaseBase32 + strings.ToLower(cidEncoding.EncodeToString(d)), nil
+}
+
+// sha1FromMultihash returns sha1 from binary multihash
+func sha1FromMultihash(d []byte) (sha1 [20]byte, ok bool) {
+	if len(d) != 2+len(sha1) || d[0] != multihashSha1 || int(d[1]) != len(sha1) {
+		return sha1, false
+	}
+	copy(sha1[:], d[2:])
+	return sha1, true
+}
+
+// sha1FromCID returns sha1 from hex multihash or base32 CID version 1 with
+// sha1 multihash. We accept any codec
+func sha1FromCID(s string) (sha1 [20]byte, ok bool) {
+	if d, err := hex.DecodeString(s); err == nil {
+		return sha1FromMultihash(d)
+	}
+	if !strings.HasPrefix(s, multibaseBase32) {
+		return sha1, false
+	}
+	d, err := cidEncoding.DecodeString(strings.ToUpper(s[len(multibaseBase32):]))
+	if err != nil {
+		return sha1, false
+	}
+	version, n := binary.Uvarint(d)
+	if n <= 0 || version != cidVersion1 {
+		return sha1, false
+	}
+	d = d[n:]
+	if _, n = binary.Uvarint(d); n <= 0 {
+		return sha1, false
+	}
+	return sha1FromMultihash(d[n:])
+}
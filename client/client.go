@@ -0,0 +1,443 @@
+// Package client implements contentstore.Storer on top of HTTP API served
+// by contentstore.Handler (e.g. by "contentstore serve"), so that code
+// written against Storer can use a store on another machine by changing
+// only how it's created.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errClosed = errors.New("client is closed")
+	errNoSize = errors.New("server didn't send size of the blob")
+)
+
+const (
+	blobsPath = "/blobs"
+	// max number of ids the server accepts in one /missing request
+	maxMissingIds = 10000
+)
+
+// Client talks to a contentstore server. It's safe for concurrent use.
+// Connections are re-used between requests.
+//
+// Requests that fail because of network errors or 5xx responses are
+// retried. It's safe to retry Put() because storing the same content
+// again doesn't change anything.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	retries    int
+	closed     atomic.Bool
+}
+
+// Option configures optional behavior of a Client
+type Option func(*Client)
+
+// WithToken makes the client authenticate with bearer token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient makes the client use httpClient for sending requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times failed requests are retried (3 by default)
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		c.retries = n
+	}
+}
+
+// New returns a client for server at baseURL e.g. "http://localhost:8080"
+// or "https://host/ns/app1" for a namespace
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		retries: 3,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		// we usually talk to a single server
+		transport.MaxIdleConnsPerHost = 64
+		c.httpClient = &http.Client{Transport: transport}
+	}
+	return c
+}
+
+// make sure Client implements Storer
+var _ contentstore.Storer = (*Client)(nil)
+
+// statusError is returned when the server responds with unexpected status
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("contentstore server returned %d: %s", e.status, e.msg)
+}
+
+// do sends request, retrying it if it fails in a way that might be temporary.
+// body can be nil. On success the caller must close response body
+func (c *Client) do(method, path string, body []byte) (*http.Response, error) {
+	if c.closed.Load() {
+		return nil, errClosed
+	}
+	var err error
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(100<<(i-1)) * time.Millisecond)
+		}
+		var req *http.Request
+		req, err = c.newRequest(method, path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		var rsp *http.Response
+		rsp, err = c.httpClient.Do(req)
+		if err != nil {
+			continue
+		}
+		if rsp.StatusCode < 400 || rsp.StatusCode == http.StatusNotFound {
+			return rsp, nil
+		}
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		err = &statusError{status: rsp.StatusCode, msg: strings.TrimSpace(string(msg))}
+		if rsp.StatusCode < 500 || rsp.StatusCode == http.StatusInsufficientStorage {
+			break
+		}
+	}
+	return nil, err
+}
+
+// newRequest returns request to the server, with authorization
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// blobError converts error of a request for a blob to the error
+// contentstore.Store would return
+func blobError(err error) error {
+	var se *statusError
+	if errors.As(err, &se) && se.status == http.StatusBadRequest {
+		return contentstore.ErrInvalidId
+	}
+	return err
+}
+
+// blobPath returns path of the blob with a given id. The id is escaped so
+// that whatever is in it stays part of the id
+func blobPath(id string) string {
+	return blobsPath + "/" + url.PathEscape(id)
+}
+
+// closeBody reads what's left of the body so that the connection can be
+// re-used
+func closeBody(rsp *http.Response) {
+	io.Copy(io.Discard, rsp.Body)
+	rsp.Body.Close()
+}
+
+// Put stores d on the server and returns its id
+func (c *Client) Put(d []byte) (string, error) {
+	rsp, err := c.do(http.MethodPost, blobsPath, d)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusCreated {
+		return "", &statusError{status: rsp.StatusCode, msg: "unexpected status"}
+	}
+	id, err := io.ReadAll(rsp.Body)
+	return string(id), err
+}
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// PutReader stores data read from r on the server and returns its id and
+// size. Unlike Put(), it streams the data, so it doesn't have to be in
+// memory. Since r can only be read once, the request isn't retried
+func (c *Client) PutReader(r io.Reader) (id string, n int64, err error) {
+	if c.closed.Load() {
+		return "", 0, errClosed
+	}
+	cr := &countingReader{r: r}
+	req, err := c.newRequest(http.MethodPost, blobsPath, cr)
+	if err != nil {
+		return "", 0, err
+	}
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", cr.n, err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return "", cr.n, &statusError{status: rsp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	d, err := io.ReadAll(rsp.Body)
+	return string(d), cr.n, err
+}
+
+// GetReader returns content of the blob as a stream. The caller must close it
+func (c *Client) GetReader(id string) (io.ReadCloser, error) {
+	rsp, err := c.do(http.MethodGet, blobPath(id), nil)
+	if err != nil {
+		return nil, blobError(err)
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		closeBody(rsp)
+		return nil, contentstore.ErrNotFound
+	}
+	return rsp.Body, nil
+}
+
+// Get returns content of the blob
+func (c *Client) Get(id string) ([]byte, error) {
+	r, err := c.GetReader(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CopyTo writes content of the blob to w without reading it into memory
+func (c *Client) CopyTo(id string, w io.Writer) (int64, error) {
+	r, err := c.GetReader(id)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+// Stat returns information about the blob without downloading it
+func (c *Client) Stat(id string) (contentstore.BlobInfo, error) {
+	rsp, err := c.do(http.MethodHead, blobPath(id), nil)
+	if err != nil {
+		return contentstore.BlobInfo{}, blobError(err)
+	}
+	closeBody(rsp)
+	if rsp.StatusCode == http.StatusNotFound {
+		return contentstore.BlobInfo{}, contentstore.ErrNotFound
+	}
+	if rsp.ContentLength < 0 {
+		return contentstore.BlobInfo{}, errNoSize
+	}
+	info := contentstore.BlobInfo{Id: id, Size: int(rsp.ContentLength)}
+	// the server sends time when the blob was added as Last-Modified
+	if t, err := http.ParseTime(rsp.Header.Get("Last-Modified")); err == nil {
+		info.Created = t
+	}
+	return info, nil
+}
+
+// Delete removes the blob from the server. Returns contentstore.ErrNotFound
+// if it's not there
+func (c *Client) Delete(id string) error {
+	rsp, err := c.do(http.MethodDelete, blobPath(id), nil)
+	if err != nil {
+		return blobError(err)
+	}
+	closeBody(rsp)
+	if rsp.StatusCode == http.StatusNotFound {
+		return contentstore.ErrNotFound
+	}
+	if rsp.StatusCode != http.StatusNoContent {
+		return &statusError{status: rsp.StatusCode, msg: "unexpected status"}
+	}
+	return nil
+}
+
+// Exists returns true if blob is on the server. It returns false if
+// talking to the server failed
+func (c *Client) Exists(id string) bool {
+	_, err := c.Stat(id)
+	return err == nil
+}
+
+// Close closes idle connections. Client can't be used after Close()
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	c.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// List returns information about up to limit blobs on the server whose ids
+// are greater than afterID, sorted by id, and afterID for the next page,
+// which is empty if there are no more blobs. The server returns at most
+// 1000 blobs per call. See contentstore.Store.List()
+func (c *Client) List(afterID string, limit int) (infos []contentstore.BlobInfo, next string, err error) {
+	q := url.Values{}
+	if afterID != "" {
+		q.Set("after", afterID)
+	}
+	q.Set("limit", strconv.Itoa(limit))
+	rsp, err := c.do(http.MethodGet, blobsPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusOK {
+		return nil, "", &statusError{status: rsp.StatusCode, msg: "server doesn't support listing blobs"}
+	}
+	var res struct {
+		Blobs []struct {
+			Id      string `json:"id"`
+			Size    int    `json:"size"`
+			Created int64  `json:"created"`
+		} `json:"blobs"`
+		Next string `json:"next"`
+	}
+	if err = json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return nil, "", err
+	}
+	for _, b := range res.Blobs {
+		info := contentstore.BlobInfo{Id: b.Id, Size: b.Size}
+		if b.Created != 0 {
+			info.Created = time.Unix(b.Created, 0)
+		}
+		infos = append(infos, info)
+	}
+	return infos, res.Next, nil
+}
+
+// MissingFrom returns ids, out of ids, of blobs that are not on the server.
+// See contentstore.Store.MissingFrom()
+func (c *Client) MissingFrom(ids []string) ([]string, error) {
+	var res []string
+	for len(ids) > 0 {
+		n := min(len(ids), maxMissingIds)
+		body, err := json.Marshal(map[string][]string{"ids": ids[:n]})
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := c.do(http.MethodPost, "/missing", body)
+		if err != nil {
+			return nil, err
+		}
+		var missing struct {
+			Ids []string `json:"ids"`
+		}
+		if rsp.StatusCode != http.StatusOK {
+			err = &statusError{status: rsp.StatusCode, msg: "server doesn't support syncing"}
+		} else {
+			err = json.NewDecoder(rsp.Body).Decode(&missing)
+		}
+		closeBody(rsp)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, missing.Ids...)
+		ids = ids[n:]
+	}
+	return res, nil
+}
+
+// BloomFilter returns bloom filter of ids of all blobs on the server with
+// a given false positive rate. See contentstore.Store.BloomFilter()
+func (c *Client) BloomFilter(falsePositiveRate float64) (*contentstore.BloomFilter, error) {
+	path := "/bloom"
+	if falsePositiveRate > 0 {
+		path += "?fp=" + strconv.FormatFloat(falsePositiveRate, 'g', -1, 64)
+	}
+	rsp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusOK {
+		return nil, &statusError{status: rsp.StatusCode, msg: "server doesn't support syncing"}
+	}
+	d, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	filter := &contentstore.BloomFilter{}
+	if err = filter.UnmarshalBinary(d); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// ExportIDSet writes ids of all blobs on the server to w as an id set. See
+// contentstore.Store.ExportIDSet()
+func (c *Client) ExportIDSet(w io.Writer) error {
+	rsp, err := c.do(http.MethodGet, "/idset", nil)
+	if err != nil {
+		return err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusOK {
+		return &statusError{status: rsp.StatusCode, msg: "server doesn't support id sets"}
+	}
+	_, err = io.Copy(w, rsp.Body)
+	return err
+}
+
+// Changes returns ids of blobs added to the store on the server after
+// cursor after and cursor to pass to the next call. See
+// contentstore.Store.Changes()
+func (c *Client) Changes(after contentstore.Cursor) (ids []string, next contentstore.Cursor, err error) {
+	uri := "/changes?gen=" + strconv.FormatInt(after.Generation, 10) + "&after=" + strconv.FormatInt(after.Position, 10)
+	rsp, err := c.do(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, after, err
+	}
+	defer closeBody(rsp)
+	if rsp.StatusCode != http.StatusOK {
+		return nil, after, &statusError{status: rsp.StatusCode, msg: "server doesn't support replication"}
+	}
+	var res struct {
+		Ids        []string `json:"ids"`
+		Next       int64    `json:"next"`
+		Generation int64    `json:"generation"`
+	}
+	if err = json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return nil, after, err
+	}
+	return res.Ids, contentstore.Cursor{Generation: res.Generation, Position: res.Next}, nil
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kjk/contentstore"
+)
+
+func removeStoreFiles(basePath string) {
+	files, _ := filepath.Glob(basePath + "_*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func TestClient(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := contentstore.New(basePath)
+	if err != nil {
+		t.Fatalf("contentstore.New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	handler := contentstore.NewHandler(store, false)
+	handler.SetTokens(map[string]contentstore.Scope{"token": contentstore.ScopeRead | contentstore.ScopeWrite})
+	// fail first request to check that we retry
+	var nRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&nRequests, 1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	var c contentstore.Storer = New(srv.URL, WithToken("token"))
+	defer c.Close()
+	content := []byte("content stored over http")
+	id, err := c.Put(content)
+	if err != nil {
+		t.Fatalf("c.Put() failed with %q", err)
+	}
+	if !store.Exists(id) {
+		t.Fatalf("blob %s not in the store", id)
+	}
+	d, err := c.Get(id)
+	if err != nil || !bytes.Equal(d, content) {
+		t.Fatalf("c.Get(%q) returned %q, %v", id, d, err)
+	}
+	info, err := c.Stat(id)
+	if err != nil || info.Size != len(content) {
+		t.Fatalf("c.Stat(%q) returned %v, %v", id, info, err)
+	}
+	missingId := "0000000000000000000000000000000000000000"
+	if _, err = c.Get(missingId); err != contentstore.ErrNotFound {
+		t.Fatalf("c.Get(%q) returned %v, expected %v", missingId, err, contentstore.ErrNotFound)
+	}
+	if _, err = c.Get("not-an-id"); err != contentstore.ErrInvalidId {
+		t.Fatalf("c.Get() of invalid id returned %v, expected %v", err, contentstore.ErrInvalidId)
+	}
+	if c.Exists(missingId) {
+		t.Fatalf("c.Exists(%q) returned true", missingId)
+	}
+	// ids are escaped, so these don't reach the blob with id
+	for _, s := range []string{id + "?x=1", id + "#x", id + "/x"} {
+		if _, err = c.Get(s); err != contentstore.ErrInvalidId {
+			t.Fatalf("c.Get(%q) returned %v, expected %v", s, err, contentstore.ErrInvalidId)
+		}
+		if _, err = c.Stat(s); err != contentstore.ErrInvalidId {
+			t.Fatalf("c.Stat(%q) returned %v, expected %v", s, err, contentstore.ErrInvalidId)
+		}
+		if err = c.(*Client).Delete(s); err != contentstore.ErrInvalidId {
+			t.Fatalf("c.Delete(%q) returned %v, expected %v", s, err, contentstore.ErrInvalidId)
+		}
+	}
+	if !store.Exists(id) {
+		t.Fatalf("blob %s was deleted", id)
+	}
+
+	// page through blobs one at a time
+	id2, _ := c.Put([]byte("another blob"))
+	var listed []string
+	after := ""
+	for {
+		infos, next, err := c.(*Client).List(after, 1)
+		if err != nil {
+			t.Fatalf("c.List(%q) failed with %q", after, err)
+		}
+		for _, info := range infos {
+			listed = append(listed, info.Id)
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	expected := []string{id, id2}
+	slices.Sort(expected)
+	if !slices.Equal(listed, expected) {
+		t.Fatalf("c.List() returned %v, expected %v", listed, expected)
+	}
+
+	// streamed, without knowing the size up front
+	streamed := bytes.Repeat([]byte("streamed content "), 10000)
+	id3, n, err := c.(*Client).PutReader(io.MultiReader(bytes.NewReader(streamed)))
+	if err != nil || n != int64(len(streamed)) {
+		t.Fatalf("c.PutReader() returned %q, %d, %v", id3, n, err)
+	}
+	if d, err := store.Get(id3); err != nil || !bytes.Equal(d, streamed) {
+		t.Fatalf("store.Get(%q) returned %d bytes, %v", id3, len(d), err)
+	}
+
+	bad := New(srv.URL, WithToken("bad"), WithRetries(0))
+	if _, err = bad.Get(id); err == nil {
+		t.Fatalf("Get() with bad token didn't fail")
+	}
+	if _, _, err = bad.PutReader(bytes.NewReader(content)); err == nil {
+		t.Fatalf("PutReader() with bad token didn't fail")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	var stores []*contentstore.Store
+	var urls []string
+	for i := 0; i < 5; i++ {
+		basePath := fmt.Sprintf("test%d", i)
+		removeStoreFiles(basePath)
+		defer removeStoreFiles(basePath)
+		store, err := contentstore.New(basePath)
+		if err != nil {
+			t.Fatalf("contentstore.New(%q) failed with %q", basePath, err)
+		}
+		defer store.Close()
+		srv := httptest.NewServer(contentstore.NewHandler(store, false))
+		defer srv.Close()
+		stores = append(stores, store)
+		urls = append(urls, srv.URL)
+	}
+	storeOf := make(map[string]*contentstore.Store)
+	for i, url := range urls {
+		storeOf[url] = stores[i]
+	}
+	// each blob must be on all servers returned by Nodes()
+	checkPlacement := func(c *Cluster, ids []string) {
+		t.Helper()
+		for _, id := range ids {
+			nodes := c.Nodes(id)
+			if len(nodes) != 2 {
+				t.Fatalf("c.Nodes(%q) returned %v", id, nodes)
+			}
+			for _, node := range nodes {
+				if !storeOf[node].Exists(id) {
+					t.Fatalf("blob %s is not on %s", id, node)
+				}
+			}
+		}
+	}
+
+	c, err := NewCluster(urls[:3], 2)
+	if err != nil {
+		t.Fatalf("NewCluster() failed with %q", err)
+	}
+	defer c.Close()
+	var ids []string
+	for i := 0; i < 50; i++ {
+		id, err := c.Put([]byte(fmt.Sprintf("blob %d", i)))
+		if err != nil {
+			t.Fatalf("c.Put() failed with %q", err)
+		}
+		ids = append(ids, id)
+	}
+	checkPlacement(c, ids)
+	placement := make(map[string][]string)
+	for _, id := range ids {
+		placement[id] = c.Nodes(id)
+	}
+
+	if err = c.AddNode(urls[3]); err != nil {
+		t.Fatalf("c.AddNode() failed with %q", err)
+	}
+	// only some blobs move to the new server
+	nMoved := 0
+	for _, id := range ids {
+		if fmt.Sprint(c.Nodes(id)) != fmt.Sprint(placement[id]) {
+			nMoved++
+		}
+	}
+	if nMoved == 0 || nMoved > len(ids)*3/4 {
+		t.Fatalf("%d of %d blobs moved after adding a server", nMoved, len(ids))
+	}
+	// blobs are found even if they're not yet on the new server
+	for i, id := range ids {
+		d, err := c.Get(id)
+		if err != nil || string(d) != fmt.Sprintf("blob %d", i) {
+			t.Fatalf("c.Get(%q) returned %q, %v", id, d, err)
+		}
+	}
+
+	c.AddNode(urls[4])
+	n, err := c.Rebalance()
+	if err != nil || n == 0 {
+		t.Fatalf("c.Rebalance() returned %d, %v", n, err)
+	}
+	checkPlacement(c, ids)
+	if c.Exists("0000000000000000000000000000000000000000") || c.Exists("invalid") {
+		t.Fatalf("c.Exists() returned true for missing blob")
+	}
+	if _, err = c.Get("invalid"); err != contentstore.ErrInvalidId {
+		t.Fatalf("c.Get() of invalid id returned %v, expected %v", err, contentstore.ErrInvalidId)
+	}
+	// multihash is on the same servers and its content is valid
+	mh, _ := contentstore.Multihash(ids[0])
+	if fmt.Sprint(c.Nodes(mh)) != fmt.Sprint(c.Nodes(ids[0])) {
+		t.Fatalf("c.Nodes(%q) returned %v, expected %v", mh, c.Nodes(mh), c.Nodes(ids[0]))
+	}
+	if d, err := c.Get(mh); err != nil || string(d) != "blob 0" {
+		t.Fatalf("c.Get(%q) returned %q, %v", mh, d, err)
+	}
+}
+
+func TestClusterReadRepair(t *testing.T) {
+	storeOf := make(map[string]*contentstore.Store)
+	var urls []string
+	for i := 0; i < 3; i++ {
+		basePath := fmt.Sprintf("test%d", i)
+		removeStoreFiles(basePath)
+		defer removeStoreFiles(basePath)
+		store, err := contentstore.New(basePath)
+		if err != nil {
+			t.Fatalf("contentstore.New(%q) failed with %q", basePath, err)
+		}
+		defer store.Close()
+		srv := httptest.NewServer(contentstore.NewHandler(store, false))
+		defer srv.Close()
+		storeOf[srv.URL] = store
+		urls = append(urls, srv.URL)
+	}
+	c, err := NewCluster(urls, 3)
+	if err != nil {
+		t.Fatalf("NewCluster() failed with %q", err)
+	}
+	defer c.Close()
+	var logBuf bytes.Buffer
+	c.SetLogger(log.New(&logBuf, "", 0))
+	content := []byte("replicated content")
+	id, err := c.Put(content)
+	if err != nil {
+		t.Fatalf("c.Put() failed with %q", err)
+	}
+	// the first server has a corrupted copy, the second lost it
+	nodes := c.Nodes(id)
+	segmentPath := fmt.Sprintf("test%d_0.txt", slices.Index(urls, nodes[0]))
+	f, err := os.OpenFile(segmentPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("os.OpenFile(%q) failed with %q", segmentPath, err)
+	}
+	f.WriteAt([]byte("X"), 0)
+	f.Close()
+	storeOf[nodes[1]].Delete(id)
+
+	d, err := c.Get(id)
+	if err != nil || !bytes.Equal(d, content) {
+		t.Fatalf("c.Get(%q) returned %q, %v", id, d, err)
+	}
+	for _, node := range nodes {
+		if d, err := storeOf[node].Get(id); err != nil || !bytes.Equal(d, content) {
+			t.Fatalf("%s has %q, %v after read repair", node, d, err)
+		}
+	}
+	if n := strings.Count(logBuf.String(), "repaired"); n != 2 {
+		t.Fatalf("logged %d repairs, expected 2:\n%s", n, logBuf.String())
+	}
+}
+
+func TestSync(t *testing.T) {
+	srcPath, dstPath := "test_src", "test_dst"
+	removeStoreFiles(srcPath)
+	removeStoreFiles(dstPath)
+	defer removeStoreFiles(srcPath)
+	defer removeStoreFiles(dstPath)
+	src, err := contentstore.New(srcPath)
+	if err != nil {
+		t.Fatalf("contentstore.New(%q) failed with %q", srcPath, err)
+	}
+	defer src.Close()
+	dst, err := contentstore.New(dstPath)
+	if err != nil {
+		t.Fatalf("contentstore.New(%q) failed with %q", dstPath, err)
+	}
+	defer dst.Close()
+	var ids []string
+	for i := 0; i < 3000; i++ {
+		d := []byte(fmt.Sprintf("blob %d", i))
+		id, _ := src.Put(d)
+		ids = append(ids, id)
+		// dst already has a third of them
+		if i%3 == 0 {
+			dst.Put(d)
+		}
+	}
+	srv := httptest.NewServer(contentstore.NewHandler(dst, false))
+	defer srv.Close()
+	c := New(srv.URL)
+	defer c.Close()
+
+	missing, err := c.MissingFrom(ids[:6])
+	if err != nil || !slices.Equal(missing, []string{ids[1], ids[2], ids[4], ids[5]}) {
+		t.Fatalf("c.MissingFrom() returned %v, %v", missing, err)
+	}
+	filter, err := c.BloomFilter(0.01)
+	if err != nil {
+		t.Fatalf("c.BloomFilter() failed with %q", err)
+	}
+	for i := 0; i < len(ids); i += 3 {
+		if !filter.MayContain(ids[i]) {
+			t.Fatalf("bloom filter doesn't contain %s", ids[i])
+		}
+	}
+
+	var srcSet, dstSet bytes.Buffer
+	src.ExportIDSet(&srcSet)
+	if err = c.ExportIDSet(&dstSet); err != nil {
+		t.Fatalf("c.ExportIDSet() failed with %q", err)
+	}
+	onlySrc, onlyDst, err := contentstore.DiffIDSets(&srcSet, &dstSet)
+	if err != nil || len(onlySrc) != 2000 || len(onlyDst) != 0 {
+		t.Fatalf("contentstore.DiffIDSets() returned %d, %d ids, %v", len(onlySrc), len(onlyDst), err)
+	}
+
+	res, err := src.SyncTo(c, contentstore.SyncOptions{Exact: true})
+	if err != nil || res.Checked != len(ids) || res.Copied != 2000 {
+		t.Fatalf("src.SyncTo() returned %+v, %v", res, err)
+	}
+	if missing, _ = dst.MissingFrom(ids); len(missing) != 0 {
+		t.Fatalf("%d blobs are missing after sync", len(missing))
+	}
+	res, err = src.SyncTo(c, contentstore.SyncOptions{})
+	if err != nil || res.Copied != 0 {
+		t.Fatalf("src.SyncTo() returned %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,360 @@
+package client
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kjk/contentstore"
+)
+
+// Cluster spreads blobs across several servers with consistent hashing.
+// Each server has many points on a ring of hashes and a blob is stored on
+// the first replicas servers that follow the hash of the blob (its id) on
+// the ring. When a server is added, it takes over only blobs between its
+// points and the points before them, about 1/N of the blobs, and the rest
+// stay where they are.
+//
+// Blobs that should be on the new server aren't there until they're copied.
+// Get() finds them on other servers and copies them (read repair) and
+// Rebalance() copies all of them.
+//
+// Read repair also fixes replicas that lost a blob or have a corrupted copy
+// (content that doesn't match the id). Get() writes the good copy to them,
+// after deleting the corrupted one, and logs it (see SetLogger()).
+
+var (
+	errNoNodes     = errors.New("cluster needs at least one server")
+	errNodeExists  = errors.New("server is already in the cluster")
+	errBadReplicas = errors.New("replication factor must be at least 1")
+	errCorrupted   = errors.New("content of the blob doesn't match its id")
+)
+
+const (
+	// points on the ring for each server. More means more even spread
+	pointsPerNode = 128
+)
+
+type ringPoint struct {
+	hash uint64
+	node *Client
+}
+
+// Cluster is a contentstore.Storer that stores blobs on several servers.
+// It's safe for concurrent use
+type Cluster struct {
+	opts     []Option
+	replicas int
+	mu       sync.RWMutex
+	nodes    map[string]*Client
+	// sorted by hash
+	ring   []ringPoint
+	logger atomic.Pointer[log.Logger]
+}
+
+// NewCluster returns a client for servers at baseURLs that stores each blob
+// on replicas servers. opts are used for clients of each server
+func NewCluster(baseURLs []string, replicas int, opts ...Option) (*Cluster, error) {
+	if len(baseURLs) == 0 {
+		return nil, errNoNodes
+	}
+	if replicas < 1 {
+		return nil, errBadReplicas
+	}
+	c := &Cluster{
+		opts:     opts,
+		replicas: replicas,
+		nodes:    make(map[string]*Client),
+	}
+	for _, baseURL := range baseURLs {
+		if err := c.AddNode(baseURL); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// SetLogger makes the cluster log repairs of replicas to logger. nil
+// disables logging
+func (c *Cluster) SetLogger(logger *log.Logger) {
+	c.logger.Store(logger)
+}
+
+func (c *Cluster) logf(format string, args ...any) {
+	if logger := c.logger.Load(); logger != nil {
+		logger.Printf(format, args...)
+	}
+}
+
+// AddNode adds server at baseURL to the cluster
+func (c *Cluster) AddNode(baseURL string) error {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[baseURL] != nil {
+		return errNodeExists
+	}
+	node := New(baseURL, c.opts...)
+	c.nodes[baseURL] = node
+	for i := 0; i < pointsPerNode; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s-%d", baseURL, i)))
+		c.ring = append(c.ring, ringPoint{hash: binary.BigEndian.Uint64(sum[:8]), node: node})
+	}
+	sort.Slice(c.ring, func(i, j int) bool {
+		return c.ring[i].hash < c.ring[j].hash
+	})
+	return nil
+}
+
+// nodesFor returns all servers in the order they're tried for blob with
+// a given id. The first replicas of them store the blob. id can be
+// multihash or CID too, the blob is on the same servers
+func (c *Cluster) nodesFor(id string) ([]*Client, error) {
+	hexId, err := contentstore.HexId(id)
+	if err != nil {
+		return nil, err
+	}
+	sum, _ := hex.DecodeString(hexId)
+	hash := binary.BigEndian.Uint64(sum[:8])
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]*Client, 0, len(c.nodes))
+	seen := make(map[*Client]bool, len(c.nodes))
+	start := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i].hash >= hash
+	})
+	for i := 0; i < len(c.ring) && len(res) < len(c.nodes); i++ {
+		node := c.ring[(start+i)%len(c.ring)].node
+		if !seen[node] {
+			seen[node] = true
+			res = append(res, node)
+		}
+	}
+	return res, nil
+}
+
+// replicasOf returns number of servers that store a blob
+func (c *Cluster) replicasOf(nodes []*Client) int {
+	return min(c.replicas, len(nodes))
+}
+
+// Nodes returns base URLs of servers that store blob with a given id. It
+// returns nil if id is not valid
+func (c *Cluster) Nodes(id string) []string {
+	nodes, _ := c.nodesFor(id)
+	var res []string
+	for _, node := range nodes[:c.replicasOf(nodes)] {
+		res = append(res, node.baseURL)
+	}
+	return res
+}
+
+// Put stores d on all servers that should have it. It fails if storing on
+// any of them fails
+func (c *Cluster) Put(d []byte) (string, error) {
+	sum := sha1.Sum(d)
+	id := hex.EncodeToString(sum[:])
+	nodes, _ := c.nodesFor(id)
+	return id, putAll(nodes[:c.replicasOf(nodes)], id, d)
+}
+
+// putAll stores d with a given id on nodes, in parallel
+func putAll(nodes []*Client, id string, d []byte) error {
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Client) {
+			defer wg.Done()
+			nodeId, err := node.Put(d)
+			if err == nil && nodeId != id {
+				err = fmt.Errorf("%s returned id %s, expected %s", node.baseURL, nodeId, id)
+			}
+			errs[i] = err
+		}(i, node)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// validCopy returns true if d is content of blob with a given id
+func validCopy(id string, d []byte) bool {
+	hexId, err := contentstore.HexId(id)
+	sum := sha1.Sum(d)
+	return err == nil && hexId == hex.EncodeToString(sum[:])
+}
+
+// Get returns content of the blob from the first server that has a good
+// copy of it. Servers that should have it but don't, or have a corrupted
+// copy, get the good copy
+func (c *Cluster) Get(id string) ([]byte, error) {
+	nodes, err := c.nodesFor(id)
+	if err != nil {
+		return nil, err
+	}
+	nReplicas := c.replicasOf(nodes)
+	var missing, corrupted []*Client
+	err = contentstore.ErrNotFound
+	for i, node := range nodes {
+		d, nodeErr := node.Get(id)
+		if nodeErr == nil && !validCopy(id, d) {
+			nodeErr = errCorrupted
+			if i < nReplicas {
+				corrupted = append(corrupted, node)
+			}
+		}
+		if nodeErr == nil {
+			// check replicas we didn't read
+			for _, other := range nodes[min(i+1, nReplicas):nReplicas] {
+				if !other.Exists(id) {
+					missing = append(missing, other)
+				}
+			}
+			c.repair(id, d, missing, corrupted)
+			return d, nil
+		}
+		if nodeErr == contentstore.ErrNotFound {
+			if i < nReplicas {
+				missing = append(missing, node)
+			}
+		} else {
+			err = nodeErr
+		}
+	}
+	return nil, err
+}
+
+// repair writes good copy d of a blob to servers that don't have it and to
+// servers that have a corrupted copy. It's fine if it fails, we'll try again
+// next time. Returns number of repaired servers
+func (c *Cluster) repair(id string, d []byte, missing, corrupted []*Client) int {
+	for _, node := range corrupted {
+		// the server wouldn't store it again
+		if err := node.Delete(id); err != nil && err != contentstore.ErrNotFound {
+			c.logf("failed to delete corrupted copy of %s from %s: %s", id, node.baseURL, err)
+			continue
+		}
+		missing = append(missing, node)
+	}
+	n := 0
+	for _, node := range missing {
+		if _, err := node.Put(d); err != nil {
+			c.logf("failed to repair %s on %s: %s", id, node.baseURL, err)
+			continue
+		}
+		c.logf("repaired %s on %s", id, node.baseURL)
+		n++
+	}
+	return n
+}
+
+// Stat returns information about the blob from the first server that has it
+func (c *Cluster) Stat(id string) (contentstore.BlobInfo, error) {
+	nodes, err := c.nodesFor(id)
+	if err != nil {
+		return contentstore.BlobInfo{}, err
+	}
+	err = contentstore.ErrNotFound
+	for _, node := range nodes {
+		info, nodeErr := node.Stat(id)
+		if nodeErr == nil {
+			return info, nil
+		}
+		if nodeErr != contentstore.ErrNotFound {
+			err = nodeErr
+		}
+	}
+	return contentstore.BlobInfo{}, err
+}
+
+// Exists returns true if any server has the blob
+func (c *Cluster) Exists(id string) bool {
+	_, err := c.Stat(id)
+	return err == nil
+}
+
+// Rebalance copies blobs to servers that should have them but don't, e.g.
+// after AddNode(). It lists blobs with Changes() so servers must support
+// replication. Returns number of copies made
+func (c *Cluster) Rebalance() (int, error) {
+	c.mu.RLock()
+	nodes := make([]*Client, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+	nCopied := 0
+	for _, node := range nodes {
+		var after contentstore.Cursor
+		for {
+			ids, next, err := node.Changes(after)
+			if err != nil {
+				return nCopied, err
+			}
+			if len(ids) == 0 {
+				break
+			}
+			for _, id := range ids {
+				n, err := c.copyToReplicas(node, id)
+				nCopied += n
+				if err != nil {
+					return nCopied, err
+				}
+			}
+			after = next
+		}
+	}
+	return nCopied, nil
+}
+
+// copyToReplicas copies blob with a given id from node to servers that
+// should have it but don't. Returns number of copies made
+func (c *Cluster) copyToReplicas(from *Client, id string) (int, error) {
+	nodes, err := c.nodesFor(id)
+	if err != nil {
+		return 0, err
+	}
+	var missing []*Client
+	for _, node := range nodes[:c.replicasOf(nodes)] {
+		if node != from && !node.Exists(id) {
+			missing = append(missing, node)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	d, err := from.Get(id)
+	if err == contentstore.ErrNotFound {
+		// deleted since it was listed
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !validCopy(id, d) {
+		// Get() will find a good copy and repair it
+		c.logf("%s has corrupted copy of %s", from.baseURL, id)
+		return 0, nil
+	}
+	return len(missing), putAll(missing, id, d)
+}
+
+// Close closes clients of all servers
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range c.nodes {
+		node.Close()
+	}
+	return nil
+}
+
+// make sure Cluster implements Storer
+var _ contentstore.Storer = (*Cluster)(nil)
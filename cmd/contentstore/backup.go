@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedBackupDir = errors.New("missing <dir> argument")
+	errNeedSets      = errors.New("missing <set> arguments")
+)
+
+func cmdBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	since := flags.Int("since", 0, "only copy what changed since backup with this generation, 0 means full backup")
+	basePath, rest, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return errNeedBackupDir
+	}
+	if !contentstore.StoreExists(basePath) {
+		return fmt.Errorf("%s: %w", basePath, errNoStore)
+	}
+	store, err := contentstore.New(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	res, err := store.BackupIncremental(rest[0], *since)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backup generation %d: copied %d files (%s)\n", res.Gen, res.Files, formatSize(res.Size))
+	fmt.Println(res.Gen)
+	return nil
+}
+
+func cmdRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	basePath, sets, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(sets) == 0 {
+		return errNeedSets
+	}
+	return contentstore.RestoreBackup(basePath, sets...)
+}
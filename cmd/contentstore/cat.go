@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedId = errors.New("missing <id> argument")
+)
+
+func cmdCat(args []string) error {
+	flags := flag.NewFlagSet("cat", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "verify sha1 of the content while streaming it")
+	outPath := flags.String("o", "", "write the content to a file instead of stdout. The file only appears when it's complete")
+	basePath, args, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return errNeedId
+	}
+	id := args[0]
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *outPath != "" {
+		return catToFile(store, id, *outPath, *verify)
+	}
+	if !*verify {
+		// when stdout is a file or a pipe, the kernel does the copying
+		_, err = store.CopyTo(id, os.Stdout)
+		return err
+	}
+	h := sha1.New()
+	if _, err = store.CopyTo(id, io.MultiWriter(os.Stdout, h)); err != nil {
+		return err
+	}
+	return checkSha1(id, h.Sum(nil))
+}
+
+func checkSha1(id string, sha1 []byte) error {
+	if sha1Hex := fmt.Sprintf("%x", sha1); sha1Hex != id {
+		return fmt.Errorf("blob %s is corrupted, sha1 of the content is %s", id, sha1Hex)
+	}
+	return nil
+}
+
+// catToFile writes content of the blob to a file at path. With verify, the
+// file is removed if it's corrupted
+func catToFile(store *contentstore.Store, id string, path string, verify bool) error {
+	if err := store.CopyToFile(id, path); err != nil || !verify {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	file.Close()
+	if err == nil {
+		err = checkSha1(id, h.Sum(nil))
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
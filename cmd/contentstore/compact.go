@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kjk/contentstore"
+)
+
+func cmdCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be reclaimed")
+	minDead := flags.Float64("min-dead", 0, "only compact segments in which deleted blobs take at least this fraction (0 to 1) of the file")
+	maxRate := flags.Int64("max-rate", 0, "max MB per second read from segments, 0 means unlimited")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if !contentstore.StoreExists(basePath) {
+		return fmt.Errorf("%s: %w", basePath, errNoStore)
+	}
+	var store *contentstore.Store
+	if *dryRun {
+		store, err = openStore(basePath)
+	} else {
+		store, err = contentstore.New(basePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	opts := contentstore.CompactOptions{
+		MinDeadRatio:   *minDead,
+		MaxBytesPerSec: *maxRate * 1024 * 1024,
+		DryRun:         *dryRun,
+	}
+	res, err := store.Compact(opts)
+	if res != nil {
+		verb := "compacted"
+		if *dryRun {
+			verb = "would compact"
+		}
+		fmt.Fprintf(os.Stderr, "%s %d segment files (%s), moving %d blobs (%s), reclaiming %s and %d index records\n", verb, len(res.Segments), formatSize(res.SegmentsSize), res.MovedBlobs, formatSize(res.MovedSize), formatSize(res.SegmentsSize-res.MovedSize), res.IndexRecords)
+	}
+	return err
+}
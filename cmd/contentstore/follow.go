@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjk/contentstore"
+	"github.com/kjk/contentstore/client"
+)
+
+// With -follow the server is a replica (follower) of another server (the
+// leader). It periodically asks the leader for blobs added since it last
+// asked and copies those it doesn't have. Position in leader's list of
+// changes (generation of leader's index and position in it) is saved in
+// <store>_follow.txt so that a restarted follower continues where it
+// stopped.
+//
+// Followers don't accept writes. To fail over when the leader dies:
+//  1. stop the follower
+//  2. start it again without -follow
+//  3. point writers (and other followers, with -follow) to it
+//
+// Blobs stored by the old leader that the follower didn't copy yet are
+// missing until the old leader comes back and is made to follow the new one.
+
+var (
+	errWrongContent = errors.New("leader returned content that doesn't match id")
+)
+
+const (
+	// how often we ask the leader for changes
+	followInterval = time.Second
+)
+
+type follower struct {
+	leader     *client.Client
+	store      *contentstore.Store
+	cursorPath string
+}
+
+func newFollower(leaderURL, token string, store *contentstore.Store, basePath string) *follower {
+	var opts []client.Option
+	if token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	return &follower{
+		leader:     client.New(leaderURL, opts...),
+		store:      store,
+		cursorPath: basePath + "_follow.txt",
+	}
+}
+
+// parseCursor parses cursor saved with formatCursor. Older versions saved
+// only the position, which is in generation 0
+func parseCursor(s string) (contentstore.Cursor, error) {
+	var cursor contentstore.Cursor
+	parts := strings.Fields(s)
+	if len(parts) == 1 {
+		parts = []string{"0", parts[0]}
+	}
+	if len(parts) != 2 {
+		return cursor, fmt.Errorf("invalid cursor %q", s)
+	}
+	var err error
+	if cursor.Generation, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return cursor, err
+	}
+	cursor.Position, err = strconv.ParseInt(parts[1], 10, 64)
+	return cursor, err
+}
+
+func formatCursor(cursor contentstore.Cursor) string {
+	return fmt.Sprintf("%d %d", cursor.Generation, cursor.Position)
+}
+
+// readCursor returns saved position in leader's list of changes
+func (f *follower) readCursor() contentstore.Cursor {
+	d, err := os.ReadFile(f.cursorPath)
+	if err != nil {
+		return contentstore.Cursor{}
+	}
+	// if it's invalid, we start from the beginning, which is slower but safe
+	cursor, err := parseCursor(string(d))
+	if err != nil {
+		return contentstore.Cursor{}
+	}
+	return cursor
+}
+
+func (f *follower) saveCursor(cursor contentstore.Cursor) error {
+	tmpPath := f.cursorPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(formatCursor(cursor)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.cursorPath)
+}
+
+// copyBlob copies blob from the leader to our store
+func (f *follower) copyBlob(id string) error {
+	if f.store.Exists(id) {
+		return nil
+	}
+	d, err := f.leader.Get(id)
+	if err == contentstore.ErrNotFound {
+		// deleted from the leader since it was added
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	gotId, err := f.store.Put(d)
+	if err != nil {
+		return err
+	}
+	if gotId != id {
+		return fmt.Errorf("%s: %w", id, errWrongContent)
+	}
+	return nil
+}
+
+// sync copies blobs added to the leader since the last time
+func (f *follower) sync() error {
+	cursor := f.readCursor()
+	for {
+		ids, next, err := f.leader.Changes(cursor)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		// if we fail, we'll copy the whole batch again, skipping blobs we
+		// already have
+		for _, id := range ids {
+			if err = f.copyBlob(id); err != nil {
+				return err
+			}
+		}
+		cursor = next
+		if err = f.saveCursor(cursor); err != nil {
+			return err
+		}
+	}
+}
+
+// run syncs with the leader until stop is closed
+func (f *follower) run(stop <-chan struct{}) {
+	for {
+		if err := f.sync(); err != nil {
+			log.Printf("failed to sync with the leader: %s", err)
+		}
+		select {
+		case <-stop:
+			f.leader.Close()
+			return
+		case <-time.After(followInterval):
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedKeep = errors.New("missing -keep file")
+)
+
+// readKeepFile reads ids of blobs to keep, one per line. Empty lines and
+// lines starting with # are ignored
+func readKeepFile(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keep := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keep[strings.ToLower(line)] = true
+	}
+	return keep, scanner.Err()
+}
+
+func cmdGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	keepPath := flags.String("keep", "", "file with ids of blobs to keep, one per line")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *keepPath == "" {
+		return errNeedKeep
+	}
+	keep, err := readKeepFile(*keepPath)
+	if err != nil {
+		return err
+	}
+	if !contentstore.StoreExists(basePath) {
+		return fmt.Errorf("%s: %w", basePath, errNoStore)
+	}
+	var store *contentstore.Store
+	if *dryRun {
+		store, err = openStore(basePath)
+	} else {
+		store, err = contentstore.New(basePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	opts := contentstore.GCOptions{
+		Keep:   func(id string) bool { return keep[id] },
+		DryRun: *dryRun,
+	}
+	res, err := store.GC(opts)
+	if res != nil && *dryRun {
+		for _, id := range res.Ids {
+			fmt.Println(id)
+		}
+		fmt.Fprintf(os.Stderr, "would remove %d blobs (%s) and %d segment files (%s)\n", len(res.Ids), formatSize(res.Size), len(res.Segments), formatSize(res.SegmentsSize))
+	} else if res != nil {
+		fmt.Fprintf(os.Stderr, "removed %d blobs (%s) and %d segment files (%s)\n", len(res.Ids), formatSize(res.Size), len(res.Segments), formatSize(res.SegmentsSize))
+	}
+	return err
+}
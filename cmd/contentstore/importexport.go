@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedSource = errors.New("missing <dir|tar|zip> argument")
+)
+
+// importer stores blobs and prints their ids, so that the caller can
+// map file names to ids
+type importer struct {
+	store *contentstore.Store
+	n     int
+}
+
+func (imp *importer) put(name string, r io.Reader) error {
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	id, err := imp.store.Put(d)
+	if err != nil {
+		return err
+	}
+	imp.n++
+	fmt.Printf("%s %s\n", id, name)
+	return nil
+}
+
+func (imp *importer) importDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return imp.put(path, f)
+	})
+}
+
+func (imp *importer) importTar(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = imp.put(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (imp *importer) importZip(path string, refPrefix string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	files, err := imp.store.ImportZip(f, stat.Size(), contentstore.ZipImportOptions{RefPrefix: refPrefix})
+	for _, file := range files {
+		fmt.Printf("%s %s\n", file.Id, file.Name)
+	}
+	imp.n += len(files)
+	return err
+}
+
+func cmdImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	hashed := flags.String("hashed", "", "directory is laid out by hash, with comma-separated lengths of directory names (e.g. 2 for ab/cdef...)")
+	sha1Names := flags.Bool("sha1-names", false, "with -hashed, names of files are sha1 of their content")
+	refPrefix := flags.String("ref-prefix", "", "with zip, record names of files as refs with this prefix")
+	basePath, args, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return errNeedSource
+	}
+	src := args[0]
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	store, err := contentstore.New(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *hashed != "" {
+		return importHashedDir(store, src, *hashed, *sha1Names)
+	}
+	imp := &importer{store: store}
+	lower := strings.ToLower(src)
+	switch {
+	case stat.IsDir():
+		err = imp.importDir(src)
+	case strings.HasSuffix(lower, ".zip"):
+		err = imp.importZip(src, *refPrefix)
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		err = imp.importTar(src)
+	default:
+		return fmt.Errorf("don't know how to import %s, expected a directory, .tar, .tar.gz or .zip file", src)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d files\n", imp.n)
+	return err
+}
+
+// parseLevels parses -hashed, e.g. "2,2"
+func parseLevels(levels string) ([]int, error) {
+	var res []int
+	for _, s := range strings.Split(levels, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid -hashed %q", levels)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func importHashedDir(store *contentstore.Store, dir string, levels string, sha1Names bool) error {
+	layout := contentstore.HashedDirLayout{Sha1: sha1Names}
+	var err error
+	if layout.Levels, err = parseLevels(levels); err != nil {
+		return err
+	}
+	res, err := store.ImportHashedDir(dir, layout)
+	if res != nil {
+		for _, path := range res.Mismatched {
+			fmt.Fprintf(os.Stderr, "%s: content doesn't match the name\n", path)
+		}
+		for _, path := range res.Ignored {
+			fmt.Fprintf(os.Stderr, "%s: ignored, doesn't match the layout\n", path)
+		}
+		fmt.Fprintf(os.Stderr, "imported %d files, skipped %d already stored\n", res.Imported, res.Skipped)
+	}
+	return err
+}
+
+func exportTar(store *contentstore.Store, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := store.ForEach(func(info contentstore.BlobInfo) error {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     info.Id,
+			Size:     int64(info.Size),
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+		}
+		if !info.Created.IsZero() {
+			hdr.ModTime = info.Created
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := store.CopyTo(info.Id, tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportHashedDir(store *contentstore.Store, dir string, levels string) error {
+	var layout contentstore.HashedDirLayout
+	var err error
+	if layout.Levels, err = parseLevels(levels); err != nil {
+		return err
+	}
+	res, err := store.ExportHashedDir(dir, layout)
+	if res != nil {
+		fmt.Fprintf(os.Stderr, "exported %d blobs, skipped %d already exported\n", res.Exported, res.Skipped)
+	}
+	return err
+}
+
+func cmdExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "tar", "format of the export, tar or dir")
+	out := flags.String("o", "", "file to write to, stdout if not given. Directory for -format dir")
+	hashed := flags.String("hashed", "2", "with -format dir, comma-separated lengths of directory names (e.g. 2 for ab/cdef...)")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *format != "tar" && *format != "dir" {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+	if *format == "dir" && *out == "" {
+		return errors.New("-format dir needs -o")
+	}
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *format == "dir" {
+		return exportHashedDir(store, *out, *hashed)
+	}
+	if *out == "" {
+		return exportTar(store, os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = exportTar(store, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
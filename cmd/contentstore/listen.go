@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// first file descriptor passed by systemd, see sd_listen_fds(3)
+	listenFdsStart = 3
+)
+
+// systemdListener returns listener passed by systemd with socket activation
+// or nil if we were not socket-activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nFds < 1 {
+		return nil, nil
+	}
+	if nFds > 1 {
+		return nil, fmt.Errorf("got %d sockets from systemd, expected 1", nFds)
+	}
+	// so that child processes don't think the sockets are for them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	file := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// listen returns listener passed by systemd or, if there is none, creates
+// a listener on addr
+func listen(addr string) (net.Listener, error) {
+	l, err := systemdListener()
+	if l != nil || err != nil {
+		return l, err
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,109 @@
+// Command contentstore inspects and manages stores created with
+// github.com/kjk/contentstore. A store is identified by its base path,
+// the same value that was passed to contentstore.New().
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNoStore   = errors.New("store doesn't exist")
+	errNeedStore = errors.New("missing <store> argument")
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"stats", "stats <store> | stats -config file\n\tshow number of blobs, their size and dedup savings. With -config, show number of blobs and their size in each namespace", cmdStats},
+	{"du", "du <store>\n\tshow disk usage of each segment", cmdDu},
+	{"cat", "cat [-verify] [-o file] <store> <id>\n\twrite content of the blob to stdout or to a file", cmdCat},
+	{"import", "import [-hashed 2[,2...] [-sha1-names]] [-ref-prefix prefix] <store> <dir|tar|zip>\n\tstore each file as a blob and print its id. -hashed imports a directory of files named by their hash. -ref-prefix records names of files in zip as refs", cmdImport},
+	{"export", "export [-format tar|dir] [-hashed 2[,2...]] [-o file|dir] <store>\n\twrite all blobs, named by their ids, to a tar file or to files in a directory laid out by hash", cmdExport},
+	{"verify", "verify [-deep] [-workers N] [-max-rate MB] [-q] <store>\n\tcheck integrity of the store, exits with error if any blob is corrupted", cmdVerify},
+	{"serve", "serve [-addr :8080] [-read-only] [-admin] [-uploads-dir dir] [-q] [-config file] [-tls-cert file -tls-key file] [-follow url] <store>\n\tserve blobs over HTTP, optionally as a replica of another server", cmdServe},
+	{"gc", "gc -keep file [-dry-run] <store>\n\tremove blobs not listed in file with ids to keep. -dry-run prints ids of blobs that would be removed", cmdGC},
+	{"compact", "compact [-dry-run] [-min-dead ratio] [-max-rate MB] <store>\n\treclaim space of deleted blobs by rewriting segment files and the index. -dry-run prints what would be reclaimed", cmdCompact},
+	{"migrate", "migrate -to store1,store2... [-keep] [-max-rate MB] [-state file] [-q] <store>\n\tmove blobs from <store> to stores they belong to when spread across -to stores (see contentstore.Router)", cmdMigrate},
+	{"backup", "backup [-since gen] <store> <dir>\n\tcopy files of the store to a backup set in <dir> and print its generation. -since only copies what changed since an earlier backup", cmdBackup},
+	{"pack", "pack [-segment-size MB] <store> <dst>\n\twrite blobs to a new store <dst> in order of their ids, so that stores with the same blobs have identical files", cmdPack},
+	{"restore", "restore <store> <set> [<set>...]\n\tcreate <store> from a full backup set followed by incremental sets, in order", cmdRestore},
+	{"sign", "sign -config file [-ns namespace] [-ttl 24h] <id>\n\tprint path of the blob that can be read without a token until it expires", cmdSign},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: contentstore <command> [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+}
+
+// openStore opens existing store for reading. We don't want to create a new
+// store because of a typo in the path. It's safe to use while another
+// process writes to the store
+func openStore(basePath string, opts ...contentstore.Option) (*contentstore.Store, error) {
+	if !contentstore.StoreExists(basePath) {
+		return nil, fmt.Errorf("%s: %w", basePath, errNoStore)
+	}
+	return contentstore.OpenReadOnly(basePath, opts...)
+}
+
+// parseStoreArgs parses flags of a command that takes store as the first
+// argument and returns base path of the store and remaining arguments
+func parseStoreArgs(flags *flag.FlagSet, args []string) (string, []string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if flags.NArg() < 1 {
+		return "", nil, errNeedStore
+	}
+	basePath := flags.Arg(0)
+	// also allow flags after <store> e.g. "serve <store> -addr :8080"
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return "", nil, err
+	}
+	return basePath, flags.Args(), nil
+}
+
+// formatSize returns human-readable version of size in bytes
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				fmt.Fprintf(os.Stderr, "contentstore %s: %s\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
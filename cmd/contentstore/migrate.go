@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedTo = errors.New("missing -to stores")
+)
+
+// readMoveState returns position saved by a previous, interrupted, run of
+// migrate or the beginning if there wasn't one
+func readMoveState(path string) (contentstore.Cursor, error) {
+	d, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return contentstore.Cursor{}, nil
+	}
+	if err != nil {
+		return contentstore.Cursor{}, err
+	}
+	return parseCursor(string(d))
+}
+
+func cmdMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := flags.String("to", "", "comma-separated stores to spread blobs across, in order")
+	keep := flags.Bool("keep", false, "copy blobs, don't remove them from <store>")
+	maxRate := flags.Int64("max-rate", 0, "max MB per second read from <store>, 0 means unlimited")
+	statePath := flags.String("state", "", "file to save progress in, to continue if interrupted")
+	quiet := flags.Bool("q", false, "don't show progress")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if *to == "" {
+		return errNeedTo
+	}
+	if !contentstore.StoreExists(basePath) {
+		return fmt.Errorf("%s: %w", basePath, errNoStore)
+	}
+	src, err := contentstore.New(basePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var stores []contentstore.Storer
+	for _, path := range strings.Split(*to, ",") {
+		if path == basePath {
+			// can't open the same store twice
+			stores = append(stores, src)
+			continue
+		}
+		store, err := contentstore.New(path)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+	router, err := contentstore.NewRouter(stores...)
+	if err != nil {
+		return err
+	}
+	opts := contentstore.MoveOptions{
+		Keep:           *keep,
+		MaxBytesPerSec: *maxRate * 1024 * 1024,
+	}
+	if *statePath != "" {
+		if opts.After, err = readMoveState(*statePath); err != nil {
+			return err
+		}
+	}
+	opts.Progress = func(p contentstore.MoveProgress) {
+		if *statePath != "" {
+			// if we fail, we'll only redo some work
+			os.WriteFile(*statePath, []byte(formatCursor(p.Position)), 0644)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "\rmoved %d blobs (%s), %d already in place", p.Moved, formatSize(p.MovedBytes), p.Skipped)
+		}
+	}
+	res, err := router.MoveFrom(src, opts)
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err != nil {
+		return err
+	}
+	if *statePath != "" {
+		os.Remove(*statePath)
+	}
+	fmt.Printf("moved %d blobs (%s), %d already in place\n", res.Moved, formatSize(res.MovedBytes), res.Skipped)
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kjk/contentstore"
+)
+
+// Namespaces allow one server to serve several applications. Each namespace
+// is a separate store, served under /ns/<name>/ (e.g. /ns/<name>/blobs/<id>).
+// Since each has its own tokens, clients of one namespace can't see or add
+// blobs in another and each can have its own quota and max size of a blob.
+// Namespaces are defined in config file:
+//
+//	"namespaces": {
+//		"app1": {"store": "/data/app1", "quota": 1000000000, "max_blob_size": 10000000, "tokens": {"secret": "read,write"}}
+//	}
+//
+// Each namespace can also have its own encryption key, in a file with the
+// key in hex (e.g. created with "openssl rand -hex 32"):
+//
+//	"app2": {"store": "/data/app2", "key_file": "/secrets/app2.key", "tokens": {"secret2": "read,write"}}
+//
+// The key is only used for a new store, an existing store can't be
+// encrypted. Deleting the key file (and its backups) makes blobs of the
+// namespace unreadable.
+
+var (
+	errNamespaceConfig = errors.New("namespace needs store and at least one token")
+)
+
+const (
+	namespacesPath = "/ns/"
+)
+
+type namespaceConfig struct {
+	// base path of the store
+	Store string `json:"store"`
+	// max total size of blobs, 0 means unlimited
+	Quota int64 `json:"quota"`
+	// max size of a blob, 0 means unlimited
+	MaxBlobSize int `json:"max_blob_size"`
+	// file with encryption key, in hex. If empty, blobs are not encrypted
+	KeyFile string `json:"key_file"`
+	accessConfig
+}
+
+type namespace struct {
+	name    string
+	access  accessConfig
+	store   *contentstore.Store
+	handler *contentstore.Handler
+}
+
+func openNamespaces(cfg *serveConfig, readOnly, admin bool) ([]*namespace, error) {
+	var names []string
+	for name := range cfg.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var res []*namespace
+	for _, name := range names {
+		nsCfg := cfg.Namespaces[name]
+		var opts []contentstore.Option
+		if nsCfg.Quota > 0 {
+			opts = append(opts, contentstore.WithQuota(nsCfg.Quota))
+		}
+		if nsCfg.MaxBlobSize > 0 {
+			opts = append(opts, contentstore.WithMaxBlobSize(nsCfg.MaxBlobSize))
+		}
+		if nsCfg.KeyFile != "" {
+			opts = append(opts, contentstore.WithEncryption(keyFromFile(nsCfg.KeyFile)))
+		}
+		var store *contentstore.Store
+		var err error
+		if readOnly {
+			store, err = openStore(nsCfg.Store, opts...)
+		} else {
+			store, err = contentstore.New(nsCfg.Store, opts...)
+		}
+		if err != nil {
+			closeNamespaces(res)
+			return nil, fmt.Errorf("namespace %s: %w", name, err)
+		}
+		handler := contentstore.NewHandler(store, readOnly)
+		if admin {
+			handler.EnableAdmin()
+		}
+		res = append(res, &namespace{
+			name:    name,
+			access:  nsCfg.accessConfig,
+			store:   store,
+			handler: handler,
+		})
+	}
+	return res, nil
+}
+
+// keyFromFile returns a function that reads encryption key from a file
+func keyFromFile(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(string(d)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: key must be in hex: %w", path, err)
+		}
+		return key, nil
+	}
+}
+
+func closeNamespaces(namespaces []*namespace) {
+	for _, ns := range namespaces {
+		ns.store.Close()
+	}
+}
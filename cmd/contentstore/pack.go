@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+var (
+	errNeedPackDst = errors.New("missing <dst> argument")
+)
+
+func cmdPack(args []string) error {
+	flags := flag.NewFlagSet("pack", flag.ContinueOnError)
+	segmentSize := flags.Int("segment-size", 10, "max size of segment files in MB")
+	basePath, rest, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return errNeedPackDst
+	}
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.Pack(rest[0], *segmentSize*1024*1024)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/kjk/contentstore"
+)
+
+// serveConfig are settings of serve command that can be changed without
+// restarting the server by editing config file and sending SIGHUP.
+// Settings missing from config file keep values given with flags
+type serveConfig struct {
+	ReadOnly    *bool `json:"read_only"`
+	LogRequests *bool `json:"log_requests"`
+	accessConfig
+	// additional stores, see namespaces.go. Only their access settings
+	// are changed on reload
+	Namespaces map[string]*namespaceConfig `json:"namespaces"`
+}
+
+// accessConfig determines who can access a store
+type accessConfig struct {
+	// maps token to its scope: "read", "write" or "read,write". If there
+	// are no tokens, clients don't have to authenticate
+	Tokens map[string]string `json:"tokens"`
+	// key for signing URLs of blobs (see sign command)
+	SigningKey string `json:"signing_key"`
+
+	tokens map[string]contentstore.Scope
+}
+
+func parseScope(s string) (contentstore.Scope, error) {
+	var scope contentstore.Scope
+	for _, part := range strings.Split(s, ",") {
+		switch strings.TrimSpace(part) {
+		case "read":
+			scope |= contentstore.ScopeRead
+		case "write":
+			scope |= contentstore.ScopeWrite
+		default:
+			return 0, fmt.Errorf("invalid scope %q", s)
+		}
+	}
+	return scope, nil
+}
+
+func readServeConfig(path string) (*serveConfig, error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg serveConfig
+	if err = json.Unmarshal(d, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.tokens, err = parseTokens(cfg.Tokens); err != nil {
+		return nil, err
+	}
+	for name, nsCfg := range cfg.Namespaces {
+		if nsCfg.Store == "" || len(nsCfg.Tokens) == 0 {
+			return nil, fmt.Errorf("namespace %s: %w", name, errNamespaceConfig)
+		}
+		if nsCfg.tokens, err = parseTokens(nsCfg.Tokens); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+func parseTokens(tokens map[string]string) (map[string]contentstore.Scope, error) {
+	res := make(map[string]contentstore.Scope, len(tokens))
+	for token, s := range tokens {
+		scope, err := parseScope(s)
+		if err != nil {
+			return nil, err
+		}
+		res[token] = scope
+	}
+	return res, nil
+}
+
+// applyServeConfig changes settings of handler according to cfg. access
+// is for the store served by the handler
+func applyServeConfig(handler *contentstore.Handler, access *accessConfig, cfg *serveConfig, readOnly, logRequests bool) {
+	// store opened with -read-only can't be written to
+	if cfg.ReadOnly != nil && !readOnly {
+		readOnly = *cfg.ReadOnly
+	}
+	if cfg.LogRequests != nil {
+		logRequests = *cfg.LogRequests
+	}
+	handler.SetReadOnly(readOnly)
+	handler.SetTokens(access.tokens)
+	handler.SetSigningKey([]byte(access.SigningKey))
+	if logRequests {
+		handler.SetLogger(log.Default())
+	} else {
+		handler.SetLogger(nil)
+	}
+}
+
+func cmdServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "address to listen on, unless started with systemd socket activation")
+	readOnly := flags.Bool("read-only", false, "don't allow storing new blobs. Can be used while another process writes to the store")
+	admin := flags.Bool("admin", false, "serve admin page at /admin")
+	uploadsDir := flags.String("uploads-dir", "", "directory for data of resumable uploads. Enables resumable uploads at /uploads")
+	quiet := flags.Bool("q", false, "don't log requests")
+	configPath := flags.String("config", "", "JSON file with settings, re-read on SIGHUP")
+	certPath := flags.String("tls-cert", "", "TLS certificate file, re-read on SIGHUP. Enables HTTPS")
+	keyPath := flags.String("tls-key", "", "TLS key file, re-read on SIGHUP")
+	leaderURL := flags.String("follow", "", "URL of the leader server to replicate. Implies not allowing storing new blobs")
+	leaderToken := flags.String("follow-token", "", "token for the leader server")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	cfg := &serveConfig{}
+	if *configPath != "" {
+		if cfg, err = readServeConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	var certs *certReloader
+	if *certPath != "" || *keyPath != "" {
+		if certs, err = newCertReloader(*certPath, *keyPath); err != nil {
+			return err
+		}
+	}
+	var store *contentstore.Store
+	if *readOnly && *leaderURL == "" {
+		store, err = openStore(basePath)
+	} else {
+		store, err = contentstore.New(basePath)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if *leaderURL != "" {
+		// only the follower writes to the store
+		*readOnly = true
+		f := newFollower(*leaderURL, *leaderToken, store, basePath)
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			f.run(stop)
+			close(stopped)
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	handler := contentstore.NewHandler(store, *readOnly)
+	if *admin {
+		handler.EnableAdmin()
+	}
+	if *uploadsDir != "" {
+		if err = handler.EnableUploads(*uploadsDir); err != nil {
+			return err
+		}
+	}
+	applyServeConfig(handler, &cfg.accessConfig, cfg, *readOnly, !*quiet)
+	namespaces, err := openNamespaces(cfg, *readOnly, *admin)
+	if err != nil {
+		return err
+	}
+	defer closeNamespaces(namespaces)
+	for _, ns := range namespaces {
+		applyServeConfig(ns.handler, &ns.access, cfg, *readOnly, !*quiet)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	for _, ns := range namespaces {
+		prefix := namespacesPath + ns.name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, ns.handler))
+	}
+	srv := &http.Server{
+		Handler: mux,
+	}
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+	}
+	// shut down cleanly so that the store is closed
+	done := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		for sig := range c {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			// keep serving with old settings if new ones are bad
+			if certs != nil {
+				if err := certs.load(); err != nil {
+					log.Printf("failed to reload TLS certificate: %s", err)
+				}
+			}
+			if *configPath == "" {
+				continue
+			}
+			cfg, err := readServeConfig(*configPath)
+			if err != nil {
+				log.Printf("failed to reload %s: %s", *configPath, err)
+				continue
+			}
+			applyServeConfig(handler, &cfg.accessConfig, cfg, *readOnly, !*quiet)
+			for _, ns := range namespaces {
+				nsCfg := cfg.Namespaces[ns.name]
+				if nsCfg == nil {
+					log.Printf("namespace %s removed from config, restart to stop serving it", ns.name)
+					continue
+				}
+				applyServeConfig(ns.handler, &nsCfg.accessConfig, cfg, *readOnly, !*quiet)
+			}
+			log.Printf("reloaded %s", *configPath)
+		}
+		srv.Shutdown(context.Background())
+		close(done)
+	}()
+	listener, err := listen(*addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving %s on %s", basePath, listener.Addr())
+	if certs != nil {
+		// certificate comes from TLSConfig
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/kjk/contentstore"
+)
+
+var (
+	errNeedConfig       = errors.New("missing -config argument")
+	errNoSigningKey     = errors.New("no signing_key in config file")
+	errUnknownNamespace = errors.New("unknown namespace")
+)
+
+func cmdSign(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file of serve command, with signing_key")
+	nsName := flags.String("ns", "", "namespace of the blob")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the URL is valid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return errNeedId
+	}
+	if *configPath == "" {
+		return errNeedConfig
+	}
+	cfg, err := readServeConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	access := &cfg.accessConfig
+	prefix := ""
+	if *nsName != "" {
+		nsCfg := cfg.Namespaces[*nsName]
+		if nsCfg == nil {
+			return fmt.Errorf("%s: %w", *nsName, errUnknownNamespace)
+		}
+		access = &nsCfg.accessConfig
+		prefix = namespacesPath + *nsName
+	}
+	if access.SigningKey == "" {
+		return errNoSigningKey
+	}
+	id := flags.Arg(0)
+	fmt.Println(prefix + contentstore.SignBlobPath([]byte(access.SigningKey), id, time.Now().Add(*ttl)))
+	return nil
+}
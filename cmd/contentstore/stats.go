@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func cmdStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file of serve command, to show stats of each namespace")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configPath != "" {
+		return namespacesStats(*configPath)
+	}
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "blobs:\t%d\n", stats.Blobs)
+	fmt.Fprintf(w, "blobs size:\t%s\n", formatSize(stats.BlobsSize))
+	fmt.Fprintf(w, "segments:\t%d\n", len(stats.Segments))
+	fmt.Fprintf(w, "segments size:\t%s\n", formatSize(stats.SegmentsSize))
+	fmt.Fprintf(w, "index size:\t%s\n", formatSize(stats.IndexSize))
+	fmt.Fprintf(w, "dedup hits:\t%d\n", stats.DedupHits)
+	fmt.Fprintf(w, "dedup savings:\t%s\n", formatSize(stats.DedupSavedBytes))
+	return w.Flush()
+}
+
+// namespacesStats shows number of blobs and their size in each namespace,
+// e.g. for billing tenants
+func namespacesStats(configPath string) error {
+	cfg, err := readServeConfig(configPath)
+	if err != nil {
+		return err
+	}
+	namespaces, err := openNamespaces(cfg, true, false)
+	if err != nil {
+		return err
+	}
+	defer closeNamespaces(namespaces)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "namespace\tblobs\tblobs size\tquota\t\n")
+	for _, ns := range namespaces {
+		stats, err := ns.store.Stats()
+		if err != nil {
+			return fmt.Errorf("namespace %s: %w", ns.name, err)
+		}
+		quota := ""
+		if q := cfg.Namespaces[ns.name].Quota; q > 0 {
+			quota = formatSize(q)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", ns.name, stats.Blobs, formatSize(stats.BlobsSize), quota)
+	}
+	return w.Flush()
+}
+
+func cmdDu(args []string) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "segment\tblobs\tblobs size\tfile size\tunused\t\n")
+	for _, seg := range stats.Segments {
+		if seg.Missing {
+			fmt.Fprintf(w, "%d\t%d\t%s\tmissing\t\t\n", seg.No, seg.Blobs, formatSize(seg.BlobsSize))
+			continue
+		}
+		unused := seg.FileSize - seg.BlobsSize
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t\n", seg.No, seg.Blobs, formatSize(seg.BlobsSize), formatSize(seg.FileSize), formatSize(unused))
+	}
+	fmt.Fprintf(w, "index\t\t\t%s\t\t\n", formatSize(stats.IndexSize))
+	fmt.Fprintf(w, "total\t%d\t%s\t%s\t%s\t\n", stats.Blobs, formatSize(stats.BlobsSize), formatSize(stats.SegmentsSize+stats.IndexSize), formatSize(stats.SegmentsSize-stats.BlobsSize))
+	return w.Flush()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/kjk/contentstore"
+)
+
+func cmdVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	deep := flags.Bool("deep", false, "re-hash content of all blobs")
+	workers := flags.Int("workers", runtime.NumCPU(), "number of segments verified in parallel")
+	quiet := flags.Bool("q", false, "don't show progress")
+	maxRate := flags.Int64("max-rate", 0, "max MB per second read with -deep, 0 means unlimited")
+	basePath, _, err := parseStoreArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(basePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	opts := contentstore.VerifyOptions{
+		Deep:           *deep,
+		Workers:        *workers,
+		MaxBytesPerSec: *maxRate * 1024 * 1024,
+	}
+	if !*quiet {
+		opts.Progress = func(done, total int) {
+			fmt.Fprintf(os.Stderr, "\rverified %d of %d segments", done, total)
+			if done == total {
+				fmt.Fprintf(os.Stderr, "\n")
+			}
+		}
+	}
+	res, err := store.Verify(opts)
+	if err != nil {
+		return err
+	}
+	for _, nSegment := range res.MissingSegments {
+		fmt.Printf("missing segment %d\n", nSegment)
+	}
+	for _, id := range res.Corrupted {
+		fmt.Printf("corrupted %s\n", id)
+	}
+	if !res.OK() {
+		return fmt.Errorf("%d of %d blobs are corrupted", len(res.Corrupted), res.Blobs)
+	}
+	fmt.Printf("%d blobs in %d segments are ok\n", res.Blobs, res.Segments)
+	return nil
+}
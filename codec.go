@@ -0,0 +1,85 @@
+package contentstore
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errInvalidRecord = errors.New("invalid index record")
+)
+
+// IndexRecord is information about a blob, as stored in the index
+type IndexRecord struct {
+	Sha1    [20]byte
+	Segment int
+	Offset  int
+	Size    int
+	// Extra is additional data stored in the record, set with
+	// PutWithExtra() and returned in BlobInfo.Extra. IndexCodec
+	// implementations that extend DefaultIndexCodec can use it for their
+	// fields. The store keeps it when it re-writes records (e.g. in
+	// Compact())
+	Extra []byte
+}
+
+const (
+	// MaxExtraSize is the max size of IndexRecord.Extra. Records must stay
+	// small, all of them are kept in memory
+	MaxExtraSize = 1024
+)
+
+// IndexCodec encodes and decodes index records. Use WithIndexCodec() to
+// store additional information (e.g. tenant id) in the index.
+type IndexCodec interface {
+	// AppendRecord appends encoded rec to dst and returns the extended slice
+	AppendRecord(dst []byte, rec *IndexRecord) []byte
+	// DecodeRecord decodes record encoded with AppendRecord
+	DecodeRecord(d []byte, rec *IndexRecord) error
+}
+
+// DefaultIndexCodec is IndexCodec used by default. It encodes Extra after
+// all other fields and when decoding, puts everything that follows known
+// fields in Extra. This way it can read records written by future versions
+// with more fields. Codecs that store more information can use it by
+// encoding their fields in Extra.
+type DefaultIndexCodec struct{}
+
+// AppendRecord appends encoded rec to dst
+func (DefaultIndexCodec) AppendRecord(dst []byte, rec *IndexRecord) []byte {
+	dst = append(dst, rec.Sha1[:]...)
+	dst = binary.AppendUvarint(dst, uint64(rec.Segment))
+	dst = binary.AppendUvarint(dst, uint64(rec.Offset))
+	dst = binary.AppendUvarint(dst, uint64(rec.Size))
+	return append(dst, rec.Extra...)
+}
+
+// DecodeRecord decodes record encoded with AppendRecord
+func (DefaultIndexCodec) DecodeRecord(d []byte, rec *IndexRecord) error {
+	if len(d) < len(rec.Sha1) {
+		return errInvalidRecord
+	}
+	copy(rec.Sha1[:], d)
+	d = d[len(rec.Sha1):]
+	for _, v := range []*int{&rec.Segment, &rec.Offset, &rec.Size} {
+		n, nBytes := binary.Uvarint(d)
+		if nBytes <= 0 {
+			return errInvalidRecord
+		}
+		*v = int(n)
+		d = d[nBytes:]
+	}
+	rec.Extra = nil
+	if len(d) > 0 {
+		rec.Extra = d
+	}
+	return nil
+}
+
+// WithIndexCodec sets codec used to encode and decode index records. It must
+// be able to decode records written by codec used previously.
+func WithIndexCodec(codec IndexCodec) Option {
+	return func(store *Store) {
+		store.indexCodec = codec
+	}
+}
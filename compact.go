@@ -0,0 +1,385 @@
+package contentstore
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Compaction reclaims space of deleted blobs by moving blobs that are still
+// in the store out of sealed segments that have many dead bytes. Blobs are
+// moved by the writer goroutine: it appends their data to the current
+// segment and a move record to the index, which replaces the previous
+// record of the blob atomically. Segment files without blobs are then
+// removed. If we crash in the middle, some blobs are moved and some aren't,
+// which is fine: the next compaction continues where we stopped.
+//
+// Delete and move records make the index bigger than needed. Rewriting it
+// writes a new index file with a single record for each blob and atomically
+// replaces the old one.
+//
+// The store compacts itself according to a policy (see WithAutoCompaction())
+// or when Compact() is called.
+
+// CompactionPolicy describes when the store compacts itself. Sealed segment
+// files without blobs are always removed. Thresholds are checked by a
+// background goroutine every Interval, starting Interval after opening the
+// store
+type CompactionPolicy struct {
+	// compact sealed segments in which dead bytes (of deleted blobs) are
+	// more than MaxDeadRatio (between 0 and 1) of the file size
+	MaxDeadRatio float64
+	// if there are more than MaxSegments segment files, compact segments
+	// with dead bytes, those with the fewest live bytes first, until there
+	// aren't
+	MaxSegments int
+	// rewrite the index when it has more than MaxIndexRecords records and
+	// at least a quarter of them are for deleted or moved blobs. Rewriting
+	// the index starts a new generation of it, so consumers of Changes()
+	// start again from the beginning (see Cursor)
+	MaxIndexRecords int
+	// limits how fast compaction reads segments. 0 means no limit
+	MaxBytesPerSec int64
+	// how often thresholds are checked. Defaults to 1 minute
+	Interval time.Duration
+}
+
+const (
+	defaultCompactionInterval = time.Minute
+	// blobs being moved at the same time. More means fewer fsyncs but more
+	// memory
+	maxMovesInFlight     = 64
+	maxMovesInFlightSize = 16 * 1024 * 1024
+)
+
+// WithAutoCompaction makes the store compact itself according to policy
+func WithAutoCompaction(policy CompactionPolicy) Option {
+	return func(store *Store) {
+		if policy.Interval <= 0 {
+			policy.Interval = defaultCompactionInterval
+		}
+		store.compaction = &policy
+	}
+}
+
+// autoCompact compacts segments and rewrites the index if thresholds in
+// compaction policy are exceeded
+func (store *Store) autoCompact() error {
+	policy := store.compaction
+	segments, err := store.segmentsToCompact(policy)
+	if err != nil {
+		return err
+	}
+	if len(segments) > 0 {
+		if err = store.compactSegments(segments, newThrottle(policy.MaxBytesPerSec)); err != nil {
+			return err
+		}
+	}
+	if policy.MaxIndexRecords <= 0 {
+		return nil
+	}
+	store.Lock()
+	nRecords := store.idxRecords
+	unused := nRecords - store.index.count()
+	store.Unlock()
+	if nRecords <= policy.MaxIndexRecords || unused < nRecords/4 {
+		return nil
+	}
+	return store.sendRewriteIndex()
+}
+
+// sendRewriteIndex asks the writer goroutine to rewrite the index and waits
+// until it's done
+func (store *Store) sendRewriteIndex() error {
+	req := &putRequest{
+		rewriteIndex: true,
+		done:         make(chan struct{}),
+	}
+	if err := store.send(req); err != nil {
+		return err
+	}
+	_, err := req.wait()
+	return err
+}
+
+// CompactOptions configures Compact()
+type CompactOptions struct {
+	// only compact sealed segments in which dead bytes (of deleted blobs)
+	// are at least MinDeadRatio (between 0 and 1) of the file size. 0
+	// compacts every sealed segment with dead bytes
+	MinDeadRatio float64
+	// limits how fast segments are read. 0 means no limit
+	MaxBytesPerSec int64
+	// if true, Compact() only reports what it would do, without changing
+	// anything
+	DryRun bool
+}
+
+// CompactResult describes what Compact() did or, with DryRun, would do
+type CompactResult struct {
+	// compacted (and removed) segment files and their total size
+	Segments     []int
+	SegmentsSize int64
+	// blobs moved out of compacted segments and their total size. Disk space
+	// reclaimed is SegmentsSize - MovedSize
+	MovedBlobs int
+	MovedSize  int64
+	// number of records removed from the index by rewriting it
+	IndexRecords int
+}
+
+// Compact reclaims space of deleted blobs: it moves blobs that are still in
+// the store out of sealed segments with dead bytes, removes those segments
+// and rewrites the index without records of deleted and moved blobs. It's
+// safe to call while the store is used and if the process dies in the
+// middle, nothing is lost and calling it again finishes the job
+func (store *Store) Compact(opts CompactOptions) (*CompactResult, error) {
+	if store.readOnly && !opts.DryRun {
+		return nil, errReadOnly
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		return nil, err
+	}
+	res := &CompactResult{}
+	// current segment can't be compacted
+	for _, seg := range stats.Segments[:len(stats.Segments)-1] {
+		dead := seg.FileSize - seg.BlobsSize
+		if seg.FileSize == 0 || dead <= 0 || float64(dead) < opts.MinDeadRatio*float64(seg.FileSize) {
+			continue
+		}
+		res.Segments = append(res.Segments, seg.No)
+		res.SegmentsSize += seg.FileSize
+		res.MovedBlobs += seg.Blobs
+		res.MovedSize += seg.BlobsSize
+	}
+	store.Lock()
+	res.IndexRecords = store.idxRecords - store.index.count()
+	store.Unlock()
+	if opts.DryRun {
+		// moving a blob adds a record and makes the previous one unused
+		res.IndexRecords += res.MovedBlobs
+		return res, nil
+	}
+	if len(res.Segments) > 0 {
+		if err = store.compactSegments(res.Segments, newThrottle(opts.MaxBytesPerSec)); err != nil {
+			return res, err
+		}
+	}
+	store.Lock()
+	res.IndexRecords = store.idxRecords - store.index.count()
+	store.Unlock()
+	if res.IndexRecords == 0 {
+		return res, nil
+	}
+	return res, store.sendRewriteIndex()
+}
+
+// segmentsToCompact returns sealed segments that should be compacted
+// according to policy
+func (store *Store) segmentsToCompact(policy *CompactionPolicy) ([]int, error) {
+	stats, err := store.Stats()
+	if err != nil {
+		return nil, err
+	}
+	// current segment file always exists
+	nFiles := 1
+	var res []int
+	var candidates []SegmentStats
+	for _, seg := range stats.Segments[:len(stats.Segments)-1] {
+		if seg.FileSize == 0 {
+			// removed
+			continue
+		}
+		nFiles++
+		dead := seg.FileSize - seg.BlobsSize
+		switch {
+		case seg.Blobs == 0:
+			res = append(res, seg.No)
+		case dead <= 0:
+			// nothing to reclaim
+		case policy.MaxDeadRatio > 0 && float64(dead) > policy.MaxDeadRatio*float64(seg.FileSize):
+			res = append(res, seg.No)
+		default:
+			candidates = append(candidates, seg)
+		}
+	}
+	nFiles -= len(res)
+	if policy.MaxSegments > 0 && nFiles > policy.MaxSegments {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].BlobsSize < candidates[j].BlobsSize
+		})
+		for i := 0; i < len(candidates) && nFiles > policy.MaxSegments; i++ {
+			res = append(res, candidates[i].No)
+			nFiles--
+		}
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+// compactSegments moves blobs out of sealed segments and removes them.
+// Reading segments is limited by t
+func (store *Store) compactSegments(segments []int, t *throttle) error {
+	defer store.pauseReuse()()
+	compacted := make(map[int]bool, len(segments))
+	for _, nSegment := range segments {
+		compacted[nSegment] = true
+	}
+	var blobs []blob
+	store.Lock()
+	store.index.forEach(func(blob *blob) {
+		if compacted[blob.nSegment] {
+			blobs = append(blobs, *blob)
+		}
+	})
+	nCurr := store.currSegmentNo
+	store.Unlock()
+	if compacted[nCurr] {
+		return fmt.Errorf("segment %d is not sealed", nCurr)
+	}
+	// read segments sequentially
+	sort.Slice(blobs, func(i, j int) bool {
+		if blobs[i].nSegment != blobs[j].nSegment {
+			return blobs[i].nSegment < blobs[j].nSegment
+		}
+		return blobs[i].offset < blobs[j].offset
+	})
+
+	var inFlight []*putRequest
+	inFlightSize := 0
+	wait := func() error {
+		var err error
+		for _, req := range inFlight {
+			if _, reqErr := req.wait(); err == nil {
+				err = reqErr
+			}
+		}
+		inFlight = inFlight[:0]
+		inFlightSize = 0
+		return err
+	}
+	for i := range blobs {
+		blob := &blobs[i]
+		store.Lock()
+		d, err := store.readBlob(*blob)
+		store.Unlock()
+		var content []byte
+		if err == nil {
+			// encrypted blobs are moved as they are
+			content, err = store.contentOf(blob, d)
+		}
+		if err == nil && store.sha1Of(content) != blob.sha1 {
+			err = fmt.Errorf("blob %x in segment %d is corrupted", blob.sha1, blob.nSegment)
+		}
+		if err != nil {
+			wait()
+			return err
+		}
+		t.done(len(d))
+		req := &putRequest{
+			d:    d,
+			sha1: blob.sha1,
+			move: blob,
+			done: make(chan struct{}),
+		}
+		go func() {
+			if err := store.send(req); err != nil {
+				store.finish(req, err)
+			}
+		}()
+		inFlight = append(inFlight, req)
+		inFlightSize += len(d)
+		if len(inFlight) >= maxMovesInFlight || inFlightSize >= maxMovesInFlightSize {
+			if err = wait(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wait(); err != nil {
+		return err
+	}
+	return store.removeEmptySegments(segments)
+}
+
+// rewriteIndex replaces index file with a new one that only has records of
+// blobs in the store. Only called by writer goroutine
+func (store *Store) rewriteIndex() error {
+	store.Lock()
+	poisoned := store.poisoned
+	blobs := make([]blob, 0, store.index.count())
+	store.index.forEach(func(blob *blob) {
+		blobs = append(blobs, *blob)
+	})
+	store.Unlock()
+	if poisoned != nil {
+		return poisoned
+	}
+	// roughly in the order they were added
+	sort.Slice(blobs, func(i, j int) bool {
+		if blobs[i].nSegment != blobs[j].nSegment {
+			return blobs[i].nSegment < blobs[j].nSegment
+		}
+		return blobs[i].offset < blobs[j].offset
+	})
+	// checkpoint describes the old index, which won't match the new one
+	store.Lock()
+	cp := store.checkpoint(false)
+	store.Unlock()
+	dir := filepath.Dir(store.basePath)
+	err := writeCheckpoint(store.basePath, cp)
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return err
+	}
+	path := idxFilePath(store.basePath)
+	// positions in the new index are different
+	gen := store.idxGen + 1
+	hdr := store.newIndexHeader(gen)
+	size := int64(len(hdr))
+	crc := crc32.Checksum(hdr, crcTable)
+	err = writeFileAtomically(path, func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, 64*1024)
+		bw.Write(hdr)
+		var buf []byte
+		for i := range blobs {
+			buf = appendBlobRecord(buf[:0], store.indexCodec, &blobs[i])
+			bw.Write(buf)
+			size += int64(len(buf))
+			crc = crc32.Update(crc, crcTable, buf)
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		// old index is still good
+		return err
+	}
+	// records we append to the new index must not be lost if, after
+	// a crash, we see the old one
+	err = syncDir(dir)
+	var file *os.File
+	if err == nil {
+		file, err = openFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	store.Lock()
+	defer store.Unlock()
+	if err != nil {
+		store.poison(err)
+		return store.poisoned
+	}
+	closeFilePtr(&store.idxFile)
+	store.idxFile = file
+	store.idxHdr = hdr
+	store.idxGen = gen
+	store.idxRecords = len(blobs)
+	store.idxOffset = size
+	store.idxCrc = crc
+	return nil
+}
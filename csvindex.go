@@ -0,0 +1,100 @@
+package contentstore
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Previous versions stored the index as a CSV file, with a line for each
+// blob: sha1 of the content, number of segment file, offset within the
+// segment and size of the blob. We only read it, to convert it to a journal.
+
+var (
+	errInvalidIndexLine = errors.New("invalid index line")
+	errNotValidSha1     = errors.New("not a valid sha1")
+	// first line in CSV index file
+	csvIdxHdr = "github.com/kjk/contentstore header 1.0"
+)
+
+func csvIdxFilePath(basePath string) string {
+	return basePath + "_idx.txt"
+}
+
+func decodeIndexLine(rec []string) (blob blob, err error) {
+	if len(rec) != 4 {
+		return blob, errInvalidIndexLine
+	}
+	sha1, err := hex.DecodeString(rec[0])
+	if err != nil {
+		return blob, err
+	}
+	if len(sha1) != 20 {
+		return blob, errNotValidSha1
+	}
+	copy(blob.sha1[:], sha1)
+	if blob.nSegment, err = strconv.Atoi(rec[1]); err != nil {
+		return blob, err
+	}
+	if blob.offset, err = strconv.Atoi(rec[2]); err != nil {
+		return blob, err
+	}
+	if blob.size, err = strconv.Atoi(rec[3]); err != nil {
+		return blob, err
+	}
+	return blob, nil
+}
+
+// readCsvIndex reads CSV index file. If recoverIndex is true, the first
+// line that can't be parsed is treated as the end of the index and what
+// was skipped is recorded in stats
+func readCsvIndex(path string, recoverIndex bool, stats *RecoveryStats) ([]blob, error) {
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.Comma = ','
+	csvReader.FieldsPerRecord = -1
+	rec, err := csvReader.Read()
+	if err != nil || len(rec) != 1 || rec[0] != csvIdxHdr {
+		return nil, errInvalidIndexHdr
+	}
+	blobs := make([]blob, 0)
+	var blob blob
+	for {
+		// end of the last valid record
+		validSize := csvReader.InputOffset()
+		rec, err = csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			blob, err = decodeIndexLine(rec)
+		}
+		if err != nil {
+			if !recoverIndex {
+				return nil, err
+			}
+			tail, err := io.ReadAll(io.NewSectionReader(file, validSize, math.MaxInt64-validSize))
+			if err != nil {
+				return nil, err
+			}
+			nRecords := bytes.Count(tail, []byte{'\n'})
+			if len(tail) > 0 && tail[len(tail)-1] != '\n' {
+				nRecords++
+			}
+			stats.DiscardedRecords += nRecords
+			stats.DiscardedBytes += int64(len(tail))
+			break
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, nil
+}
@@ -0,0 +1,138 @@
+package contentstore
+
+import (
+	"os"
+	"sort"
+)
+
+// Deleting a blob appends a delete record to the index and removes the blob
+// from the in-memory index. Its data stays in the segment file (dead bytes)
+// until the space is reclaimed, unless the store punches holes (see
+// WithPunchHoles()). Like writes, deletes are done by the writer goroutine,
+// so that records in the index are in the order of operations.
+
+// Delete removes the blob from the store. It returns after the removal is
+// safely on disk. Returns ErrNotFound if there is no blob with this id
+func (store *Store) Delete(id string) error {
+	sha1, ok := store.idToSha1(id)
+	if !ok {
+		return ErrInvalidId
+	}
+	n, err := store.deleteSha1s([][20]byte{sha1})
+	if err == nil && n == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// deleteSha1s deletes blobs with a given sha1s, with a single fsync, and
+// returns the number of deleted blobs. Blobs that are not in the store
+// are skipped
+func (store *Store) deleteSha1s(sha1s [][20]byte) (int, error) {
+	if store.readOnly {
+		return 0, errReadOnly
+	}
+	req := &putRequest{
+		dels: sha1s,
+		done: make(chan struct{}),
+	}
+	store.accept(req)
+	// Put() of the same data that comes after us must not share result with
+	// a Put() that was submitted before us (and is going to be deleted)
+	store.inFlightMu.Lock()
+	for _, sha1 := range sha1s {
+		delete(store.inFlightIds, sha1)
+	}
+	store.inFlightMu.Unlock()
+	if err := store.send(req); err != nil {
+		store.finish(req, err)
+	}
+	_, err := req.wait()
+	return req.nDeleted, err
+}
+
+// deleteBlobs appends delete records for blobs in req to the index and
+// removes them from in-memory index. Only called by writer goroutine
+func (store *Store) deleteBlobs(req *putRequest) error {
+	watching := store.watchers.watching()
+	var events []BlobEvent
+	store.Lock()
+	poisoned := store.poisoned
+	store.idxBuf = store.idxBuf[:0]
+	var sha1s [][20]byte
+	for _, sha1 := range req.dels {
+		if blob, ok := store.index.find(sha1); ok {
+			store.idxBuf = appendDeleteRecord(store.idxBuf, sha1)
+			sha1s = append(sha1s, sha1)
+			if watching {
+				seq := store.idxOffset + int64(len(store.idxBuf))
+				events = append(events, store.blobEvent(&blob, seq, true))
+			}
+		}
+	}
+	store.Unlock()
+	if poisoned != nil {
+		return poisoned
+	}
+	if len(sha1s) == 0 {
+		return nil
+	}
+	err := store.writeIndex(store.idxBuf)
+	if err == nil {
+		// make sure deleted blobs don't come back after a crash
+		err = store.idxFile.Sync()
+	}
+	store.Lock()
+	if err != nil {
+		store.poison(err)
+		store.Unlock()
+		return store.poisoned
+	}
+	var removed []blob
+	for _, sha1 := range sha1s {
+		blob, _ := store.index.remove(sha1)
+		store.blobsSize -= int64(blob.size)
+		if store.access != nil {
+			delete(store.access.hits, sha1)
+		}
+		if store.punchHoles {
+			removed = append(removed, blob)
+		}
+		if store.reuse != nil {
+			store.reuse.add(hole{nSegment: blob.nSegment, offset: blob.offset, size: blob.size})
+		}
+	}
+	req.nDeleted = len(sha1s)
+	store.idxRecords += len(sha1s)
+	store.Unlock()
+	store.watchers.notify(events)
+	// Get() reads with store locked so after removing blobs from the index
+	// nobody reads them
+	store.punchBlobHoles(removed)
+	return nil
+}
+
+// punchBlobHoles deallocates space used by blobs in segment files. Only
+// called by writer goroutine
+func (store *Store) punchBlobHoles(blobs []blob) {
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].nSegment < blobs[j].nSegment
+	})
+	var file *os.File
+	nSegment := -1
+	for _, blob := range blobs {
+		if blob.nSegment != nSegment {
+			closeFilePtr(&file)
+			nSegment = blob.nSegment
+			file, _ = openFile(segmentFilePath(store.basePath, nSegment), os.O_WRONLY, 0)
+		}
+		if file == nil {
+			continue
+		}
+		// failing only means the space is reclaimed later, by compaction
+		if err := punchHole(file, int64(blob.offset), int64(blob.size)); err != nil {
+			closeFilePtr(&file)
+		}
+	}
+	closeFilePtr(&file)
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package contentstore
+
+import "errors"
+
+// freeDiskSpace returns number of bytes available to us on the disk with
+// a given path
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("getting free disk space is not supported on this platform")
+}
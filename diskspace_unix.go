@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package contentstore
+
+import "syscall"
+
+// freeDiskSpace returns number of bytes available to us on the disk with
+// a given path
+func freeDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
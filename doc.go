@@ -1,5 +1,4 @@
 /*
-
 Package contentstore is for storing small to medium number of content-addresable
 blobs ([]byte).
 
@@ -7,17 +6,27 @@ You can store a []blob of data in the store and retrieve it back using the
 returned unique id (which is a sha1 of the content, but that's implementation
 detail).
 
-
-    // Note: in production code, check the error codes!
-    store, _ := contentstore.New("mystore")
-    id, _ := store.Put([]byte("my piece of content"))
-    v, _ := store.Get(id)
-    store.Close()
+	// Note: in production code, check the error codes!
+	store, _ := contentstore.New("mystore")
+	id, _ := store.Put([]byte("my piece of content"))
+	v, _ := store.Get(id)
+	store.Close()
 
 The data is de-duplicated (i.e. storing the same blob for the second time is
 a no-op).
 
-You cannot delete the data. It would be possible to implement but I haven't.
+Blobs can be removed with Delete(), many at once with GC(), or automatically
+with a retention policy (see WithPolicy()), which removes blobs older than
+Policy.MaxAge or the least recently used blobs when the store gets bigger
+than Policy.MaxTotalSize. Blobs pointed to by refs are never removed by GC() or
+a policy.
+
+Removing a blob doesn't shrink segment files: its data stays there as dead
+bytes. GC() removes sealed segment files left without blobs. Otherwise the
+space is reclaimed by Compact(), which rewrites segments with many dead
+bytes, or automatically with WithAutoCompaction(). On Linux WithPunchHoles()
+returns the space to the OS as soon as a blob is deleted, without rewriting
+anything.
 
 Where and why should you use content store?
 
@@ -42,6 +51,5 @@ file. This significantly reduces number of files created (and you can control
 how big a single file can get).
 
 It's sheer elegance in its simplicity.
-
 */
 package contentstore
@@ -0,0 +1,196 @@
+package contentstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Blobs can be encrypted with AES-GCM, with a key supplied by the caller
+// (see WithEncryption()). Each store has its own key so a server with
+// namespaces (a store for each tenant) can give each tenant its own key.
+// Destroying the key makes blobs of the tenant unreadable (crypto-shredding)
+// without having to find and overwrite them, including in backups.
+//
+// Ids are still sha1 of the content, not of the encrypted bytes, so they
+// don't change when a store is encrypted (they do reveal if the store has
+// a given content). Each blob is stored as a random nonce followed by the
+// encrypted content and the authentication tag, which takes 28 bytes more.
+// Sha1 of the content is authenticated with it, so a blob can't be swapped
+// for another in the segment file.
+//
+// Only the content is encrypted. The index, refs and other files are not.
+// Sizes in Stats() and the quota (see WithQuota()) are of encrypted blobs,
+// as stored on disk.
+//
+// When an encrypted store is created, we save a small encrypted value in
+// a file so that opening the store with a different key fails with
+// ErrWrongKey and opening it without a key fails with ErrNeedKey, instead
+// of failing to read every blob.
+
+var (
+	// ErrWrongKey is returned when opening an encrypted store with a key
+	// different from the one it was created with
+	ErrWrongKey = errors.New("wrong encryption key")
+	// ErrNeedKey is returned when opening an encrypted store without
+	// WithEncryption()
+	ErrNeedKey = errors.New("store is encrypted, it needs a key")
+
+	errNotEncrypted   = errors.New("store was created without encryption")
+	errInvalidKeyFile = errors.New("invalid key check file")
+	errDecrypt        = errors.New("can't decrypt, data is corrupted")
+	// first line in key check file
+	keyCheckHdr = "github.com/kjk/contentstore key 1.0"
+	// content we encrypt to check the key
+	keyCheckContent = []byte("github.com/kjk/contentstore key check")
+)
+
+// WithEncryption makes the store encrypt blobs with AES-GCM. key is called
+// once, when the store is opened, and must return a 16, 24 or 32 byte key
+// (for AES-128, AES-192 or AES-256). Opening fails if it returns an error.
+// Encryption can only be enabled when the store is created: opening an
+// existing store that is not encrypted fails
+func WithEncryption(key func() ([]byte, error)) Option {
+	return func(store *Store) {
+		store.encryptionKey = key
+	}
+}
+
+func keyCheckFilePath(basePath string) string {
+	return basePath + "_key.txt"
+}
+
+// readKeyCheck returns encrypted key check value or nil if the file doesn't
+// exist
+func readKeyCheck(path string) ([]byte, error) {
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	recs, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) != 2 || recs[0][0] != keyCheckHdr {
+		return nil, errInvalidKeyFile
+	}
+	d, err := hex.DecodeString(recs[1][0])
+	if err != nil || len(d) == 0 {
+		return nil, errInvalidKeyFile
+	}
+	return d, nil
+}
+
+func writeKeyCheck(path string, d []byte) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{keyCheckHdr})
+		csvWriter.Write([]string{hex.EncodeToString(d)})
+		csvWriter.Flush()
+		return csvWriter.Error()
+	})
+}
+
+// initEncryption gets the key and checks that it's the key the store was
+// created with. For a new store it saves the key check
+func (store *Store) initEncryption() error {
+	path := keyCheckFilePath(store.basePath)
+	check, err := readKeyCheck(path)
+	if err != nil {
+		return err
+	}
+	if store.encryptionKey == nil {
+		if check != nil {
+			return ErrNeedKey
+		}
+		return nil
+	}
+	key, err := store.encryptionKey()
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	if check != nil {
+		d, err := store.decrypt(check, nil)
+		if err != nil || string(d) != string(keyCheckContent) {
+			return ErrWrongKey
+		}
+		return nil
+	}
+	if StoreExists(store.basePath) {
+		return errNotEncrypted
+	}
+	if store.readOnly {
+		// opening it will fail
+		return nil
+	}
+	return writeKeyCheck(path, store.encrypt(keyCheckContent, nil))
+}
+
+// encrypt returns d encrypted with a random nonce, as stored in segment file.
+// ad is authenticated along with d
+func (store *Store) encrypt(d, ad []byte) []byte {
+	nonceSize := store.aead.NonceSize()
+	res := make([]byte, nonceSize, nonceSize+len(d)+store.aead.Overhead())
+	rand.Read(res)
+	return store.aead.Seal(res, res, d, ad)
+}
+
+// decrypt returns content of d returned by encrypt() with the same ad
+func (store *Store) decrypt(d, ad []byte) ([]byte, error) {
+	nonceSize := store.aead.NonceSize()
+	if len(d) < nonceSize {
+		return nil, errDecrypt
+	}
+	res, err := store.aead.Open(nil, d[:nonceSize], d[nonceSize:], ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return res, nil
+}
+
+// contentOf returns content of blob from d, as read from segment file
+func (store *Store) contentOf(blob *blob, d []byte) ([]byte, error) {
+	if store.aead == nil {
+		return d, nil
+	}
+	res, err := store.decrypt(d, blob.sha1[:])
+	if err != nil {
+		return nil, fmt.Errorf("blob %x: %w", blob.sha1, err)
+	}
+	return res, nil
+}
+
+// contentSize returns size of the content of blob
+func (store *Store) contentSize(blob *blob) int {
+	if store.aead == nil {
+		return blob.size
+	}
+	return blob.size - store.aead.NonceSize() - store.aead.Overhead()
+}
+
+// verifyEncrypted returns true if encrypted blob read from r decrypts to
+// content matching its sha1
+func (store *Store) verifyEncrypted(blob *blob, r io.Reader) bool {
+	d, err := io.ReadAll(r)
+	if err == nil {
+		d, err = store.contentOf(blob, d)
+	}
+	return err == nil && store.sha1Of(d) == blob.sha1
+}
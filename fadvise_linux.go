@@ -0,0 +1,25 @@
+//go:build linux && (amd64 || arm64)
+
+package contentstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// values of advice for posix_fadvise(2), from <linux/fadvise.h>
+const (
+	fadvSequential = 2
+	fadvWillNeed   = 3
+	fadvDontNeed   = 4
+)
+
+// fadvise tells the kernel how we're going to access a range of the file.
+// It's only a hint so callers are free to ignore the error
+func fadvise(file *os.File, offset, size int64, advice int) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), uintptr(offset), uintptr(size), uintptr(advice), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
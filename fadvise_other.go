@@ -0,0 +1,16 @@
+//go:build !linux || !(amd64 || arm64)
+
+package contentstore
+
+import "os"
+
+const (
+	fadvSequential = 2
+	fadvWillNeed   = 3
+	fadvDontNeed   = 4
+)
+
+// fadvise is a no-op on platforms without posix_fadvise(2)
+func fadvise(file *os.File, offset, size int64, advice int) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package contentstore
+
+import "os"
+
+// openFile is os.OpenFile. On Windows it allows other processes to delete
+// and rename files we have open
+func openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+// renameFile is os.Rename. On Windows it retries if the file is briefly
+// opened by another process
+func renameFile(from, to string) error {
+	return os.Rename(from, to)
+}
+
+// syncDir makes changes to directory entries (e.g. renames) durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package contentstore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// On Windows a file can't be renamed over or deleted while another process
+// has it open, unless that process opened it with FILE_SHARE_DELETE, which
+// Go doesn't use. We open files with all sharing flags so that backup agents
+// and other processes can read, rename and delete them while we have them
+// open. We also retry renames because those other processes don't
+// necessarily do the same for us.
+
+const (
+	// how many times we try to rename a file
+	renameRetries = 10
+	// not defined in syscall
+	errorSharingViolation syscall.Errno = 32
+)
+
+// openFile is like os.OpenFile but allows other processes to read, write,
+// delete and rename the file while we have it open
+func openFile(path string, flag int, perm os.FileMode) (*os.File, error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+	if flag&os.O_CREATE != 0 {
+		access |= syscall.GENERIC_WRITE
+	}
+	if flag&os.O_APPEND != 0 && flag&os.O_TRUNC == 0 {
+		// FILE_APPEND_DATA without FILE_WRITE_DATA makes writes go
+		// to the end of the file
+		access &^= syscall.GENERIC_WRITE
+		access |= syscall.FILE_APPEND_DATA | syscall.FILE_WRITE_ATTRIBUTES | syscall.STANDARD_RIGHTS_WRITE | syscall.SYNCHRONIZE
+	}
+	var createMode uint32
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		createMode = syscall.CREATE_NEW
+	case flag&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE|os.O_TRUNC:
+		createMode = syscall.CREATE_ALWAYS
+	case flag&os.O_CREATE == os.O_CREATE:
+		createMode = syscall.OPEN_ALWAYS
+	case flag&os.O_TRUNC == os.O_TRUNC:
+		createMode = syscall.TRUNCATE_EXISTING
+	default:
+		createMode = syscall.OPEN_EXISTING
+	}
+	shareMode := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(pathp, access, shareMode, nil, createMode, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// renameFile is like os.Rename but retries for a while if the file is
+// opened by another process
+func renameFile(from, to string) error {
+	var err error
+	for i := 0; i < renameRetries; i++ {
+		err = os.Rename(from, to)
+		if !errors.Is(err, syscall.ERROR_ACCESS_DENIED) && !errors.Is(err, errorSharingViolation) {
+			return err
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+	return err
+}
+
+// syncDir is a no-op because Windows doesn't allow syncing a directory.
+// NTFS journals metadata changes, like renames
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+package contentstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// GC removes blobs that are not needed anymore, as decided by the caller.
+// Sealed segment files that end up without blobs are removed, which returns
+// their space to the OS. Space of other removed blobs stays in segment files
+// until they're rewritten.
+
+var (
+	errNoKeep = errors.New("GCOptions.Keep must be set")
+)
+
+// GCOptions configures GC()
+type GCOptions struct {
+	// Keep returns true for blobs that must be kept. All other blobs,
+	// except for blobs pointed to by refs, are removed. It must be set:
+	// removing all blobs is too easy to do by mistake
+	Keep func(id string) bool
+	// if true, GC() only reports what it would remove, without changing
+	// anything
+	DryRun bool
+}
+
+// GCResult describes what GC() removed or, with DryRun, would remove
+type GCResult struct {
+	// removed blobs and their total size
+	Ids  []string
+	Size int64
+	// removed segment files and their total size. That's how much disk
+	// space was reclaimed
+	Segments     []int
+	SegmentsSize int64
+}
+
+// GC removes blobs for which opts.Keep returns false, except for blobs
+// pointed to by refs (see SetRef()). Don't Put() content
+// that is being removed while it runs: it might be removed after Put()
+// returns its id
+func (store *Store) GC(opts GCOptions) (*GCResult, error) {
+	if opts.Keep == nil {
+		return nil, errNoKeep
+	}
+	if store.readOnly && !opts.DryRun {
+		return nil, errReadOnly
+	}
+	// so that new blobs don't end up in segments we remove
+	defer store.pauseReuse()()
+	// so that refs don't change while we remove blobs
+	refs, err := store.lockedRefs()
+	if err != nil {
+		return nil, err
+	}
+	defer store.refs.mu.Unlock()
+	referenced := refsSha1s(refs)
+	store.Lock()
+	blobs := make([]blob, 0, store.index.count())
+	store.index.forEach(func(blob *blob) {
+		blobs = append(blobs, *blob)
+	})
+	// current segment is never removed
+	nSealed := store.currSegmentNo
+	store.Unlock()
+
+	res := &GCResult{}
+	var toRemove [][20]byte
+	// number of blobs that remain in each sealed segment
+	nKept := make([]int, nSealed)
+	for i := range blobs {
+		blob := &blobs[i]
+		id := fmt.Sprintf("%x", blob.sha1[:])
+		if referenced[blob.sha1] || opts.Keep(id) {
+			if blob.nSegment < nSealed {
+				nKept[blob.nSegment]++
+			}
+			continue
+		}
+		toRemove = append(toRemove, blob.sha1)
+		res.Ids = append(res.Ids, id)
+		res.Size += int64(blob.size)
+	}
+	if !opts.DryRun && len(toRemove) > 0 {
+		if _, err := store.deleteSha1s(toRemove); err != nil {
+			return res, err
+		}
+	}
+	var empty []int
+	for nSegment, n := range nKept {
+		if n > 0 {
+			continue
+		}
+		stat, err := os.Stat(segmentFilePath(store.basePath, nSegment))
+		if err != nil {
+			// already removed
+			continue
+		}
+		empty = append(empty, nSegment)
+		res.SegmentsSize += stat.Size()
+	}
+	res.Segments = empty
+	if opts.DryRun || len(empty) == 0 {
+		return res, nil
+	}
+	return res, store.removeEmptySegments(empty)
+}
+
+// removeEmptySegments removes sealed segment files, making sure they don't
+// have blobs. It waits for a backup in progress to finish
+func (store *Store) removeEmptySegments(segments []int) error {
+	removed := make(map[int]bool, len(segments))
+	defer func() {
+		for _, nSegment := range segments {
+			if removed[nSegment] {
+				store.segmentEvent(SegmentRemoved, nSegment, 0)
+			}
+		}
+	}()
+	store.backupMu.Lock()
+	defer store.backupMu.Unlock()
+	store.Lock()
+	defer store.Unlock()
+	inUse := make(map[int]bool)
+	store.index.forEach(func(blob *blob) {
+		inUse[blob.nSegment] = true
+	})
+	if store.reuse != nil {
+		// blobs written to holes but not yet in the index
+		for nSegment := range store.reuse.pending {
+			inUse[nSegment] = true
+		}
+		defer store.reuse.removeSegments(removed)
+	}
+	for _, nSegment := range segments {
+		if inUse[nSegment] {
+			return fmt.Errorf("segment %d is not empty", nSegment)
+		}
+		if nSegment == store.cachedSegmentNo {
+			closeFilePtr(&store.cachedSegmentFile)
+			store.cachedSegmentNo = -1
+		}
+		if err := os.Remove(segmentFilePath(store.basePath, nSegment)); err != nil {
+			return err
+		}
+		removed[nSegment] = true
+	}
+	return nil
+}
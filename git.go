@@ -0,0 +1,110 @@
+package contentstore
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+)
+
+// In git object mode ids are the same as ids git gives to blobs: sha1 of
+// "blob <size>\0" followed by the content. This allows using the store as
+// object storage for git tools: `git hash-object` of a file is its id in
+// the store. Git keeps loose objects compressed with zlib. We store the
+// content uncompressed so that Get(), CopyTo() and GetSeeker() work the
+// same in both modes and convert to and from git's format with GitObject()
+// and PutGitObject().
+
+var (
+	// ErrNotGitObjects is returned by GitObject() and PutGitObject() if the
+	// store wasn't opened with WithGitObjects()
+	ErrNotGitObjects = errors.New("store doesn't use git object ids")
+
+	errInvalidGitObject = errors.New("invalid git object")
+)
+
+// WithGitObjects makes ids of blobs the same as git's ids of blob objects.
+// Ids of blobs already in the store don't change so the store must always
+// be opened with (or always without) this option.
+func WithGitObjects() Option {
+	return func(store *Store) {
+		store.gitObjects = true
+	}
+}
+
+func gitBlobHdr(size int) string {
+	return "blob " + strconv.Itoa(size) + "\x00"
+}
+
+// resetHash prepares h (sha1) for calculating id of a blob of a given size
+func (store *Store) resetHash(h hash.Hash, size int) {
+	h.Reset()
+	if store.gitObjects {
+		io.WriteString(h, gitBlobHdr(size))
+	}
+}
+
+// hashName returns name of the hash of ids, as recorded in index file
+func (store *Store) hashName() string {
+	if store.gitObjects {
+		return "git-sha1"
+	}
+	return "sha1"
+}
+
+// sha1Of returns sha1 of d, as used in id of d
+func (store *Store) sha1Of(d []byte) [20]byte {
+	if !store.gitObjects {
+		return sha1.Sum(d)
+	}
+	var sum [20]byte
+	h := sha1.New()
+	store.resetHash(h, len(d))
+	h.Write(d)
+	h.Sum(sum[:0])
+	return sum
+}
+
+// GitObject returns blob with a given id as git loose object (zlib
+// compressed, with a header), as stored in .git/objects
+func (store *Store) GitObject(id string) ([]byte, error) {
+	if !store.gitObjects {
+		return nil, ErrNotGitObjects
+	}
+	d, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	io.WriteString(w, gitBlobHdr(len(d)))
+	w.Write(d)
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// PutGitObject stores content of git loose object of type blob (as read from
+// .git/objects) and returns its id, which is the same as git's id
+func (store *Store) PutGitObject(obj []byte) (string, error) {
+	if !store.gitObjects {
+		return "", ErrNotGitObjects
+	}
+	r, err := zlib.NewReader(bytes.NewReader(obj))
+	if err != nil {
+		return "", errInvalidGitObject
+	}
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return "", errInvalidGitObject
+	}
+	hdr, content, ok := bytes.Cut(d, []byte{0})
+	if !ok || string(hdr)+"\x00" != gitBlobHdr(len(content)) {
+		return "", errInvalidGitObject
+	}
+	return store.Put(content)
+}
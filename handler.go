@@ -0,0 +1,651 @@
+package contentstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Handler is http.Handler that serves blobs from a store:
+//   - GET /blobs/<id> (and HEAD) returns content of the blob
+//   - POST /blobs stores the body of the request and returns its id
+//   - GET /blobs?after=<id>&limit=<n> lists blobs with ids greater than id,
+//     sorted by id, if the store supports it (see Store.List())
+//   - DELETE /blobs/<id> removes the blob, if the store supports it (see
+//     Store.Delete())
+//   - GET /changes?gen=<gen>&after=<pos> returns ids of blobs added after
+//     position pos in generation gen of the index, for replication (see
+//     Store.Changes())
+//   - POST /missing with {"ids": [...]} returns ids of blobs the store
+//     doesn't have and GET /bloom?fp=<rate> returns bloom filter of ids of
+//     its blobs, for syncing (see Store.SyncTo())
+//   - GET /idset returns ids of all blobs as an id set (see
+//     Store.ExportIDSet())
+//   - GET /health returns 200 if the store works and 503 if it's poisoned
+//     (see Store.Health()). It doesn't require authentication so that load
+//     balancers can use it
+//
+// Blobs can be requested by their multihash or CID too (see cid.go).
+//
+// Since content of a blob never changes, responses can be cached forever.
+// Id of the blob is its ETag so clients can revalidate cached blobs with
+// If-None-Match (we respond with 304 Not Modified) and make sure they get
+// the content they expect with If-Match (412 Precondition Failed otherwise).
+//
+// If enabled with EnableAdmin(), it also serves admin page at /admin and,
+// if enabled with EnableUploads(), resumable uploads at /uploads (see
+// uploads.go).
+//
+// Every request gets an id, taken from X-Request-Id header of the request
+// or generated if there isn't one. It's sent back in X-Request-Id header
+// of the response and included in log lines about the request, so that
+// a failed request can be matched with logs of other services.
+//
+// Use SetTokens() to require authentication (see auth.go) and
+// SetSigningKey() to allow reading blobs with signed URLs (see signed.go).
+type Handler struct {
+	store Storer
+	admin bool
+	// those can be changed while serving requests
+	readOnly   atomic.Bool
+	logger     atomic.Pointer[log.Logger]
+	tokens     atomic.Pointer[map[[32]byte]Scope]
+	signingKey atomic.Pointer[[]byte]
+	recent     recentRequests
+	// nil if resumable uploads are not enabled
+	uploads *uploads
+}
+
+// NewHandler returns a handler serving blobs from store. If readOnly is true,
+// it doesn't allow storing new blobs.
+func NewHandler(store Storer, readOnly bool) *Handler {
+	h := &Handler{
+		store: store,
+	}
+	h.readOnly.Store(readOnly)
+	return h
+}
+
+const (
+	blobsPath   = "/blobs"
+	changesPath = "/changes"
+	healthPath  = "/health"
+	missingPath = "/missing"
+	bloomPath   = "/bloom"
+	idSetPath   = "/idset"
+	// max number of ids returned by /changes
+	maxChanges = 1000
+	// max number of blobs returned by GET /blobs
+	maxList = 1000
+	// max number of ids sent to /missing
+	maxMissingIds = 10000
+
+	// RequestIdHeader is the name of HTTP header with request id
+	RequestIdHeader = "X-Request-Id"
+	// we don't trust ids sent by clients to be reasonable
+	maxRequestIdLen = 128
+)
+
+type requestIdKey struct{}
+
+// RequestIdFromContext returns id of the request served by Handler, given
+// context of the request
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLen {
+		return false
+	}
+	// only allow printable ascii so that they can't mess up logs
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	var d [8]byte
+	rand.Read(d[:])
+	return hex.EncodeToString(d[:])
+}
+
+// EnableAdmin enables admin page at /admin, which shows stats of the store,
+// recent requests and allows looking up blobs. Must be called before
+// serving requests
+func (h *Handler) EnableAdmin() {
+	h.admin = true
+}
+
+// SetLogger makes the handler log every request and errors to logger.
+// nil disables logging. Can be called while serving requests
+func (h *Handler) SetLogger(logger *log.Logger) {
+	h.logger.Store(logger)
+}
+
+// SetReadOnly changes whether the handler allows storing new blobs. Can be
+// called while serving requests
+func (h *Handler) SetReadOnly(readOnly bool) {
+	h.readOnly.Store(readOnly)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqId := r.Header.Get(RequestIdHeader)
+	if !isValidRequestId(reqId) {
+		reqId = newRequestId()
+	}
+	w.Header().Set(RequestIdHeader, reqId)
+	r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, reqId))
+	if h.admin && r.URL.Path == adminPath {
+		if h.authorize(w, r, ScopeWrite) {
+			h.serveAdmin(w, r)
+		}
+		return
+	}
+	logger := h.logger.Load()
+	if !h.admin && logger == nil {
+		h.serve(w, r)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	h.serve(rec, r)
+	ri := requestInfo{
+		Time:      start,
+		RequestId: reqId,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    rec.status,
+		Size:      rec.size,
+		Duration:  time.Since(start),
+	}
+	if h.admin {
+		h.recent.add(ri)
+	}
+	if logger != nil {
+		logger.Printf("%s %s %s %d %d %s", ri.RequestId, ri.Method, ri.Path, ri.Status, ri.Size, ri.Duration)
+	}
+}
+
+// serverError logs err and, if possible, sends it to the client
+func (h *Handler) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	if logger := h.logger.Load(); logger != nil {
+		logger.Printf("%s %s %s failed with %s", RequestIdFromContext(r.Context()), r.Method, r.URL.Path, err)
+	}
+	if w != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == healthPath {
+		h.serveHealth(w, r)
+		return
+	}
+	if h.uploads != nil && (path == uploadsPath || strings.HasPrefix(path, uploadsPath+"/")) {
+		if !h.authorize(w, r, ScopeWrite) {
+			return
+		}
+		if h.readOnly.Load() {
+			http.Error(w, "store is read-only", http.StatusForbidden)
+			return
+		}
+		h.serveUploads(w, r)
+		return
+	}
+	if path == changesPath {
+		if h.authorize(w, r, ScopeRead) {
+			h.serveChanges(w, r)
+		}
+		return
+	}
+	if path == missingPath || path == bloomPath {
+		if h.authorize(w, r, ScopeRead) {
+			h.serveSync(w, r)
+		}
+		return
+	}
+	if path == idSetPath {
+		if h.authorize(w, r, ScopeRead) {
+			h.serveIDSet(w, r)
+		}
+		return
+	}
+	if path == blobsPath || path == blobsPath+"/" {
+		if r.Method == http.MethodGet {
+			if h.authorize(w, r, ScopeRead) {
+				h.serveList(w, r)
+			}
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.authorize(w, r, ScopeWrite) {
+			h.servePut(w, r)
+		}
+		return
+	}
+	if !strings.HasPrefix(path, blobsPath+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	id := path[len(blobsPath)+1:]
+	if r.Method == http.MethodDelete {
+		if h.authorize(w, r, ScopeWrite) {
+			h.serveDelete(w, r, id)
+		}
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key := h.signingKey.Load(); key != nil && r.URL.Query().Has("sig") {
+		// signed URL replaces a token
+		if err := VerifyBlobSignature(*key, id, r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.serveGet(w, r, id)
+		return
+	}
+	if h.authorize(w, r, ScopeRead) {
+		h.serveGet(w, r, id)
+	}
+}
+
+// etagMatches returns true if etag is in the list of etags from If-Match or
+// If-None-Match header. Since our etags never change, weak etags match too
+func etagMatches(hdr, etag string) bool {
+	for _, s := range strings.Split(hdr, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+		if s == "*" || s == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// blobCopier is implemented by stores that can copy a blob to a writer
+// without reading it into memory
+type blobCopier interface {
+	CopyTo(id string, w io.Writer) (int64, error)
+}
+
+func (h *Handler) serveGet(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := h.store.Stat(id)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err == ErrInvalidId {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	hdr := w.Header()
+	etag := `"` + id + `"`
+	if s := r.Header.Get("If-Match"); s != "" && !etagMatches(s, etag) {
+		http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	hdr.Set("ETag", etag)
+	hdr.Set("Cache-Control", "public, max-age=31536000, immutable")
+	if !info.Created.IsZero() {
+		hdr.Set("Last-Modified", info.Created.UTC().Format(http.TimeFormat))
+	}
+	if s := r.Header.Get("If-None-Match"); s != "" && etagMatches(s, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	hdr.Set("Content-Type", "application/octet-stream")
+	hdr.Set("Content-Length", strconv.Itoa(info.Size))
+	if r.Method == http.MethodHead {
+		return
+	}
+	// once we've started writing the response we can only log errors
+	if copier, ok := h.store.(blobCopier); ok {
+		if _, err = copier.CopyTo(id, w); err != nil {
+			h.serverError(nil, r, err)
+		}
+		return
+	}
+	d, err := h.store.Get(id)
+	if err != nil {
+		hdr.Del("Content-Length")
+		h.serverError(w, r, err)
+		return
+	}
+	w.Write(d)
+}
+
+// readerPutter is implemented by stores that can store a blob without
+// reading it into memory
+type readerPutter interface {
+	PutReader(r io.Reader) (string, int64, error)
+}
+
+// bodyReader remembers the error of reading request body, so that we can
+// tell it apart from errors of the store
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
+
+func (h *Handler) servePut(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly.Load() {
+		http.Error(w, "store is read-only", http.StatusForbidden)
+		return
+	}
+	var id string
+	var err error
+	if putter, ok := h.store.(readerPutter); ok {
+		body := &bodyReader{r: r.Body}
+		id, _, err = putter.PutReader(body)
+		if body.err != nil {
+			http.Error(w, body.err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var d []byte
+		if d, err = io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err = h.store.Put(d)
+	}
+	if err == ErrQuotaExceeded || err == ErrDiskFull {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err == ErrBlobTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", blobsPath+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, id)
+}
+
+// blobDeleter is implemented by stores that can remove blobs
+type blobDeleter interface {
+	Delete(id string) error
+}
+
+func (h *Handler) serveDelete(w http.ResponseWriter, r *http.Request, id string) {
+	if h.readOnly.Load() {
+		http.Error(w, "store is read-only", http.StatusForbidden)
+		return
+	}
+	deleter, ok := h.store.(blobDeleter)
+	if !ok {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := deleter.Delete(id)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err == ErrInvalidId {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changeLister is implemented by stores that support replication
+type changeLister interface {
+	Changes(after Cursor, max int) ([]string, Cursor, error)
+	IndexGeneration() int64
+}
+
+// changesResponse is the response of /changes
+type changesResponse struct {
+	Ids        []string `json:"ids"`
+	Next       int64    `json:"next"`
+	Generation int64    `json:"generation"`
+}
+
+func (h *Handler) serveChanges(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.store.(changeLister)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var after Cursor
+	q := r.URL.Query()
+	if s := q.Get("after"); s != "" {
+		var err error
+		if after.Position, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("gen"); s != "" {
+		var err error
+		if after.Generation, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid gen", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// clients that don't know about generations
+		after.Generation = lister.IndexGeneration()
+	}
+	ids, next, err := lister.Changes(after, maxChanges)
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changesResponse{Ids: ids, Next: next.Position, Generation: next.Generation})
+}
+
+// blobLister is implemented by stores that can list blobs sorted by id
+type blobLister interface {
+	List(afterID string, limit int) ([]BlobInfo, error)
+}
+
+// listedBlob is a blob in the response of GET /blobs
+type listedBlob struct {
+	Id   string `json:"id"`
+	Size int    `json:"size"`
+	// unix seconds, 0 if not known
+	Created int64 `json:"created,omitempty"`
+}
+
+// listResponse is the response of GET /blobs. Next is the after to use for
+// the next page, empty if there are no more blobs
+type listResponse struct {
+	Blobs []listedBlob `json:"blobs"`
+	Next  string       `json:"next,omitempty"`
+}
+
+func (h *Handler) serveList(w http.ResponseWriter, r *http.Request) {
+	lister, ok := h.store.(blobLister)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	limit := maxList
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxList)
+	}
+	infos, err := lister.List(r.URL.Query().Get("after"), limit)
+	if err == ErrInvalidId {
+		http.Error(w, "invalid after", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	res := listResponse{Blobs: make([]listedBlob, len(infos))}
+	for i, info := range infos {
+		res.Blobs[i] = listedBlob{Id: info.Id, Size: info.Size}
+		if !info.Created.IsZero() {
+			res.Blobs[i].Created = info.Created.Unix()
+		}
+	}
+	if len(infos) == limit {
+		res.Next = infos[len(infos)-1].Id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// haveChecker is implemented by stores that can tell which blobs they
+// don't have
+type haveChecker interface {
+	MissingFrom(ids []string) ([]string, error)
+	BloomFilter(falsePositiveRate float64) (*BloomFilter, error)
+}
+
+// missingRequest is the body of POST /missing and missing ids are sent back
+// in the same form
+type missingRequest struct {
+	Ids []string `json:"ids"`
+}
+
+func (h *Handler) serveSync(w http.ResponseWriter, r *http.Request) {
+	checker, ok := h.store.(haveChecker)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == bloomPath {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var fp float64
+		if s := r.URL.Query().Get("fp"); s != "" {
+			var err error
+			if fp, err = strconv.ParseFloat(s, 64); err != nil || fp <= 0 || fp >= 1 {
+				http.Error(w, "invalid fp", http.StatusBadRequest)
+				return
+			}
+		}
+		filter, err := checker.BloomFilter(fp)
+		var d []byte
+		if err == nil {
+			d, err = filter.MarshalBinary()
+		}
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(d)))
+		w.Write(d)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req missingRequest
+	// 41 bytes per id is enough for hex ids, CIDs are a bit longer
+	body := http.MaxBytesReader(w, r.Body, maxMissingIds*100)
+	if err := json.NewDecoder(body).Decode(&req); err != nil || len(req.Ids) > maxMissingIds {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	missing, err := checker.MissingFrom(req.Ids)
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(missingRequest{Ids: missing})
+}
+
+// idSetExporter is implemented by stores that can export ids of their blobs
+// as an id set
+type idSetExporter interface {
+	ExportIDSet(w io.Writer) error
+}
+
+func (h *Handler) serveIDSet(w http.ResponseWriter, r *http.Request) {
+	exporter, ok := h.store.(idSetExporter)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := exporter.ExportIDSet(w); err != nil {
+		// too late to send an error. The set won't have the end marker so
+		// the client knows it's incomplete
+		h.serverError(nil, r, err)
+	}
+}
+
+// healthChecker is implemented by stores that can report their health
+type healthChecker interface {
+	Health() error
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if checker, ok := h.store.(healthChecker); ok {
+		if err := checker.Health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
@@ -0,0 +1,342 @@
+package contentstore
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	srv := httptest.NewServer(NewHandler(store, false))
+	defer srv.Close()
+
+	content := "my piece of content"
+	rsp, err := http.Post(srv.URL+"/blobs", "text/plain", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("http.Post() failed with %q", err)
+	}
+	d, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned status %d", rsp.StatusCode)
+	}
+	id := string(d)
+
+	rsp, err = http.Get(srv.URL + "/blobs/" + id)
+	if err != nil {
+		t.Fatalf("http.Get() failed with %q", err)
+	}
+	d, _ = io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || string(d) != content {
+		t.Fatalf("GET returned status %d and %q", rsp.StatusCode, d)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/blobs/"+id, nil)
+	req.Header.Set("If-None-Match", `"other", "`+id+`"`)
+	rsp, _ = http.DefaultClient.Do(req)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotModified {
+		t.Fatalf("GET with matching If-None-Match returned status %d", rsp.StatusCode)
+	}
+	req.Header.Del("If-None-Match")
+	req.Header.Set("If-Match", `"other"`)
+	rsp, _ = http.DefaultClient.Do(req)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("GET with not matching If-Match returned status %d", rsp.StatusCode)
+	}
+
+	rsp, _ = http.Get(srv.URL + "/blobs/" + strings.Repeat("0", 40))
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of missing blob returned status %d", rsp.StatusCode)
+	}
+	rsp, _ = http.Get(srv.URL + "/blobs/not-an-id")
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("GET of invalid id returned status %d", rsp.StatusCode)
+	}
+
+	roHandler := NewHandler(store, true)
+	roSrv := httptest.NewServer(roHandler)
+	defer roSrv.Close()
+	rsp, _ = http.Post(roSrv.URL+"/blobs", "text/plain", strings.NewReader(content))
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusForbidden {
+		t.Fatalf("POST to read-only handler returned status %d", rsp.StatusCode)
+	}
+	roHandler.SetReadOnly(false)
+	rsp, _ = http.Post(roSrv.URL+"/blobs", "text/plain", strings.NewReader(content))
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST after SetReadOnly(false) returned status %d", rsp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/blobs/"+id, nil)
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rsp, _ = http.DefaultClient.Do(req)
+		rsp.Body.Close()
+		if rsp.StatusCode != status {
+			t.Fatalf("DELETE returned status %d, expected %d", rsp.StatusCode, status)
+		}
+	}
+	if store.Exists(id) {
+		t.Fatalf("DELETE didn't remove the blob")
+	}
+}
+
+func TestHandlerAdmin(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, err := store.Put([]byte("my piece of content"))
+	if err != nil {
+		t.Fatalf("Put() failed with %q", err)
+	}
+	h := NewHandler(store, false)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	rsp, _ := http.Get(srv.URL + "/admin")
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /admin with admin disabled returned status %d", rsp.StatusCode)
+	}
+
+	h.EnableAdmin()
+	rsp, _ = http.Get(srv.URL + "/blobs/" + id)
+	rsp.Body.Close()
+	rsp, err = http.Get(srv.URL + "/admin?id=" + id)
+	if err != nil {
+		t.Fatalf("http.Get() failed with %q", err)
+	}
+	d, _ := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /admin returned status %d", rsp.StatusCode)
+	}
+	page := string(d)
+	// id shows up in the lookup box, lookup result and recent requests
+	if !strings.Contains(page, id+"</a>: 19 bytes") || !strings.Contains(page, "/blobs/"+id+"</td>") {
+		t.Fatalf("admin page doesn't show blob %s:\n%s", id, page)
+	}
+}
+
+func TestHandlerRequestId(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var logBuf bytes.Buffer
+	h := NewHandler(store, false)
+	h.SetLogger(log.New(&logBuf, "", 0))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	missing := strings.Repeat("0", 40)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/blobs/"+missing, nil)
+	req.Header.Set(RequestIdHeader, "my-request-id")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Get() failed with %q", err)
+	}
+	rsp.Body.Close()
+	if got := rsp.Header.Get(RequestIdHeader); got != "my-request-id" {
+		t.Fatalf("got request id %q, expected %q", got, "my-request-id")
+	}
+	if !strings.HasPrefix(logBuf.String(), "my-request-id GET /blobs/"+missing+" 404 ") {
+		t.Fatalf("unexpected log line %q", logBuf.String())
+	}
+
+	// invalid ids are replaced
+	req.Header.Set(RequestIdHeader, "bad id")
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Get() failed with %q", err)
+	}
+	rsp.Body.Close()
+	if got := rsp.Header.Get(RequestIdHeader); got == "" || strings.Contains(got, "bad") {
+		t.Fatalf("got request id %q", got)
+	}
+}
+
+func TestHandlerTokens(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, _ := store.Put([]byte("secret content"))
+	h := NewHandler(store, false)
+	h.SetTokens(map[string]Scope{
+		"reader": ScopeRead,
+		"writer": ScopeRead | ScopeWrite,
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	status := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader("new content"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed with %q", method, path, err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/blobs/" + id, "", http.StatusUnauthorized},
+		{http.MethodGet, "/blobs/" + id, "bad", http.StatusUnauthorized},
+		{http.MethodGet, "/blobs/" + id, "reader", http.StatusOK},
+		{http.MethodPost, "/blobs", "reader", http.StatusForbidden},
+		{http.MethodPost, "/blobs", "writer", http.StatusCreated},
+	}
+	for _, test := range tests {
+		if got := status(test.method, test.path, test.token); got != test.status {
+			t.Fatalf("%s %s with token %q returned status %d, expected %d", test.method, test.path, test.token, got, test.status)
+		}
+	}
+	h.SetTokens(nil)
+	if got := status(http.MethodGet, "/blobs/"+id, ""); got != http.StatusOK {
+		t.Fatalf("GET without tokens returned status %d", got)
+	}
+}
+
+func TestHandlerUploads(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	uploadsDir := basePath + "_uploads"
+	defer os.RemoveAll(uploadsDir)
+	store, err := New(basePath, WithMaxBlobSize(100))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	h := NewHandler(store, false)
+	if err = h.EnableUploads(uploadsDir); err != nil {
+		t.Fatalf("h.EnableUploads(%q) failed with %q", uploadsDir, err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, path string, hdrs map[string]string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		for k, v := range hdrs {
+			req.Header.Set(k, v)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed with %q", method, path, err)
+		}
+		d, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return rsp, string(d)
+	}
+	// bigger than max blob size of the store
+	rsp, _ := do(http.MethodPost, "/uploads", map[string]string{"Upload-Length": "101"}, "")
+	if rsp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST /uploads of too big blob returned status %d", rsp.StatusCode)
+	}
+	content := "content uploaded in parts"
+	rsp, _ = do(http.MethodPost, "/uploads", map[string]string{"Upload-Length": strconv.Itoa(len(content))}, "")
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /uploads returned status %d", rsp.StatusCode)
+	}
+	uploadPath := rsp.Header.Get("Location")
+	rsp, _ = do(http.MethodPatch, uploadPath, map[string]string{"Upload-Offset": "0"}, content[:10])
+	if rsp.StatusCode != http.StatusNoContent || rsp.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("PATCH returned status %d, offset %s", rsp.StatusCode, rsp.Header.Get("Upload-Offset"))
+	}
+	// client that lost track of the offset asks for it
+	rsp, _ = do(http.MethodHead, uploadPath, nil, "")
+	if rsp.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("HEAD returned offset %s", rsp.Header.Get("Upload-Offset"))
+	}
+	rsp, _ = do(http.MethodPatch, uploadPath, map[string]string{"Upload-Offset": "5"}, content[5:])
+	if rsp.StatusCode != http.StatusConflict {
+		t.Fatalf("PATCH with wrong offset returned status %d", rsp.StatusCode)
+	}
+	rsp, id := do(http.MethodPatch, uploadPath, map[string]string{"Upload-Offset": "10"}, content[10:])
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("last PATCH returned status %d", rsp.StatusCode)
+	}
+	if d, err := store.Get(id); err != nil || string(d) != content {
+		t.Fatalf("store.Get(%q) returned %q, %v", id, d, err)
+	}
+	if rsp, _ = do(http.MethodHead, uploadPath, nil, ""); rsp.StatusCode != http.StatusNotFound {
+		t.Fatalf("HEAD of finished upload returned status %d", rsp.StatusCode)
+	}
+}
+
+func TestHandlerSignedURL(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, _ := store.Put([]byte("shared content"))
+	key := []byte("signing key")
+	h := NewHandler(store, false)
+	h.SetTokens(map[string]Scope{"token": ScopeRead})
+	h.SetSigningKey(key)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{SignBlobPath(key, id, time.Now().Add(time.Hour)), http.StatusOK},
+		{SignBlobPath(key, id, time.Now().Add(-time.Hour)), http.StatusForbidden},
+		{SignBlobPath([]byte("other key"), id, time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"/blobs/" + id, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		rsp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatalf("http.Get() failed with %q", err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status {
+			t.Fatalf("GET %s returned status %d, expected %d", test.path, rsp.StatusCode, test.status)
+		}
+	}
+}
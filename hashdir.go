@@ -0,0 +1,137 @@
+package contentstore
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Many systems store blobs as files named by the hash of their content,
+// spread over directories named by the first characters of the hash (e.g.
+// objects/ab/cdef... where abcdef... is the hash). ImportHashedDir() moves
+// such stores into a Store and ExportHashedDir() creates them from a Store.
+
+// HashedDirLayout describes directory with files named by hash of their content
+type HashedDirLayout struct {
+	// lengths of names of directories, from the top. E.g. []int{2} for
+	// ab/cdef..., []int{2, 2} for ab/cd/ef...
+	Levels []int
+	// true if the hash is the id of the content, i.e. hex sha1 of the content
+	// (or git blob id if the store was opened with WithGitObjects()). We
+	// skip files that are already in the store without reading them and
+	// don't import files whose content doesn't match the name
+	Sha1 bool
+}
+
+// ImportResult describes what ImportHashedDir() did
+type ImportResult struct {
+	Imported int
+	// files already in the store
+	Skipped int
+	// paths of files whose content doesn't match their name
+	Mismatched []string
+	// paths of files that don't fit the layout and were ignored
+	Ignored []string
+}
+
+// hashFromPath returns the hash that is the name of the file at relPath
+// (relative to top directory) or "" if the path doesn't fit the layout
+func (layout *HashedDirLayout) hashFromPath(relPath string) string {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	if len(parts) != len(layout.Levels)+1 {
+		return ""
+	}
+	for i, n := range layout.Levels {
+		if len(parts[i]) != n {
+			return ""
+		}
+	}
+	return strings.ToLower(strings.Join(parts, ""))
+}
+
+// pathFor returns path, relative to top directory, of the file named hash
+func (layout *HashedDirLayout) pathFor(hash string) string {
+	var parts []string
+	for _, n := range layout.Levels {
+		if len(hash) <= n {
+			break
+		}
+		parts = append(parts, hash[:n])
+		hash = hash[n:]
+	}
+	return filepath.Join(append(parts, hash)...)
+}
+
+// ImportHashedDir stores all files from dir, which is laid out as described
+// by layout. Files are stored one at a time with PutFile(), so they're not
+// read into memory
+func (store *Store) ImportHashedDir(dir string, layout HashedDirLayout) (*ImportResult, error) {
+	res := &ImportResult{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hash := layout.hashFromPath(relPath)
+		if hash == "" {
+			res.Ignored = append(res.Ignored, path)
+			return nil
+		}
+		wantId := ""
+		if layout.Sha1 {
+			if store.Exists(hash) {
+				res.Skipped++
+				return nil
+			}
+			wantId = hash
+		}
+		_, err = store.putFile(path, wantId)
+		if err == errIdMismatch {
+			res.Mismatched = append(res.Mismatched, path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res.Imported++
+		return nil
+	})
+	return res, err
+}
+
+// ExportResult describes what ExportHashedDir() did
+type ExportResult struct {
+	Exported int
+	// blobs whose files already existed
+	Skipped int
+}
+
+// ExportHashedDir writes each blob to a file in dir, named by its id and
+// laid out as described by layout (Sha1 is ignored). Files that already
+// exist and have the size of the blob are skipped, so an interrupted export
+// can be resumed. Content is copied by the kernel with copy_file_range(2)
+// (see CopyTo()), which on filesystems with reflinks (e.g. btrfs or XFS)
+// can share blocks with segment files instead of duplicating them
+func (store *Store) ExportHashedDir(dir string, layout HashedDirLayout) (*ExportResult, error) {
+	res := &ExportResult{}
+	err := store.ForEach(func(info BlobInfo) error {
+		path := filepath.Join(dir, layout.pathFor(info.Id))
+		if stat, err := os.Stat(path); err == nil && stat.Size() == int64(info.Size) {
+			res.Skipped++
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := store.CopyToFile(info.Id, path); err != nil {
+			return err
+		}
+		res.Exported++
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,180 @@
+package contentstore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An id set is a compact, sorted list of ids of all blobs in a store (see
+// ExportIDSet()). Unlike a bloom filter it's exact, so two stores that
+// exchange their sets can find blobs each of them is missing, without false
+// positives, by merging the sorted lists (see DiffIDSets()). Since ids are
+// sorted, each id shares a prefix with the previous one, which we don't
+// repeat. For a million blobs it takes about 19 bytes per blob, compared to
+// 41 for hex ids, one per line.
+//
+// Format: magic, then for each id the length of the prefix it shares with
+// the previous id (1 byte) followed by the rest of the id, then 0xff. The end
+// marker tells a complete set from one that was cut short.
+
+var (
+	errInvalidIDSet = errors.New("invalid id set")
+)
+
+const (
+	idSetMagic = "csids1"
+	idSetEnd   = 0xff
+	// number of ids we take from the index at once when exporting
+	idSetBatchSize = 4096
+)
+
+// ExportIDSet writes ids of all blobs in the store to w as an id set. The
+// store is not locked while writing, so blobs added or deleted while it runs
+// might or might not be included
+func (store *Store) ExportIDSet(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(idSetMagic)
+	var prev [20]byte
+	var after *[20]byte
+	for {
+		store.Lock()
+		blobs := store.index.after(after, idSetBatchSize)
+		store.Unlock()
+		for i := range blobs {
+			sha1 := blobs[i].sha1
+			n := 0
+			for n < len(sha1)-1 && sha1[n] == prev[n] {
+				n++
+			}
+			bw.WriteByte(byte(n))
+			bw.Write(sha1[n:])
+			prev = sha1
+		}
+		if len(blobs) < idSetBatchSize {
+			break
+		}
+		after = &blobs[len(blobs)-1].sha1
+	}
+	bw.WriteByte(idSetEnd)
+	return bw.Flush()
+}
+
+// IDSetReader reads ids from an id set written by ExportIDSet()
+type IDSetReader struct {
+	r    *bufio.Reader
+	prev [20]byte
+	// true after the first id
+	started bool
+	done    bool
+}
+
+// NewIDSetReader returns a reader of id set read from r
+func NewIDSetReader(r io.Reader) (*IDSetReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(idSetMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != idSetMagic {
+		return nil, errInvalidIDSet
+	}
+	return &IDSetReader{r: br}, nil
+}
+
+// next returns sha1 of the next id or io.EOF after the last one
+func (sr *IDSetReader) next() ([20]byte, error) {
+	var sha1 [20]byte
+	if sr.done {
+		return sha1, io.EOF
+	}
+	n, err := sr.r.ReadByte()
+	if err == io.EOF {
+		return sha1, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return sha1, err
+	}
+	if n == idSetEnd {
+		sr.done = true
+		return sha1, io.EOF
+	}
+	if int(n) >= len(sha1) {
+		return sha1, errInvalidIDSet
+	}
+	copy(sha1[:n], sr.prev[:n])
+	if _, err = io.ReadFull(sr.r, sha1[n:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return sha1, err
+	}
+	// ids must be sorted and unique
+	if sr.started && bytes.Compare(sha1[:], sr.prev[:]) <= 0 {
+		return sha1, errInvalidIDSet
+	}
+	sr.prev = sha1
+	sr.started = true
+	return sha1, nil
+}
+
+// Next returns the next id, in sorted order, or io.EOF after the last one.
+// It returns io.ErrUnexpectedEOF if the set is incomplete
+func (sr *IDSetReader) Next() (string, error) {
+	sha1, err := sr.next()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1[:]), nil
+}
+
+// DiffIDSets compares id sets read from a and b and returns ids that are
+// only in a and ids that are only in b. It only keeps the differences in
+// memory, so it's cheap for big sets that are mostly the same
+func DiffIDSets(a, b io.Reader) (onlyInA, onlyInB []string, err error) {
+	ra, err := NewIDSetReader(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	rb, err := NewIDSetReader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	idA, errA := ra.next()
+	idB, errB := rb.next()
+	for errA == nil || errB == nil {
+		if errA != nil && errA != io.EOF {
+			return nil, nil, errA
+		}
+		if errB != nil && errB != io.EOF {
+			return nil, nil, errB
+		}
+		cmp := 0
+		switch {
+		case errA == io.EOF:
+			cmp = 1
+		case errB == io.EOF:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(idA[:], idB[:])
+		}
+		if cmp < 0 {
+			onlyInA = append(onlyInA, fmt.Sprintf("%x", idA[:]))
+			idA, errA = ra.next()
+			continue
+		}
+		if cmp > 0 {
+			onlyInB = append(onlyInB, fmt.Sprintf("%x", idB[:]))
+			idB, errB = rb.next()
+			continue
+		}
+		idA, errA = ra.next()
+		idB, errB = rb.next()
+	}
+	if errA != io.EOF {
+		return nil, nil, errA
+	}
+	if errB != io.EOF {
+		return nil, nil, errB
+	}
+	return onlyInA, onlyInB, nil
+}
@@ -0,0 +1,343 @@
+package contentstore
+
+import (
+	"bytes"
+	"sort"
+)
+
+// IndexMode selects in-memory representation of the index
+type IndexMode int
+
+const (
+	// IndexMap keeps blobs in a hash map. It's the fastest for lookups
+	// and inserts but uses the most memory.
+	IndexMap IndexMode = iota
+	// IndexSorted keeps blobs in a single slice sorted by sha1 and finds
+	// them with binary search. Lookups and inserts are slower but it uses
+	// ~3x less memory and, having no pointers (unless blobs have extra
+	// data, see PutWithExtra()), is much easier on the GC.
+	// Best for big, read-mostly stores.
+	IndexSorted
+	// only keeps sha1 of blobs, used by OpenIngestOnly()
+	indexIds
+)
+
+// blobIndex is an in-memory index of all blobs in the store
+type blobIndex interface {
+	// load replaces content of the index with blobs. Takes ownership of blobs
+	load(blobs []blob)
+	add(blob blob)
+	// remove removes blob with a given sha1 and returns it
+	remove(sha1 [20]byte) (blob, bool)
+	find(sha1 [20]byte) (blob, bool)
+	count() int
+	// forEach calls fn for every blob. For mapIndex the order is the order
+	// of insertion, for sortedIndex it's sorted by sha1
+	forEach(fn func(blob *blob))
+	// after returns up to limit blobs whose sha1 is greater than sha1 (or
+	// the first blobs if sha1 is nil), sorted by sha1
+	after(sha1 *[20]byte, limit int) []blob
+}
+
+func newBlobIndex(mode IndexMode) blobIndex {
+	if mode == IndexSorted {
+		return &sortedIndex{}
+	}
+	if mode == indexIds {
+		return &idsIndex{}
+	}
+	return newMapIndex()
+}
+
+type mapIndex struct {
+	blobs []blob
+	// sha1ToBlobNo is to quickly find a blob based on sha1
+	// string is really [20]byte cast to string and int is a position within blobs array
+	sha1ToBlobNo map[string]int
+	// removed blobs stay in blobs (marked with negative size) until there's
+	// enough of them to be worth re-building the index
+	nRemoved int
+	// sha1 of blobs sorted, for after(). It's built by the first call to
+	// after() and blobs added since are merged into it by the next one.
+	// Removed blobs stay in it until it's re-built, and so can blobs
+	// added again after being removed, so it can have duplicates
+	sorted [][20]byte
+	// sha1 of blobs added since sorted was updated
+	unsorted [][20]byte
+}
+
+func newMapIndex() *mapIndex {
+	return &mapIndex{
+		blobs:        make([]blob, 0),
+		sha1ToBlobNo: make(map[string]int),
+	}
+}
+
+func (idx *mapIndex) load(blobs []blob) {
+	idx.blobs = blobs
+	idx.nRemoved = 0
+	idx.sorted = nil
+	idx.unsorted = nil
+	idx.sha1ToBlobNo = make(map[string]int, len(blobs))
+	for blobNo, blob := range blobs {
+		idx.sha1ToBlobNo[string(blob.sha1[:])] = blobNo
+	}
+}
+
+// TODO: error out if already in sha1ToBlobNo
+func (idx *mapIndex) add(blob blob) {
+	blobNo := len(idx.blobs)
+	idx.blobs = append(idx.blobs, blob)
+	idx.sha1ToBlobNo[string(blob.sha1[:])] = blobNo
+	if idx.sorted == nil {
+		return
+	}
+	if len(idx.unsorted) > len(idx.sorted)+1024 {
+		// re-building it is cheaper than keeping it up to date
+		idx.sorted, idx.unsorted = nil, nil
+		return
+	}
+	idx.unsorted = append(idx.unsorted, blob.sha1)
+}
+
+func (idx *mapIndex) remove(sha1 [20]byte) (blob, bool) {
+	blobNo, ok := idx.sha1ToBlobNo[string(sha1[:])]
+	if !ok {
+		return blob{}, false
+	}
+	res := idx.blobs[blobNo]
+	delete(idx.sha1ToBlobNo, string(sha1[:]))
+	idx.blobs[blobNo].size = -1
+	idx.nRemoved++
+	if idx.nRemoved > 1024 && idx.nRemoved > len(idx.blobs)/2 {
+		blobs := make([]blob, 0, len(idx.blobs)-idx.nRemoved)
+		idx.forEach(func(blob *blob) {
+			blobs = append(blobs, *blob)
+		})
+		idx.load(blobs)
+	}
+	return res, true
+}
+
+func (idx *mapIndex) find(sha1 [20]byte) (blob, bool) {
+	blobNo, ok := idx.sha1ToBlobNo[string(sha1[:])]
+	if !ok {
+		return blob{}, false
+	}
+	return idx.blobs[blobNo], true
+}
+
+func (idx *mapIndex) count() int {
+	return len(idx.blobs) - idx.nRemoved
+}
+
+func (idx *mapIndex) forEach(fn func(blob *blob)) {
+	for i := range idx.blobs {
+		if idx.blobs[i].size >= 0 {
+			fn(&idx.blobs[i])
+		}
+	}
+}
+
+func (idx *mapIndex) after(sha1 *[20]byte, limit int) []blob {
+	idx.updateSorted()
+	i := 0
+	if sha1 != nil {
+		i = sort.Search(len(idx.sorted), func(i int) bool {
+			return bytes.Compare(idx.sorted[i][:], sha1[:]) > 0
+		})
+	}
+	var res []blob
+	for ; i < len(idx.sorted) && len(res) < limit; i++ {
+		if i > 0 && idx.sorted[i] == idx.sorted[i-1] {
+			continue
+		}
+		if blobNo, ok := idx.sha1ToBlobNo[string(idx.sorted[i][:])]; ok {
+			res = append(res, idx.blobs[blobNo])
+		}
+	}
+	return res
+}
+
+// updateSorted makes idx.sorted have sha1 of all blobs. Paging through all
+// blobs (see Store.List()) calls after() many times, so we don't want to
+// sort them every time
+func (idx *mapIndex) updateSorted() {
+	// re-build it if it's mostly removed blobs
+	if idx.sorted == nil || len(idx.sorted) > 2*idx.count()+1024 {
+		idx.sorted = make([][20]byte, 0, idx.count())
+		idx.forEach(func(blob *blob) {
+			idx.sorted = append(idx.sorted, blob.sha1)
+		})
+		sortSha1s(idx.sorted)
+		idx.unsorted = nil
+		return
+	}
+	if len(idx.unsorted) == 0 {
+		return
+	}
+	// merge, from the end, so that we don't need another slice
+	added := idx.unsorted
+	sortSha1s(added)
+	i, j := len(idx.sorted)-1, len(added)-1
+	idx.sorted = append(idx.sorted, added...)
+	for k := len(idx.sorted) - 1; j >= 0; k-- {
+		if i >= 0 && bytes.Compare(idx.sorted[i][:], added[j][:]) > 0 {
+			idx.sorted[k] = idx.sorted[i]
+			i--
+		} else {
+			idx.sorted[k] = added[j]
+			j--
+		}
+	}
+	idx.unsorted = idx.unsorted[:0]
+}
+
+func sortSha1s(sha1s [][20]byte) {
+	sort.Slice(sha1s, func(i, j int) bool {
+		return bytes.Compare(sha1s[i][:], sha1s[j][:]) < 0
+	})
+}
+
+type sortedIndex struct {
+	// sorted by sha1
+	blobs []blob
+}
+
+type bySha1 []blob
+
+func (a bySha1) Len() int           { return len(a) }
+func (a bySha1) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySha1) Less(i, j int) bool { return bytes.Compare(a[i].sha1[:], a[j].sha1[:]) < 0 }
+
+// search returns position of the first blob whose sha1 is >= sha1
+func (idx *sortedIndex) search(sha1 [20]byte) int {
+	return sort.Search(len(idx.blobs), func(i int) bool {
+		return bytes.Compare(idx.blobs[i].sha1[:], sha1[:]) >= 0
+	})
+}
+
+func (idx *sortedIndex) load(blobs []blob) {
+	// sorting once is much faster than inserting one by one
+	sort.Stable(bySha1(blobs))
+	idx.blobs = blobs
+}
+
+func (idx *sortedIndex) add(blob blob) {
+	i := idx.search(blob.sha1)
+	idx.blobs = append(idx.blobs, blob)
+	copy(idx.blobs[i+1:], idx.blobs[i:])
+	idx.blobs[i] = blob
+}
+
+func (idx *sortedIndex) remove(sha1 [20]byte) (blob, bool) {
+	i := idx.search(sha1)
+	if i >= len(idx.blobs) || idx.blobs[i].sha1 != sha1 {
+		return blob{}, false
+	}
+	res := idx.blobs[i]
+	idx.blobs = append(idx.blobs[:i], idx.blobs[i+1:]...)
+	return res, true
+}
+
+func (idx *sortedIndex) find(sha1 [20]byte) (blob, bool) {
+	i := idx.search(sha1)
+	if i < len(idx.blobs) && idx.blobs[i].sha1 == sha1 {
+		return idx.blobs[i], true
+	}
+	return blob{}, false
+}
+
+func (idx *sortedIndex) count() int {
+	return len(idx.blobs)
+}
+
+func (idx *sortedIndex) forEach(fn func(blob *blob)) {
+	for i := range idx.blobs {
+		fn(&idx.blobs[i])
+	}
+}
+
+func (idx *sortedIndex) after(sha1 *[20]byte, limit int) []blob {
+	i := 0
+	if sha1 != nil {
+		i = idx.search(*sha1)
+		if i < len(idx.blobs) && idx.blobs[i].sha1 == *sha1 {
+			i++
+		}
+	}
+	end := min(i+limit, len(idx.blobs))
+	return append([]blob(nil), idx.blobs[i:end]...)
+}
+
+// idsIndex is like sortedIndex but only keeps sha1 of blobs, which takes
+// ~3x less memory. Blobs it returns only have sha1 set, so it can only be
+// used when we don't read blobs (see OpenIngestOnly())
+type idsIndex struct {
+	// sorted
+	sha1s [][20]byte
+}
+
+// search returns position of the first sha1 that is >= sha1
+func (idx *idsIndex) search(sha1 [20]byte) int {
+	return sort.Search(len(idx.sha1s), func(i int) bool {
+		return bytes.Compare(idx.sha1s[i][:], sha1[:]) >= 0
+	})
+}
+
+func (idx *idsIndex) load(blobs []blob) {
+	sort.Stable(bySha1(blobs))
+	idx.sha1s = make([][20]byte, len(blobs))
+	for i := range blobs {
+		idx.sha1s[i] = blobs[i].sha1
+	}
+}
+
+func (idx *idsIndex) add(blob blob) {
+	i := idx.search(blob.sha1)
+	idx.sha1s = append(idx.sha1s, blob.sha1)
+	copy(idx.sha1s[i+1:], idx.sha1s[i:])
+	idx.sha1s[i] = blob.sha1
+}
+
+func (idx *idsIndex) remove(sha1 [20]byte) (blob, bool) {
+	i := idx.search(sha1)
+	if i >= len(idx.sha1s) || idx.sha1s[i] != sha1 {
+		return blob{}, false
+	}
+	idx.sha1s = append(idx.sha1s[:i], idx.sha1s[i+1:]...)
+	return blob{sha1: sha1}, true
+}
+
+func (idx *idsIndex) find(sha1 [20]byte) (blob, bool) {
+	i := idx.search(sha1)
+	if i < len(idx.sha1s) && idx.sha1s[i] == sha1 {
+		return blob{sha1: sha1}, true
+	}
+	return blob{}, false
+}
+
+func (idx *idsIndex) count() int {
+	return len(idx.sha1s)
+}
+
+func (idx *idsIndex) forEach(fn func(blob *blob)) {
+	for _, sha1 := range idx.sha1s {
+		fn(&blob{sha1: sha1})
+	}
+}
+
+func (idx *idsIndex) after(sha1 *[20]byte, limit int) []blob {
+	i := 0
+	if sha1 != nil {
+		i = idx.search(*sha1)
+		if i < len(idx.sha1s) && idx.sha1s[i] == *sha1 {
+			i++
+		}
+	}
+	var res []blob
+	for ; i < len(idx.sha1s) && len(res) < limit; i++ {
+		res = append(res, blob{sha1: idx.sha1s[i]})
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+package contentstore
+
+import "io"
+
+// IngestStore is a handle to a store that can only add blobs and check if
+// they exist, for processes whose only job is to append content that is
+// read elsewhere (e.g. edge collectors that forward it). Since it never
+// reads blobs, it only keeps their ids in memory (~3x less than
+// IndexSorted) and doesn't open segment files other than the current one.
+type IngestStore struct {
+	store *Store
+}
+
+// OpenIngestOnly opens (or creates) the store at basePath for adding blobs.
+// Options that need to know where blobs are (WithIndexMode(), WithPolicy(),
+// WithAutoCompaction() and WithSpaceReuse()) are ignored
+func OpenIngestOnly(basePath string, opts ...Option) (*IngestStore, error) {
+	opts = append(opts, withIngestOnly())
+	store, err := New(basePath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if store.readOnly {
+		// New() opens stores on read-only media as read-only
+		store.Close()
+		return nil, errReadOnly
+	}
+	return &IngestStore{store: store}, nil
+}
+
+// withIngestOnly undoes options that don't work with idsIndex
+func withIngestOnly() Option {
+	return func(store *Store) {
+		store.indexMode = indexIds
+		store.policy = nil
+		store.compaction = nil
+		store.reuse = nil
+	}
+}
+
+// Put stores d in the store and returns its id. It returns after the data
+// is safely on disk
+func (s *IngestStore) Put(d []byte) (string, error) {
+	return s.store.Put(d)
+}
+
+// PutReader stores data read from r and returns its id and size, without
+// reading all of it into memory (see Store.PutReader())
+func (s *IngestStore) PutReader(r io.Reader) (string, int64, error) {
+	return s.store.PutReader(r)
+}
+
+// Exists returns true if blob is in the store
+func (s *IngestStore) Exists(id string) bool {
+	return s.store.Exists(id)
+}
+
+// Sync waits until all blobs accepted so far are on disk
+func (s *IngestStore) Sync() error {
+	return s.store.Sync()
+}
+
+// Close closes the store
+func (s *IngestStore) Close() error {
+	return s.store.Close()
+}
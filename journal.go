@@ -0,0 +1,310 @@
+package contentstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Index file is a journal: a header followed by records, appended one
+// after another. The header is a line that says which hash ids of blobs
+// are and how many bytes it has, so that a store isn't opened with a
+// different one (see WithGitObjects()), and its generation. Generation
+// starts at 0 and grows every time the index file is rewritten (see
+// rewriteIndex()), which changes positions of records in it, so that
+// positions from before (see Changes()) can be told apart. Stores created by
+// old versions have a header without them, which we accept with any hash
+// and replace when the store is opened for writing. Each record is framed
+// as:
+// - size of the payload (uint32, little endian)
+// - payload, whose first byte is the type of the record
+// - crc32 (Castagnoli) of the payload (uint32, little endian)
+//
+// Framing allows us to tell apart a torn record (we crashed while appending
+// it, so the file ends in the middle of the record) from a corrupted record
+// (checksum doesn't match). Torn record is always safe to discard.
+//
+// Blob record is the type followed by a record encoded with IndexCodec. Blob
+// records written since we record when blobs were added have a different
+// type and the time (unix seconds, uvarint) between the type and the rest.
+// Delete record is the type followed by sha1 of the deleted blob.
+// Move record is like blob record with the time but it's for a blob that
+// was moved to a different place by compaction. It replaces the previous
+// record of the blob, so moving it is atomic.
+
+var (
+	errTornRecord    = errors.New("torn index record")
+	errCorruptRecord = errors.New("corrupted index record")
+	// ErrHashMismatch is returned when opening a store with a different
+	// hash of ids than the one it was created with
+	ErrHashMismatch = errors.New("store was created with a different hash of ids")
+	// header of index file of stores created by old versions
+	idxHdrV1 = []byte("github.com/kjk/contentstore journal 1.0\n")
+	// followed by name of the hash, size of hash in bytes and generation.
+	// Generation is missing in headers written by old versions
+	idxHdrPrefix = "github.com/kjk/contentstore journal 1.1 "
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	// types of records
+	recBlob        = 1
+	recBlobCreated = 2
+	recDelete      = 3
+	recMove        = 4
+
+	// longer header line means it's not a header
+	maxIdxHdrSize = 128
+
+	// our records are much smaller so a bigger size means the size
+	// itself is corrupted
+	maxRecordPayload = 64 * 1024
+	// 4 (size) + 1 (type) + 20 (sha1) + 3 (1 byte varints) + 4 (crc32)
+	minBlobRecordSize = 32
+)
+
+// newIndexHeader returns header of index file of a given generation
+func (store *Store) newIndexHeader(gen int64) []byte {
+	return []byte(fmt.Sprintf("%s%s %d %d\n", idxHdrPrefix, store.hashName(), sha1.Size, gen))
+}
+
+// readIndexHeader reads header of index file from r and checks that it
+// matches hash of the store. It returns the header and generation of the
+// index
+func (store *Store) readIndexHeader(r *bufio.Reader) ([]byte, int64, error) {
+	hdr, err := r.Peek(min(maxIdxHdrSize, r.Size()))
+	if n := bytes.IndexByte(hdr, '\n'); n >= 0 {
+		hdr, err = hdr[:n+1], nil
+	} else if err == nil || err == io.EOF {
+		err = errInvalidIndexHdr
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr = bytes.Clone(hdr)
+	r.Discard(len(hdr))
+	if bytes.Equal(hdr, idxHdrV1) {
+		return hdr, 0, nil
+	}
+	rest, ok := bytes.CutPrefix(hdr, []byte(idxHdrPrefix))
+	if !ok {
+		return nil, 0, errInvalidIndexHdr
+	}
+	fields := strings.Fields(string(rest))
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, 0, errInvalidIndexHdr
+	}
+	name := fields[0]
+	size, err := strconv.Atoi(fields[1])
+	var gen int64
+	if err == nil && len(fields) == 3 {
+		gen, err = strconv.ParseInt(fields[2], 10, 64)
+	}
+	if err != nil {
+		return nil, 0, errInvalidIndexHdr
+	}
+	if name != store.hashName() || size != sha1.Size {
+		return nil, 0, fmt.Errorf("%w: ids are %s of %d bytes, expected %s of %d bytes", ErrHashMismatch, name, size, store.hashName(), sha1.Size)
+	}
+	return hdr, gen, nil
+}
+
+// upgradeIndexHeader replaces header of index file written by old versions,
+// which doesn't say what hash ids are, with the current one, so that
+// opening the store with a different hash fails from now on. It changes
+// positions of records so it's a new generation. Called when opening the
+// store for writing, after reading the index
+func (store *Store) upgradeIndexHeader() error {
+	if !bytes.Equal(store.idxHdr, idxHdrV1) {
+		return nil
+	}
+	path := idxFilePath(store.basePath)
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gen := store.idxGen + 1
+	hdr := store.newIndexHeader(gen)
+	oldSize := int64(len(store.idxHdr))
+	h := crc32.New(crcTable)
+	err = writeFileAtomically(path, func(w io.Writer) error {
+		w = io.MultiWriter(w, h)
+		if _, err := w.Write(hdr); err != nil {
+			return err
+		}
+		// only the part of the index we've read, the rest is discarded
+		_, err := io.Copy(w, io.NewSectionReader(file, oldSize, store.idxOffset-oldSize))
+		return err
+	})
+	if err == nil {
+		err = syncDir(filepath.Dir(store.basePath))
+	}
+	if err != nil {
+		return err
+	}
+	store.idxHdr = hdr
+	store.idxGen = gen
+	store.idxOffset += int64(len(hdr)) - oldSize
+	store.idxCrc = h.Sum32()
+	return nil
+}
+
+// appendRecordFrame appends payload, framed as a record, to dst
+func appendRecordFrame(dst, payload []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, payload...)
+	return binary.LittleEndian.AppendUint32(dst, crc32.Checksum(payload, crcTable))
+}
+
+// appendBlobRecord appends framed record for the blob to dst
+func appendBlobRecord(dst []byte, codec IndexCodec, blob *blob) []byte {
+	if blob.created != 0 {
+		return appendBlobRecordType(dst, codec, recBlobCreated, blob)
+	}
+	return appendBlobRecordType(dst, codec, recBlob, blob)
+}
+
+// appendMoveRecord appends framed record for the blob that was moved to dst
+func appendMoveRecord(dst []byte, codec IndexCodec, blob *blob) []byte {
+	return appendBlobRecordType(dst, codec, recMove, blob)
+}
+
+func appendBlobRecordType(dst []byte, codec IndexCodec, typ byte, blob *blob) []byte {
+	rec := IndexRecord{
+		Sha1:    blob.sha1,
+		Segment: blob.nSegment,
+		Offset:  blob.offset,
+		Size:    blob.size,
+		Extra:   blob.extra,
+	}
+	var buf [64]byte
+	payload := append(buf[:0], typ)
+	if typ != recBlob {
+		payload = binary.AppendUvarint(payload, uint64(blob.created))
+	}
+	payload = codec.AppendRecord(payload, &rec)
+	return appendRecordFrame(dst, payload)
+}
+
+// appendDeleteRecord appends framed record deleting blob with sha1 to dst
+func appendDeleteRecord(dst []byte, sha1 [20]byte) []byte {
+	var buf [21]byte
+	buf[0] = recDelete
+	copy(buf[1:], sha1[:])
+	return appendRecordFrame(dst, buf[:])
+}
+
+// decodeRecord decodes blob or delete record. For delete record only sha1
+// of the blob is set and deleted is true
+func decodeRecord(codec IndexCodec, payload []byte) (blob blob, deleted bool, err error) {
+	if len(payload) > 0 && payload[0] == recDelete {
+		if len(payload) != 1+len(blob.sha1) {
+			return blob, false, errCorruptRecord
+		}
+		copy(blob.sha1[:], payload[1:])
+		return blob, true, nil
+	}
+	blob, err = decodeBlobRecord(codec, payload)
+	return blob, false, err
+}
+
+// isMoveRecord returns true if payload is a move record. Its blob replaces
+// the previous blob with the same sha1
+func isMoveRecord(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == recMove
+}
+
+func decodeBlobRecord(codec IndexCodec, payload []byte) (blob blob, err error) {
+	if len(payload) < 1 || (payload[0] != recBlob && payload[0] != recBlobCreated && payload[0] != recMove) {
+		return blob, errCorruptRecord
+	}
+	d := payload[1:]
+	if payload[0] != recBlob {
+		created, n := binary.Uvarint(d)
+		if n <= 0 {
+			return blob, errCorruptRecord
+		}
+		blob.created = int64(created)
+		d = d[n:]
+	}
+	var rec IndexRecord
+	if err = codec.DecodeRecord(d, &rec); err != nil {
+		return blob, errCorruptRecord
+	}
+	blob.sha1 = rec.Sha1
+	blob.nSegment = rec.Segment
+	blob.offset = rec.Offset
+	blob.size = rec.Size
+	if len(rec.Extra) > 0 {
+		// rec.Extra points into payload, which is re-used
+		blob.extra = bytes.Clone(rec.Extra)
+	}
+	return blob, nil
+}
+
+// countRecordFrames returns approximate number of records in d, for
+// reporting how many records were discarded during recovery
+func countRecordFrames(d []byte) int {
+	n := 0
+	for len(d) > 0 {
+		n++
+		if len(d) < 4 {
+			break
+		}
+		size := uint64(binary.LittleEndian.Uint32(d)) + 8
+		if size > uint64(len(d)) {
+			break
+		}
+		d = d[size:]
+	}
+	return n
+}
+
+type journalReader struct {
+	r *bufio.Reader
+	// offset of the end of the last valid record
+	offset int64
+	// crc32 of the journal up to offset, including the header
+	crc uint32
+}
+
+// next returns payload of the next record. Returns io.EOF at the end
+// of the journal
+func (jr *journalReader) next() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(jr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTornRecord
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[:])
+	if size > maxRecordPayload {
+		return nil, errCorruptRecord
+	}
+	d := make([]byte, size+4)
+	if _, err := io.ReadFull(jr.r, d); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTornRecord
+		}
+		return nil, err
+	}
+	payload := d[:size]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(d[size:]) {
+		return nil, errCorruptRecord
+	}
+	jr.offset += 8 + int64(size)
+	jr.crc = crc32.Update(jr.crc, crcTable, hdr[:])
+	jr.crc = crc32.Update(jr.crc, crcTable, d)
+	return payload, nil
+}
@@ -0,0 +1,122 @@
+package contentstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Large files are stored as chunks (regular blobs) and a manifest blob
+// that lists ids of the chunks. The id of a large file is the id of its
+// manifest. This way the size of a file isn't limited by available memory
+// and identical chunks of different files are stored only once.
+//
+// Manifest is a text file:
+//
+//	github.com/kjk/contentstore manifest 1.0
+//	<id of chunk> <size of chunk>
+//	...
+
+var (
+	errInvalidManifest = errors.New("invalid manifest")
+	// first line of manifest
+	manifestHdr = "github.com/kjk/contentstore manifest 1.0"
+)
+
+const (
+	largeChunkSize = 1024 * 1024
+)
+
+type manifestChunk struct {
+	id   string
+	size int64
+}
+
+// PutLarge stores data read from r, in chunks, and returns id to use with
+// GetLarge()
+func (store *Store) PutLarge(r io.Reader) (string, error) {
+	var manifest bytes.Buffer
+	manifest.WriteString(manifestHdr + "\n")
+	buf := make([]byte, largeChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		id, putErr := store.Put(buf[:n])
+		if putErr != nil {
+			return "", putErr
+		}
+		fmt.Fprintf(&manifest, "%s %d\n", id, n)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	return store.Put(manifest.Bytes())
+}
+
+func parseManifest(d []byte) ([]manifestChunk, error) {
+	lines := strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+	if lines[0] != manifestHdr {
+		return nil, errInvalidManifest
+	}
+	var chunks []manifestChunk
+	for _, line := range lines[1:] {
+		id, sizeStr, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, errInvalidManifest
+		}
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			return nil, errInvalidManifest
+		}
+		chunks = append(chunks, manifestChunk{id: id, size: size})
+	}
+	return chunks, nil
+}
+
+// largeReader reads chunks of a large file one by one
+type largeReader struct {
+	store  *Store
+	chunks []manifestChunk
+	curr   *bytes.Reader
+}
+
+func (lr *largeReader) Read(p []byte) (int, error) {
+	for lr.curr == nil || lr.curr.Len() == 0 {
+		if len(lr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := lr.chunks[0]
+		lr.chunks = lr.chunks[1:]
+		d, err := lr.store.Get(chunk.id)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(d)) != chunk.size {
+			return 0, errInvalidManifest
+		}
+		lr.curr = bytes.NewReader(d)
+	}
+	return lr.curr.Read(p)
+}
+
+// GetLarge returns reader for a file stored with PutLarge(). Only one chunk
+// at a time is kept in memory
+func (store *Store) GetLarge(id string) (io.Reader, error) {
+	d, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := parseManifest(d)
+	if err != nil {
+		return nil, err
+	}
+	return &largeReader{store: store, chunks: chunks}, nil
+}
@@ -0,0 +1,118 @@
+package contentstore
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// When stores of a Router change (e.g. a disk is added or removed), blobs
+// have to be moved to the store where the router now looks for them.
+// MoveFrom() reads blobs from a store of the old setup, writes each of them
+// to the store of the router where it belongs, reads it back to verify it
+// and removes it from the old store. It goes through blobs in the order of
+// the index of the old store (see Changes()) so it can be resumed from the
+// position it reported last. Blobs that were already moved are skipped
+// because they're no longer in the old store. If the index of the old store
+// was rewritten since, it starts from the beginning, which is slower but
+// doesn't miss blobs.
+
+const (
+	// number of blobs moved between reporting progress
+	moveBatchSize = 256
+)
+
+// MoveOptions configures Router.MoveFrom()
+type MoveOptions struct {
+	// position in the index of the source store (see Changes()) to continue
+	// from, as reported by Progress. The zero Cursor starts from the
+	// beginning
+	After Cursor
+	// if not nil, called after moving each batch of blobs
+	Progress func(MoveProgress)
+	// limits reading from the source store to this many bytes per second.
+	// 0 means unlimited
+	MaxBytesPerSec int64
+	// if true, blobs are copied and not removed from the source store
+	Keep bool
+}
+
+// MoveProgress describes what Router.MoveFrom() did so far
+type MoveProgress struct {
+	// pass it as MoveOptions.After to continue from here
+	Position Cursor
+	// blobs moved and their total size
+	Moved      int
+	MovedBytes int64
+	// blobs that were already in the right store
+	Skipped int
+}
+
+// MoveFrom moves blobs from src to stores of the router where they belong.
+// src can be one of the stores of the router
+func (r *Router) MoveFrom(src *Store, opts MoveOptions) (MoveProgress, error) {
+	t := newThrottle(opts.MaxBytesPerSec)
+	res := MoveProgress{Position: opts.After}
+	for {
+		ids, next, err := src.Changes(res.Position, moveBatchSize)
+		if err != nil {
+			return res, err
+		}
+		if len(ids) == 0 {
+			return res, nil
+		}
+		for _, id := range ids {
+			if err = r.moveBlob(src, id, t, opts.Keep, &res); err != nil {
+				return res, err
+			}
+		}
+		res.Position = next
+		if opts.Progress != nil {
+			opts.Progress(res)
+		}
+	}
+}
+
+// moveBlob moves blob with a given id from src to the store where it
+// belongs, if it's not there
+func (r *Router) moveBlob(src *Store, id string, t *throttle, keep bool, res *MoveProgress) error {
+	sha1, _ := sha1FromId(id)
+	dst := r.storeFor(sha1)
+	if dst == Storer(src) {
+		res.Skipped++
+		return nil
+	}
+	d, err := src.Get(id)
+	if err == ErrNotFound {
+		// deleted or already moved
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.done(len(d))
+	if src.sha1Of(d) != sha1 {
+		return fmt.Errorf("blob %s in source store is corrupted", id)
+	}
+	dstId, err := dst.Put(d)
+	if err != nil {
+		return err
+	}
+	if dstId != id {
+		return fmt.Errorf("store returned id %s, expected %s", dstId, id)
+	}
+	stored, err := dst.Get(id)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, d) {
+		return fmt.Errorf("blob %s wasn't stored correctly", id)
+	}
+	if !keep {
+		if err = src.Delete(id); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	res.Moved++
+	res.MovedBytes += int64(len(d))
+	return nil
+}
@@ -0,0 +1,156 @@
+package contentstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Pack() writes a copy of the store that only depends on the set of blobs
+// in it: blobs are written in order of their ids, to segments of a given
+// size, and without the time they were added. Packing stores with the same
+// blobs gives byte-identical files, so packed stores can be content-hashed
+// and cached by build systems.
+//
+// Only blobs are copied. Refs, sha256 ids, access counts and other files
+// are not. Encrypted stores can't be packed because encrypting the same
+// content twice gives different bytes.
+
+var (
+	errPackEncrypted = errors.New("encrypted stores can't be packed")
+)
+
+const (
+	// number of blobs we take from the index at once
+	packBatchSize = 4096
+)
+
+// Pack writes blobs of the store to a new store at dstBasePath, with
+// segment files of maxSegmentSize. The result only depends on the blobs,
+// not on the order in which they were added or when. Blobs added or deleted
+// while it runs might or might not be included
+func (store *Store) Pack(dstBasePath string, maxSegmentSize int) error {
+	if store.aead != nil {
+		return errPackEncrypted
+	}
+	if StoreExists(dstBasePath) {
+		return errStoreExists
+	}
+	var segment *os.File
+	defer func() {
+		closeFilePtr(&segment)
+	}()
+	nSegment := 0
+	segmentSize := 0
+	// the index is written last so that we don't leave a store behind if
+	// we fail
+	var idx []byte
+	nBlobs := 0
+	var after *[20]byte
+	for {
+		store.Lock()
+		blobs := store.index.after(after, packBatchSize)
+		store.Unlock()
+		for i := range blobs {
+			d, err := store.readPacked(&blobs[i])
+			if err != nil {
+				return err
+			}
+			if d == nil {
+				// deleted since
+				continue
+			}
+			if segment == nil {
+				segment, err = openFile(segmentFilePath(dstBasePath, nSegment), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+				if err != nil {
+					return err
+				}
+			}
+			if _, err = segment.Write(d); err != nil {
+				return err
+			}
+			packed := blob{
+				sha1:     blobs[i].sha1,
+				nSegment: nSegment,
+				offset:   segmentSize,
+				size:     len(d),
+				extra:    blobs[i].extra,
+			}
+			idx = appendBlobRecord(idx, store.indexCodec, &packed)
+			nBlobs++
+			segmentSize += len(d)
+			if segmentSize >= maxSegmentSize {
+				// sealed, like the writer does it
+				if err = syncAndClose(&segment); err != nil {
+					return err
+				}
+				nSegment++
+				segmentSize = 0
+			}
+		}
+		if len(blobs) < packBatchSize {
+			break
+		}
+		after = &blobs[len(blobs)-1].sha1
+	}
+	if err := syncAndClose(&segment); err != nil {
+		return err
+	}
+	hdr := store.newIndexHeader(0)
+	err := writeFileAtomically(idxFilePath(dstBasePath), func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, 64*1024)
+		bw.Write(hdr)
+		bw.Write(idx)
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	crc := crc32.Checksum(hdr, crcTable)
+	cp := checkpoint{
+		nBlobs:     nBlobs,
+		idxSize:    int64(len(hdr) + len(idx)),
+		idxRecords: nBlobs,
+		idxCrc:     crc32.Update(crc, crcTable, idx),
+		clean:      true,
+	}
+	if err = writeCheckpoint(dstBasePath, cp); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dstBasePath))
+}
+
+// readPacked reads content of the blob for Pack() and checks that it
+// matches its sha1. Returns nil if the blob was deleted
+func (store *Store) readPacked(b *blob) ([]byte, error) {
+	store.Lock()
+	defer store.Unlock()
+	curr, ok := store.index.find(b.sha1)
+	if !ok {
+		return nil, nil
+	}
+	d, err := store.readBlob(curr)
+	if err != nil {
+		return nil, err
+	}
+	if store.sha1Of(d) != curr.sha1 {
+		return nil, fmt.Errorf("blob %x in segment %d is corrupted", curr.sha1, curr.nSegment)
+	}
+	return d, nil
+}
+
+// syncAndClose syncs and closes *filePtr, if it's not nil
+func syncAndClose(filePtr **os.File) error {
+	if *filePtr == nil {
+		return nil
+	}
+	err := (*filePtr).Sync()
+	if closeErr := closeFilePtr(filePtr); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package contentstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Policy describes which blobs are removed automatically by the store.
+// A background goroutine (the maintainer) applies it every Interval, starting
+// Interval after opening the store.
+//
+// When a rule based on size (MaxTotalSize or MinFreeDisk) requires removing
+// blobs, least recently used blobs are removed first. Last use is the last
+// read if the store counts reads (see WithAccessCounts()) and the time the
+// blob was added otherwise.
+//
+// Space used by removed blobs in segment files isn't returned to the OS
+// right away (unless the store punches holes, see WithPunchHoles()).
+// MinFreeDisk counts the part of it that automatic compaction (see
+// WithAutoCompaction()) will reclaim as free so that we don't remove more
+// blobs than needed.
+type Policy struct {
+	// remove blobs added more than MaxAge ago. Blobs added by old versions
+	// of Store, which don't record when a blob was added, are kept
+	MaxAge time.Duration
+	// remove blobs when their total size exceeds MaxTotalSize
+	MaxTotalSize int64
+	// remove blobs when free space on the disk with the store is less
+	// than MinFreeDisk
+	MinFreeDisk int64
+	// if set, blobs for which it returns true are never removed. Blobs
+	// pointed to by refs (see SetRef()) are never removed either
+	Pinned func(id string) bool
+	// how often the policy is applied. Defaults to 1 minute
+	Interval time.Duration
+}
+
+const (
+	defaultPolicyInterval = time.Minute
+)
+
+// WithPolicy makes the store remove blobs according to policy
+func WithPolicy(policy Policy) Option {
+	return func(store *Store) {
+		if policy.Interval <= 0 {
+			policy.Interval = defaultPolicyInterval
+		}
+		store.policy = &policy
+	}
+}
+
+// EvictResult describes blobs removed by ApplyPolicy()
+type EvictResult struct {
+	Ids []string
+	// total size of removed blobs
+	Size int64
+}
+
+// policyCandidate is a blob that can be removed by the policy
+type policyCandidate struct {
+	blob blob
+	// unix seconds of last read or, if not known, of adding the blob
+	lastUsed int64
+}
+
+// ApplyPolicy removes blobs according to the policy set with WithPolicy().
+// It's called periodically by the store but can also be called directly
+func (store *Store) ApplyPolicy() (*EvictResult, error) {
+	res := &EvictResult{}
+	policy := store.policy
+	if policy == nil || store.readOnly {
+		return res, nil
+	}
+	// so that refs don't change while we remove blobs
+	refs, err := store.lockedRefs()
+	if err != nil {
+		return res, err
+	}
+	defer store.refs.mu.Unlock()
+	referenced := refsSha1s(refs)
+	var candidates []policyCandidate
+	store.Lock()
+	blobsSize := store.blobsSize
+	store.index.forEach(func(blob *blob) {
+		c := policyCandidate{blob: *blob, lastUsed: blob.created}
+		if store.access != nil {
+			if lastRead := store.access.hits[blob.sha1].lastRead; lastRead > c.lastUsed {
+				c.lastUsed = lastRead
+			}
+		}
+		candidates = append(candidates, c)
+	})
+	store.Unlock()
+
+	var toRemove [][20]byte
+	remove := func(blob *blob) {
+		toRemove = append(toRemove, blob.sha1)
+		res.Ids = append(res.Ids, fmt.Sprintf("%x", blob.sha1[:]))
+		res.Size += int64(blob.size)
+	}
+	// blobs that are not removed by age are candidates for removal by size
+	bySize := candidates[:0]
+	var minCreated int64
+	if policy.MaxAge > 0 {
+		minCreated = time.Now().Add(-policy.MaxAge).Unix()
+	}
+	for _, c := range candidates {
+		if referenced[c.blob.sha1] {
+			continue
+		}
+		if policy.Pinned != nil && policy.Pinned(fmt.Sprintf("%x", c.blob.sha1[:])) {
+			continue
+		}
+		if c.blob.created != 0 && c.blob.created < minCreated {
+			remove(&c.blob)
+			continue
+		}
+		bySize = append(bySize, c)
+	}
+
+	// how many more bytes we need to remove
+	var excess int64
+	if policy.MaxTotalSize > 0 {
+		excess = blobsSize - res.Size - policy.MaxTotalSize
+	}
+	if policy.MinFreeDisk > 0 {
+		free, err := freeDiskSpace(filepath.Dir(store.basePath))
+		if err != nil {
+			return res, err
+		}
+		dead, err := store.reclaimableSpace()
+		if err != nil {
+			return res, err
+		}
+		if need := policy.MinFreeDisk - free - dead - res.Size; need > excess {
+			excess = need
+		}
+	}
+	if excess > 0 {
+		sort.Slice(bySize, func(i, j int) bool {
+			return bySize[i].lastUsed < bySize[j].lastUsed
+		})
+		for i := 0; i < len(bySize) && excess > 0; i++ {
+			remove(&bySize[i].blob)
+			excess -= int64(bySize[i].blob.size)
+		}
+	}
+	if len(toRemove) == 0 {
+		return res, nil
+	}
+	_, err = store.deleteSha1s(toRemove)
+	return res, err
+}
+
+// reclaimableSpace returns how much space used by removed blobs in segment
+// files automatic compaction will return to the OS, which is only space in
+// segments it compacts. Stores that punch holes return it right away, so
+// it's already free
+func (store *Store) reclaimableSpace() (int64, error) {
+	if store.compaction == nil || store.punchHoles {
+		return 0, nil
+	}
+	segments, err := store.segmentsToCompact(store.compaction)
+	if err != nil || len(segments) == 0 {
+		return 0, err
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		return 0, err
+	}
+	var dead int64
+	for _, nSegment := range segments {
+		seg := stats.Segments[nSegment]
+		dead += max(seg.FileSize-seg.BlobsSize, 0)
+	}
+	return dead, nil
+}
+
+// maintainer applies the policy, compacts the store (see compact.go) and
+// sends statistics to StatsD (see statsd.go) periodically until the store is
+// closed. It's fine if they fail, we'll try again
+func (store *Store) maintainer() {
+	defer close(store.maintainerDone)
+	var policyTick, compactionTick, statsdTick <-chan time.Time
+	if store.policy != nil {
+		ticker := time.NewTicker(store.policy.Interval)
+		defer ticker.Stop()
+		policyTick = ticker.C
+	}
+	if store.compaction != nil {
+		ticker := time.NewTicker(store.compaction.Interval)
+		defer ticker.Stop()
+		compactionTick = ticker.C
+	}
+	if store.statsd != nil {
+		// counters loaded from disk were already sent by whoever had the
+		// store open before
+		store.Lock()
+		store.statsd.dedupHits = store.dedupHits
+		store.statsd.dedupSavedBytes = store.dedupSavedBytes
+		store.Unlock()
+		defer store.closeStatsD()
+		ticker := time.NewTicker(store.statsd.cfg.Interval)
+		defer ticker.Stop()
+		statsdTick = ticker.C
+	}
+	for {
+		select {
+		case <-policyTick:
+			store.ApplyPolicy()
+		case <-compactionTick:
+			store.autoCompact()
+		case <-statsdTick:
+			store.flushStatsD()
+		case <-store.closing:
+			return
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package contentstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// values of mode for fallocate(2), from <linux/falloc.h>
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates a range of the file, without changing its size.
+// The range reads as zeros afterwards
+func punchHole(file *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocKeepSize|fallocPunchHole, offset, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package contentstore
+
+import (
+	"errors"
+	"os"
+)
+
+// punchHole is not supported on platforms other than Linux
+func punchHole(file *os.File, offset, size int64) error {
+	return errors.ErrUnsupported
+}
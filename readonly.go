@@ -0,0 +1,160 @@
+package contentstore
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// A store can be opened for writing by one process and, at the same time,
+// for reading by many processes with OpenReadOnly(). The writer only ever
+// appends to the index and, before it appends a record for a blob, the
+// data of the blob is already in the segment file. Readers learn about new
+// blobs by reading records appended to the index since they last looked
+// (tailing it). A torn record at the end of the index is one the writer is
+// in the middle of appending, so we stop there and try again later. When
+// the writer replaces the index with a smaller one (see compact.go), we
+// read it again from the start.
+//
+// The writer appends the index record of a blob before Put() returns and
+// readers tail the index when they don't find a blob. This gives
+// read-after-write consistency across processes without any other
+// coordination: once Put() returns in the writer, Get() of the blob in any
+// reader finds it. Deletes are not seen until the reader tails the index
+// for another reason, e.g. in Refresh().
+//
+// New() opens an existing store on read-only media (a DVD or an ISO image,
+// a read-only bind mount) as if with OpenReadOnly(), since it can't append
+// to the index.
+
+// OpenReadOnly opens existing store for reading, without creating or
+// modifying any files. It can be used by many processes while another
+// process has the store open for writing.
+//
+// Blobs added by the writer are picked up when Get(), Exists(), Stat() or
+// CopyTo() don't find a blob. Call Refresh() to pick them up for ForEach(),
+// List() and Stats(). Put() returns an error.
+func OpenReadOnly(basePath string, opts ...Option) (*Store, error) {
+	store := newStore(basePath, 0, opts)
+	store.readOnly = true
+	if err := store.initEncryption(); err != nil {
+		return nil, err
+	}
+	var err error
+	// we can't migrate CSV index so it has to be opened for writing first
+	if store.idxFile, err = openFile(idxFilePath(basePath), os.O_RDONLY, 0); err != nil {
+		return nil, err
+	}
+	// checkpoint is only a hint so it's fine if we can't read it
+	cp, _ := readCheckpoint(basePath)
+	if err = store.readIndex(cp); err != nil {
+		store.Close()
+		return nil, err
+	}
+	store.dedupHits = cp.dedupHits
+	store.dedupSavedBytes = cp.dedupSavedBytes
+	store.readAccessCounts()
+	if err = store.openAliases(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// isReadOnlyMedia returns true if file at path can't be written to because
+// it's on read-only media (a DVD, a read-only mount). Not having permission
+// to write it is not the same: opening the store for writing fails with
+// the error so that a misconfigured store isn't silently read-only
+func isReadOnlyMedia(path string) bool {
+	file, err := openFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		file.Close()
+		return false
+	}
+	return errors.Is(err, syscall.EROFS)
+}
+
+// ReadOnly returns true if the store was opened with OpenReadOnly() or by
+// New() on read-only media
+func (store *Store) ReadOnly() bool {
+	return store.readOnly
+}
+
+// tailIndex adds to the index blobs from records appended to index file
+// since we last read it. Must be called with store locked
+func (store *Store) tailIndex() error {
+	stat, err := store.idxFile.Stat()
+	if err != nil {
+		return err
+	}
+	if pathStat, err := os.Stat(idxFilePath(store.basePath)); err == nil && !os.SameFile(stat, pathStat) {
+		return store.reloadIndex()
+	}
+	size := stat.Size()
+	if size <= store.idxOffset {
+		return nil
+	}
+	jr := &journalReader{
+		r:      bufio.NewReader(io.NewSectionReader(store.idxFile, store.idxOffset, size-store.idxOffset)),
+		offset: store.idxOffset,
+		crc:    store.idxCrc,
+	}
+	for {
+		payload, err := jr.next()
+		if err == io.EOF || err == errTornRecord {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		blob, deleted, err := decodeRecord(store.indexCodec, payload)
+		if err != nil {
+			return err
+		}
+		store.idxRecords++
+		if deleted || isMoveRecord(payload) {
+			if blob, ok := store.index.remove(blob.sha1); ok {
+				store.blobsSize -= int64(blob.size)
+			}
+		}
+		if deleted {
+			store.idxOffset, store.idxCrc = jr.offset, jr.crc
+			continue
+		}
+		if blob.nSegment > store.currSegmentNo {
+			store.currSegmentNo = blob.nSegment
+		}
+		store.index.add(blob)
+		store.blobsSize += int64(blob.size)
+		store.idxOffset, store.idxCrc = jr.offset, jr.crc
+	}
+}
+
+// reloadIndex reads the index from scratch after the writer replaced index
+// file with a new one (see rewriteIndex()). Must be called with store locked
+func (store *Store) reloadIndex() error {
+	file, err := openFile(idxFilePath(store.basePath), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	closeFilePtr(&store.idxFile)
+	store.idxFile = file
+	store.index = newBlobIndex(store.indexMode)
+	store.blobsSize = 0
+	store.idxRecords = 0
+	return store.readIndex(checkpoint{nBlobs: -1})
+}
+
+// Refresh adds to the index blobs stored by the writer since the store was
+// opened or last refreshed. It only does something for stores opened with
+// OpenReadOnly()
+func (store *Store) Refresh() error {
+	store.Lock()
+	defer store.Unlock()
+	if !store.readOnly {
+		return nil
+	}
+	return store.tailIndex()
+}
@@ -0,0 +1,268 @@
+package contentstore
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Refs are names pointing to blobs, e.g. "site/logo" -> id of the current
+// logo. Unlike blobs they can change. They're kept in memory and saved to
+// a file, which is atomically replaced on every change. Blobs that are
+// pointed to by a ref are never removed by GC() or the policy (see
+// policy.go).
+//
+// Stores opened with OpenReadOnly() re-read the file when it changes.
+
+var (
+	// ErrInvalidRefName is returned by SetRef() for an empty name
+	ErrInvalidRefName = errors.New("invalid ref name")
+	// ErrRefChanged is returned by CompareAndSetRef() if the ref doesn't
+	// point to the expected blob
+	ErrRefChanged = errors.New("ref changed")
+
+	errInvalidRefsFile = errors.New("invalid refs file")
+	// first line in refs file
+	refsHdr = "github.com/kjk/contentstore refs 1.0"
+)
+
+// Ref is a name pointing to a blob
+type Ref struct {
+	Name string
+	Id   string
+}
+
+type refs struct {
+	// we don't use the store lock because writing the file is slow
+	mu sync.Mutex
+	m  map[string]string
+	// of the file when we read it, so that read-only stores know it changed
+	modTime time.Time
+	size    int64
+}
+
+func refsFilePath(basePath string) string {
+	return basePath + "_refs.txt"
+}
+
+func readRefs(path string) (map[string]string, error) {
+	m := make(map[string]string)
+	file, err := openFile(path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	recs, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 || len(recs[0]) != 1 || recs[0][0] != refsHdr {
+		return nil, errInvalidRefsFile
+	}
+	for _, rec := range recs[1:] {
+		if len(rec) != 2 {
+			return nil, errInvalidRefsFile
+		}
+		m[rec[0]] = rec[1]
+	}
+	return m, nil
+}
+
+func writeRefs(path string, m map[string]string) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		csvWriter := csv.NewWriter(w)
+		csvWriter.Write([]string{refsHdr})
+		for name, id := range m {
+			csvWriter.Write([]string{name, id})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	})
+}
+
+// loadRefs reads refs file if it changed since we last read it. Must be
+// called with store.refs.mu locked
+func (store *Store) loadRefs() error {
+	r := &store.refs
+	path := refsFilePath(store.basePath)
+	stat, err := os.Stat(path)
+	if err == nil && r.m != nil && stat.ModTime().Equal(r.modTime) && stat.Size() == r.size {
+		return nil
+	}
+	if err == nil {
+		r.modTime = stat.ModTime()
+		r.size = stat.Size()
+	}
+	m, err := readRefs(path)
+	if err != nil {
+		return err
+	}
+	r.m = m
+	return nil
+}
+
+// lockedRefs locks refs and returns them, up to date
+func (store *Store) lockedRefs() (map[string]string, error) {
+	store.refs.mu.Lock()
+	if store.refs.m != nil && !store.readOnly {
+		// we're the only writer
+		return store.refs.m, nil
+	}
+	if err := store.loadRefs(); err != nil {
+		store.refs.mu.Unlock()
+		return nil, err
+	}
+	return store.refs.m, nil
+}
+
+// SetRef makes name point to blob with a given id. Empty id removes the ref.
+// It returns after the change is safely on disk
+func (store *Store) SetRef(name, id string) error {
+	return store.setRef(name, id, nil)
+}
+
+// CompareAndSetRef is like SetRef() but only changes the ref if it points
+// to oldId (or, if oldId is empty, doesn't exist). Otherwise it returns
+// ErrRefChanged. This allows updating a ref safely from many goroutines
+func (store *Store) CompareAndSetRef(name, oldId, newId string) error {
+	return store.setRef(name, newId, &oldId)
+}
+
+func (store *Store) setRef(name, id string, oldId *string) error {
+	if store.readOnly {
+		return errReadOnly
+	}
+	if name == "" {
+		return ErrInvalidRefName
+	}
+	m, err := store.lockedRefs()
+	if err != nil {
+		return err
+	}
+	defer store.refs.mu.Unlock()
+	// checked with refs locked so that GC() doesn't remove the blob
+	if id != "" {
+		if _, err = store.Stat(id); err != nil {
+			return err
+		}
+		id = store.idToHex(id)
+	}
+	prev, existed := m[name]
+	if oldId != nil && prev != store.idToHex(*oldId) {
+		return ErrRefChanged
+	}
+	if id == "" {
+		delete(m, name)
+	} else {
+		m[name] = id
+	}
+	if err = writeRefs(refsFilePath(store.basePath), m); err != nil {
+		// keep memory in sync with the file
+		if existed {
+			m[name] = prev
+		} else {
+			delete(m, name)
+		}
+	}
+	return err
+}
+
+// setRefs is like SetRef() for many refs, with a single write of the file
+func (store *Store) setRefs(refs map[string]string) error {
+	if store.readOnly {
+		return errReadOnly
+	}
+	m, err := store.lockedRefs()
+	if err != nil {
+		return err
+	}
+	defer store.refs.mu.Unlock()
+	prev := make(map[string]string, len(m))
+	for name, id := range m {
+		prev[name] = id
+	}
+	for name, id := range refs {
+		if name == "" {
+			return ErrInvalidRefName
+		}
+		if _, err = store.Stat(id); err != nil {
+			return err
+		}
+	}
+	for name, id := range refs {
+		m[name] = store.idToHex(id)
+	}
+	if err = writeRefs(refsFilePath(store.basePath), m); err != nil {
+		// keep memory in sync with the file
+		clear(m)
+		for name, id := range prev {
+			m[name] = id
+		}
+	}
+	return err
+}
+
+// Ref returns id of the blob that name points to. Returns ErrNotFound if
+// there's no such ref
+func (store *Store) Ref(name string) (string, error) {
+	m, err := store.lockedRefs()
+	if err != nil {
+		return "", err
+	}
+	defer store.refs.mu.Unlock()
+	id, ok := m[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return id, nil
+}
+
+// ListRefs returns refs whose names start with prefix, sorted by name
+func (store *Store) ListRefs(prefix string) ([]Ref, error) {
+	m, err := store.lockedRefs()
+	if err != nil {
+		return nil, err
+	}
+	defer store.refs.mu.Unlock()
+	var res []Ref
+	for name, id := range m {
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, Ref{Name: name, Id: id})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// idToHex returns id in the form returned by Put() (e.g. for a CID or sha256
+// id) or id unchanged if it's not valid
+func (store *Store) idToHex(id string) string {
+	if sha1, ok := store.idToSha1(id); ok {
+		return fmt.Sprintf("%x", sha1[:])
+	}
+	return id
+}
+
+// refsSha1s returns sha1 of blobs pointed to by refs
+func refsSha1s(m map[string]string) map[[20]byte]bool {
+	res := make(map[[20]byte]bool, len(m))
+	for _, id := range m {
+		if sha1, ok := sha1FromId(id); ok {
+			res[sha1] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package contentstore
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// Two Stores writing the same files would corrupt them: each has its own
+// idea of where the current segment and the index end. We keep a registry
+// of stores opened for writing in this process, by canonical path, so that
+// opening a store twice fails with ErrAlreadyOpen or, with
+// WithSharedHandle(), returns the store that is already open. It doesn't
+// protect from other processes. Stores opened with OpenReadOnly() are not
+// registered since any number of them can be open.
+//
+// A store stays in the registry until Close() is done with its files, so
+// that it can't be opened again while the writer is still writing.
+
+var (
+	// ErrAlreadyOpen is returned when opening a store that is already open
+	// for writing in this process
+	ErrAlreadyOpen = errors.New("store is already open in this process")
+)
+
+type registeredStore struct {
+	store *Store
+	// number of handles returned with WithSharedHandle(). The store is closed
+	// when all of them are
+	refs int
+}
+
+var registry = struct {
+	mu     sync.Mutex
+	stores map[string]*registeredStore
+}{
+	stores: make(map[string]*registeredStore),
+}
+
+// WithSharedHandle makes opening a store that is already open in this
+// process return the open store instead of failing with ErrAlreadyOpen.
+// Other options and max segment size are ignored in that case. Each handle
+// must be closed and the store is closed when the last one is
+func WithSharedHandle() Option {
+	return func(store *Store) {
+		store.sharedHandle = true
+	}
+}
+
+// canonicalPath returns basePath as an absolute path with symlinks in its
+// directory resolved, so that different ways of referring to the same store
+// give the same path
+func canonicalPath(basePath string) (string, error) {
+	abs, err := filepath.Abs(basePath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		// the directory doesn't exist so creating the store will fail
+		return abs, nil
+	}
+	return filepath.Join(dir, filepath.Base(abs)), nil
+}
+
+// register adds the store to the registry. If a store with the same path
+// is already open, it returns it (with WithSharedHandle()) or ErrAlreadyOpen
+func (store *Store) register() (*Store, error) {
+	path, err := canonicalPath(store.basePath)
+	if err != nil {
+		return nil, err
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if rs := registry.stores[path]; rs != nil {
+		// the last handle is being closed
+		if !store.sharedHandle || rs.refs == 0 {
+			return nil, ErrAlreadyOpen
+		}
+		rs.refs++
+		return rs.store, nil
+	}
+	registry.stores[path] = &registeredStore{store: store, refs: 1}
+	store.registryPath = path
+	return nil, nil
+}
+
+// release removes a handle of the store and returns true if it was the last
+// one, so the store should be closed. The store stays in the registry until
+// unregister() is called
+func (store *Store) release() bool {
+	if store.registryPath == "" {
+		return true
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	rs := registry.stores[store.registryPath]
+	if rs == nil || rs.store != store || rs.refs == 0 {
+		// already closed or being closed
+		return true
+	}
+	rs.refs--
+	return rs.refs == 0
+}
+
+// unregister removes the store from the registry, after its files are
+// closed, so that it can be opened again
+func (store *Store) unregister() {
+	if store.registryPath == "" {
+		return
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if rs := registry.stores[store.registryPath]; rs != nil && rs.store == store {
+		delete(registry.stores, store.registryPath)
+	}
+}
@@ -0,0 +1,93 @@
+package contentstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Replication: a follower keeps a copy of a store (the leader) by asking
+// it for blobs added since the last time it asked. Since the index is
+// append-only, a position in the index file identifies all blobs added
+// before it and is a good cursor: it stays valid when the leader restarts.
+// It doesn't stay valid when the leader rewrites the index (see
+// CompactionPolicy.MaxIndexRecords and Compact()), which starts a new
+// generation of the index. A cursor has the generation it's for and
+// Changes() starts from the beginning when it's not the current one, so
+// followers copy all blobs again (skipping those they have) instead of
+// missing some.
+
+// Cursor is a position in the list of changes of a store (see Changes()).
+// The zero value is the beginning
+type Cursor struct {
+	// generation of the index the position is in
+	Generation int64
+	// position in the index file
+	Position int64
+}
+
+// IndexGeneration returns generation of the index. It changes when the
+// index is rewritten
+func (store *Store) IndexGeneration() int64 {
+	store.Lock()
+	defer store.Unlock()
+	return store.idxGen
+}
+
+// Changes returns ids of blobs added to the store after cursor after, in
+// the order they were added, and cursor to pass to the next call. Use the
+// zero Cursor to start from the beginning. If the index was rewritten since
+// after was returned, it starts from the beginning. Returns at most max
+// ids. It also returns blobs that were deleted since they were added.
+// Deletes aren't replicated: followers keep their copies of deleted blobs
+func (store *Store) Changes(after Cursor, max int) (ids []string, next Cursor, err error) {
+	file, err := openFile(idxFilePath(store.basePath), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, after, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, after, err
+	}
+	r := bufio.NewReader(file)
+	// generation of the file we opened, which might have been replaced
+	// since
+	hdr, gen, err := store.readIndexHeader(r)
+	if err != nil {
+		return nil, after, err
+	}
+	pos := after.Position
+	if after.Generation != gen || pos < int64(len(hdr)) {
+		pos = int64(len(hdr))
+	}
+	next = Cursor{Generation: gen, Position: pos}
+	if pos > stat.Size() {
+		return nil, next, nil
+	}
+	jr := &journalReader{
+		r:      bufio.NewReader(io.NewSectionReader(file, pos, stat.Size()-pos)),
+		offset: pos,
+	}
+	for len(ids) < max {
+		payload, err := jr.next()
+		// torn record is being written right now
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err != nil {
+			return ids, Cursor{Generation: gen, Position: jr.offset}, err
+		}
+		blob, deleted, err := decodeRecord(store.indexCodec, payload)
+		if err != nil {
+			return ids, Cursor{Generation: gen, Position: jr.offset}, err
+		}
+		// moved blobs were returned when they were added
+		if deleted || isMoveRecord(payload) {
+			continue
+		}
+		ids = append(ids, fmt.Sprintf("%x", blob.sha1[:]))
+	}
+	return ids, Cursor{Generation: gen, Position: jr.offset}, nil
+}
@@ -0,0 +1,259 @@
+package contentstore
+
+import (
+	"errors"
+	"os"
+	"sort"
+)
+
+// With WithSpaceReuse(), Put() writes new blobs over space of deleted blobs
+// in sealed segments instead of always appending to the current segment.
+// This limits growth of stores where blobs are often deleted and added,
+// without waiting for compaction to rewrite segments.
+//
+// We keep a list of holes (ranges of sealed segments not used by any blob),
+// sorted by size. It's built from the index when the store is opened and
+// deleting a blob adds a hole. For a new blob we pick the smallest hole it
+// fits in (best fit), but only if the hole isn't bigger than the blob by
+// more than the tolerance, to avoid leaving lots of small, useless holes.
+// What's left of the hole stays on the list.
+//
+// Like appended data, data written to a hole is synced before its index
+// record is written, so a crash in between leaves the hole unused.
+//
+// We don't reuse holes in a segment while:
+// - CopyTo() or GetSeeker() is reading a blob from it without the store
+//   lock, because the blob might be deleted and overwritten under it
+// - GC(), compaction or Verify() runs, because they work on a snapshot of
+//   the index and would remove or report segments with new blobs in them
+
+var (
+	errSpaceReuseIncremental = errors.New("incremental backups don't work with WithSpaceReuse()")
+)
+
+type hole struct {
+	nSegment int
+	offset   int
+	size     int
+}
+
+type spaceReuse struct {
+	// max size of hole relative to size of the blob written to it, above 1
+	maxRatio float64
+	// sorted by size, then by segment and offset
+	holes []hole
+	// number of readers of blobs in each segment
+	readers map[int]int
+	// segments with blobs written to holes and not yet committed
+	pending map[int]bool
+	// reuse is paused while it's > 0
+	paused int
+	// segment files written to by the writer since the last commit
+	files map[int]*os.File
+}
+
+// WithSpaceReuse makes Put() write new blobs over space of deleted blobs
+// when there's a hole no bigger than the blob by more than tolerance (e.g.
+// 0.1 for 10%). It changes sealed segment files, so don't use it if you
+// rely on them never changing (e.g. to rsync the store) or with
+// BackupIncremental(), which fails. Like WithPunchHoles(), don't use it if
+// other processes read the store with OpenReadOnly()
+func WithSpaceReuse(tolerance float64) Option {
+	return func(store *Store) {
+		store.reuse = &spaceReuse{
+			maxRatio: 1 + tolerance,
+			readers:  make(map[int]int),
+			pending:  make(map[int]bool),
+			files:    make(map[int]*os.File),
+		}
+	}
+}
+
+// less orders holes by size, segment and offset
+func (h *hole) less(other *hole) bool {
+	if h.size != other.size {
+		return h.size < other.size
+	}
+	if h.nSegment != other.nSegment {
+		return h.nSegment < other.nSegment
+	}
+	return h.offset < other.offset
+}
+
+// add adds a hole to the list
+func (r *spaceReuse) add(h hole) {
+	if h.size <= 0 {
+		return
+	}
+	i := sort.Search(len(r.holes), func(i int) bool {
+		return !r.holes[i].less(&h)
+	})
+	r.holes = append(r.holes, hole{})
+	copy(r.holes[i+1:], r.holes[i:])
+	r.holes[i] = h
+}
+
+// take removes from the list the smallest hole, in a segment before
+// nSealed, that fits size bytes within tolerance and returns the part of
+// it used for them
+func (r *spaceReuse) take(size int, nSealed int) (hole, bool) {
+	if r.paused > 0 || size == 0 {
+		return hole{}, false
+	}
+	maxSize := int(float64(size) * r.maxRatio)
+	i := sort.Search(len(r.holes), func(i int) bool {
+		return r.holes[i].size >= size
+	})
+	for ; i < len(r.holes) && r.holes[i].size <= maxSize; i++ {
+		h := r.holes[i]
+		if h.nSegment >= nSealed || r.readers[h.nSegment] > 0 {
+			continue
+		}
+		r.holes = append(r.holes[:i], r.holes[i+1:]...)
+		r.add(hole{nSegment: h.nSegment, offset: h.offset + size, size: h.size - size})
+		r.pending[h.nSegment] = true
+		return hole{nSegment: h.nSegment, offset: h.offset, size: size}, true
+	}
+	return hole{}, false
+}
+
+// removeSegments forgets holes in removed segments
+func (r *spaceReuse) removeSegments(removed map[int]bool) {
+	holes := r.holes[:0]
+	for _, h := range r.holes {
+		if !removed[h.nSegment] {
+			holes = append(holes, h)
+		}
+	}
+	r.holes = holes
+}
+
+// findHoles builds the list of holes in sealed segments from the index.
+// Called when opening the store
+func (store *Store) findHoles() error {
+	r := store.reuse
+	if r == nil {
+		return nil
+	}
+	nSealed := store.currSegmentNo
+	segments := make([][]blob, nSealed)
+	store.index.forEach(func(blob *blob) {
+		if blob.nSegment < nSealed {
+			segments[blob.nSegment] = append(segments[blob.nSegment], *blob)
+		}
+	})
+	for nSegment, blobs := range segments {
+		stat, err := os.Stat(segmentFilePath(store.basePath, nSegment))
+		if os.IsNotExist(err) {
+			// removed by GC() or compaction
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		sort.Slice(blobs, func(i, j int) bool {
+			return blobs[i].offset < blobs[j].offset
+		})
+		offset := 0
+		for _, blob := range blobs {
+			r.add(hole{nSegment: nSegment, offset: offset, size: blob.offset - offset})
+			offset = max(offset, blob.offset+blob.size)
+		}
+		r.add(hole{nSegment: nSegment, offset: offset, size: int(stat.Size()) - offset})
+	}
+	return nil
+}
+
+// pauseReuse stops reusing holes until the returned function is called
+func (store *Store) pauseReuse() func() {
+	if store.reuse == nil {
+		return func() {}
+	}
+	store.Lock()
+	store.reuse.paused++
+	store.Unlock()
+	return func() {
+		store.Lock()
+		store.reuse.paused--
+		store.Unlock()
+	}
+}
+
+// startReading prevents reuse of holes in segment while a blob is read from
+// it without the store lock. Must be called with store locked
+func (store *Store) startReading(nSegment int) {
+	if store.reuse != nil {
+		store.reuse.readers[nSegment]++
+	}
+}
+
+// doneReading undoes startReading()
+func (store *Store) doneReading(nSegment int) {
+	if store.reuse == nil {
+		return
+	}
+	store.Lock()
+	if store.reuse.readers[nSegment]--; store.reuse.readers[nSegment] <= 0 {
+		delete(store.reuse.readers, nSegment)
+	}
+	store.Unlock()
+}
+
+// writeToHole writes data of a new blob to a hole, if there's one that
+// fits it, and adds it to blobs committed by the next commit(). Returns
+// false if there isn't. Only called by writer goroutine
+func (store *Store) writeToHole(req *putRequest, created int64) bool {
+	r := store.reuse
+	if r == nil || req.file != nil {
+		return false
+	}
+	store.Lock()
+	h, ok := r.take(len(req.d), store.currSegmentNo)
+	store.Unlock()
+	if !ok {
+		return false
+	}
+	file := r.files[h.nSegment]
+	var err error
+	if file == nil {
+		file, err = openFile(segmentFilePath(store.basePath, h.nSegment), os.O_WRONLY, 0)
+		if err == nil {
+			r.files[h.nSegment] = file
+		}
+	}
+	if err == nil {
+		_, err = file.WriteAt(req.d, int64(h.offset))
+	}
+	if err != nil {
+		// the hole is lost until the store is opened again
+		store.finish(req, err)
+		return true
+	}
+	store.pending = append(store.pending, req)
+	store.pendingBlobs = append(store.pendingBlobs, blob{
+		sha1:     req.sha1,
+		nSegment: h.nSegment,
+		offset:   h.offset,
+		size:     h.size,
+		created:  created,
+		extra:    req.extra,
+	})
+	return true
+}
+
+// syncHoles syncs and closes segment files written to by writeToHole().
+// Only called by writer goroutine
+func (store *Store) syncHoles() error {
+	if store.reuse == nil {
+		return nil
+	}
+	var err error
+	for nSegment, file := range store.reuse.files {
+		if syncErr := file.Sync(); err == nil {
+			err = syncErr
+		}
+		file.Close()
+		delete(store.reuse.files, nSegment)
+	}
+	return err
+}
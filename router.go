@@ -0,0 +1,91 @@
+package contentstore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Router is a Storer that spreads blobs across several stores (e.g. on
+// different disks or hosts) by their id, so that one logical store can be
+// bigger than a single volume. A blob always goes to the same store, so
+// when the stores, or their order, change, blobs have to be moved with
+// MoveFrom() (see migrate.go).
+//
+// The router calculates ids itself so the stores must use ids returned by
+// Put() of Store (i.e. not WithGitObjects()).
+
+var (
+	errNoStores = errors.New("router needs at least one store")
+)
+
+// Router spreads blobs across stores
+type Router struct {
+	stores []Storer
+}
+
+// NewRouter returns a router over stores
+func NewRouter(stores ...Storer) (*Router, error) {
+	if len(stores) == 0 {
+		return nil, errNoStores
+	}
+	return &Router{stores: stores}, nil
+}
+
+// storeFor returns the store that has blob with a given sha1
+func (r *Router) storeFor(sha1 [20]byte) Storer {
+	n := binary.BigEndian.Uint32(sha1[:4])
+	return r.stores[n%uint32(len(r.stores))]
+}
+
+// Put stores d in one of the stores
+func (r *Router) Put(d []byte) (string, error) {
+	sum := sha1.Sum(d)
+	id, err := r.storeFor(sum).Put(d)
+	if err != nil {
+		return "", err
+	}
+	if expected := fmt.Sprintf("%x", sum[:]); id != expected {
+		return "", fmt.Errorf("store returned id %s, expected %s", id, expected)
+	}
+	return id, nil
+}
+
+// Get returns content of the blob
+func (r *Router) Get(id string) ([]byte, error) {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return nil, ErrInvalidId
+	}
+	return r.storeFor(sha1).Get(id)
+}
+
+// Exists returns true if blob is in the store
+func (r *Router) Exists(id string) bool {
+	sha1, ok := sha1FromId(id)
+	return ok && r.storeFor(sha1).Exists(id)
+}
+
+// Stat returns information about the blob
+func (r *Router) Stat(id string) (BlobInfo, error) {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		return BlobInfo{}, ErrInvalidId
+	}
+	return r.storeFor(sha1).Stat(id)
+}
+
+// Close closes all stores
+func (r *Router) Close() error {
+	var err error
+	for _, store := range r.stores {
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// make sure Router implements Storer
+var _ Storer = (*Router)(nil)
@@ -0,0 +1,70 @@
+package contentstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Signed URLs allow sharing a blob with someone who doesn't have a token,
+// for a limited time. URL has expiration time and HMAC-SHA256 signature of
+// the id and expiration time, made with a key only the server knows:
+// /blobs/<id>?exp=<unix time>&sig=<hex signature>
+
+var (
+	errSignatureExpired = errors.New("signature expired")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+func blobSignature(key []byte, id string, exp int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "\n" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignBlobPath returns path of the blob with signature that allows reading
+// it without a token until expires, when served by Handler with the same
+// key set with SetSigningKey()
+func SignBlobPath(key []byte, id string, expires time.Time) string {
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", blobSignature(key, id, exp))
+	return blobsPath + "/" + id + "?" + q.Encode()
+}
+
+// VerifyBlobSignature returns nil if query of a request for blob id has
+// a valid signature that didn't expire
+func VerifyBlobSignature(key []byte, id string, query url.Values) error {
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil {
+		return errInvalidSignature
+	}
+	expected, _ := hex.DecodeString(blobSignature(key, id, exp))
+	if !hmac.Equal(sig, expected) {
+		return errInvalidSignature
+	}
+	if time.Now().Unix() > exp {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+// SetSigningKey makes the handler allow reading blobs without a token with
+// URLs signed with key (see SignBlobPath()). nil disables it. Can be
+// called while serving requests
+func (h *Handler) SetSigningKey(key []byte) {
+	if len(key) == 0 {
+		h.signingKey.Store(nil)
+		return
+	}
+	h.signingKey.Store(&key)
+}
@@ -0,0 +1,71 @@
+package contentstore
+
+// Hard limits on total size of blobs (WithQuota() and MaxTotalSize of
+// Policy) are only noticed when Put()s start failing or blobs are removed.
+// WithSoftLimit() lets the application know earlier, e.g. to alert or to
+// start its own cleanup. The writer checks the limits after it adds or
+// deletes blobs, before Put() or Delete() return, and calls the callback
+// when total size goes over a soft limit. It's called again only after
+// total size goes below it.
+
+// SoftLimitKind tells which limit a soft limit is for
+type SoftLimitKind int
+
+const (
+	// SoftLimitQuota is for the limit set with WithQuota()
+	SoftLimitQuota SoftLimitKind = iota
+	// SoftLimitMaxTotalSize is for MaxTotalSize of the policy set with
+	// WithPolicy()
+	SoftLimitMaxTotalSize
+)
+
+// SoftLimit describes total size of blobs going over a soft limit
+type SoftLimit struct {
+	Kind SoftLimitKind
+	// total size of blobs
+	Size int64
+	// the hard limit
+	Max int64
+}
+
+type softLimits struct {
+	// soft limit relative to the hard limit, between 0 and 1
+	ratio float64
+	fn    func(SoftLimit)
+	// limits we're over. Only used by writer goroutine
+	over [2]bool
+}
+
+// WithSoftLimit makes the store call fn when total size of blobs goes over
+// ratio (e.g. 0.8 for 80%) of the quota or of MaxTotalSize of the policy.
+// fn is called once per crossing, from the writer goroutine, so it
+// shouldn't block for long and can't add or delete blobs. If the store is
+// over the soft limit when it's opened, fn is called right away
+func WithSoftLimit(ratio float64, fn func(SoftLimit)) Option {
+	return func(store *Store) {
+		store.softLimits = &softLimits{ratio: ratio, fn: fn}
+	}
+}
+
+// checkSoftLimits calls the callback set with WithSoftLimit() for limits
+// that total size of blobs went over. Only called by writer goroutine
+func (store *Store) checkSoftLimits() {
+	sl := store.softLimits
+	if sl == nil {
+		return
+	}
+	store.Lock()
+	size := store.blobsSize
+	store.Unlock()
+	limits := [2]int64{SoftLimitQuota: store.quota}
+	if store.policy != nil {
+		limits[SoftLimitMaxTotalSize] = store.policy.MaxTotalSize
+	}
+	for kind, limit := range limits {
+		over := limit > 0 && float64(size) >= sl.ratio*float64(limit)
+		if over && !sl.over[kind] {
+			sl.fn(SoftLimit{Kind: SoftLimitKind(kind), Size: size, Max: limit})
+		}
+		sl.over[kind] = over
+	}
+}
@@ -0,0 +1,97 @@
+package contentstore
+
+import (
+	"os"
+)
+
+// Stats describes the content of the store
+type Stats struct {
+	// number of blobs and their total size
+	Blobs     int
+	BlobsSize int64
+	// size of index file
+	IndexSize int64
+	// size of all segment files. Can be bigger than BlobsSize if there
+	// were failed writes
+	SegmentsSize int64
+	Segments     []SegmentStats
+	// number of Put()s of content that was already in the store and how many
+	// bytes we didn't have to write thanks to that. They're saved when the
+	// store is closed so they can be lower than the real numbers if the
+	// process crashed
+	DedupHits       int
+	DedupSavedBytes int64
+	// statistics of PutWithSource() since the store was opened, by source
+	Sources map[string]SourceStats
+}
+
+// SourceStats describes Put()s done with PutWithSource() for a source
+type SourceStats struct {
+	// number of Put()s and total size of their content
+	Puts  int
+	Bytes int64
+	// how many of them were of content that was already in the store and
+	// how many bytes we didn't have to write thanks to that
+	DedupHits       int
+	DedupSavedBytes int64
+}
+
+// SegmentStats describes a segment file
+type SegmentStats struct {
+	No int
+	// number of blobs in the segment and their total size
+	Blobs     int
+	BlobsSize int64
+	// size of segment file
+	FileSize int64
+	// true if segment file with blobs doesn't exist. Segment files without
+	// blobs are removed by GC()
+	Missing bool
+}
+
+// Stats returns information about the content of the store
+func (store *Store) Stats() (Stats, error) {
+	store.Lock()
+	stats := Stats{
+		Blobs:           store.index.count(),
+		Segments:        make([]SegmentStats, store.currSegmentNo+1),
+		DedupHits:       store.dedupHits,
+		DedupSavedBytes: store.dedupSavedBytes,
+	}
+	if len(store.sources) > 0 {
+		stats.Sources = make(map[string]SourceStats, len(store.sources))
+		for source, s := range store.sources {
+			stats.Sources[source] = *s
+		}
+	}
+	store.index.forEach(func(blob *blob) {
+		stats.BlobsSize += int64(blob.size)
+		if blob.nSegment < len(stats.Segments) {
+			seg := &stats.Segments[blob.nSegment]
+			seg.Blobs++
+			seg.BlobsSize += int64(blob.size)
+		}
+	})
+	store.Unlock()
+
+	stat, err := os.Stat(idxFilePath(store.basePath))
+	if err != nil {
+		return stats, err
+	}
+	stats.IndexSize = stat.Size()
+	for i := range stats.Segments {
+		seg := &stats.Segments[i]
+		seg.No = i
+		stat, err = os.Stat(segmentFilePath(store.basePath, i))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return stats, err
+			}
+			seg.Missing = seg.Blobs > 0
+			continue
+		}
+		seg.FileSize = stat.Size()
+		stats.SegmentsSize += seg.FileSize
+	}
+	return stats, nil
+}
@@ -0,0 +1,118 @@
+package contentstore
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// With WithStatsD() the maintainer (see policy.go) periodically sends
+// statistics of the store to a StatsD server (or Datadog agent) over UDP,
+// for deployments where nothing scrapes Stats(). Sending is fire and
+// forget: if the server is down, metrics are lost.
+//
+// Metrics (with Prefix in front):
+// - blobs, blobs_size, segments: gauges with the current values. segments
+//   is the number of segment files
+// - dedup_hits, dedup_saved_bytes: counters, incremented by the change
+//   since the previous flush
+
+// StatsD describes where and how often statistics are sent
+type StatsD struct {
+	// host:port of the server, e.g. "127.0.0.1:8125"
+	Addr string
+	// prepended to names of metrics, e.g. "myapp.store."
+	Prefix string
+	// if set, added to each metric in DogStatsD format (e.g. "env:prod").
+	// Plain StatsD servers don't understand them
+	Tags []string
+	// how often statistics are sent. Defaults to 10 seconds
+	Interval time.Duration
+}
+
+const (
+	defaultStatsDInterval = 10 * time.Second
+)
+
+// statsdEmitter is state of sending to StatsD, only used by maintainer
+type statsdEmitter struct {
+	cfg  StatsD
+	conn net.Conn
+	// values of counters at the previous flush
+	dedupHits       int
+	dedupSavedBytes int64
+	buf             []byte
+}
+
+// WithStatsD makes the store send its statistics to a StatsD server
+func WithStatsD(cfg StatsD) Option {
+	return func(store *Store) {
+		if cfg.Interval <= 0 {
+			cfg.Interval = defaultStatsDInterval
+		}
+		store.statsd = &statsdEmitter{cfg: cfg}
+	}
+}
+
+// appendMetric appends a metric line in StatsD format to e.buf
+func (e *statsdEmitter) appendMetric(name string, value int64, typ string) {
+	e.buf = fmt.Appendf(e.buf, "%s%s:%d|%s", e.cfg.Prefix, name, value, typ)
+	for i, tag := range e.cfg.Tags {
+		if i == 0 {
+			e.buf = append(e.buf, "|#"...)
+		} else {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = append(e.buf, tag...)
+	}
+	e.buf = append(e.buf, '\n')
+}
+
+// flushStatsD sends current statistics to StatsD server. It's fine if it
+// fails, we'll try again
+func (store *Store) flushStatsD() error {
+	e := store.statsd
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	// current segment file always exists, others might have been removed
+	// by compaction or GC()
+	segments := 1
+	for _, seg := range stats.Segments[:len(stats.Segments)-1] {
+		if seg.FileSize > 0 {
+			segments++
+		}
+	}
+
+	if e.conn == nil {
+		conn, err := net.Dial("udp", e.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	e.buf = e.buf[:0]
+	e.appendMetric("blobs", int64(stats.Blobs), "g")
+	e.appendMetric("blobs_size", stats.BlobsSize, "g")
+	e.appendMetric("segments", int64(segments), "g")
+	e.appendMetric("dedup_hits", int64(stats.DedupHits-e.dedupHits), "c")
+	e.appendMetric("dedup_saved_bytes", stats.DedupSavedBytes-e.dedupSavedBytes, "c")
+	// a few short lines, well below the size of a UDP packet
+	if _, err = e.conn.Write(e.buf[:len(e.buf)-1]); err != nil {
+		// counters not sent will be in the next packet
+		return err
+	}
+	e.dedupHits = stats.DedupHits
+	e.dedupSavedBytes = stats.DedupSavedBytes
+	return nil
+}
+
+// closeStatsD sends statistics one last time and closes the connection
+func (store *Store) closeStatsD() {
+	store.flushStatsD()
+	if store.statsd.conn != nil {
+		store.statsd.conn.Close()
+		store.statsd.conn = nil
+	}
+}
@@ -1,15 +1,19 @@
 package contentstore
 
 import (
-	"encoding/csv"
+	"bufio"
+	"bytes"
+	"crypto/cipher"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
-	"sort"
-	"strconv"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/kjk/u"
 )
@@ -17,29 +21,94 @@ import (
 // Files we use:
 // - index where for each blob we store: sha1 of the content, number of segment
 //   file in which the blob is stored, offset within the segment and size of
-//   the blob
+//   the blob. It's an append-only journal of checksummed records (see
+//   journal.go)
 // - one or more segment files. User can control the max size of segment
 //   file (10 MB by default) to pick the right file size/number of files
 //   balance for his needs
 
+// Once a segment file reaches max size it's sealed: we never write to it
+// again, not even after a restart, so that tools like rsync can skip sealed
+// segments by their size and modification time. Sealed segments are only
+// removed (see gc.go) or, with WithPunchHoles(), have space of deleted blobs
+// deallocated or, with WithSpaceReuse(), overwritten by new blobs.
+
 // Ideas for the future:
-// - add a mode where we store big blobs (e.g. over 1MB) in their own files
-// - add a way to delete files and re-use deleted space via some sort of
-//   best-fit allocator (if we're adding a new blob and have free space
-//   due to deletion, pick the free space that is the closest in size to
-//   new blob but only if it's e.g. withing 10% in size, to avoid excessive
-//   fragmentation)
-// - add a way to delete files by rewriting the files (expensive! we have to
-//   rewrite the whole index and each segment that contains deleted files)
+// - add a mode where we store big blobs (e.g. over 1MB) in their own files.
+//   With it, PutFile(path) could ingest a big file by reflink (FICLONE on
+//   Linux, clonefile() on macOS) or hardlink, falling back to copying, so
+//   that adding multi-GB files doesn't read them through memory. A hardlink
+//   needs the file to never be modified afterwards, so it should be opt-in.
+//   Such files should also stay sparse: find holes on ingest (SEEK_HOLE,
+//   SEEK_DATA) and recreate them on export, so that e.g. disk images don't
+//   take their full logical size
+// - a Storer that keeps sealed segments in S3 (uploaded when a segment fills
+//   up) and only the current segment and the index on local disk. Reading a
+//   blob would be a ranged GET of the segment object. Not done yet because
+//   it needs an S3 client library. When it's done, it should also support
+//   archive storage classes (e.g. Glacier) where reading is asynchronous:
+//   Get() of a blob in an archived segment returns a typed "restore in
+//   progress" error, RequestRestore(id) starts restoring the segment and
+//   the caller is notified when the blob can be read
+// - blobs don't have tags. If they get them, Stats() should also show the
+//   number of blobs and their size for each tag, like "stats -config" does
+//   for namespaces, so that it can be used for billing and cleanup. With
+//   metadata (e.g. content type) there should also be an optional,
+//   persisted secondary index for queries like "image/* added in the last 7
+//   days" that don't scan all blobs. Today the only metadata is size and
+//   creation time, and blobs added after a point are found with Changes()
+// - once blobs can be stored compressed (gzip or zstd), Handler should send
+//   compressed bytes as they are, with Content-Encoding, to clients whose
+//   Accept-Encoding allows it, instead of decompressing them. Compact()
+//   should then be able to recompress blobs it moves with the current codec
+//   and level (e.g. gzip to zstd with a dictionary), so that upgrading the
+//   format of old data is done as part of compaction
+// - compress sealed segments as a whole (e.g. <base>_<n>.zst), which
+//   compresses many small, similar blobs much better than compressing each
+//   of them. Get() needs to read a blob without decompressing the segment
+//   up to it, so it should be compressed in independent frames (e.g. of
+//   1MB) with a table of their offsets. Not done yet because zstd isn't
+//   in the standard library. It doesn't work with WithSpaceReuse() or
+//   WithPunchHoles(), which change sealed segments
+// - an IndexMode that keeps the index on disk (e.g. in SQLite) instead of
+//   in memory, for stores with tens of millions of blobs. blobIndex is the
+//   place for it but find() and add() would have to return errors, and it
+//   needs a SQLite library, so it's not done yet. IndexSorted is the
+//   cheapest in-memory option until then
 
 var (
-	errNotFound           = errors.New("not found")
+	// ErrNotFound is returned when there is no blob with a given id
+	ErrNotFound = errors.New("not found")
+	// ErrQuotaExceeded is returned by Put() when storing the blob would
+	// exceed the limit set with WithQuota()
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrBlobTooLarge is returned by Put() of a blob bigger than the limit
+	// set with WithMaxBlobSize()
+	ErrBlobTooLarge = errors.New("blob too large")
+	// ErrExtraTooLarge is returned by PutWithExtra() when extra data is
+	// longer than MaxExtraSize
+	ErrExtraTooLarge = errors.New("extra data too large")
+	// ErrDiskFull is returned by Put() when storing the blob would leave
+	// less free disk space than reserved with WithReservedSpace()
+	ErrDiskFull = errors.New("disk full")
+	// ErrPoisoned is returned by Put() after the store found that its files
+	// are not in the state they should be (e.g. writing failed half-way or
+	// index points past the end of a segment). Writing more could make
+	// things worse so we stop. Reading still works. Errors returned by Put()
+	// wrap both ErrPoisoned and the reason.
+	ErrPoisoned = errors.New("store is poisoned")
+	// ErrIndexMismatch is returned when opening a store whose index file is
+	// shorter than or different from what it was when the store was last
+	// closed, which means that it was truncated or modified. Open with
+	// WithRecovery() to use it anyway
+	ErrIndexMismatch = errors.New("index file doesn't match checkpoint")
+	// ErrInvalidId is returned for an id that is not hex sha1, multihash or
+	// CID (see cid.go) or, for stores opened with WithSha256Ids(), hex sha256
+	ErrInvalidId = errors.New("invalid id")
+
 	errInvalidIndexHdr    = errors.New("invalid index file header")
-	errInvalidIndexLine   = errors.New("invalid index line")
 	errSegmentFileMissing = errors.New("segment file missing")
-	errNotValidSha1       = errors.New("not a valid sha1")
-	// first line in index file, for additional safety
-	idxHdr = "github.com/kjk/contentstore header 1.0"
+	errSegmentFileShort   = errors.New("segment file shorter than expected")
 )
 
 type blob struct {
@@ -47,173 +116,630 @@ type blob struct {
 	nSegment int
 	offset   int
 	size     int
+	// when the blob was added, in unix seconds. 0 if unknown (blobs added
+	// by old versions)
+	created int64
+	// IndexRecord.Extra, nil for most blobs (see PutWithExtra())
+	extra []byte
+}
+
+// Option configures optional behavior of a Store
+type Option func(*Store)
+
+// WithIndexMode selects in-memory representation of the index
+func WithIndexMode(mode IndexMode) Option {
+	return func(store *Store) {
+		store.indexMode = mode
+	}
+}
+
+// WithReadaheadHint makes the store tell the kernel when it reads files
+// sequentially (e.g. in Warm()), so that it can read ahead more aggressively
+func WithReadaheadHint() Option {
+	return func(store *Store) {
+		store.readaheadHint = true
+	}
+}
+
+// WithDropCacheAfterWrite makes the store tell the kernel that it doesn't
+// need data written by Put() to be cached. This is useful when doing
+// bulk imports, so that they don't evict from page cache the data that
+// the rest of the application is using
+func WithDropCacheAfterWrite() Option {
+	return func(store *Store) {
+		store.dropCacheAfterWrite = true
+	}
+}
+
+// WithReservedSpace makes Put() fail with ErrDiskFull, without writing
+// anything, when storing the blob would leave less than n bytes of free
+// space on the disk with the store. Running out of space in the middle of
+// writing poisons the store (see ErrPoisoned) while this leaves room for
+// the index, compaction and other files on the disk. Health() returns
+// ErrDiskFull while free space is below n
+func WithReservedSpace(n int64) Option {
+	return func(store *Store) {
+		store.reservedSpace = n
+	}
+}
+
+// WithPunchHoles makes the store deallocate space used by deleted blobs in
+// segment files right away, which returns it to the OS without rewriting
+// segments. It only works on Linux, on filesystems that support punching
+// holes (ext4, xfs, btrfs, tmpfs). Don't use it if other processes read the
+// store with OpenReadOnly(): they can read zeros instead of a blob that is
+// being deleted
+func WithPunchHoles() Option {
+	return func(store *Store) {
+		store.punchHoles = true
+	}
+}
+
+// WithRecovery makes the store recover from a corrupted index instead of
+// failing to open. The first corrupted record is treated as the end of the
+// index and it (along with everything that follows it) is removed from the
+// index file. Use RecoveryStats() to find out what was discarded.
+// A torn record at the end of the index (which happens when the process
+// crashes while writing it) is always discarded, even without this option,
+// and so is a corrupted record appended since the store was last closed
+// if it wasn't closed cleanly (see checkpoint.go).
+func WithRecovery() Option {
+	return func(store *Store) {
+		store.recoverIndex = true
+	}
+}
+
+// WithQuota limits total size of blobs in the store to maxBytes. Put() of
+// a blob that would exceed it fails with ErrQuotaExceeded
+func WithQuota(maxBytes int64) Option {
+	return func(store *Store) {
+		store.quota = maxBytes
+	}
+}
+
+// WithMaxBlobSize limits size of a blob to maxBytes. Put() of a bigger blob
+// fails with ErrBlobTooLarge without writing anything
+func WithMaxBlobSize(maxBytes int) Option {
+	return func(store *Store) {
+		store.maxBlobSize = maxBytes
+	}
+}
+
+// MaxBlobSize returns the limit set with WithMaxBlobSize() or 0 if size of
+// blobs isn't limited
+func (store *Store) MaxBlobSize() int {
+	return max(store.maxBlobSize, 0)
+}
+
+// RecoveryStats describes what was discarded when recovering a corrupted index
+type RecoveryStats struct {
+	// number of (possibly partial) records removed from the index
+	DiscardedRecords int
+	// number of bytes removed from the index file
+	DiscardedBytes int64
+	// true if the index didn't match the checkpoint written when the store
+	// was last closed (see ErrIndexMismatch). LostRecords is how many
+	// records are missing, if the index is shorter
+	IndexMismatch bool
+	LostRecords   int
+	// true if the store wasn't closed the last time it was opened for
+	// writing, i.e. the process crashed (see checkpoint.go)
+	Crashed bool
+	// number of bytes at the end of current segment that no blob in the
+	// index uses (written before a crash or by failed writes). They're
+	// removed, unless a backup has them
+	OrphanedBytes int64
+	// true if current segment is shorter than the index says, so some
+	// blobs in it are lost. New blobs are written to a new segment
+	ShortSegment bool
 }
 
 type Store struct {
 	sync.Mutex
-	basePath       string
-	maxSegmentSize int
-	blobs          []blob
-	// sha1ToBlob is to quickly find a message based on sha1
-	// string is really [20]byte cast to string and int is a position within blobs array
-	sha1HexToBlobNo map[string]int
-	idxFile         *os.File
-	idxCsvWriter    *csv.Writer
+	basePath            string
+	maxSegmentSize      int
+	indexMode           IndexMode
+	readaheadHint       bool
+	dropCacheAfterWrite bool
+	punchHoles          bool
+	recoverIndex        bool
+	recoveryStats       RecoveryStats
+	indexCodec          IndexCodec
+	// true if ids are git blob ids (see git.go)
+	gitObjects bool
+	index      blobIndex
+	// total size of blobs in the index
+	blobsSize int64
+	// if set, all writes fail with this error. Wraps ErrPoisoned
+	poisoned error
+	// max value of blobsSize, 0 if unlimited
+	quota int64
+	// see softlimit.go
+	softLimits *softLimits
+	// max size of a blob, 0 if unlimited
+	maxBlobSize int
+	// min free disk space left by Put(), 0 if not checked
+	reservedSpace int64
+	idxFile       *os.File
+	// header of index file and generation of the index (see journal.go)
+	idxHdr []byte
+	idxGen int64
+	// buffer for encoding index records, to avoid allocations
+	idxBuf          []byte
 	currSegmentFile *os.File
 	currSegmentNo   int
 	currSegmentSize int
+	// end of data of blobs in current segment according to the index.
+	// Only set by readIndex()
+	currSegmentEnd int64
 	// we cache file descriptor for one segment file (in addition to current
 	// segment file) to reduce file open/close for Get()
 	cachedSegmentFile *os.File
 	cachedSegmentNo   int
+	cachedSegmentSize int
+
+	// state of writer goroutine (see writer.go)
+	putChan    chan *putRequest
+	closing    chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{}
+	// requests written to current segment but not yet committed
+	pending      []*putRequest
+	pendingBlobs []blob
+	pendingSize  int
+	// Put()s of content that was already in the store
+	dedupHits       int
+	dedupSavedBytes int64
+	// statistics of PutWithSource(), by source
+	sources map[string]*SourceStats
+	// requests that were accepted but not yet processed
+	inFlightMu sync.Mutex
+	inFlight   map[*putRequest]struct{}
+	// the first of in flight requests with a given sha1 (see follow())
+	inFlightIds map[[20]byte]*putRequest
+	// nil if we don't count reads (see access.go)
+	access *accessCounts
+	// see refs.go
+	refs refs
+	// nil if blobs can't be found by sha256 (see alias.go)
+	aliases *aliases
+	// nil if we don't reuse space of deleted blobs (see reuse.go)
+	reuse *spaceReuse
+	// see watch.go
+	watchers       watchers
+	onSegmentEvent func(SegmentEvent)
+	// nil if we don't remove blobs automatically (see policy.go)
+	policy         *Policy
+	maintainerDone chan struct{}
+	// if set, statistics are sent to StatsD by maintainer
+	statsd *statsdEmitter
+
+	// see registry.go
+	sharedHandle bool
+	registryPath string
+
+	// true if opened with OpenReadOnly(). There's no writer goroutine,
+	// idxFile is opened for reading and we tail it (see readonly.go)
+	readOnly bool
+	// offset of the end of the last valid record in the index file and crc32
+	// of the file up to it
+	idxOffset int64
+	idxCrc    uint32
+	// number of records in the index file
+	idxRecords int
+	// nil if we don't compact automatically (see compact.go)
+	compaction *CompactionPolicy
+	// nil if blobs are not encrypted (see encrypt.go)
+	encryptionKey func() ([]byte, error)
+	aead          cipher.AEAD
+	// held while a backup copies files so that segments are not removed
+	// (see backup.go)
+	backupMu sync.Mutex
 }
 
 func idxFilePath(basePath string) string {
-	return basePath + "_idx.txt"
+	return basePath + "_idx.bin"
 }
 
 func segmentFilePath(basePath string, nSegment int) string {
 	return fmt.Sprintf("%s_%d.txt", basePath, nSegment)
 }
 
-func decodeIndexLine(rec []string) (blob blob, err error) {
-	if len(rec) != 4 {
-		return blob, errInvalidIndexLine
+// sha1FromId converts id returned by Put() (or its multihash or CID, see
+// cid.go) back to sha1. Ids are lower-case: we don't accept other spellings
+// so that a blob has only one id (and one ETag)
+func sha1FromId(id string) (sha1 [20]byte, ok bool) {
+	if !isLowerCase(id) {
+		return sha1, false
 	}
-	sha1, err := hex.DecodeString(rec[0])
-	if err != nil {
-		return blob, err
+	if len(id) != hex.EncodedLen(len(sha1)) {
+		return sha1FromCID(id)
 	}
-	if len(sha1) != 20 {
-		return blob, errNotValidSha1
+	if _, err := hex.Decode(sha1[:], []byte(id)); err != nil {
+		// base32 CID has the same length
+		return sha1FromCID(id)
 	}
-	copy(blob.sha1[:], sha1)
-	if blob.nSegment, err = strconv.Atoi(rec[1]); err != nil {
-		return blob, err
+	return sha1, true
+}
+
+// isLowerCase returns true if s has no upper-case ASCII letters
+func isLowerCase(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= 'Z' {
+			return false
+		}
 	}
-	if blob.offset, err = strconv.Atoi(rec[2]); err != nil {
-		return blob, err
+	return true
+}
+
+func (store *Store) blobInfo(blob *blob, id string) BlobInfo {
+	info := BlobInfo{Id: id, Size: store.contentSize(blob), Extra: bytes.Clone(blob.extra)}
+	if blob.created != 0 {
+		info.Created = time.Unix(blob.created, 0)
 	}
-	if blob.size, err = strconv.Atoi(rec[3]); err != nil {
-		return blob, err
+	return info
+}
+
+// findBlob finds blob with a given id. Returns ErrInvalidId or ErrNotFound
+// if it can't. Must be called with store locked
+func (store *Store) findBlob(id string) (blob, error) {
+	sha1, ok := store.idToSha1(id)
+	if !ok {
+		return blob{}, ErrInvalidId
+	}
+	blob, ok := store.index.find(sha1)
+	if !ok && store.readOnly {
+		// the writer might have added it since we last looked
+		if store.tailIndex() == nil {
+			blob, ok = store.index.find(sha1)
+		}
+	}
+	if !ok {
+		return blob, ErrNotFound
 	}
 	return blob, nil
 }
 
-// appends x to array of ints
-func appendIntIfNotExists(aPtr *[]int, x int) {
-	a := *aPtr
-	if sort.SearchInts(a, x) >= 0 {
-		return
+// blobsCountHint returns expected number of blobs in index file, based on
+// number recorded in checkpoint file. Pre-allocating avoids re-growing
+// when loading big indexes
+func (store *Store) blobsCountHint(idxFile *os.File, cp checkpoint) int {
+	if cp.nBlobs < 0 {
+		return 0
+	}
+	// don't trust the checkpoint blindly
+	stat, err := idxFile.Stat()
+	if err != nil || int64(cp.nBlobs) > stat.Size()/minBlobRecordSize {
+		return 0
 	}
-	a = append(a, x)
-	sort.Ints(a)
-	*aPtr = a
+	return cp.nBlobs
 }
 
-// TODO: error out if already in sha1HexToBlobNo
-func (store *Store) appendBlob(blob blob) {
-	sha1 := fmt.Sprintf("%x", blob.sha1[:])
-	blobNo := len(store.blobs)
-	store.blobs = append(store.blobs, blob)
-	store.sha1HexToBlobNo[sha1] = blobNo
+// discardIndexTail truncates index file to validSize bytes and records
+// what was discarded in store.recoveryStats
+func (store *Store) discardIndexTail(file *os.File, validSize int64) error {
+	tail, err := io.ReadAll(io.NewSectionReader(file, validSize, math.MaxInt64-validSize))
+	if err != nil {
+		return err
+	}
+	store.recoveryStats.DiscardedRecords += countRecordFrames(tail)
+	store.recoveryStats.DiscardedBytes += int64(len(tail))
+	return os.Truncate(idxFilePath(store.basePath), validSize)
 }
 
-func (store *Store) readIndex() error {
+func (store *Store) readIndex(cp checkpoint) error {
 	// at this point idx file must exist
-	file, err := os.Open(idxFilePath(store.basePath))
+	file, err := openFile(idxFilePath(store.basePath), os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	// TODO: would be faster (and easier?) to use a bitset since we know
-	// segment numbers are consequitive integers
-	segments := make([]int, 0)
-	csvReader := csv.NewReader(file)
-	csvReader.Comma = ','
-	csvReader.FieldsPerRecord = -1
-	rec, err := csvReader.Read()
-	if err != nil || len(rec) != 1 || rec[0] != idxHdr {
-		return errInvalidIndexHdr
-	}
-	var blob blob
+	r := bufio.NewReaderSize(file, 64*1024)
+	if store.idxHdr, store.idxGen, err = store.readIndexHeader(r); err != nil {
+		return err
+	}
+	jr := &journalReader{
+		r:      r,
+		offset: int64(len(store.idxHdr)),
+		crc:    crc32.Checksum(store.idxHdr, crcTable),
+	}
+	// the index only grows so it must start with what it had when we wrote
+	// the checkpoint. A read-only store might see the index while the writer
+	// replaces it
+	checked := cp.idxSize <= 0 || store.readOnly
+	check := func(eof bool) error {
+		if checked || (jr.offset < cp.idxSize && !eof) {
+			return nil
+		}
+		checked = true
+		if jr.offset == cp.idxSize && jr.crc == cp.idxCrc && cp.idxGen == store.idxGen {
+			return nil
+		}
+		if !store.recoverIndex {
+			return ErrIndexMismatch
+		}
+		store.recoveryStats.IndexMismatch = true
+		if n := cp.idxRecords - store.idxRecords; n > 0 && jr.offset < cp.idxSize {
+			store.recoveryStats.LostRecords = n
+		}
+		return nil
+	}
+	if err = check(false); err != nil {
+		return err
+	}
+	// read-only stores don't mark the checkpoint
+	store.recoveryStats.Crashed = !cp.clean && !store.readOnly
+	blobs := make([]blob, 0, store.blobsCountHint(file, cp))
+	// for deleted blobs, number of blobs that were added before deleting it
+	var deletedAt map[[20]byte]int
 	for {
-		if rec, err = csvReader.Read(); err != nil {
+		payload, err := jr.next()
+		if err == io.EOF {
 			break
 		}
-		if blob, err = decodeIndexLine(rec); err != nil {
+		var blob blob
+		var deleted bool
+		if err == nil {
+			blob, deleted, err = decodeRecord(store.indexCodec, payload)
+		}
+		if err != nil {
+			// after a crash, it's probably a record we were writing
+			crashed := store.recoveryStats.Crashed && cp.idxSize > 0 && jr.offset >= cp.idxSize
+			if err != errTornRecord && (err != errCorruptRecord || !(store.recoverIndex || crashed)) {
+				return err
+			}
+			// treat it as the end of the index and discard the rest. When
+			// read-only, the writer might be in the middle of appending it
+			if store.readOnly {
+				break
+			}
+			if err = store.discardIndexTail(file, jr.offset); err != nil {
+				return err
+			}
 			break
 		}
-		appendIntIfNotExists(&segments, blob.nSegment)
-		store.appendBlob(blob)
+		store.idxRecords++
+		if err = check(false); err != nil {
+			return err
+		}
+		if deleted || isMoveRecord(payload) {
+			if deletedAt == nil {
+				deletedAt = make(map[[20]byte]int)
+			}
+			deletedAt[blob.sha1] = len(blobs)
+		}
+		if deleted {
+			continue
+		}
+		if blob.nSegment > store.currSegmentNo {
+			store.currSegmentNo = blob.nSegment
+			store.currSegmentEnd = 0
+		}
+		if blob.nSegment == store.currSegmentNo {
+			store.currSegmentEnd = max(store.currSegmentEnd, int64(blob.offset+blob.size))
+		}
+		blobs = append(blobs, blob)
 	}
-	if err == io.EOF {
-		err = nil
+	if err = check(true); err != nil {
+		return err
 	}
-	// verify segment files exist
-	// TODO: also verify offset + size is <= size of segment file
-	for _, nSegment := range segments {
-		path := segmentFilePath(store.basePath, nSegment)
-		if !u.PathExists(path) {
-			return errSegmentFileMissing
-		}
-		store.currSegmentNo = nSegment
+	if len(deletedAt) > 0 {
+		blobs = removeDeleted(blobs, deletedAt)
+	}
+	for i := range blobs {
+		store.blobsSize += int64(blobs[i].size)
 	}
+	store.index.load(blobs)
+	store.idxOffset = jr.offset
+	store.idxCrc = jr.crc
+	// we don't verify that segment files exist because it's slow for stores
+	// with many segments. Current segment is checked when we open it for
+	// writing and other segments when we read from them for the first time
 	return nil
 }
 
-func NewWithLimit(basePath string, maxSegmentSize int) (store *Store, err error) {
-	store = &Store{
+// removeOrphanedData truncates current segment at path, whose size is size,
+// to the end of the data of the last blob in the index. A segment that was
+// backed up is only truncated to its size at the time of the backup,
+// so that the next incremental backup continues where it stopped
+func (store *Store) removeOrphanedData(path string, size int64) error {
+	end := store.currSegmentEnd
+	points, err := readBackupPoints(backupsFilePath(store.basePath))
+	if err != nil {
+		// not worth failing to open the store
+		return nil
+	}
+	for _, p := range points {
+		if p.nSegment == store.currSegmentNo {
+			end = max(end, p.segmentSize)
+		}
+	}
+	if size <= end {
+		return nil
+	}
+	store.recoveryStats.OrphanedBytes = size - end
+	return os.Truncate(path, end)
+}
+
+// removeDeleted removes from blobs those that were deleted (or moved) after
+// being added. deletedAt is the number of blobs added before a blob was
+// deleted
+func removeDeleted(blobs []blob, deletedAt map[[20]byte]int) []blob {
+	res := blobs[:0]
+	for i, blob := range blobs {
+		if n, ok := deletedAt[blob.sha1]; ok && i < n {
+			continue
+		}
+		res = append(res, blob)
+	}
+	return res
+}
+
+// migrateCsvIndex converts CSV index used by previous versions to a journal
+func (store *Store) migrateCsvIndex() error {
+	csvPath := csvIdxFilePath(store.basePath)
+	blobs, err := readCsvIndex(csvPath, store.recoverIndex, &store.recoveryStats)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(idxFilePath(store.basePath), func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		bw.Write(store.newIndexHeader(0))
+		var buf []byte
+		for i := range blobs {
+			buf = appendBlobRecord(buf[:0], store.indexCodec, &blobs[i])
+			bw.Write(buf)
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(csvPath)
+}
+
+func newStore(basePath string, maxSegmentSize int, opts []Option) *Store {
+	store := &Store{
 		basePath:        basePath,
-		blobs:           make([]blob, 0),
-		sha1HexToBlobNo: make(map[string]int),
 		maxSegmentSize:  maxSegmentSize,
 		cachedSegmentNo: -1,
+		putChan:         make(chan *putRequest),
+		closing:         make(chan struct{}),
+		inFlight:        make(map[*putRequest]struct{}),
+		inFlightIds:     make(map[[20]byte]*putRequest),
+		indexCodec:      DefaultIndexCodec{},
+	}
+	for _, opt := range opts {
+		opt(store)
+	}
+	store.index = newBlobIndex(store.indexMode)
+	return store
+}
+
+func NewWithLimit(basePath string, maxSegmentSize int, opts ...Option) (store *Store, err error) {
+	if StoreExists(basePath) && isReadOnlyMedia(idxFilePath(basePath)) {
+		return OpenReadOnly(basePath, opts...)
+	}
+	store = newStore(basePath, maxSegmentSize, opts)
+	if open, err := store.register(); err != nil || open != nil {
+		return open, err
+	}
+	defer func(store *Store) {
+		if err != nil {
+			store.unregister()
+		}
+	}(store)
+	if err = store.initEncryption(); err != nil {
+		return nil, err
 	}
 	idxPath := idxFilePath(basePath)
+	if !u.PathExists(idxPath) && u.PathExists(csvIdxFilePath(basePath)) {
+		if err = store.migrateCsvIndex(); err != nil {
+			return nil, err
+		}
+	}
 	idxDidExist := u.PathExists(idxPath)
 	if idxDidExist {
-		if err = store.readIndex(); err != nil {
+		// checkpoint is only a hint so it's fine if we can't read it
+		cp, _ := readCheckpoint(basePath)
+		if err = store.readIndex(cp); err != nil {
 			return nil, err
 		}
+		if err = store.upgradeIndexHeader(); err != nil {
+			return nil, err
+		}
+		store.dedupHits = cp.dedupHits
+		store.dedupSavedBytes = cp.dedupSavedBytes
 	}
-	if store.idxFile, err = os.OpenFile(idxPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+	store.readAccessCounts()
+	if err = store.openAliases(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if store.idxFile, err = openFile(idxPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		store.Close()
 		return nil, err
 	}
-	store.idxCsvWriter = csv.NewWriter(store.idxFile)
 	if !idxDidExist {
-		rec := [][]string{{idxHdr}}
-		err = store.idxCsvWriter.WriteAll(rec)
-		if err != nil {
+		store.idxHdr = store.newIndexHeader(0)
+		if err = store.writeIndex(store.idxHdr); err != nil {
+			store.Close()
 			return nil, err
 		}
 	}
+	// until Close() marks it clean, a crash is detected when opening
+	if err = writeCheckpoint(basePath, store.checkpoint(true)); err != nil {
+		store.Close()
+		return nil, err
+	}
+	// the index doesn't mention segments whose blobs were all removed (if it
+	// was rewritten) and we must not append to a segment before them
+	for u.PathExists(segmentFilePath(store.basePath, store.currSegmentNo+1)) {
+		store.currSegmentNo++
+		store.currSegmentEnd = 0
+	}
 	segmentPath := segmentFilePath(store.basePath, store.currSegmentNo)
 	stat, err := os.Stat(segmentPath)
+	create := false
 	if err != nil {
 		// TODO: fail if error is different than "file doesn't exist"
 		if store.currSegmentNo != 0 {
 			store.Close()
 			return nil, errSegmentFileMissing
 		}
-		store.currSegmentFile, err = os.Create(segmentPath)
+		create = true
+	} else if stat.Size() >= int64(store.maxSegmentSize) {
+		// it's sealed, we crashed before creating the next one
+		store.segmentEvent(SegmentSealed, store.currSegmentNo, stat.Size())
+		store.currSegmentNo++
+		segmentPath = segmentFilePath(store.basePath, store.currSegmentNo)
+		create = true
+	} else if stat.Size() < store.currSegmentEnd {
+		// data of blobs in the index is missing. We can't get it back but
+		// we must not write new blobs where the index says they are
+		store.recoveryStats.ShortSegment = true
+		store.currSegmentNo++
+		segmentPath = segmentFilePath(store.basePath, store.currSegmentNo)
+		create = true
+	} else if err = store.removeOrphanedData(segmentPath, stat.Size()); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if create {
+		store.currSegmentFile, err = openFile(segmentPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			store.Close()
 			return nil, err
 		}
+		store.segmentEvent(SegmentCreated, store.currSegmentNo, 0)
 	} else {
 		store.currSegmentSize = int(stat.Size())
-		store.currSegmentFile, err = os.OpenFile(segmentPath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+		store.currSegmentFile, err = openFile(segmentPath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			store.Close()
 			return nil, err
 		}
 	}
+	if err = store.findHoles(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	store.writerDone = make(chan struct{})
+	go store.writer()
+	if store.policy != nil || store.compaction != nil || store.statsd != nil {
+		store.maintainerDone = make(chan struct{})
+		go store.maintainer()
+	}
 	return store, nil
 }
 
-func New(basePath string) (*Store, error) {
-	return NewWithLimit(basePath, 10*1024*1024)
+func New(basePath string, opts ...Option) (*Store, error) {
+	return NewWithLimit(basePath, 10*1024*1024, opts...)
+}
+
+// StoreExists returns true if there is a store at basePath
+func StoreExists(basePath string) bool {
+	return u.PathExists(idxFilePath(basePath)) || u.PathExists(csvIdxFilePath(basePath))
 }
 
 func closeFilePtr(filePtr **os.File) (err error) {
@@ -225,66 +751,159 @@ func closeFilePtr(filePtr **os.File) (err error) {
 	return err
 }
 
-func (store *Store) Close() {
-	closeFilePtr(&store.idxFile)
-	closeFilePtr(&store.currSegmentFile)
-	closeFilePtr(&store.cachedSegmentFile)
+// writeFileAtomically creates a file at path with content written by write.
+// Readers either see the old content of the file or the whole new content
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := openFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return renameFile(tmpPath, path)
 }
 
-func writeBlobRec(csvWriter *csv.Writer, blob *blob) error {
-	sha1Str := hex.EncodeToString(blob.sha1[:])
-	rec := [][]string{
-		{
-			sha1Str,
-			strconv.Itoa(blob.nSegment),
-			strconv.Itoa(blob.offset),
-			strconv.Itoa(blob.size),
-		}}
-	return csvWriter.WriteAll(rec)
-}
+func (store *Store) Close() error {
+	if !store.release() {
+		// other handles to it are still open (see WithSharedHandle())
+		return nil
+	}
+	defer store.unregister()
+	// wait for writes in progress to finish
+	store.closeOnce.Do(func() { close(store.closing) })
+	if store.maintainerDone != nil {
+		<-store.maintainerDone
+	}
+	if store.writerDone != nil {
+		<-store.writerDone
+	}
+	if store.access != nil {
+		store.access.flushWg.Wait()
+	}
 
-func (store *Store) Put(d []byte) (id string, err error) {
 	store.Lock()
 	defer store.Unlock()
 
-	idBytes := u.Sha1OfBytes(d)
-	id = fmt.Sprintf("%x", idBytes)
-	if _, ok := store.sha1HexToBlobNo[id]; ok {
-		return id, nil
+	if store.access != nil && store.idxFile != nil && !store.readOnly {
+		writeAccessCounts(store.basePath, store.access.hits)
+	}
+
+	if store.idxFile != nil && !store.readOnly {
+		// checkpoint is only a hint so it's ok if we fail to write it
+		cp := store.checkpoint(true)
+		cp.clean = cp.idxSize > 0
+		writeCheckpoint(store.basePath, cp)
 	}
-	blob := blob{
-		size:     len(d),
-		offset:   store.currSegmentSize,
-		nSegment: store.currSegmentNo,
+	err := closeFilePtr(&store.idxFile)
+	if store.aliases != nil {
+		if err2 := closeFilePtr(&store.aliases.file); err == nil {
+			err = err2
+		}
 	}
-	copy(blob.sha1[:], idBytes)
+	if err2 := closeFilePtr(&store.currSegmentFile); err == nil {
+		err = err2
+	}
+	if err2 := closeFilePtr(&store.cachedSegmentFile); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Put stores d in the store and returns its id. It returns after the data
+// is safely on disk
+func (store *Store) Put(d []byte) (id string, err error) {
+	return store.put(newPutRequest(d))
+}
+
+// PutWithSource is like Put() but also counts it, and whether its content
+// was already in the store, for source (e.g. name of the upload pipeline).
+// See Stats().Sources
+func (store *Store) PutWithSource(d []byte, source string) (id string, err error) {
+	req := newPutRequest(d)
+	req.source = source
+	return store.put(req)
+}
 
-	if _, err = store.currSegmentFile.Write(d); err != nil {
-		return "", err
+// PutWithExtra is like Put() but also stores extra (e.g. tenant id or
+// content type) in the index record of the blob. It's returned in
+// BlobInfo.Extra by Stat() and List(). If the store already has the blob,
+// its extra data doesn't change
+func (store *Store) PutWithExtra(d, extra []byte) (id string, err error) {
+	if len(extra) > MaxExtraSize {
+		return "", ErrExtraTooLarge
 	}
-	if err = store.currSegmentFile.Sync(); err != nil {
-		return "", err
+	req := newPutRequest(d)
+	req.extra = bytes.Clone(extra)
+	return store.put(req)
+}
+
+func (store *Store) put(req *putRequest) (string, error) {
+	store.accept(req)
+	if err := store.submit(req); err != nil {
+		store.finish(req, err)
 	}
-	store.currSegmentSize += blob.size
-	if store.currSegmentSize >= store.maxSegmentSize {
-		// filled current segment => create a new one
-		err = store.currSegmentFile.Close()
-		if err != nil {
-			return "", err
-		}
-		store.currSegmentNo += 1
-		store.currSegmentSize = 0
-		path := segmentFilePath(store.basePath, store.currSegmentNo)
-		store.currSegmentFile, err = os.Create(path)
-		if err != nil {
-			return "", err
-		}
+	return req.wait()
+}
+
+// Sync waits until all writes accepted by the store before the call (including
+// those started with PutAsync()) are safely on disk. It returns an error if
+// any of them failed
+func (store *Store) Sync() error {
+	store.inFlightMu.Lock()
+	reqs := make([]*putRequest, 0, len(store.inFlight))
+	for req := range store.inFlight {
+		reqs = append(reqs, req)
 	}
-	if err = writeBlobRec(store.idxCsvWriter, &blob); err != nil {
-		return "", err
+	store.inFlightMu.Unlock()
+	var err error
+	for _, req := range reqs {
+		if _, reqErr := req.wait(); err == nil {
+			err = reqErr
+		}
 	}
-	store.appendBlob(blob)
-	return id, nil
+	return err
+}
+
+// PutFuture is the result of PutAsync()
+type PutFuture struct {
+	req *putRequest
+}
+
+// Done returns a channel that is closed when the data is safely on disk
+// (or writing it failed)
+func (f *PutFuture) Done() <-chan struct{} {
+	return f.req.done
+}
+
+// Wait waits until the data is safely on disk and returns the same
+// values as Put()
+func (f *PutFuture) Wait() (id string, err error) {
+	return f.req.wait()
+}
+
+// PutAsync is like Put() but doesn't wait for the data to be written.
+// Having many writes in flight is much faster than doing them one by one
+// because they're written to disk together. d must not be modified until
+// the write is done
+func (store *Store) PutAsync(d []byte) *PutFuture {
+	req := newPutRequest(d)
+	store.accept(req)
+	go func() {
+		if err := store.submit(req); err != nil {
+			store.finish(req, err)
+		}
+	}()
+	return &PutFuture{req: req}
 }
 
 func readFromFile(file *os.File, offset, size int) ([]byte, error) {
@@ -295,35 +914,310 @@ func readFromFile(file *os.File, offset, size int) ([]byte, error) {
 	return res, nil
 }
 
-func (store *Store) getSegmentFile(nSegment int) (*os.File, error) {
-	if nSegment == store.currSegmentNo {
-		return store.currSegmentFile, nil
+func openSegmentForRead(basePath string, nSegment int) (*os.File, error) {
+	file, err := openFile(segmentFilePath(basePath, nSegment), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		err = errSegmentFileMissing
+	}
+	return file, err
+}
+
+// getSegmentFile returns opened segment file and its size
+func (store *Store) getSegmentFile(nSegment int) (*os.File, int, error) {
+	if nSegment == store.currSegmentNo && store.currSegmentFile != nil {
+		return store.currSegmentFile, store.currSegmentSize, nil
 	}
 	if nSegment == store.cachedSegmentNo {
-		return store.cachedSegmentFile, nil
+		return store.cachedSegmentFile, store.cachedSegmentSize, nil
 	}
 	closeFilePtr(&store.cachedSegmentFile)
-	path := segmentFilePath(store.basePath, nSegment)
-	var err error
-	if store.cachedSegmentFile, err = os.Open(path); err != nil {
-		return nil, err
+	store.cachedSegmentNo = -1
+	file, err := openSegmentForRead(store.basePath, nSegment)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
 	}
+	store.cachedSegmentFile = file
 	store.cachedSegmentNo = nSegment
-	return store.cachedSegmentFile, nil
+	store.cachedSegmentSize = int(stat.Size())
+	return file, store.cachedSegmentSize, nil
+}
+
+// readBlob reads content of the blob, validating it fits in segment file
+func (store *Store) readBlob(blob blob) ([]byte, error) {
+	segmentFile, segmentSize, err := store.getSegmentFile(blob.nSegment)
+	if err != nil {
+		return nil, err
+	}
+	if blob.offset+blob.size > segmentSize && store.readOnly {
+		// the writer might have appended to it since we opened it
+		if stat, err := segmentFile.Stat(); err == nil {
+			segmentSize = int(stat.Size())
+			store.cachedSegmentSize = segmentSize
+		}
+	}
+	if blob.offset+blob.size > segmentSize {
+		store.poison(errSegmentFileShort)
+		return nil, errSegmentFileShort
+	}
+	return readFromFile(segmentFile, blob.offset, blob.size)
 }
 
 func (store *Store) Get(id string) ([]byte, error) {
 	store.Lock()
 	defer store.Unlock()
 
-	blobNo, ok := store.sha1HexToBlobNo[id]
-	if !ok {
-		return nil, errNotFound
+	blob, err := store.findBlob(id)
+	if err != nil {
+		return nil, err
 	}
-	blob := store.blobs[blobNo]
-	segmentFile, err := store.getSegmentFile(blob.nSegment)
+	store.countAccess(blob.sha1)
+	d, err := store.readBlob(blob)
 	if err != nil {
 		return nil, err
 	}
-	return readFromFile(segmentFile, blob.offset, blob.size)
+	return store.contentOf(&blob, d)
+}
+
+// poison makes all future writes fail because of reason. Must be called
+// with store locked
+func (store *Store) poison(reason error) {
+	if store.poisoned == nil {
+		store.poisoned = fmt.Errorf("%w: %w", ErrPoisoned, reason)
+	}
+}
+
+// Health returns nil if the store works, an error wrapping ErrPoisoned
+// if it stopped accepting writes or ErrDiskFull if Put()s fail because
+// free disk space is below what's reserved with WithReservedSpace()
+func (store *Store) Health() error {
+	store.Lock()
+	poisoned := store.poisoned
+	store.Unlock()
+	if poisoned != nil {
+		return poisoned
+	}
+	if store.reservedSpace > 0 && !store.readOnly && store.freeSpace() < store.reservedSpace {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// freeSpace returns free space on the disk with the store or math.MaxInt64
+// if we can't get it
+func (store *Store) freeSpace() int64 {
+	free, err := freeDiskSpace(filepath.Dir(store.basePath))
+	if err != nil {
+		return math.MaxInt64
+	}
+	return free
+}
+
+// RecoveryStats returns information about index records discarded when
+// opening the store with WithRecovery()
+func (store *Store) RecoveryStats() RecoveryStats {
+	store.Lock()
+	defer store.Unlock()
+	return store.recoveryStats
+}
+
+// Exists returns true if blob with a given id is in the store
+func (store *Store) Exists(id string) bool {
+	store.Lock()
+	defer store.Unlock()
+
+	_, err := store.findBlob(id)
+	return err == nil
+}
+
+// Stat returns information about the blob without reading its content
+func (store *Store) Stat(id string) (BlobInfo, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	blob, err := store.findBlob(id)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return store.blobInfo(&blob, id), nil
+}
+
+// ForEach calls fn for every blob in the store. It iterates over a snapshot
+// of the index taken when it's called, so fn can use the store (including
+// Put() and Delete()) and it's safe to call while other goroutines write.
+// Every blob that was in the store when ForEach was called is visited once.
+// Blobs added during iteration are not visited. Blobs deleted during
+// iteration are still visited, but reading them fails with ErrNotFound.
+// If fn returns an error, iteration stops and ForEach returns that error
+func (store *Store) ForEach(fn func(info BlobInfo) error) error {
+	store.Lock()
+	blobs := make([]blob, 0, store.index.count())
+	store.index.forEach(func(blob *blob) {
+		blobs = append(blobs, *blob)
+	})
+	store.Unlock()
+	for i := range blobs {
+		info := store.blobInfo(&blobs[i], fmt.Sprintf("%x", blobs[i].sha1[:]))
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns information about up to limit blobs whose ids are greater
+// than afterID, sorted by id. Use "" to start from the beginning and id of
+// the last returned blob to get the next page. Memory it uses doesn't depend
+// on the number of blobs, so it's good for paging through huge stores.
+// To page through blobs in the order they were added, use Changes()
+func (store *Store) List(afterID string, limit int) ([]BlobInfo, error) {
+	var after *[20]byte
+	if afterID != "" {
+		sha1, ok := sha1FromId(afterID)
+		if !ok {
+			return nil, ErrInvalidId
+		}
+		after = &sha1
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+	store.Lock()
+	blobs := store.index.after(after, limit)
+	store.Unlock()
+	res := make([]BlobInfo, len(blobs))
+	for i := range blobs {
+		res[i] = store.blobInfo(&blobs[i], fmt.Sprintf("%x", blobs[i].sha1[:]))
+	}
+	return res, nil
+}
+
+// openBlob opens segment file with the blob for reading. We use a new file
+// for each call so that the caller can change its offset and doesn't have
+// to hold the lock while reading
+func (store *Store) openBlob(id string) (*os.File, blob, error) {
+	store.Lock()
+	blob, err := store.findBlob(id)
+	if err == nil {
+		store.countAccess(blob.sha1)
+		store.startReading(blob.nSegment)
+	}
+	store.Unlock()
+	if err != nil {
+		return nil, blob, err
+	}
+	file, err := openSegmentForRead(store.basePath, blob.nSegment)
+	if err != nil {
+		store.doneReading(blob.nSegment)
+		return nil, blob, err
+	}
+	stat, err := file.Stat()
+	if err == nil && int64(blob.offset+blob.size) > stat.Size() {
+		err = errSegmentFileShort
+	}
+	if err != nil {
+		file.Close()
+		store.doneReading(blob.nSegment)
+		return nil, blob, err
+	}
+	return file, blob, nil
+}
+
+// buffers for CopyTo() to writers that can't copy from a file by themselves
+var copyBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// CopyTo writes content of the blob to w. When w is a TCP connection or
+// a file, the data is copied by the kernel (using sendfile(2), splice(2) or
+// copy_file_range(2)) without going through user space. Otherwise it's
+// copied through a buffer shared with other calls, so serving a blob doesn't
+// allocate memory for its content. The store is not locked while copying so
+// it's ok to use it for serving big blobs to slow clients. Encrypted blobs
+// are read into memory and decrypted
+func (store *Store) CopyTo(id string, w io.Writer) (int64, error) {
+	if store.aead != nil {
+		d, err := store.Get(id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(d)
+		return int64(n), err
+	}
+	file, blob, err := store.openBlob(id)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	defer store.doneReading(blob.nSegment)
+	if _, err = file.Seek(int64(blob.offset), io.SeekStart); err != nil {
+		return 0, err
+	}
+	// net.TCPConn and os.File know how to optimize copying from
+	// io.LimitedReader wrapping os.File. io.CopyBuffer() only uses buf
+	// when w doesn't
+	r := &io.LimitedReader{R: file, N: int64(blob.size)}
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	return io.CopyBuffer(w, r, *buf)
+}
+
+// CopyToFile writes content of the blob to a file at path, for tools that
+// need a real file. Like CopyTo(), the data is copied by the kernel. The
+// file is written under a temporary name, synced and renamed, so there's
+// never a partially written file at path
+func (store *Store) CopyToFile(id string, path string) error {
+	return writeFileAtomically(path, func(w io.Writer) error {
+		_, err := store.CopyTo(id, w)
+		return err
+	})
+}
+
+type blobSeeker struct {
+	*io.SectionReader
+	file *os.File
+	// called when closed
+	done func()
+}
+
+func (bs *blobSeeker) Close() error {
+	bs.done()
+	return bs.file.Close()
+}
+
+type bytesSeeker struct {
+	*bytes.Reader
+}
+
+func (bytesSeeker) Close() error {
+	return nil
+}
+
+// GetSeeker returns content of the blob as io.ReadSeekCloser, for code that
+// needs to seek, like http.ServeContent() or zip.NewReader(). Content isn't
+// read into memory, unless it's encrypted. The caller must close it
+func (store *Store) GetSeeker(id string) (io.ReadSeekCloser, error) {
+	if store.aead != nil {
+		d, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		return bytesSeeker{bytes.NewReader(d)}, nil
+	}
+	file, blob, err := store.openBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	return &blobSeeker{
+		SectionReader: io.NewSectionReader(file, int64(blob.offset), int64(blob.size)),
+		file:          file,
+		done:          sync.OnceFunc(func() { store.doneReading(blob.nSegment) }),
+	}, nil
 }
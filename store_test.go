@@ -1,12 +1,28 @@
 package contentstore
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"maps"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kjk/u"
 )
@@ -20,16 +36,10 @@ const (
 )
 
 func removeStoreFiles(basePath string) {
-	path := idxFilePath(basePath)
-	os.Remove(path)
-	nSegment := 0
-	for {
-		path = segmentFilePath(basePath, nSegment)
-		if !u.PathExists(path) {
-			break
-		}
+	// all files used by the store start with basePath + "_"
+	paths, _ := filepath.Glob(basePath + "_*")
+	for _, path := range paths {
 		os.Remove(path)
-		nSegment += 1
 	}
 }
 
@@ -84,18 +94,60 @@ func testGet(t *testing.T, store *Store, rnd *rand.Rand, blobIds []string) {
 		if sha1Hex != id {
 			t.Fatalf("store.Get() returned bad content, id is %s while sha1 is %s, should be same", id, sha1Hex)
 		}
+		if !store.Exists(id) {
+			t.Fatalf("store.Exists(%q) returned false", id)
+		}
+		info, err := store.Stat(id)
+		if err != nil || info.Size != len(d) {
+			t.Fatalf("store.Stat(%q) returned %v, %v, expected size %d", id, info, err, len(d))
+		}
+	}
+	for i := 0; i < 16; i++ {
+		id := blobIds[rnd.Intn(nBlobs)]
+		var buf bytes.Buffer
+		if _, err = store.CopyTo(id, &buf); err != nil {
+			t.Fatalf("store.CopyTo(%q) failed with %q", id, err)
+		}
+		sha1Hex := fmt.Sprintf("%x", u.Sha1OfBytes(buf.Bytes()))
+		if sha1Hex != id {
+			t.Fatalf("store.CopyTo() wrote bad content, id is %s while sha1 is %s, should be same", id, sha1Hex)
+		}
+	}
+	for i := 0; i < 16; i++ {
+		id := blobIds[rnd.Intn(nBlobs)]
+		r, err := store.GetSeeker(id)
+		if err != nil {
+			t.Fatalf("store.GetSeeker(%q) failed with %q", id, err)
+		}
+		d, _ = io.ReadAll(r)
+		// read the second half again
+		r.Seek(int64(len(d)/2), io.SeekStart)
+		half, _ := io.ReadAll(r)
+		r.Close()
+		if sha1Hex := fmt.Sprintf("%x", u.Sha1OfBytes(d)); sha1Hex != id || !bytes.Equal(half, d[len(d)/2:]) {
+			t.Fatalf("store.GetSeeker() read bad content, id is %s while sha1 is %s, should be same", id, sha1Hex)
+		}
 	}
 	k := "non-existint"
 	d, err = store.Get(k)
-	if err == nil {
-		t.Fatalf("store.Get(%q) returned nil err, expected an error", k)
+	if err != ErrInvalidId {
+		t.Fatalf("store.Get(%q) returned %v, expected %q", k, err, ErrInvalidId)
+	}
+	if _, err = store.Stat(strings.Repeat("0", 40)); err != ErrNotFound {
+		t.Fatalf("store.Stat() of missing blob returned %v, expected %q", err, ErrNotFound)
+	}
+	if err = store.Delete(k); err != ErrInvalidId {
+		t.Fatalf("store.Delete(%q) returned %v, expected %q", k, err, ErrInvalidId)
+	}
+	if store.Exists(k) {
+		t.Fatalf("store.Exists(%q) returned true", k)
 	}
 }
 
-func TestStore(t *testing.T) {
+func testStore(t *testing.T, opts ...Option) {
 	basePath := "test"
 	removeStoreFiles(basePath)
-	store, err := NewWithLimit(basePath, SEGMENT_MAX_SIZE)
+	store, err := NewWithLimit(basePath, SEGMENT_MAX_SIZE, opts...)
 	if err != nil {
 		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, SEGMENT_MAX_SIZE, err)
 	}
@@ -122,15 +174,2888 @@ func TestStore(t *testing.T) {
 	//fmt.Printf("total strings: %d\n", len(blobIds))
 	rnd := rand.New(rand.NewSource(0))
 	testGet(t, store, rnd, blobIds)
+	nBlobs := store.index.count()
 	store.Close()
 	store = nil
-	store, err = NewWithLimit(basePath, SEGMENT_MAX_SIZE)
+	cp, err := readCheckpoint(basePath)
+	if err != nil {
+		t.Fatalf("readCheckpoint(%q) failed with %q", basePath, err)
+	}
+	if cp.nBlobs != nBlobs {
+		t.Fatalf("checkpoint has %d blobs, expected %d", cp.nBlobs, nBlobs)
+	}
+	store, err = NewWithLimit(basePath, SEGMENT_MAX_SIZE, opts...)
 	if err != nil {
 		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, SEGMENT_MAX_SIZE, err)
 	}
+	nForEach := 0
+	err = store.ForEach(func(info BlobInfo) error {
+		nForEach++
+		return nil
+	})
+	if err != nil || nForEach != nBlobs {
+		t.Fatalf("store.ForEach() visited %d blobs, expected %d, err: %v", nForEach, nBlobs, err)
+	}
+	if err = store.Warm(nil); err != nil {
+		t.Fatalf("store.Warm(nil) failed with %q", err)
+	}
+	if err = store.Warm(blobIds[:10]); err != nil {
+		t.Fatalf("store.Warm() failed with %q", err)
+	}
 	testGet(t, store, rnd, blobIds)
 	// TODO: add new items
 	store.Close()
 	store = nil
 	removeStoreFiles(basePath)
 }
+
+func TestStore(t *testing.T) {
+	testStore(t)
+}
+
+func TestStoreSortedIndex(t *testing.T) {
+	testStore(t, WithIndexMode(IndexSorted))
+}
+
+func TestMissingSegment(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	id0, _ := store.Put([]byte("blob in segment 0"))
+	id1, _ := store.Put([]byte("blob in segment 1"))
+	store.Close()
+	os.Remove(segmentFilePath(basePath, 0))
+	// missing segments are only detected when we read from them
+	store, err = NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	defer store.Close()
+	if _, err = store.Get(id0); err != errSegmentFileMissing {
+		t.Fatalf("store.Get(%q) returned %v, expected %q", id0, err, errSegmentFileMissing)
+	}
+	if _, err = store.Get(id1); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id1, err)
+	}
+}
+
+func TestSealedSegment(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	// fills segment 0
+	id0, _ := store.Put([]byte("blob in segment 0"))
+	store.Close()
+	path := segmentFilePath(basePath, 0)
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) failed with %q", path, err)
+	}
+	store, err = NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	defer store.Close()
+	id1, _ := store.Put([]byte("blob 1"))
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("os.Stat(%q) failed with %q", path, err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("sealed segment 0 was modified")
+	}
+	for i, id := range []string{id0, id1} {
+		sha1, _ := sha1FromId(id)
+		blob, ok := store.index.find(sha1)
+		if !ok || blob.nSegment != i {
+			t.Fatalf("blob %q is not in segment %d", id, i)
+		}
+	}
+}
+
+func appendToFile(t *testing.T, path string, d []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("os.OpenFile(%q) failed with %q", path, err)
+	}
+	f.Write(d)
+	f.Close()
+}
+
+func TestRecovery(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("content"))
+	store.Close()
+
+	// simulate a crash in the middle of writing index record
+	torn := appendBlobRecord(nil, DefaultIndexCodec{}, &blob{size: 5})[:10]
+	appendToFile(t, idxFilePath(basePath), torn)
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	stats := store.RecoveryStats()
+	if stats.DiscardedRecords != 1 || stats.DiscardedBytes != int64(len(torn)) {
+		t.Fatalf("unexpected recovery stats %v", stats)
+	}
+	store.Close()
+
+	// corrupted records need WithRecovery()
+	corrupted := appendBlobRecord(nil, DefaultIndexCodec{}, &blob{size: 5})
+	corrupted[8] ^= 0xff
+	corrupted = append(corrupted, appendBlobRecord(nil, DefaultIndexCodec{}, &blob{size: 6})...)
+	appendToFile(t, idxFilePath(basePath), corrupted)
+	if _, err = New(basePath); err != errCorruptRecord {
+		t.Fatalf("New(%q) returned %v, expected %q", basePath, err, errCorruptRecord)
+	}
+	store, err = New(basePath, WithRecovery())
+	if err != nil {
+		t.Fatalf("New(%q, WithRecovery()) failed with %q", basePath, err)
+	}
+	stats = store.RecoveryStats()
+	if stats.DiscardedRecords != 2 || stats.DiscardedBytes != int64(len(corrupted)) {
+		t.Fatalf("unexpected recovery stats %v", stats)
+	}
+	if _, err = store.Get(id); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id, err)
+	}
+	id2, _ := store.Put([]byte("more content"))
+	store.Close()
+	// the index should be valid again
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Get(id2); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id2, err)
+	}
+}
+
+func TestForEachWhileWriting(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 1024)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 1024, err)
+	}
+	defer store.Close()
+	before := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("before %d", i)))
+		before[id] = true
+	}
+	stop := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			store.PutAsync([]byte(fmt.Sprintf("during %d", i)))
+		}
+	}()
+	seen := make(map[string]bool)
+	err = store.ForEach(func(info BlobInfo) error {
+		if seen[info.Id] {
+			t.Fatalf("%s visited twice", info.Id)
+		}
+		seen[info.Id] = true
+		return nil
+	})
+	close(stop)
+	<-written
+	store.Sync()
+	if err != nil {
+		t.Fatalf("store.ForEach() failed with %q", err)
+	}
+	for id := range before {
+		if !seen[id] {
+			t.Fatalf("%s was not visited", id)
+		}
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("content"))
+	store.Close()
+
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	if store.RecoveryStats().Crashed {
+		t.Fatalf("store was closed cleanly but RecoveryStats().Crashed is true")
+	}
+	// simulate a crash by restoring the checkpoint written when opening
+	cpPath := checkpointFilePath(basePath)
+	dirty, err := os.ReadFile(cpPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) failed with %q", cpPath, err)
+	}
+	id2, _ := store.Put([]byte("more content"))
+	store.Close()
+	os.WriteFile(cpPath, dirty, 0644)
+	corrupted := appendBlobRecord(nil, DefaultIndexCodec{}, &blob{size: 5})
+	corrupted[8] ^= 0xff
+	appendToFile(t, idxFilePath(basePath), corrupted)
+
+	// a corrupted record written after a crash doesn't need WithRecovery()
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	stats := store.RecoveryStats()
+	if !stats.Crashed || stats.DiscardedRecords != 1 {
+		t.Fatalf("unexpected recovery stats %v", stats)
+	}
+	for _, id := range []string{id, id2} {
+		if _, err = store.Get(id); err != nil {
+			t.Fatalf("store.Get(%q) failed with %q", id, err)
+		}
+	}
+}
+
+func TestSegmentMismatch(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("content"))
+	id2, _ := store.Put([]byte("more content"))
+	store.Close()
+
+	// data written before a crash, without index record
+	path := segmentFilePath(basePath, 0)
+	before, _ := os.Stat(path)
+	appendToFile(t, path, []byte("orphaned"))
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	if n := store.RecoveryStats().OrphanedBytes; n != int64(len("orphaned")) {
+		t.Fatalf("RecoveryStats().OrphanedBytes is %d, expected %d", n, len("orphaned"))
+	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Fatalf("segment size is %d, expected %d", after.Size(), before.Size())
+	}
+	store.Close()
+
+	// lost data of the last blob
+	os.Truncate(path, before.Size()-1)
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if !store.RecoveryStats().ShortSegment {
+		t.Fatalf("RecoveryStats().ShortSegment is false")
+	}
+	id3, _ := store.Put([]byte("new content"))
+	if _, err = store.Get(id); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id, err)
+	}
+	if _, err = store.Get(id2); err == nil {
+		t.Fatalf("store.Get(%q) of a lost blob didn't fail", id2)
+	}
+	sha1, _ := sha1FromId(id3)
+	if blob, _ := store.index.find(sha1); blob.nSegment != 1 {
+		t.Fatalf("new blob is in segment %d, expected 1", blob.nSegment)
+	}
+}
+
+func TestMigrateCsvIndex(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	d := []byte("content")
+	id := fmt.Sprintf("%x", u.Sha1OfBytes(d))
+	csvIdx := fmt.Sprintf("%s\n%s,0,0,%d\n", csvIdxHdr, id, len(d))
+	os.WriteFile(csvIdxFilePath(basePath), []byte(csvIdx), 0644)
+	os.WriteFile(segmentFilePath(basePath, 0), d, 0644)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if u.PathExists(csvIdxFilePath(basePath)) {
+		t.Fatalf("CSV index should be removed after migration")
+	}
+	d2, err := store.Get(id)
+	if err != nil || !bytes.Equal(d, d2) {
+		t.Fatalf("store.Get(%q) returned %q, %v", id, d2, err)
+	}
+}
+
+func TestPutAfterClose(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Close()
+	if _, err = store.Put([]byte("content")); err != errClosed {
+		t.Fatalf("store.Put() after Close() returned %v, expected %q", err, errClosed)
+	}
+}
+
+func TestPutAsync(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, SEGMENT_MAX_SIZE)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, SEGMENT_MAX_SIZE, err)
+	}
+	defer store.Close()
+	rnd := rand.New(rand.NewSource(0))
+	futures := make([]*PutFuture, 0)
+	for i := 0; i < 100; i++ {
+		futures = append(futures, store.PutAsync(genRandBytes(rnd, rnd.Intn(SMALL_BLOB_MAX))))
+	}
+	blobIds := make([]string, 0)
+	for _, f := range futures {
+		<-f.Done()
+		id, err := f.Wait()
+		if err != nil {
+			t.Fatalf("PutFuture.Wait() failed with %q", err)
+		}
+		blobIds = append(blobIds, id)
+	}
+	testGet(t, store, rnd, blobIds)
+}
+
+func TestSync(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	futures := make([]*PutFuture, 0)
+	for i := 0; i < 50; i++ {
+		futures = append(futures, store.PutAsync([]byte(fmt.Sprintf("blob %d", i))))
+	}
+	if err = store.Sync(); err != nil {
+		t.Fatalf("store.Sync() failed with %q", err)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatalf("store.Sync() returned before all writes finished")
+		}
+	}
+}
+
+func TestConcurrentIdenticalPuts(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	d := []byte("same content")
+	futures := make([]*PutFuture, 0)
+	for i := 0; i < 50; i++ {
+		futures = append(futures, store.PutAsync(d))
+	}
+	for _, f := range futures {
+		id, err := f.Wait()
+		if err != nil || id != fmt.Sprintf("%x", u.Sha1OfBytes(d)) {
+			t.Fatalf("PutFuture.Wait() returned %q, %v", id, err)
+		}
+	}
+	stats, _ := store.Stats()
+	if stats.SegmentsSize != int64(len(d)) || stats.DedupHits != 49 {
+		t.Fatalf("content written %d bytes, %d dedup hits, expected %d and 49", stats.SegmentsSize, stats.DedupHits, len(d))
+	}
+}
+
+func TestPutReader(t *testing.T) {
+	basePath := "test"
+	rnd := rand.New(rand.NewSource(1))
+	big := genRandBytes(rnd, 3*1024*1024+17)
+	for _, opts := range [][]Option{nil, {WithGitObjects()}, {WithSha256Ids()}} {
+		removeStoreFiles(basePath)
+		store, err := NewWithLimit(basePath, 1024*1024, opts...)
+		if err != nil {
+			t.Fatalf("NewWithLimit(%q) failed with %q", basePath, err)
+		}
+		small, _ := store.Put([]byte("small"))
+		id, n, err := store.PutReader(bytes.NewReader(big))
+		if err != nil {
+			t.Fatalf("store.PutReader() failed with %q", err)
+		}
+		if expected := fmt.Sprintf("%x", store.sha1Of(big)); id != expected || n != int64(len(big)) {
+			t.Fatalf("store.PutReader() returned %q, %d, expected %q, %d", id, n, expected, len(big))
+		}
+		if id2, _, _ := store.PutReader(strings.NewReader("small")); id2 != small {
+			t.Fatalf("store.PutReader() returned %q, expected %q", id2, small)
+		}
+		store.Close()
+
+		store, err = New(basePath, opts...)
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		if d, err := store.Get(id); err != nil || !bytes.Equal(d, big) {
+			t.Fatalf("store.Get(%q) returned %d bytes, %v", id, len(d), err)
+		}
+		if store.aliases != nil {
+			sum := sha256.Sum256(big)
+			if d, err := store.Get(hex.EncodeToString(sum[:])); err != nil || !bytes.Equal(d, big) {
+				t.Fatalf("store.Get() by sha256 returned %d bytes, %v", len(d), err)
+			}
+		}
+		store.Close()
+	}
+	defer removeStoreFiles(basePath)
+	if paths, _ := filepath.Glob(basePath + "_put_*"); len(paths) > 0 {
+		t.Fatalf("temporary files %v were not removed", paths)
+	}
+
+	removeStoreFiles(basePath)
+	store, err := New(basePath, WithMaxBlobSize(1024))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, _, err = store.PutReader(bytes.NewReader(big)); err != ErrBlobTooLarge {
+		t.Fatalf("store.PutReader() returned %v, expected %v", err, ErrBlobTooLarge)
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 1024*1024, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	rnd := rand.New(rand.NewSource(1))
+	d := genRandBytes(rnd, 2*1024*1024+3)
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, d, 0644)
+	id, err := store.PutFile(path)
+	if err != nil {
+		t.Fatalf("store.PutFile(%q) failed with %q", path, err)
+	}
+	if expected := fmt.Sprintf("%x", sha1.Sum(d)); id != expected {
+		t.Fatalf("store.PutFile(%q) returned %q, expected %q", path, id, expected)
+	}
+	sum := sha256.Sum256(d)
+	for _, id := range []string{id, hex.EncodeToString(sum[:])} {
+		if got, err := store.Get(id); err != nil || !bytes.Equal(got, d) {
+			t.Fatalf("store.Get(%q) returned %d bytes, %v", id, len(got), err)
+		}
+	}
+	if _, err = store.PutFile(path + ".missing"); !os.IsNotExist(err) {
+		t.Fatalf("store.PutFile() of missing file returned %v", err)
+	}
+}
+
+// hashWriter only implements io.Writer, so that io.Copy() can't use
+// ReadFrom()
+type hashWriter struct {
+	h hash.Hash
+}
+
+func (w hashWriter) Write(d []byte) (int, error) {
+	return w.h.Write(d)
+}
+
+func TestCopyToReusesBuffer(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	d := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	id, _ := store.Put(d)
+	w := hashWriter{sha1.New()}
+	if n, err := store.CopyTo(id, w); err != nil || n != int64(len(d)) || fmt.Sprintf("%x", w.h.Sum(nil)) != id {
+		t.Fatalf("store.CopyTo(%q) returned %d, %v", id, n, err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	const n = 100
+	for i := 0; i < n; i++ {
+		store.CopyTo(id, w)
+	}
+	runtime.ReadMemStats(&after)
+	// without reusing a buffer each call allocates 32 kB
+	if perCall := (after.TotalAlloc - before.TotalAlloc) / n; perCall > 16*1024 {
+		t.Fatalf("store.CopyTo() allocated %d bytes per call", perCall)
+	}
+}
+
+func TestCopyToFile(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, _ := store.Put([]byte("for an external tool"))
+	path := filepath.Join(t.TempDir(), "blob")
+	if err = store.CopyToFile(id, path); err != nil {
+		t.Fatalf("store.CopyToFile(%q) failed with %q", id, err)
+	}
+	if d, err := os.ReadFile(path); err != nil || string(d) != "for an external tool" {
+		t.Fatalf("os.ReadFile(%q) returned %q, %v", path, d, err)
+	}
+	missing := strings.Repeat("0", 40)
+	path2 := filepath.Join(filepath.Dir(path), "missing")
+	if err = store.CopyToFile(missing, path2); err != ErrNotFound {
+		t.Fatalf("store.CopyToFile(%q) returned %v, expected %v", missing, err, ErrNotFound)
+	}
+	if paths, _ := filepath.Glob(path2 + "*"); len(paths) != 0 {
+		t.Fatalf("store.CopyToFile() of missing blob left %v", paths)
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() failed with %q", err)
+	}
+	defer conn.Close()
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	cfg := StatsD{
+		Addr:     conn.LocalAddr().String(),
+		Prefix:   "cs.",
+		Tags:     []string{"env:test"},
+		Interval: 10 * time.Millisecond,
+	}
+	store, err := New(basePath, WithStatsD(cfg))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Put([]byte("content"))
+	store.Put([]byte("content"))
+
+	// counters are sent as a change since the previous packet so we add
+	// them up until we see the dedup hit
+	hits := 0
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for hits == 0 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("conn.ReadFrom() failed with %q", err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		if !slices.Contains(lines, "cs.segments:1|g|#env:test") {
+			t.Fatalf("unexpected packet %q", buf[:n])
+		}
+		if slices.Contains(lines, "cs.dedup_hits:1|c|#env:test") {
+			if !slices.Contains(lines, "cs.blobs:1|g|#env:test") || !slices.Contains(lines, "cs.dedup_saved_bytes:7|c|#env:test") {
+				t.Fatalf("unexpected packet %q", buf[:n])
+			}
+			hits++
+		}
+	}
+	if err = store.Close(); err != nil {
+		t.Fatalf("store.Close() failed with %q", err)
+	}
+
+	// the dedup hit was saved and sent already
+	store, err = New(basePath, WithStatsD(cfg))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("conn.ReadFrom() failed with %q", err)
+	}
+	if !strings.Contains(string(buf[:n]), "cs.dedup_hits:0|c|#env:test") {
+		t.Fatalf("unexpected packet %q", buf[:n])
+	}
+	store.Close()
+
+	// segments removed by GC() are not counted
+	conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() failed with %q", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	removeStoreFiles(basePath)
+	cfg.Addr = conn.LocalAddr().String()
+	cfg.Interval = time.Hour
+	store, err = NewWithLimit(basePath, 100, WithStatsD(cfg))
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	// 60 bytes each, so that each segment has 2 blobs
+	for i := 0; i < 5; i++ {
+		store.Put(bytes.Repeat([]byte{byte(i)}, 60))
+	}
+	if res, err := store.GC(GCOptions{Keep: func(id string) bool { return false }}); err != nil || len(res.Segments) != 2 {
+		t.Fatalf("store.GC() returned %+v, %v", res, err)
+	}
+	if err = store.flushStatsD(); err != nil {
+		t.Fatalf("store.flushStatsD() failed with %q", err)
+	}
+	n, _, err = conn.ReadFrom(buf)
+	if err != nil || !strings.Contains(string(buf[:n]), "cs.segments:1|g|#env:test") {
+		t.Fatalf("unexpected packet %q, %v", buf[:n], err)
+	}
+}
+
+func TestPutWithSource(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	store.Put([]byte("first"))
+	store.PutWithSource([]byte("first"), "resend")
+	store.PutWithSource([]byte("first"), "resend")
+	store.PutWithSource([]byte("second"), "resend")
+	store.PutWithSource([]byte("third"), "new")
+	stats, _ := store.Stats()
+	expected := map[string]SourceStats{
+		"resend": {Puts: 3, Bytes: 16, DedupHits: 2, DedupSavedBytes: 10},
+		"new":    {Puts: 1, Bytes: 5},
+	}
+	if !maps.Equal(stats.Sources, expected) {
+		t.Fatalf("stats.Sources is %v, expected %v", stats.Sources, expected)
+	}
+	if stats.DedupHits != 2 {
+		t.Fatalf("stats.DedupHits is %d, expected 2", stats.DedupHits)
+	}
+}
+
+// tenantCodec stores tenant name in every index record
+type tenantCodec struct {
+	tenant  string
+	decoded []string
+}
+
+func (c *tenantCodec) AppendRecord(dst []byte, rec *IndexRecord) []byte {
+	rec.Extra = []byte(c.tenant)
+	return DefaultIndexCodec{}.AppendRecord(dst, rec)
+}
+
+func (c *tenantCodec) DecodeRecord(d []byte, rec *IndexRecord) error {
+	err := DefaultIndexCodec{}.DecodeRecord(d, rec)
+	c.decoded = append(c.decoded, string(rec.Extra))
+	return err
+}
+
+func TestIndexCodec(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	codec := &tenantCodec{tenant: "tenant1"}
+	store, err := New(basePath, WithIndexCodec(codec))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("content"))
+	store.Close()
+	store, err = New(basePath, WithIndexCodec(codec))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Close()
+	if len(codec.decoded) != 1 || codec.decoded[0] != "tenant1" {
+		t.Fatalf("unexpected decoded records %v", codec.decoded)
+	}
+	// default codec should ignore fields it doesn't know about
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Get(id); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id, err)
+	}
+}
+
+func TestPutWithExtra(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer func() { store.Close() }()
+	// 60 bytes each, so that each segment has 2 blobs
+	removed, _ := store.Put(bytes.Repeat([]byte{1}, 60))
+	id, err := store.PutWithExtra(bytes.Repeat([]byte{2}, 60), []byte("tenant1"))
+	if err != nil {
+		t.Fatalf("store.PutWithExtra() failed with %q", err)
+	}
+	if _, err = store.PutWithExtra([]byte("too much"), make([]byte, MaxExtraSize+1)); err != ErrExtraTooLarge {
+		t.Fatalf("store.PutWithExtra() returned %v, expected %v", err, ErrExtraTooLarge)
+	}
+	checkExtra := func(when string) {
+		t.Helper()
+		if info, err := store.Stat(id); err != nil || string(info.Extra) != "tenant1" {
+			t.Fatalf("store.Stat(%q) %s returned %+v, %v", id, when, info, err)
+		}
+	}
+	checkExtra("after Put")
+	for _, clean := range []bool{true, false} {
+		store.Close()
+		if !clean {
+			os.Remove(checkpointFilePath(basePath))
+		}
+		if store, err = NewWithLimit(basePath, 100); err != nil {
+			t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+		}
+		checkExtra("after reopening")
+	}
+	// segment 0 is half dead, so the blob is moved and the index rewritten
+	store.Delete(removed)
+	res, err := store.Compact(CompactOptions{})
+	if err != nil || len(res.Segments) != 1 || res.IndexRecords == 0 {
+		t.Fatalf("store.Compact() returned %+v, %v", res, err)
+	}
+	checkExtra("after Compact()")
+	store.Close()
+	if store, err = NewWithLimit(basePath, 100); err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	checkExtra("after reopening compacted store")
+
+	dst := "test_packed"
+	removeStoreFiles(dst)
+	defer removeStoreFiles(dst)
+	if err = store.Pack(dst, 100); err != nil {
+		t.Fatalf("store.Pack(%q) failed with %q", dst, err)
+	}
+	packed, err := New(dst)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", dst, err)
+	}
+	defer packed.Close()
+	if info, err := packed.Stat(id); err != nil || string(info.Extra) != "tenant1" {
+		t.Fatalf("packed.Stat(%q) returned %+v, %v", id, info, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	defer store.Close()
+	id0, _ := store.Put([]byte("blob in segment 0"))
+	store.Put([]byte("blob in segment 1"))
+	res, err := store.Verify(VerifyOptions{Deep: true, Workers: 2})
+	if err != nil || !res.OK() || res.Blobs != 2 {
+		t.Fatalf("store.Verify() returned %v, %v", res, err)
+	}
+	// 34 bytes at 100 bytes per second
+	start := time.Now()
+	res, err = store.Verify(VerifyOptions{Deep: true, Workers: 2, MaxBytesPerSec: 100})
+	if err != nil || !res.OK() || time.Since(start) < 300*time.Millisecond {
+		t.Fatalf("store.Verify() with MaxBytesPerSec returned %v, %v after %s", res, err, time.Since(start))
+	}
+	// corrupt the content of the first blob
+	f, _ := os.OpenFile(segmentFilePath(basePath, 0), os.O_WRONLY, 0644)
+	f.WriteAt([]byte("x"), 0)
+	f.Close()
+	res, err = store.Verify(VerifyOptions{})
+	if err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %v, %v", res, err)
+	}
+	res, err = store.Verify(VerifyOptions{Deep: true, Workers: 2})
+	if err != nil || len(res.Corrupted) != 1 || res.Corrupted[0] != id0 {
+		t.Fatalf("store.Verify() returned %v, %v", res, err)
+	}
+}
+
+func TestAccessCounts(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath, WithAccessCounts())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id1, _ := store.Put([]byte("popular"))
+	id2, _ := store.Put([]byte("less popular"))
+	id3, _ := store.Put([]byte("never read"))
+	start := time.Now().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		store.Get(id1)
+	}
+	store.CopyTo(id2, io.Discard)
+	store.Close()
+
+	// counts should survive re-opening the store
+	store, err = New(basePath, WithAccessCounts())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	store.Get(id2)
+	top := store.TopN(5)
+	if len(top) != 2 || top[0] != (AccessCount{id1, 3}) || top[1] != (AccessCount{id2, 2}) {
+		t.Fatalf("store.TopN(5) returned %v", top)
+	}
+	if top = store.TopN(1); len(top) != 1 || top[0].Id != id1 {
+		t.Fatalf("store.TopN(1) returned %v", top)
+	}
+	if lastRead := store.LastRead(id1); lastRead.Before(start) || lastRead.After(time.Now()) {
+		t.Fatalf("store.LastRead(%q) returned %s", id1, lastRead)
+	}
+	if lastRead := store.LastRead(id3); !lastRead.IsZero() {
+		t.Fatalf("store.LastRead(%q) returned %s, expected zero time", id3, lastRead)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	writer, err := NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, %d) failed with %q", basePath, 16, err)
+	}
+	defer writer.Close()
+	id1, _ := writer.Put([]byte("first"))
+	reader, err := OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer reader.Close()
+	if _, err = reader.Get(id1); err != nil {
+		t.Fatalf("reader.Get(%q) failed with %q", id1, err)
+	}
+	if _, err = reader.Put([]byte("not allowed")); err != errReadOnly {
+		t.Fatalf("reader.Put() returned %v, expected %v", err, errReadOnly)
+	}
+
+	// blobs added after opening: in the same segment and in a new segment
+	id2, _ := writer.Put([]byte("second"))
+	id3, _ := writer.Put([]byte("third, in a new segment"))
+	for _, id := range []string{id2, id3} {
+		if _, err = reader.Get(id); err != nil {
+			t.Fatalf("reader.Get(%q) failed with %q", id, err)
+		}
+	}
+
+	// half-written record must be skipped but not removed
+	id4, _ := writer.Put([]byte("fourth"))
+	appendToFile(t, idxFilePath(basePath), []byte{5, 0})
+	if err = reader.Refresh(); err != nil {
+		t.Fatalf("reader.Refresh() failed with %q", err)
+	}
+	n := 0
+	reader.ForEach(func(info BlobInfo) error {
+		n++
+		return nil
+	})
+	if n != 4 || !reader.Exists(id4) {
+		t.Fatalf("reader sees %d blobs, expected 4", n)
+	}
+	stat, _ := os.Stat(idxFilePath(basePath))
+	if stat.Size() != reader.idxOffset+2 {
+		t.Fatalf("reader modified index file")
+	}
+}
+
+func TestDoubleOpen(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	for _, path := range []string{basePath, "./" + basePath, filepath.Join("..", filepath.Base(mustGetwd(t)), basePath)} {
+		if _, err = New(path); err != ErrAlreadyOpen {
+			t.Fatalf("New(%q) of open store returned %v, expected %v", path, err, ErrAlreadyOpen)
+		}
+	}
+	shared, err := New(basePath, WithSharedHandle())
+	if err != nil || shared != store {
+		t.Fatalf("New(%q, WithSharedHandle()) returned %p, %v, expected %p", basePath, shared, err, store)
+	}
+	reader, err := OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	reader.Close()
+	// the other handle is still open
+	shared.Close()
+	if _, err = store.Put([]byte("still open")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	store.Close()
+	if _, err = store.Put([]byte("closed")); err != errClosed {
+		t.Fatalf("store.Put() returned %v, expected %v", err, errClosed)
+	}
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) of closed store failed with %q", basePath, err)
+	}
+	// until Close() is done with files of the store, it can't be opened,
+	// even with a shared handle
+	store.release()
+	if _, err = New(basePath, WithSharedHandle()); err != ErrAlreadyOpen {
+		t.Fatalf("New(%q) of store being closed returned %v, expected %v", basePath, err, ErrAlreadyOpen)
+	}
+	store.Close()
+}
+
+func mustGetwd(t *testing.T) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("os.Getwd() failed with %q", err)
+	}
+	return dir
+}
+
+func TestNewWithoutWritePermission(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write read-only files")
+	}
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("not writable"))
+	store.Close()
+	paths, _ := filepath.Glob(basePath + "_*")
+	for _, path := range paths {
+		os.Chmod(path, 0444)
+	}
+	// unlike read-only media, missing permission is an error
+	if store, err = New(basePath); !errors.Is(err, os.ErrPermission) {
+		if err == nil {
+			store.Close()
+		}
+		t.Fatalf("New(%q) of read-only files returned %v, expected %v", basePath, err, os.ErrPermission)
+	}
+	store, err = OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if d, err := store.Get(id); err != nil || string(d) != "not writable" {
+		t.Fatalf("store.Get(%q) returned %q, %v", id, d, err)
+	}
+}
+
+func TestReservedSpace(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	free, err := freeDiskSpace(".")
+	if err != nil {
+		t.Skipf("freeDiskSpace() failed with %q", err)
+	}
+	store, err := New(basePath, WithReservedSpace(free/2))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Put([]byte("small")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	if err = store.Health(); err != nil {
+		t.Fatalf("store.Health() returned %v", err)
+	}
+	store.reservedSpace = free * 2
+	if err = store.Health(); err != ErrDiskFull {
+		t.Fatalf("store.Health() returned %v, expected %v", err, ErrDiskFull)
+	}
+	if _, err = store.Put([]byte("too big")); err != ErrDiskFull {
+		t.Fatalf("store.Put() returned %v, expected %v", err, ErrDiskFull)
+	}
+	if st, _ := os.Stat(segmentFilePath(basePath, 0)); st.Size() != 5 {
+		t.Fatalf("size of segment is %d, expected 5", st.Size())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath, WithQuota(10))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	if _, err = store.Put([]byte("12345678")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	if _, err = store.Put([]byte("123")); err != ErrQuotaExceeded {
+		t.Fatalf("store.Put() returned %v, expected %v", err, ErrQuotaExceeded)
+	}
+	// duplicates don't use space
+	if _, err = store.Put([]byte("12345678")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	store.Close()
+
+	// size of existing blobs counts after re-opening
+	store, err = New(basePath, WithQuota(10))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Put([]byte("123")); err != ErrQuotaExceeded {
+		t.Fatalf("store.Put() returned %v, expected %v", err, ErrQuotaExceeded)
+	}
+	if _, err = store.Put([]byte("12")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+}
+
+func TestSoftLimit(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	var mu sync.Mutex
+	var got []SoftLimit
+	opts := []Option{
+		WithQuota(100),
+		WithPolicy(Policy{MaxTotalSize: 50, Interval: time.Hour}),
+		WithSoftLimit(0.8, func(sl SoftLimit) {
+			mu.Lock()
+			got = append(got, sl)
+			mu.Unlock()
+		}),
+	}
+	expect := func(what string, expected ...SoftLimit) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Equal(got, expected) {
+			t.Fatalf("%s: got %v, expected %v", what, got, expected)
+		}
+		got = nil
+	}
+	store, err := New(basePath, opts...)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Put(bytes.Repeat([]byte("a"), 30))
+	expect("30 bytes")
+	id, _ := store.Put(bytes.Repeat([]byte("b"), 15))
+	expect("45 bytes", SoftLimit{Kind: SoftLimitMaxTotalSize, Size: 45, Max: 50})
+	store.Put(bytes.Repeat([]byte("c"), 40))
+	expect("85 bytes", SoftLimit{Kind: SoftLimitQuota, Size: 85, Max: 100})
+	store.Put(bytes.Repeat([]byte("d"), 5))
+	expect("90 bytes")
+
+	// below both limits, then over them again
+	store.Delete(id)
+	store.Put(bytes.Repeat([]byte("e"), 4))
+	expect("79 bytes")
+	store.Put(bytes.Repeat([]byte("f"), 10))
+	expect("89 bytes", SoftLimit{Kind: SoftLimitQuota, Size: 89, Max: 100})
+	store.Close()
+
+	// over the limit when opened
+	store, err = New(basePath, opts...)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Close()
+	expect("opened", SoftLimit{Kind: SoftLimitQuota, Size: 89, Max: 100}, SoftLimit{Kind: SoftLimitMaxTotalSize, Size: 89, Max: 50})
+}
+
+func TestMaxBlobSize(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath, WithMaxBlobSize(4))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Put([]byte("1234")); err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	if _, err = store.Put([]byte("12345")); err != ErrBlobTooLarge {
+		t.Fatalf("store.Put() returned %v, expected %v", err, ErrBlobTooLarge)
+	}
+	if _, err = store.PutAsync([]byte("12345")).Wait(); err != ErrBlobTooLarge {
+		t.Fatalf("store.PutAsync() returned %v, expected %v", err, ErrBlobTooLarge)
+	}
+	if stats, _ := store.Stats(); stats.Blobs != 1 {
+		t.Fatalf("store has %d blobs, expected 1", stats.Blobs)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("blob %d", i)))
+		ids = append(ids, id)
+	}
+	got, next, err := store.Changes(Cursor{}, 3)
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(ids[:3]) {
+		t.Fatalf("store.Changes({}, 3) returned %v, %v", got, err)
+	}
+	got, next, err = store.Changes(next, 3)
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(ids[3:]) {
+		t.Fatalf("store.Changes(%v, 3) returned %v, %v", next, got, err)
+	}
+	id, _ := store.Put([]byte("added later"))
+	got, next, err = store.Changes(next, 3)
+	if err != nil || len(got) != 1 || got[0] != id {
+		t.Fatalf("store.Changes(%v, 3) returned %v, %v", next, got, err)
+	}
+	ids = append(ids, id)
+
+	// rewriting the index starts a new generation, so a cursor from before
+	// starts from the beginning
+	store.Delete(ids[0])
+	if _, err = store.Compact(CompactOptions{}); err != nil {
+		t.Fatalf("store.Compact() failed with %q", err)
+	}
+	if gen := store.IndexGeneration(); gen != next.Generation+1 {
+		t.Fatalf("store.IndexGeneration() is %d after Compact(), expected %d", gen, next.Generation+1)
+	}
+	got, next2, err := store.Changes(next, 10)
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(ids[1:]) || next2.Generation != next.Generation+1 {
+		t.Fatalf("store.Changes(%v, 10) after Compact() returned %v, %v, %v", next, got, next2, err)
+	}
+	// generation survives reopening
+	store.Close()
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if got, _, err = store.Changes(next2, 10); err != nil || len(got) != 0 {
+		t.Fatalf("store.Changes(%v, 10) after reopening returned %v, %v", next2, got, err)
+	}
+}
+
+func TestPoisoned(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, _ := store.Put([]byte("content that will be cut short"))
+	if err = store.Health(); err != nil {
+		t.Fatalf("store.Health() returned %v", err)
+	}
+	// index says the blob is there but segment file is shorter
+	os.Truncate(segmentFilePath(basePath, 0), 4)
+	store.Lock()
+	store.currSegmentSize = 4
+	store.Unlock()
+	if _, err = store.Get(id); err != errSegmentFileShort {
+		t.Fatalf("store.Get(%q) returned %v, expected %v", id, err, errSegmentFileShort)
+	}
+	if err = store.Health(); !errors.Is(err, ErrPoisoned) {
+		t.Fatalf("store.Health() returned %v, expected %v", err, ErrPoisoned)
+	}
+	if _, err = store.Put([]byte("new content")); !errors.Is(err, ErrPoisoned) || !errors.Is(err, errSegmentFileShort) {
+		t.Fatalf("store.Put() returned %v, expected %v", err, ErrPoisoned)
+	}
+}
+
+func TestPutLarge(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	for _, size := range []int{0, 100, largeChunkSize, 2*largeChunkSize + 7} {
+		d := make([]byte, size)
+		rand.Read(d)
+		id, err := store.PutLarge(bytes.NewReader(d))
+		if err != nil {
+			t.Fatalf("store.PutLarge() of %d bytes failed with %q", size, err)
+		}
+		r, err := store.GetLarge(id)
+		if err != nil {
+			t.Fatalf("store.GetLarge(%q) failed with %q", id, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, d) {
+			t.Fatalf("reading large file of %d bytes returned %d bytes, %v", size, len(got), err)
+		}
+	}
+	id, _ := store.Put([]byte("not a manifest"))
+	if _, err = store.GetLarge(id); err != errInvalidManifest {
+		t.Fatalf("store.GetLarge(%q) returned %v, expected %v", id, err, errInvalidManifest)
+	}
+}
+
+func TestImportHashedDir(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	dir := t.TempDir()
+	var ids []string
+	for i := 0; i < 10; i++ {
+		d := []byte(fmt.Sprintf("blob %d", i))
+		id := fmt.Sprintf("%x", u.Sha1OfBytes(d))
+		os.MkdirAll(filepath.Join(dir, id[:2]), 0755)
+		os.WriteFile(filepath.Join(dir, id[:2], id[2:]), d, 0644)
+		ids = append(ids, id)
+	}
+	// wrong content, wrong layout
+	os.WriteFile(filepath.Join(dir, ids[0][:2], strings.Repeat("0", 38)), []byte("foo"), 0644)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("foo"), 0644)
+
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	store.Put([]byte("blob 3"))
+	layout := HashedDirLayout{Levels: []int{2}, Sha1: true}
+	res, err := store.ImportHashedDir(dir, layout)
+	if err != nil {
+		t.Fatalf("store.ImportHashedDir() failed with %q", err)
+	}
+	if res.Imported != 9 || res.Skipped != 1 || len(res.Mismatched) != 1 || len(res.Ignored) != 1 {
+		t.Fatalf("store.ImportHashedDir() returned %+v", res)
+	}
+	for _, id := range ids {
+		if !store.Exists(id) {
+			t.Fatalf("%s wasn't imported", id)
+		}
+	}
+	if fooId := fmt.Sprintf("%x", u.Sha1OfBytes([]byte("foo"))); store.Exists(fooId) {
+		t.Fatalf("mismatched file %s was imported", fooId)
+	}
+
+	outDir := t.TempDir()
+	layout.Levels = []int{2, 2}
+	if _, err = store.ExportHashedDir(outDir, layout); err != nil {
+		t.Fatalf("store.ExportHashedDir() failed with %q", err)
+	}
+	for i, id := range ids {
+		path := filepath.Join(outDir, id[:2], id[2:4], id[4:])
+		d, err := os.ReadFile(path)
+		if err != nil || string(d) != fmt.Sprintf("blob %d", i) {
+			t.Fatalf("os.ReadFile(%q) returned %q, %v", path, d, err)
+		}
+	}
+	res2, err := store.ExportHashedDir(outDir, layout)
+	if err != nil || res2.Exported != 0 || res2.Skipped != len(ids) {
+		t.Fatalf("store.ExportHashedDir() returned %+v, %v", res2, err)
+	}
+}
+
+func TestIndexHeaderHash(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	id, _ := store.Put([]byte("content"))
+	store.Close()
+	d, _ := os.ReadFile(idxFilePath(basePath))
+	if hdr := idxHdrPrefix + "sha1 20 0\n"; !bytes.HasPrefix(d, []byte(hdr)) {
+		t.Fatalf("index file starts with %q, expected %q", d[:min(len(d), len(hdr))], hdr)
+	}
+	if _, err = New(basePath, WithGitObjects()); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("New(%q, WithGitObjects()) returned %v, expected %v", basePath, err, ErrHashMismatch)
+	}
+	if _, err = OpenReadOnly(basePath, WithGitObjects()); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("OpenReadOnly(%q, WithGitObjects()) returned %v, expected %v", basePath, err, ErrHashMismatch)
+	}
+
+	// index written by an old version doesn't say so we can't check it
+	hdrEnd := bytes.IndexByte(d, '\n') + 1
+	os.WriteFile(idxFilePath(basePath), append(slices.Clone(idxHdrV1), d[hdrEnd:]...), 0644)
+	os.Remove(checkpointFilePath(basePath))
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) of old store failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if _, err = store.Get(id); err != nil {
+		t.Fatalf("store.Get(%q) failed with %q", id, err)
+	}
+	// opening it for writing upgraded the header
+	d, _ = os.ReadFile(idxFilePath(basePath))
+	if hdr := idxHdrPrefix + "sha1 20 1\n"; !bytes.HasPrefix(d, []byte(hdr)) {
+		t.Fatalf("index file starts with %q, expected %q", d[:min(len(d), len(hdr))], hdr)
+	}
+	id2, _ := store.Put([]byte("more content"))
+	if _, err = store.Compact(CompactOptions{}); err != nil {
+		t.Fatalf("store.Compact() failed with %q", err)
+	}
+	reader, err := OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer reader.Close()
+	if ids, _, err := reader.Changes(Cursor{}, 10); err != nil || !slices.Equal(ids, []string{id, id2}) {
+		t.Fatalf("reader.Changes({}, 10) returned %v, %v", ids, err)
+	}
+}
+
+func TestGitObjects(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath, WithGitObjects())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	// printf 'hello\n' | git hash-object --stdin
+	expId := "ce013625030ba8dba906f756967f9e9ca394464a"
+	id, err := store.Put([]byte("hello\n"))
+	if err != nil || id != expId {
+		t.Fatalf("store.Put() returned %q, %v, expected %q", id, err, expId)
+	}
+	obj, err := store.GitObject(id)
+	if err != nil {
+		t.Fatalf("store.GitObject(%q) failed with %q", id, err)
+	}
+	id, err = store.PutGitObject(obj)
+	if err != nil || id != expId {
+		t.Fatalf("store.PutGitObject() returned %q, %v, expected %q", id, err, expId)
+	}
+	if _, err = store.PutGitObject([]byte("foo")); err != errInvalidGitObject {
+		t.Fatalf("store.PutGitObject() returned %v, expected %v", err, errInvalidGitObject)
+	}
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+}
+
+func TestCID(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id, err := store.Put([]byte("hello\n"))
+	if err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	cid, err := store.CID(id)
+	if exp := "bafkrcfhvoljzn6xjebtcq4kpwlhab5zostzcldy"; err != nil || cid != exp {
+		t.Fatalf("store.CID(%q) returned %q, %v, expected %q", id, cid, err, exp)
+	}
+	mh, err := Multihash(id)
+	if exp := "1114" + id; err != nil || mh != exp {
+		t.Fatalf("Multihash(%q) returned %q, %v, expected %q", id, mh, err, exp)
+	}
+	for _, s := range []string{cid, mh} {
+		d, err := store.Get(s)
+		if err != nil || string(d) != "hello\n" {
+			t.Fatalf("store.Get(%q) returned %q, %v", s, d, err)
+		}
+		if hexId, err := HexId(s); err != nil || hexId != id {
+			t.Fatalf("HexId(%q) returned %q, %v, expected %q", s, hexId, err, id)
+		}
+	}
+	// only lower-case spellings are ids
+	upper := []string{strings.ToUpper(id), strings.ToUpper(mh), "b" + strings.ToUpper(cid[1:])}
+	for _, s := range append([]string{"bafkrc", "1115" + id, "b" + id}, upper...) {
+		if _, err = store.Get(s); err != ErrInvalidId {
+			t.Fatalf("store.Get(%q) returned %v, expected %v", s, err, ErrInvalidId)
+		}
+		if _, err = HexId(s); err != ErrInvalidId {
+			t.Fatalf("HexId(%q) returned %v, expected %v", s, err, ErrInvalidId)
+		}
+	}
+}
+
+func TestCreated(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	start := time.Now().Truncate(time.Second)
+	id, err := store.Put([]byte("foo"))
+	if err != nil {
+		t.Fatalf("store.Put() failed with %q", err)
+	}
+	info, err := store.Stat(id)
+	if err != nil || info.Created.Before(start) || info.Created.After(time.Now()) {
+		t.Fatalf("store.Stat(%q) returned %+v, %v", id, info, err)
+	}
+	store.Close()
+
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	store.ForEach(func(bi BlobInfo) error {
+		if !bi.Created.Equal(info.Created) {
+			t.Fatalf("after re-opening, created is %s, expected %s", bi.Created, info.Created)
+		}
+		return nil
+	})
+}
+
+func TestDelete(t *testing.T) {
+	basePath := "test"
+	for _, mode := range []IndexMode{IndexMap, IndexSorted} {
+		removeStoreFiles(basePath)
+		store, err := New(basePath, WithIndexMode(mode))
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		id1, _ := store.Put([]byte("foo"))
+		id2, _ := store.Put([]byte("bar"))
+		if err = store.Delete(id1); err != nil {
+			t.Fatalf("store.Delete(%q) failed with %q", id1, err)
+		}
+		if err = store.Delete(id1); err != ErrNotFound {
+			t.Fatalf("store.Delete(%q) returned %v, expected %v", id1, err, ErrNotFound)
+		}
+		if _, err = store.Get(id1); err != ErrNotFound {
+			t.Fatalf("store.Get(%q) returned %v, expected %v", id1, err, ErrNotFound)
+		}
+		// deleted and added again
+		store.Put([]byte("bar2"))
+		store.Delete(id2)
+		store.Put([]byte("bar"))
+		store.Close()
+
+		store, err = New(basePath, WithIndexMode(mode))
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		if store.Exists(id1) || !store.Exists(id2) {
+			t.Fatalf("after re-opening, exists(%q) is %v, exists(%q) is %v", id1, store.Exists(id1), id2, store.Exists(id2))
+		}
+		if stats, _ := store.Stats(); stats.Blobs != 2 || stats.BlobsSize != 7 {
+			t.Fatalf("after re-opening, store has %d blobs of %d bytes, expected 2 and 7", stats.Blobs, stats.BlobsSize)
+		}
+		store.Close()
+	}
+	removeStoreFiles(basePath)
+}
+
+func TestPolicy(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	var pinned string
+	policy := Policy{
+		MaxAge:       time.Hour,
+		MaxTotalSize: 27,
+		Pinned:       func(id string) bool { return id == pinned },
+		Interval:     time.Hour,
+	}
+	store, err := New(basePath, WithPolicy(policy), WithAccessCounts())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("blob %d...", i)))
+		ids = append(ids, id)
+	}
+	// blob 0 is too old, blob 1 is pinned and 3 is the least recently used
+	store.Lock()
+	for i, id := range ids {
+		sha1, _ := sha1FromId(id)
+		blob, _ := store.index.remove(sha1)
+		if i == 0 {
+			blob.created -= 2 * 3600
+		}
+		store.index.add(blob)
+		store.access.hits[sha1] = accessInfo{hits: 1, lastRead: blob.created + int64(10-i)}
+	}
+	store.access.hits[blobSha1(t, ids[3])] = accessInfo{hits: 1, lastRead: 1}
+	store.Unlock()
+	pinned = ids[1]
+	res, err := store.ApplyPolicy()
+	if err != nil {
+		t.Fatalf("store.ApplyPolicy() failed with %q", err)
+	}
+	if len(res.Ids) != 2 || res.Ids[0] != ids[0] || res.Ids[1] != ids[3] || res.Size != 18 {
+		t.Fatalf("store.ApplyPolicy() returned %+v", res)
+	}
+	for i, id := range ids {
+		if exp := i != 0 && i != 3; store.Exists(id) != exp {
+			t.Fatalf("exists(%q) is %v, expected %v", id, !exp, exp)
+		}
+	}
+}
+
+func TestReclaimableSpace(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	// 60 bytes each, so that each segment has 2 blobs
+	var ids []string
+	for i := 0; i < 4; i++ {
+		id, _ := store.Put(bytes.Repeat([]byte{byte(i)}, 60))
+		ids = append(ids, id)
+	}
+	store.Delete(ids[0])
+	// nothing reclaims space of removed blobs
+	if n, err := store.reclaimableSpace(); err != nil || n != 0 {
+		t.Fatalf("store.reclaimableSpace() without compaction returned %d, %v", n, err)
+	}
+	// segment 0 is half dead
+	for _, tc := range []struct {
+		ratio float64
+		n     int64
+	}{{0.4, 60}, {0.6, 0}} {
+		store.compaction = &CompactionPolicy{MaxDeadRatio: tc.ratio}
+		if n, err := store.reclaimableSpace(); err != nil || n != tc.n {
+			t.Fatalf("store.reclaimableSpace() with MaxDeadRatio %v returned %d, %v, expected %d", tc.ratio, n, err, tc.n)
+		}
+	}
+	store.punchHoles = true
+	if n, err := store.reclaimableSpace(); err != nil || n != 0 {
+		t.Fatalf("store.reclaimableSpace() when punching holes returned %d, %v", n, err)
+	}
+	store.compaction, store.punchHoles = nil, false
+}
+
+func blobSha1(t *testing.T, id string) [20]byte {
+	sha1, ok := sha1FromId(id)
+	if !ok {
+		t.Fatalf("invalid id %q", id)
+	}
+	return sha1
+}
+
+func TestGC(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	// 60 bytes each, so that each segment has 2 blobs
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, _ := store.Put(bytes.Repeat([]byte{byte(i)}, 60))
+		ids = append(ids, id)
+	}
+	if _, err = store.GC(GCOptions{}); err != errNoKeep {
+		t.Fatalf("store.GC() without Keep returned %v, expected %v", err, errNoKeep)
+	}
+	// keep one blob in segment 1
+	keep := func(id string) bool { return id == ids[2] }
+	res, err := store.GC(GCOptions{Keep: keep, DryRun: true})
+	if err != nil {
+		t.Fatalf("store.GC() failed with %q", err)
+	}
+	// segment 2 is the current one
+	if len(res.Ids) != 4 || res.Size != 240 || len(res.Segments) != 1 || res.Segments[0] != 0 || res.SegmentsSize != 120 {
+		t.Fatalf("store.GC() returned %+v", res)
+	}
+	if !store.Exists(ids[0]) {
+		t.Fatalf("store.GC() with DryRun removed %q", ids[0])
+	}
+	if _, err = store.GC(GCOptions{Keep: keep}); err != nil {
+		t.Fatalf("store.GC() failed with %q", err)
+	}
+	if store.Exists(ids[0]) || !store.Exists(ids[2]) {
+		t.Fatalf("store.GC() didn't remove the right blobs")
+	}
+	if u.PathExists(segmentFilePath(basePath, 0)) {
+		t.Fatalf("store.GC() didn't remove segment 0")
+	}
+	store.Close()
+
+	store, err = NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() || len(res.MissingSegments) != 0 {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+	if err = store.Warm(nil); err != nil {
+		t.Fatalf("store.Warm() failed with %q", err)
+	}
+	if d, err := store.Get(ids[2]); err != nil || len(d) != 60 {
+		t.Fatalf("store.Get(%q) returned %d bytes, %v", ids[2], len(d), err)
+	}
+}
+
+func TestRefs(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	id1, _ := store.Put([]byte("logo v1"))
+	id2, _ := store.Put([]byte("logo v2"))
+	if err = store.SetRef("site/logo", id1); err != nil {
+		t.Fatalf("store.SetRef() failed with %q", err)
+	}
+	store.SetRef("site/css", id2)
+	store.SetRef("other", id2)
+	if err = store.SetRef("", id1); err != ErrInvalidRefName {
+		t.Fatalf("store.SetRef() with empty name returned %v", err)
+	}
+	if err = store.SetRef("x", "0123456789012345678901234567890123456789"); err != ErrNotFound {
+		t.Fatalf("store.SetRef() with unknown id returned %v", err)
+	}
+	if err = store.SetRef("x", "not an id"); err != ErrInvalidId {
+		t.Fatalf("store.SetRef() with invalid id returned %v", err)
+	}
+	if err = store.CompareAndSetRef("site/logo", id2, id2); err != ErrRefChanged {
+		t.Fatalf("store.CompareAndSetRef() returned %v", err)
+	}
+	if err = store.CompareAndSetRef("site/logo", id1, id2); err != nil {
+		t.Fatalf("store.CompareAndSetRef() failed with %q", err)
+	}
+	if id, err := store.Ref("site/logo"); err != nil || id != id2 {
+		t.Fatalf("store.Ref() returned %q, %v", id, err)
+	}
+	if _, err = store.Ref("x"); err != ErrNotFound {
+		t.Fatalf("store.Ref() of missing ref returned %v", err)
+	}
+	refs, err := store.ListRefs("site/")
+	if err != nil || len(refs) != 2 || refs[0].Name != "site/css" || refs[1].Name != "site/logo" {
+		t.Fatalf("store.ListRefs() returned %v, %v", refs, err)
+	}
+	store.SetRef("other", "")
+	store.SetRef("site/css", id1)
+
+	// referenced blobs are kept even if Keep returns false
+	res, err := store.GC(GCOptions{Keep: func(id string) bool { return false }})
+	if err != nil || len(res.Ids) != 0 {
+		t.Fatalf("store.GC() returned %+v, %v", res, err)
+	}
+	store.Close()
+
+	store, err = NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	ro, err := OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer ro.Close()
+	if refs, err = ro.ListRefs(""); err != nil || len(refs) != 2 {
+		t.Fatalf("ro.ListRefs() returned %v, %v", refs, err)
+	}
+	store.SetRef("site/css", "")
+	if _, err = ro.Ref("site/css"); err != ErrNotFound {
+		t.Fatalf("ro.Ref() of removed ref returned %v", err)
+	}
+	if id, err := store.Ref("site/logo"); err != nil || id != id2 {
+		t.Fatalf("store.Ref() returned %q, %v", id, err)
+	}
+}
+
+func TestOpenIngestOnly(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 16)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q) failed with %q", basePath, err)
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("old blob %d", i)))
+		ids = append(ids, id)
+	}
+	store.Close()
+
+	ingest, err := OpenIngestOnly(basePath, WithPolicy(Policy{MaxTotalSize: 1}))
+	if err != nil {
+		t.Fatalf("OpenIngestOnly(%q) failed with %q", basePath, err)
+	}
+	for _, id := range ids {
+		if !ingest.Exists(id) {
+			t.Fatalf("ingest.Exists(%q) returned false", id)
+		}
+	}
+	id, err := ingest.Put([]byte("new blob"))
+	if err != nil {
+		t.Fatalf("ingest.Put() failed with %q", err)
+	}
+	if id2, _ := ingest.Put([]byte("old blob 0")); id2 != ids[0] {
+		t.Fatalf("ingest.Put() returned %q, expected %q", id2, ids[0])
+	}
+	if err = ingest.Close(); err != nil {
+		t.Fatalf("ingest.Close() failed with %q", err)
+	}
+	ids = append(ids, id)
+
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	for _, id := range ids {
+		if _, err = store.Get(id); err != nil {
+			t.Fatalf("store.Get(%q) failed with %q", id, err)
+		}
+	}
+	if stats, _ := store.Stats(); stats.Blobs != len(ids) {
+		t.Fatalf("stats.Blobs is %d, expected %d", stats.Blobs, len(ids))
+	}
+}
+
+func TestSpaceReuse(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100, WithSpaceReuse(0.1))
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	blobAt := func(id string) blob {
+		sha1, _ := sha1FromId(id)
+		store.Lock()
+		defer store.Unlock()
+		blob, _ := store.index.find(sha1)
+		return blob
+	}
+	// a and b fill segment 0, c is in segment 1
+	idA, _ := store.Put(bytes.Repeat([]byte{'a'}, 60))
+	idB, _ := store.Put(bytes.Repeat([]byte{'b'}, 60))
+	store.Put(bytes.Repeat([]byte{'c'}, 10))
+	store.Delete(idA)
+
+	// hole is too big for it
+	idE, _ := store.Put(bytes.Repeat([]byte{'e'}, 50))
+	if b := blobAt(idE); b.nSegment != 1 {
+		t.Fatalf("blob of 50 bytes was written to segment %d, offset %d", b.nSegment, b.offset)
+	}
+	// not while b is being read
+	seeker, err := store.GetSeeker(idB)
+	if err != nil {
+		t.Fatalf("store.GetSeeker(%q) failed with %q", idB, err)
+	}
+	idF, _ := store.Put(bytes.Repeat([]byte{'f'}, 58))
+	if b := blobAt(idF); b.nSegment == 0 {
+		t.Fatalf("blob was written to a hole in segment being read")
+	}
+	seeker.Close()
+	idD, _ := store.Put(bytes.Repeat([]byte{'d'}, 56))
+	if b := blobAt(idD); b.nSegment != 0 || b.offset != 0 {
+		t.Fatalf("blob was written to segment %d, offset %d, expected hole at 0 in segment 0", b.nSegment, b.offset)
+	}
+	if st, _ := os.Stat(segmentFilePath(basePath, 0)); st.Size() != 120 {
+		t.Fatalf("size of segment 0 is %d, expected 120", st.Size())
+	}
+	if _, err = store.BackupIncremental(basePath+"_backup", 1); err != errSpaceReuseIncremental {
+		t.Fatalf("store.BackupIncremental() returned %v, expected %v", err, errSpaceReuseIncremental)
+	}
+	store.Close()
+
+	store, err = NewWithLimit(basePath, 100, WithSpaceReuse(0.1))
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	for _, id := range []string{idB, idD, idE, idF} {
+		if _, err = store.Get(id); err != nil {
+			t.Fatalf("store.Get(%q) failed with %q", id, err)
+		}
+	}
+	if d, _ := store.Get(idD); !bytes.Equal(d, bytes.Repeat([]byte{'d'}, 56)) {
+		t.Fatalf("store.Get(%q) returned %q", idD, d)
+	}
+	// what's left of the hole is found when opening
+	store.Lock()
+	holes := store.reuse.holes
+	store.Unlock()
+	if !slices.Contains(holes, hole{nSegment: 0, offset: 56, size: 4}) {
+		t.Fatalf("holes are %v, expected 4 bytes at 56 in segment 0", holes)
+	}
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+}
+
+func TestPunchHoles(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	// check if the filesystem supports punching holes
+	probePath := basePath + "_probe"
+	probe, err := os.Create(probePath)
+	if err != nil {
+		t.Fatalf("os.Create(%q) failed with %q", probePath, err)
+	}
+	probe.Write(make([]byte, 8192))
+	err = punchHole(probe, 0, 4096)
+	probe.Close()
+	os.Remove(probePath)
+	if err != nil {
+		t.Skipf("punching holes not supported: %s", err)
+	}
+
+	store, err := New(basePath, WithPunchHoles())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	rnd := rand.New(rand.NewSource(0))
+	d1, d2, d3 := genRandBytes(rnd, 10000), genRandBytes(rnd, 20000), genRandBytes(rnd, 10000)
+	id1, _ := store.Put(d1)
+	id2, _ := store.Put(d2)
+	id3, _ := store.Put(d3)
+	if err = store.Delete(id2); err != nil {
+		t.Fatalf("store.Delete(%q) failed with %q", id2, err)
+	}
+	segment, err := os.ReadFile(segmentFilePath(basePath, 0))
+	if err != nil {
+		t.Fatalf("os.ReadFile() failed with %q", err)
+	}
+	if !bytes.Equal(segment[10000:30000], make([]byte, 20000)) {
+		t.Fatalf("space of deleted blob wasn't deallocated")
+	}
+	for _, id := range []string{id1, id3} {
+		if _, err := store.Get(id); err != nil {
+			t.Fatalf("store.Get(%q) failed with %q", id, err)
+		}
+	}
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	// 60 bytes each, so that each segment has 2 blobs
+	var ids []string
+	for i := 0; i < 6; i++ {
+		id, _ := store.Put(bytes.Repeat([]byte{byte(i)}, 60))
+		ids = append(ids, id)
+	}
+	// segment 0 is half dead, segment 1 is empty, segment 2 is current
+	store.Delete(ids[0])
+	store.Delete(ids[2])
+	store.Delete(ids[3])
+	dry, err := store.Compact(CompactOptions{DryRun: true})
+	if err != nil || !slices.Equal(dry.Segments, []int{0, 1}) || dry.MovedBlobs != 1 || dry.SegmentsSize != 240 || dry.IndexRecords != 7 {
+		t.Fatalf("store.Compact() with DryRun returned %+v, %v", dry, err)
+	}
+	if !u.PathExists(segmentFilePath(basePath, 0)) {
+		t.Fatalf("store.Compact() with DryRun removed segment 0")
+	}
+	res, err := store.Compact(CompactOptions{})
+	if err != nil || !slices.Equal(res.Segments, dry.Segments) || res.IndexRecords != dry.IndexRecords {
+		t.Fatalf("store.Compact() returned %+v, %v", res, err)
+	}
+	for _, nSegment := range []int{0, 1} {
+		if u.PathExists(segmentFilePath(basePath, nSegment)) {
+			t.Fatalf("segment %d wasn't removed", nSegment)
+		}
+	}
+	for _, id := range []string{ids[1], ids[4], ids[5]} {
+		if d, err := store.Get(id); err != nil || len(d) != 60 {
+			t.Fatalf("store.Get(%q) returned %d bytes, %v", id, len(d), err)
+		}
+	}
+	// nothing left to do
+	res, err = store.Compact(CompactOptions{})
+	if err != nil || len(res.Segments) != 0 || res.IndexRecords != 0 {
+		t.Fatalf("second store.Compact() returned %+v, %v", res, err)
+	}
+}
+
+func TestAutoCompaction(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	policy := CompactionPolicy{MaxDeadRatio: 0.4, MaxIndexRecords: 5, Interval: time.Hour}
+	store, err := NewWithLimit(basePath, 100, WithAutoCompaction(policy))
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	// 60 bytes each, so that each segment has 2 blobs
+	var ids []string
+	for i := 0; i < 6; i++ {
+		id, _ := store.Put(bytes.Repeat([]byte{byte(i)}, 60))
+		ids = append(ids, id)
+	}
+	info, _ := store.Stat(ids[1])
+	ro, err := OpenReadOnly(basePath)
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer ro.Close()
+	if _, err = ro.Get(ids[1]); err != nil {
+		t.Fatalf("ro.Get(%q) failed with %q", ids[1], err)
+	}
+	// segment 0 is half dead and segment 1 is empty
+	store.Delete(ids[0])
+	store.Delete(ids[2])
+	store.Delete(ids[3])
+	idxSize := func() int64 {
+		stat, _ := os.Stat(idxFilePath(basePath))
+		return stat.Size()
+	}
+	sizeBefore := idxSize()
+	_, cursor, _ := store.Changes(Cursor{}, 100)
+	if err = store.autoCompact(); err != nil {
+		t.Fatalf("store.autoCompact() failed with %q", err)
+	}
+	for _, nSegment := range []int{0, 1} {
+		if u.PathExists(segmentFilePath(basePath, nSegment)) {
+			t.Fatalf("segment %d wasn't removed", nSegment)
+		}
+	}
+	if idxSize() >= sizeBefore {
+		t.Fatalf("index wasn't rewritten")
+	}
+	// cursor from before the rewrite starts from the beginning
+	if changes, _, err := store.Changes(cursor, 100); err != nil || len(changes) != 3 {
+		t.Fatalf("store.Changes(%v) after rewriting index returned %v, %v", cursor, changes, err)
+	}
+	if info2, err := store.Stat(ids[1]); err != nil || !info2.Created.Equal(info.Created) {
+		t.Fatalf("store.Stat(%q) of moved blob returned %+v, %v", ids[1], info2, err)
+	}
+	// the writer replaced the index
+	if d, err := ro.Get(ids[1]); err != nil || len(d) != 60 {
+		t.Fatalf("ro.Get(%q) returned %d bytes, %v", ids[1], len(d), err)
+	}
+	store.Put([]byte("added after rewriting index"))
+	store.Close()
+
+	store, err = NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+	if stats, _ := store.Stats(); stats.Blobs != 4 {
+		t.Fatalf("store has %d blobs, expected 4", stats.Blobs)
+	}
+	for _, id := range []string{ids[1], ids[4], ids[5]} {
+		if d, err := store.Get(id); err != nil || len(d) != 60 {
+			t.Fatalf("store.Get(%q) returned %d bytes, %v", id, len(d), err)
+		}
+	}
+	if changes, _, err := store.Changes(Cursor{}, 100); err != nil || len(changes) != 4 {
+		t.Fatalf("store.Changes() returned %v, %v", changes, err)
+	}
+	// segments 2 and 3 remain, 2 has dead bytes
+	store.Delete(ids[4])
+	segments, err := store.segmentsToCompact(&CompactionPolicy{MaxSegments: 1})
+	if err != nil || len(segments) != 1 || segments[0] != 2 {
+		t.Fatalf("store.segmentsToCompact() returned %v, %v", segments, err)
+	}
+}
+
+func TestIndexMismatch(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Put([]byte("foo"))
+	store.Put([]byte("bar"))
+	store.Close()
+	cpPath := checkpointFilePath(basePath)
+	oldCheckpoint, err := os.ReadFile(cpPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) failed with %q", cpPath, err)
+	}
+
+	// checkpoint is stale after a crash but the index only grew
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Put([]byte("baz"))
+	store.Close()
+	os.WriteFile(cpPath, oldCheckpoint, 0644)
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) with stale checkpoint failed with %q", basePath, err)
+	}
+	store.Close()
+
+	// remove the last record
+	idxPath := idxFilePath(basePath)
+	stat, _ := os.Stat(idxPath)
+	blob := blob{created: time.Now().Unix()}
+	recordSize := int64(len(appendBlobRecord(nil, DefaultIndexCodec{}, &blob)))
+	os.Truncate(idxPath, stat.Size()-recordSize)
+	if _, err = New(basePath); err != ErrIndexMismatch {
+		t.Fatalf("New(%q) of truncated index returned %v, expected %v", basePath, err, ErrIndexMismatch)
+	}
+	store, err = New(basePath, WithRecovery())
+	if err != nil {
+		t.Fatalf("New(%q, WithRecovery()) failed with %q", basePath, err)
+	}
+	if stats := store.RecoveryStats(); !stats.IndexMismatch || stats.LostRecords != 1 {
+		t.Fatalf("unexpected recovery stats %+v", stats)
+	}
+	if stats, _ := store.Stats(); stats.Blobs != 2 {
+		t.Fatalf("store has %d blobs, expected 2", stats.Blobs)
+	}
+	store.Close()
+	// closing wrote a new checkpoint
+	store, err = New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	store.Close()
+}
+
+func TestRouter(t *testing.T) {
+	var stores []Storer
+	for i := 0; i < 3; i++ {
+		basePath := fmt.Sprintf("test%d", i)
+		removeStoreFiles(basePath)
+		defer removeStoreFiles(basePath)
+		store, err := New(basePath)
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		stores = append(stores, store)
+	}
+	if _, err := NewRouter(); err == nil {
+		t.Fatalf("NewRouter() without stores didn't fail")
+	}
+	r, err := NewRouter(stores...)
+	if err != nil {
+		t.Fatalf("NewRouter() failed with %q", err)
+	}
+	defer r.Close()
+	var ids []string
+	for i := 0; i < 30; i++ {
+		d := []byte(fmt.Sprintf("blob %d", i))
+		id, err := r.Put(d)
+		if err != nil {
+			t.Fatalf("r.Put() failed with %q", err)
+		}
+		ids = append(ids, id)
+	}
+	for i, id := range ids {
+		d, err := r.Get(id)
+		if err != nil || string(d) != fmt.Sprintf("blob %d", i) {
+			t.Fatalf("r.Get(%q) returned %q, %v", id, d, err)
+		}
+		if info, err := r.Stat(id); err != nil || info.Size != len(d) {
+			t.Fatalf("r.Stat(%q) returned %+v, %v", id, info, err)
+		}
+	}
+	// each blob is in exactly one store and all stores are used
+	for i, store := range stores {
+		n := 0
+		for _, id := range ids {
+			if store.Exists(id) {
+				n++
+			}
+		}
+		if n == 0 || n == len(ids) {
+			t.Fatalf("store %d has %d of %d blobs", i, n, len(ids))
+		}
+	}
+	if r.Exists("invalid") || r.Exists("0123456789012345678901234567890123456789") {
+		t.Fatalf("r.Exists() returned true for missing blob")
+	}
+	if _, err = r.Get("invalid"); err != ErrInvalidId {
+		t.Fatalf("r.Get() returned %v, expected %v", err, ErrInvalidId)
+	}
+	if _, err = r.Get("0123456789012345678901234567890123456789"); err != ErrNotFound {
+		t.Fatalf("r.Get() returned %v, expected %v", err, ErrNotFound)
+	}
+}
+
+func TestRouterMoveFrom(t *testing.T) {
+	var stores []*Store
+	for i := 0; i < 3; i++ {
+		basePath := fmt.Sprintf("test%d", i)
+		removeStoreFiles(basePath)
+		defer removeStoreFiles(basePath)
+		store, err := New(basePath)
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+	old, _ := NewRouter(stores[0], stores[1])
+	var ids []string
+	for i := 0; i < 40; i++ {
+		id, _ := old.Put([]byte(fmt.Sprintf("blob %d", i)))
+		ids = append(ids, id)
+	}
+	// a store was added
+	r, _ := NewRouter(stores[0], stores[1], stores[2])
+	var total MoveProgress
+	for _, src := range stores[:2] {
+		var last MoveProgress
+		opts := MoveOptions{Progress: func(p MoveProgress) { last = p }}
+		res, err := r.MoveFrom(src, opts)
+		if err != nil {
+			t.Fatalf("r.MoveFrom() failed with %q", err)
+		}
+		if res != last {
+			t.Fatalf("r.MoveFrom() returned %+v, last progress was %+v", res, last)
+		}
+		total.Moved += res.Moved
+		total.Skipped += res.Skipped
+		// resuming from the end doesn't do anything and neither does
+		// starting again
+		for _, after := range []Cursor{res.Position, {}} {
+			again, err := r.MoveFrom(src, MoveOptions{After: after})
+			if err != nil || again.Moved != 0 {
+				t.Fatalf("r.MoveFrom() after %v returned %+v, %v", after, again, err)
+			}
+		}
+	}
+	if total.Moved == 0 || total.Skipped == 0 {
+		t.Fatalf("moved %d and skipped %d of %d blobs", total.Moved, total.Skipped, len(ids))
+	}
+	// each blob is only in the store where it belongs
+	for _, id := range ids {
+		n := 0
+		for _, store := range stores {
+			if store.Exists(id) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("blob %s is in %d stores", id, n)
+		}
+	}
+	for i, id := range ids {
+		if d, err := r.Get(id); err != nil || string(d) != fmt.Sprintf("blob %d", i) {
+			t.Fatalf("r.Get(%q) returned %q, %v", id, d, err)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	withKey := func(key []byte) Option {
+		return WithEncryption(func() ([]byte, error) {
+			return key, nil
+		})
+	}
+	store, err := New(basePath, withKey(key1))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	secret := []byte("secret data of a tenant")
+	id, err := store.Put(secret)
+	if err != nil || id != fmt.Sprintf("%x", sha1.Sum(secret)) {
+		t.Fatalf("store.Put() returned %q, %v", id, err)
+	}
+	if d, err := store.Get(id); err != nil || !bytes.Equal(d, secret) {
+		t.Fatalf("store.Get(%q) returned %q, %v", id, d, err)
+	}
+	if info, err := store.Stat(id); err != nil || info.Size != len(secret) {
+		t.Fatalf("store.Stat(%q) returned %v, %v", id, info, err)
+	}
+	var buf bytes.Buffer
+	if n, err := store.CopyTo(id, &buf); err != nil || n != int64(len(secret)) || !bytes.Equal(buf.Bytes(), secret) {
+		t.Fatalf("store.CopyTo(%q) returned %d, %v", id, n, err)
+	}
+	r, err := store.GetSeeker(id)
+	if err != nil {
+		t.Fatalf("store.GetSeeker(%q) failed with %q", id, err)
+	}
+	r.Seek(7, io.SeekStart)
+	if d, _ := io.ReadAll(r); string(d) != string(secret[7:]) {
+		t.Fatalf("read %q from seeker", d)
+	}
+	r.Close()
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %v, %v", res, err)
+	}
+	store.Close()
+	segment, _ := os.ReadFile(segmentFilePath(basePath, 0))
+	if len(segment) != len(secret)+28 || bytes.Contains(segment, secret[:6]) {
+		t.Fatalf("content is not encrypted in segment file: %q", segment)
+	}
+
+	if _, err = New(basePath, withKey(key2)); err != ErrWrongKey {
+		t.Fatalf("New() with a different key returned %v, expected ErrWrongKey", err)
+	}
+	if _, err = OpenReadOnly(basePath); err != ErrNeedKey {
+		t.Fatalf("OpenReadOnly() without a key returned %v, expected ErrNeedKey", err)
+	}
+	store, err = OpenReadOnly(basePath, withKey(key1))
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	if d, err := store.Get(id); err != nil || !bytes.Equal(d, secret) {
+		t.Fatalf("store.Get(%q) returned %q, %v", id, d, err)
+	}
+	store.Close()
+
+	// a store that is not encrypted can't be opened with a key
+	basePath2 := "test2"
+	removeStoreFiles(basePath2)
+	defer removeStoreFiles(basePath2)
+	store, err = New(basePath2)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath2, err)
+	}
+	store.Close()
+	if _, err = New(basePath2, withKey(key1)); err != errNotEncrypted {
+		t.Fatalf("New() of store that is not encrypted returned %v", err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	dir := t.TempDir()
+	full, incr := filepath.Join(dir, "full"), filepath.Join(dir, "incr")
+	store, err := NewWithLimit(basePath, 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("blob number %d, before the first backup", i)))
+		ids = append(ids, id)
+	}
+	store.SetRef("first", ids[0])
+	res, err := store.Backup(full)
+	if err != nil || res.Gen != 1 || res.Since != 0 {
+		t.Fatalf("store.Backup() returned %v, %v", res, err)
+	}
+	if _, err = store.Backup(full); err != errBackupExists {
+		t.Fatalf("store.Backup() to existing set returned %v", err)
+	}
+	fullSize := res.Size
+	for i := 0; i < 3; i++ {
+		id, _ := store.Put([]byte(fmt.Sprintf("blob number %d, after the first backup", i)))
+		ids = append(ids, id)
+	}
+	// removes all blobs in segment 1, which removes the segment
+	var kept, deleted []string
+	for _, id := range ids {
+		store.Lock()
+		blob, _ := store.findBlob(id)
+		store.Unlock()
+		if blob.nSegment == 1 {
+			deleted = append(deleted, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	if res, err := store.GC(GCOptions{Keep: func(id string) bool { return !slices.Contains(deleted, id) }}); err != nil || len(res.Segments) != 1 {
+		t.Fatalf("store.GC() returned %v, %v", res, err)
+	}
+	res, err = store.BackupIncremental(incr, 1)
+	if err != nil || res.Gen != 2 || res.Since != 1 || res.Size >= fullSize {
+		t.Fatalf("store.BackupIncremental() returned %v, %v", res, err)
+	}
+	if _, err = store.BackupIncremental(filepath.Join(dir, "x"), 5); err != errUnknownGeneration {
+		t.Fatalf("store.BackupIncremental() of unknown generation returned %v", err)
+	}
+
+	restorePath := filepath.Join(dir, "restored")
+	if err = RestoreBackup(restorePath, incr); !errors.Is(err, errBackupChain) {
+		t.Fatalf("RestoreBackup() of incremental set alone returned %v", err)
+	}
+	if err = RestoreBackup(restorePath, full, incr); err != nil {
+		t.Fatalf("RestoreBackup() failed with %q", err)
+	}
+	restored, err := New(restorePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", restorePath, err)
+	}
+	defer restored.Close()
+	for _, id := range kept {
+		if d, err := restored.Get(id); err != nil || store.sha1Of(d) != blobSha1(t, id) {
+			t.Fatalf("restored.Get(%q) returned %q, %v", id, d, err)
+		}
+	}
+	for _, id := range deleted {
+		if restored.Exists(id) {
+			t.Fatalf("deleted blob %s was restored", id)
+		}
+	}
+	if id, err := restored.Ref("first"); err != nil || id != ids[0] {
+		t.Fatalf("restored.Ref() returned %q, %v", id, err)
+	}
+	if _, err := os.Stat(segmentFilePath(restorePath, 1)); err == nil {
+		t.Fatalf("segment removed by GC() was restored")
+	}
+}
+
+func TestBackupWithConcurrentPuts(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	dir := t.TempDir()
+	store, err := New(basePath, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			store.Put([]byte(fmt.Sprintf("blob %d, put during backups", i)))
+		}
+	}()
+	var sets []string
+	for i := 0; i < 5; i++ {
+		set := filepath.Join(dir, fmt.Sprintf("set%d", i))
+		if _, err = store.BackupIncremental(set, i); err != nil {
+			t.Fatalf("store.BackupIncremental(%q, %d) failed with %q", set, i, err)
+		}
+		sets = append(sets, set)
+	}
+	close(stop)
+	<-done
+
+	// every restored blob can be found by its sha256 id
+	restorePath := filepath.Join(dir, "restored")
+	if err = RestoreBackup(restorePath, sets...); err != nil {
+		t.Fatalf("RestoreBackup() failed with %q", err)
+	}
+	restored, err := New(restorePath, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", restorePath, err)
+	}
+	defer restored.Close()
+	n := 0
+	err = restored.ForEach(func(info BlobInfo) error {
+		d, err := restored.Get(info.Id)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(d)
+		if _, err = restored.Get(hex.EncodeToString(sum[:])); err != nil {
+			return fmt.Errorf("blob %s not found by sha256 id: %w", info.Id, err)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n == 0 {
+		t.Fatalf("checked %d restored blobs, %v", n, err)
+	}
+}
+
+func TestPack(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	dir := t.TempDir()
+	var contents [][]byte
+	for i := 0; i < 20; i++ {
+		contents = append(contents, []byte(fmt.Sprintf("blob number %d", i)))
+	}
+	// the same blobs, added in different order and with a deleted one
+	var packed []string
+	for n, order := range [][]int{{0, 1, 2}, {2, 1, 0}} {
+		removeStoreFiles(basePath)
+		store, err := NewWithLimit(basePath, 64)
+		if err != nil {
+			t.Fatalf("NewWithLimit(%q, 64) failed with %q", basePath, err)
+		}
+		for _, third := range order {
+			for i := third; i < len(contents); i += 3 {
+				store.Put(contents[i])
+			}
+		}
+		id, _ := store.Put([]byte("deleted"))
+		store.Delete(id)
+		dst := filepath.Join(dir, fmt.Sprintf("packed%d", n))
+		if err = store.Pack(dst, 100); err != nil {
+			t.Fatalf("store.Pack(%q) failed with %q", dst, err)
+		}
+		if err = store.Pack(dst, 100); err != errStoreExists {
+			t.Fatalf("second store.Pack(%q) returned %v, expected %v", dst, err, errStoreExists)
+		}
+		store.Close()
+		packed = append(packed, dst)
+	}
+	paths, _ := filepath.Glob(packed[0] + "_*")
+	if len(paths) < 4 {
+		t.Fatalf("packed store has files %v, expected index, checkpoint and segments", paths)
+	}
+	for _, path := range paths {
+		d1, _ := os.ReadFile(path)
+		d2, err := os.ReadFile(packed[1] + strings.TrimPrefix(path, packed[0]))
+		if err != nil || !bytes.Equal(d1, d2) {
+			t.Fatalf("%s differs between packed stores, %v", path, err)
+		}
+	}
+	store, err := NewWithLimit(packed[0], 100)
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", packed[0], err)
+	}
+	defer store.Close()
+	if stats, _ := store.Stats(); stats.Blobs != len(contents) {
+		t.Fatalf("packed store has %d blobs, expected %d", stats.Blobs, len(contents))
+	}
+	if res, err := store.Verify(VerifyOptions{Deep: true}); err != nil || !res.OK() {
+		t.Fatalf("store.Verify() returned %+v, %v", res, err)
+	}
+}
+
+func TestSegmentEvents(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	var mu sync.Mutex
+	var events []SegmentEvent
+	onEvent := func(ev SegmentEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+	store, err := NewWithLimit(basePath, 100, WithSegmentEvents(onEvent))
+	if err != nil {
+		t.Fatalf("NewWithLimit(%q, 100) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	id1, _ := store.Put(bytes.Repeat([]byte{1}, 60))
+	id2, _ := store.Put(bytes.Repeat([]byte{2}, 60))
+	store.Delete(id1)
+	store.Delete(id2)
+	if _, err = store.Compact(CompactOptions{}); err != nil {
+		t.Fatalf("store.Compact() failed with %q", err)
+	}
+	expected := []SegmentEvent{
+		{Kind: SegmentCreated, No: 0, Path: segmentFilePath(basePath, 0)},
+		{Kind: SegmentSealed, No: 0, Path: segmentFilePath(basePath, 0), Size: 120},
+		{Kind: SegmentCreated, No: 1, Path: segmentFilePath(basePath, 1)},
+		{Kind: SegmentRemoved, No: 0, Path: segmentFilePath(basePath, 0)},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(events, expected) {
+		t.Fatalf("got events %v, expected %v", events, expected)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := store.Watch(ctx)
+	slow := store.Watch(context.Background())
+	id1, _ := store.Put([]byte("first blob"))
+	id2, _ := store.Put([]byte("second blob"))
+	store.Delete(id1)
+	var got []BlobEvent
+	for len(got) < 3 {
+		got = append(got, <-events)
+	}
+	if got[0].Id != id1 || got[0].Size != 10 || got[1].Id != id2 || got[1].Deleted || got[2].Id != id1 || !got[2].Deleted {
+		t.Fatalf("got events %v", got)
+	}
+	if got[0].Seq >= got[1].Seq || got[1].Seq >= got[2].Seq {
+		t.Fatalf("events are not ordered by Seq: %v", got)
+	}
+	// Seq can be passed to Changes()
+	if ids, _, err := store.Changes(Cursor{got[0].Generation, got[0].Seq}, 10); err != nil || len(ids) != 1 || ids[0] != id2 {
+		t.Fatalf("store.Changes(%d) returned %v, %v", got[0].Seq, ids, err)
+	}
+	cancel()
+	for range events {
+	}
+
+	// a watcher that doesn't read is dropped when its buffer fills
+	for i := 0; i < watchBufferSize; i++ {
+		store.Put([]byte(fmt.Sprintf("blob %d", i)))
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != watchBufferSize {
+		t.Fatalf("got %d events before the channel was closed, expected %d", n, watchBufferSize)
+	}
+}
+
+func TestList(t *testing.T) {
+	basePath := "test"
+	for _, mode := range []IndexMode{IndexMap, IndexSorted} {
+		removeStoreFiles(basePath)
+		store, err := New(basePath, WithIndexMode(mode))
+		if err != nil {
+			t.Fatalf("New(%q) failed with %q", basePath, err)
+		}
+		var ids []string
+		for i := 0; i < 50; i++ {
+			id, _ := store.Put([]byte(fmt.Sprintf("blob %d", i)))
+			ids = append(ids, id)
+		}
+		deleted := ids[7]
+		store.Delete(deleted)
+		ids = append(ids[:7], ids[8:]...)
+		listAll := func() []string {
+			var listed []string
+			after := ""
+			for {
+				infos, err := store.List(after, 7)
+				if err != nil {
+					t.Fatalf("store.List(%q) failed with %q", after, err)
+				}
+				if len(infos) == 0 {
+					return listed
+				}
+				for _, info := range infos {
+					listed = append(listed, info.Id)
+				}
+				after = infos[len(infos)-1].Id
+			}
+		}
+		slices.Sort(ids)
+		if listed := listAll(); !slices.Equal(listed, ids) {
+			t.Fatalf("mode %d: store.List() returned %v, expected %v", mode, listed, ids)
+		}
+		// blobs added and removed after listing, and a removed blob added
+		// again
+		for i := 50; i < 60; i++ {
+			id, _ := store.Put([]byte(fmt.Sprintf("blob %d", i)))
+			ids = append(ids, id)
+		}
+		id, _ := store.Put([]byte("blob 7"))
+		ids = append(ids, id)
+		store.Delete(ids[0])
+		ids = ids[1:]
+		slices.Sort(ids)
+		if listed := listAll(); !slices.Equal(listed, ids) || !slices.Contains(listed, deleted) {
+			t.Fatalf("mode %d: store.List() after changes returned %v, expected %v", mode, listed, ids)
+		}
+		if _, err = store.List("not an id", 10); err != ErrInvalidId {
+			t.Fatalf("store.List() with invalid id returned %v", err)
+		}
+		store.Close()
+	}
+	removeStoreFiles(basePath)
+}
+
+func TestImportZip(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath, WithMaxBlobSize(100))
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{"a.txt": "file a", "dir/b.txt": "file b"}
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, files[name])
+	}
+	zw.Create("empty-dir/")
+	zw.Close()
+	r := bytes.NewReader(buf.Bytes())
+	imported, err := store.ImportZip(r, r.Size(), ZipImportOptions{RefPrefix: "zip/"})
+	if err != nil || len(imported) != 2 || imported[0].Name != "a.txt" || imported[1].Name != "dir/b.txt" {
+		t.Fatalf("store.ImportZip() returned %v, %v", imported, err)
+	}
+	for _, f := range imported {
+		if d, err := store.Get(f.Id); err != nil || string(d) != files[f.Name] {
+			t.Fatalf("store.Get(%q) returned %q, %v", f.Id, d, err)
+		}
+		if id, err := store.Ref("zip/" + f.Name); err != nil || id != f.Id {
+			t.Fatalf("store.Ref(%q) returned %q, %v", "zip/"+f.Name, id, err)
+		}
+	}
+
+	// files bigger than max blob size are not decompressed
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	w, _ := zw.Create("big.txt")
+	w.Write(make([]byte, 1000))
+	zw.Close()
+	r = bytes.NewReader(buf.Bytes())
+	if _, err = store.ImportZip(r, r.Size(), ZipImportOptions{}); err != ErrBlobTooLarge {
+		t.Fatalf("store.ImportZip() of big file returned %v", err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		f.add(sha1.Sum([]byte(fmt.Sprintf("in %d", i))))
+	}
+	d, _ := f.MarshalBinary()
+	f = &BloomFilter{}
+	if err := f.UnmarshalBinary(d); err != nil {
+		t.Fatalf("f.UnmarshalBinary() failed with %q", err)
+	}
+	nFalse := 0
+	for i := 0; i < 10000; i++ {
+		if !f.MayContain(fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("in %d", i))))) {
+			t.Fatalf("filter doesn't contain blob %d", i)
+		}
+		if f.MayContain(fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("out %d", i))))) {
+			nFalse++
+		}
+	}
+	if nFalse > 200 {
+		t.Fatalf("%d false positives out of 10000", nFalse)
+	}
+}
+
+func TestIDSet(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	var ids []string
+	// more than a batch
+	for i := 0; i < idSetBatchSize+100; i++ {
+		f := store.PutAsync([]byte(fmt.Sprintf("blob %d", i)))
+		if i%2 == 0 {
+			id, _ := f.Wait()
+			ids = append(ids, id)
+		}
+	}
+	store.Sync()
+	var all, half bytes.Buffer
+	if err = store.ExportIDSet(&all); err != nil {
+		t.Fatalf("store.ExportIDSet() failed with %q", err)
+	}
+	sr, err := NewIDSetReader(bytes.NewReader(all.Bytes()))
+	if err != nil {
+		t.Fatalf("NewIDSetReader() failed with %q", err)
+	}
+	n := 0
+	for {
+		if _, err = sr.Next(); err != nil {
+			break
+		}
+		n++
+	}
+	if err != io.EOF || n != idSetBatchSize+100 {
+		t.Fatalf("read %d ids, last error %v", n, err)
+	}
+	// without sharing prefixes it would take 21 bytes per id
+	if all.Len() > n*20+n/2 {
+		t.Fatalf("id set of %d ids takes %d bytes", n, all.Len())
+	}
+
+	slices.Sort(ids)
+	half.WriteString(idSetMagic)
+	var prev [20]byte
+	for _, id := range ids {
+		sha1, _ := sha1FromId(id)
+		half.WriteByte(0)
+		half.Write(sha1[:])
+		prev = sha1
+	}
+	half.WriteByte(idSetEnd)
+	onlyAll, onlyHalf, err := DiffIDSets(bytes.NewReader(all.Bytes()), &half)
+	if err != nil || len(onlyAll) != n-len(ids) || len(onlyHalf) != 0 {
+		t.Fatalf("DiffIDSets() returned %d, %d ids, %v", len(onlyAll), len(onlyHalf), err)
+	}
+	for _, id := range onlyAll {
+		if _, found := slices.BinarySearch(ids, id); found {
+			t.Fatalf("%s is in both sets", id)
+		}
+	}
+
+	// incomplete and unsorted sets
+	cut := bytes.NewReader(all.Bytes()[:all.Len()-1])
+	if _, _, err = DiffIDSets(cut, bytes.NewReader(all.Bytes())); err != io.ErrUnexpectedEOF {
+		t.Fatalf("DiffIDSets() of incomplete set returned %v", err)
+	}
+	unsorted := []byte(idSetMagic)
+	unsorted = append(append(unsorted, 0), prev[:]...)
+	unsorted = append(append(unsorted, 0), make([]byte, 20)...)
+	unsorted = append(unsorted, idSetEnd)
+	if _, _, err = DiffIDSets(bytes.NewReader(unsorted), bytes.NewReader(all.Bytes())); err != errInvalidIDSet {
+		t.Fatalf("DiffIDSets() of unsorted set returned %v", err)
+	}
+}
+
+func TestSha256Ids(t *testing.T) {
+	basePath := "test"
+	removeStoreFiles(basePath)
+	defer removeStoreFiles(basePath)
+	store, err := New(basePath)
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	oldId, _ := store.Put([]byte("stored before sha256 ids"))
+	store.Close()
+
+	store, err = New(basePath, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	d := []byte("hello")
+	id, _ := store.Put(d)
+	newId, err := store.Sha256Id(id)
+	if err != nil || newId != fmt.Sprintf("%x", sha256.Sum256(d)) {
+		t.Fatalf("store.Sha256Id(%q) returned %q, %v", id, newId, err)
+	}
+	if got, err := store.Get(newId); err != nil || !bytes.Equal(got, d) {
+		t.Fatalf("store.Get(%q) returned %q, %v", newId, got, err)
+	}
+	oldNewId, _ := store.Sha256Id(oldId)
+	if store.Exists(oldNewId) {
+		t.Fatalf("%s exists before AddSha256Ids()", oldNewId)
+	}
+	if n, err := store.AddSha256Ids(); err != nil || n != 1 {
+		t.Fatalf("store.AddSha256Ids() returned %d, %v", n, err)
+	}
+	reader, err := OpenReadOnly(basePath, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("OpenReadOnly(%q) failed with %q", basePath, err)
+	}
+	defer reader.Close()
+	d2 := []byte("added after reader was opened")
+	store.Put(d2)
+	for _, d := range [][]byte{d, d2} {
+		id := fmt.Sprintf("%x", sha256.Sum256(d))
+		if !reader.Exists(id) {
+			t.Fatalf("reader doesn't find %s", id)
+		}
+	}
+	store.Close()
+
+	store, err = New(basePath, WithSha256Ids())
+	if err != nil {
+		t.Fatalf("New(%q) failed with %q", basePath, err)
+	}
+	defer store.Close()
+	if !store.Exists(oldNewId) || !store.Exists(newId) {
+		t.Fatalf("sha256 ids were not saved")
+	}
+	if n, _ := store.AddSha256Ids(); n != 0 {
+		t.Fatalf("store.AddSha256Ids() added %d, expected 0", n)
+	}
+	// refs keep sha1 ids, so that GC() knows which blobs they point to
+	if err = store.SetRef("hello", newId); err != nil {
+		t.Fatalf("store.SetRef() failed with %q", err)
+	}
+	if got, _ := store.Ref("hello"); got != id {
+		t.Fatalf("store.Ref() returned %q, expected %q", got, id)
+	}
+	store.SetRef("hello", "")
+	if err = store.Delete(newId); err != nil {
+		t.Fatalf("store.Delete(%q) failed with %q", newId, err)
+	}
+	if store.Exists(id) {
+		t.Fatalf("%s exists after deleting %s", id, newId)
+	}
+}
@@ -0,0 +1,38 @@
+package contentstore
+
+import "time"
+
+// Storer is implemented by *Store. Code that only needs to store and
+// retrieve blobs should depend on Storer instead of *Store, so that it
+// can be given a remote client, an in-memory fake or an instrumented
+// wrapper instead.
+//
+// Implementations must be safe for concurrent use and must return
+// ErrNotFound when there is no blob with a given id.
+type Storer interface {
+	// Put stores d and returns its id. Storing the same content
+	// for the second time returns the same id
+	Put(d []byte) (id string, err error)
+	// Get returns content of the blob
+	Get(id string) ([]byte, error)
+	// Exists returns true if blob is in the store
+	Exists(id string) bool
+	// Stat returns information about the blob
+	Stat(id string) (BlobInfo, error)
+	// Close releases resources used by the store
+	Close() error
+}
+
+// BlobInfo describes a blob
+type BlobInfo struct {
+	Id   string
+	Size int
+	// when the blob was added to the store. Zero if not known (e.g. blobs
+	// added by old versions of Store)
+	Created time.Time
+	// set with PutWithExtra()
+	Extra []byte
+}
+
+// make sure Store implements Storer
+var _ Storer = (*Store)(nil)
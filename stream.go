@@ -0,0 +1,190 @@
+package contentstore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// PutReader() stores a blob without having all of it in memory. We don't
+// know the id until we've read all of the data and the writer can't wait
+// for it (other Put()s would have to wait), so the data is first copied
+// to a temporary file next to the store, and hashed while doing it. The
+// writer then copies the file to the current segment, like it writes d of
+// other requests.
+//
+// In git object mode the hash starts with the size, which we don't know
+// until we've read everything, so we hash the temporary file afterwards.
+// Encrypted stores read the data into memory because a blob is encrypted
+// as a whole.
+//
+// PutFile() skips the temporary file: it hashes the file and the writer
+// copies it from where it is.
+
+// errIdMismatch is returned by putFile() if the file isn't the blob we expect
+var errIdMismatch = errors.New("content doesn't match id")
+
+// PutReader stores data read from r and returns its id and size. Unlike
+// Put(), it only uses a small buffer, so it can be used for blobs bigger
+// than available memory. Data is copied to a temporary file in the
+// directory of the store first
+func (store *Store) PutReader(r io.Reader) (id string, n int64, err error) {
+	if store.readOnly {
+		return "", 0, errReadOnly
+	}
+	if store.aead != nil {
+		d, err := store.readAllLimited(r)
+		if err != nil {
+			return "", 0, err
+		}
+		id, err = store.Put(d)
+		return id, int64(len(d)), err
+	}
+	file, err := os.CreateTemp(filepath.Dir(store.basePath), filepath.Base(store.basePath)+"_put_*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	req := newPutRequest(nil)
+	req.file = file
+	var h1, h256 hash.Hash
+	w := io.Writer(file)
+	if !store.gitObjects {
+		h1 = sha1.New()
+		w = io.MultiWriter(w, h1)
+		if store.aliases != nil {
+			h256 = sha256.New()
+			w = io.MultiWriter(w, h256)
+		}
+	}
+	if n, err = io.Copy(w, store.limitReader(r)); err != nil {
+		return "", n, err
+	}
+	if store.maxBlobSize > 0 && n > int64(store.maxBlobSize) {
+		return "", n, ErrBlobTooLarge
+	}
+	req.fileSize = int(n)
+	if h1 == nil {
+		err = store.hashFile(req)
+	} else {
+		h1.Sum(req.sha1[:0])
+		if h256 != nil {
+			h256.Sum(req.sha256[:0])
+		}
+	}
+	if err != nil {
+		return "", n, err
+	}
+	id, err = store.put(req)
+	return id, n, err
+}
+
+// PutFile stores content of the file at path and returns its id. Like
+// PutReader(), it doesn't read the file into memory. The file must not
+// change until PutFile() returns
+func (store *Store) PutFile(path string) (string, error) {
+	return store.putFile(path, "")
+}
+
+// putFile is PutFile() that, if wantId isn't "", doesn't store the file
+// and returns errIdMismatch if its id isn't wantId
+func (store *Store) putFile(path string, wantId string) (string, error) {
+	if store.readOnly {
+		return "", errReadOnly
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if store.aead != nil {
+		d, err := store.readAllLimited(file)
+		if err != nil {
+			return "", err
+		}
+		if sum := store.sha1Of(d); wantId != "" && hex.EncodeToString(sum[:]) != wantId {
+			return "", errIdMismatch
+		}
+		return store.Put(d)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if store.maxBlobSize > 0 && stat.Size() > int64(store.maxBlobSize) {
+		return "", ErrBlobTooLarge
+	}
+	req := newPutRequest(nil)
+	req.file = file
+	req.fileSize = int(stat.Size())
+	if err = store.hashFile(req); err != nil {
+		return "", err
+	}
+	if wantId != "" && hex.EncodeToString(req.sha1[:]) != wantId {
+		return "", errIdMismatch
+	}
+	return store.put(req)
+}
+
+// limitReader returns r that stops reading one byte after max blob size, so
+// that we know the blob is too big without reading all of it
+func (store *Store) limitReader(r io.Reader) io.Reader {
+	if store.maxBlobSize <= 0 {
+		return r
+	}
+	return io.LimitReader(r, int64(store.maxBlobSize)+1)
+}
+
+// readAllLimited reads r into memory, up to max blob size
+func (store *Store) readAllLimited(r io.Reader) ([]byte, error) {
+	d, err := io.ReadAll(store.limitReader(r))
+	if err == nil && store.maxBlobSize > 0 && len(d) > store.maxBlobSize {
+		err = ErrBlobTooLarge
+	}
+	return d, err
+}
+
+// hashFile calculates sha1 (and sha256, if needed) of req.fileSize bytes of
+// req.file
+func (store *Store) hashFile(req *putRequest) error {
+	h1 := sha1.New()
+	store.resetHash(h1, req.fileSize)
+	w := io.Writer(h1)
+	var h256 hash.Hash
+	if store.aliases != nil {
+		h256 = sha256.New()
+		w = io.MultiWriter(w, h256)
+	}
+	n, err := io.Copy(w, io.NewSectionReader(req.file, 0, int64(req.fileSize)))
+	if err == nil && n != int64(req.fileSize) {
+		err = fmt.Errorf("%s changed while reading it", req.file.Name())
+	}
+	if err != nil {
+		return err
+	}
+	h1.Sum(req.sha1[:0])
+	if h256 != nil {
+		h256.Sum(req.sha256[:0])
+	}
+	return nil
+}
+
+// writeFile appends data of request from req.file to current segment file.
+// Returns number of bytes written. Only called by writer goroutine
+func (store *Store) writeFile(req *putRequest) (int, error) {
+	r := io.NewSectionReader(req.file, 0, int64(req.fileSize))
+	n, err := io.Copy(store.currSegmentFile, r)
+	if err == nil && n != int64(req.fileSize) {
+		err = fmt.Errorf("%s changed while reading it", req.file.Name())
+	}
+	return int(n), err
+}
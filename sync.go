@@ -0,0 +1,133 @@
+package contentstore
+
+import (
+	"fmt"
+)
+
+// Syncing copies blobs that another store (usually on another server, see
+// client.Client) doesn't have. To find them without sending ids of all
+// blobs, the other store sends a bloom filter of its blobs. Blobs that are
+// not in the filter are definitely missing and are copied. Blobs that are
+// in the filter are probably not missing: with 1% false positives about 1%
+// of missing blobs are not found. Since every filter has a random seed,
+// the next sync finds most of them. With SyncOptions.Exact blobs that are in
+// the filter are checked with MissingFrom(), which sends their ids, so that
+// none are missed.
+
+const (
+	defaultFalsePositiveRate = 0.01
+	// number of blobs we list and check at once when syncing
+	syncBatchSize = 1000
+)
+
+// SyncTarget is a store blobs can be copied to by SyncTo(), e.g. *Store or
+// *client.Client
+type SyncTarget interface {
+	Put(d []byte) (string, error)
+	MissingFrom(ids []string) ([]string, error)
+	BloomFilter(falsePositiveRate float64) (*BloomFilter, error)
+}
+
+// SyncOptions configures SyncTo()
+type SyncOptions struct {
+	// false positive rate of bloom filter of the target. Defaults to 1%
+	FalsePositiveRate float64
+	// if true, blobs that the bloom filter says the target probably has
+	// are checked with MissingFrom(), so that no missing blob is missed
+	Exact bool
+}
+
+// SyncResult describes what SyncTo() did
+type SyncResult struct {
+	// number of blobs in the store
+	Checked int
+	// number of blobs copied and their total size
+	Copied      int
+	CopiedBytes int64
+}
+
+// MissingFrom returns ids, out of ids, of blobs that are not in the store
+func (store *Store) MissingFrom(ids []string) ([]string, error) {
+	var res []string
+	store.Lock()
+	defer store.Unlock()
+	for _, id := range ids {
+		if _, err := store.findBlob(id); err != nil {
+			res = append(res, id)
+		}
+	}
+	return res, nil
+}
+
+// BloomFilter returns bloom filter of ids of all blobs in the store with
+// a given false positive rate (e.g. 0.01 for 1%)
+func (store *Store) BloomFilter(falsePositiveRate float64) (*BloomFilter, error) {
+	store.Lock()
+	defer store.Unlock()
+	f := newBloomFilter(store.index.count(), falsePositiveRate)
+	store.index.forEach(func(blob *blob) {
+		f.add(blob.sha1)
+	})
+	return f, nil
+}
+
+// SyncTo copies blobs from the store to dst, if dst doesn't have them.
+// Blobs added while it runs might not be copied
+func (store *Store) SyncTo(dst SyncTarget, opts SyncOptions) (*SyncResult, error) {
+	res := &SyncResult{}
+	filter, err := dst.BloomFilter(opts.FalsePositiveRate)
+	if err != nil {
+		return res, err
+	}
+	after := ""
+	for {
+		infos, err := store.List(after, syncBatchSize)
+		if err != nil || len(infos) == 0 {
+			return res, err
+		}
+		after = infos[len(infos)-1].Id
+		res.Checked += len(infos)
+		var missing, maybe []string
+		for _, info := range infos {
+			if filter.MayContain(info.Id) {
+				maybe = append(maybe, info.Id)
+			} else {
+				missing = append(missing, info.Id)
+			}
+		}
+		if opts.Exact && len(maybe) > 0 {
+			ids, err := dst.MissingFrom(maybe)
+			if err != nil {
+				return res, err
+			}
+			missing = append(missing, ids...)
+		}
+		for _, id := range missing {
+			if err = store.copyBlob(id, dst, res); err != nil {
+				return res, err
+			}
+		}
+	}
+}
+
+// copyBlob copies blob with a given id to dst
+func (store *Store) copyBlob(id string, dst SyncTarget, res *SyncResult) error {
+	d, err := store.Get(id)
+	if err == ErrNotFound {
+		// deleted since we listed it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dstId, err := dst.Put(d)
+	if err != nil {
+		return err
+	}
+	if dstId != id {
+		return fmt.Errorf("target returned id %s for blob %s", dstId, id)
+	}
+	res.Copied++
+	res.CopiedBytes += int64(len(d))
+	return nil
+}
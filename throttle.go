@@ -0,0 +1,64 @@
+package contentstore
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttle limits the rate of IO done by maintenance operations (e.g.
+// Verify()), so that they don't slow down Get() and Put(). It's shared by
+// all goroutines doing a given operation
+type throttle struct {
+	bytesPerSec int64
+	mu          sync.Mutex
+	start       time.Time
+	// bytes done since start
+	n int64
+}
+
+// newThrottle returns throttle limiting IO to bytesPerSec or nil if
+// bytesPerSec is not positive (unlimited)
+func newThrottle(bytesPerSec int64) *throttle {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &throttle{
+		bytesPerSec: bytesPerSec,
+		start:       time.Now(),
+	}
+}
+
+// done records n bytes of IO and sleeps if we're going too fast
+func (t *throttle) done(n int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.bytesPerSec) * float64(time.Second)))
+	t.mu.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// throttledReader reads from r at a rate limited by t
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.done(n)
+	return n, err
+}
+
+// reader returns r limited by t
+func (t *throttle) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
@@ -0,0 +1,275 @@
+package contentstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads let clients upload big blobs in many requests, so that
+// a client on a flaky network can continue an upload instead of starting
+// over. The protocol is a subset of tus (https://tus.io):
+//   - POST /uploads with Upload-Length header (total size) creates an upload
+//     and returns its URL (/uploads/<upload id>) in Location header. If the
+//     store limits size of blobs, a bigger upload is refused with 413
+//   - PATCH /uploads/<upload id> with Upload-Offset header appends the body
+//     of the request at that offset. Responds with the new offset in
+//     Upload-Offset header. When all data has been uploaded, it stores the
+//     blob and responds with 201 and the id of the blob, like POST /blobs
+//   - HEAD /uploads/<upload id> returns current offset in Upload-Offset
+//     header, so that the client knows where to continue from
+//   - DELETE /uploads/<upload id> cancels the upload
+//
+// Uploaded data is kept in files in a directory so that uploads survive
+// restarts of the server. Uploads that didn't change for uploadExpiration
+// are removed.
+
+const (
+	uploadsPath      = "/uploads"
+	uploadExpiration = 24 * time.Hour
+)
+
+type uploads struct {
+	dir string
+	mu  sync.Mutex
+	// uploads that are being modified by a request
+	busy map[string]bool
+}
+
+// EnableUploads enables resumable uploads at /uploads, keeping partially
+// uploaded data in dir. Must be called before serving requests
+func (h *Handler) EnableUploads(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	h.uploads = &uploads{
+		dir:  dir,
+		busy: make(map[string]bool),
+	}
+	h.uploads.removeExpired()
+	return nil
+}
+
+func (u *uploads) dataPath(uploadId string) string {
+	return filepath.Join(u.dir, uploadId)
+}
+
+// lengthPath returns path of the file with total size of the upload
+func (u *uploads) lengthPath(uploadId string) string {
+	return filepath.Join(u.dir, uploadId+".len")
+}
+
+// lock marks upload as being modified. Returns false if it already is
+func (u *uploads) lock(uploadId string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[uploadId] {
+		return false
+	}
+	u.busy[uploadId] = true
+	return true
+}
+
+func (u *uploads) unlock(uploadId string) {
+	u.mu.Lock()
+	delete(u.busy, uploadId)
+	u.mu.Unlock()
+}
+
+func (u *uploads) remove(uploadId string) {
+	os.Remove(u.dataPath(uploadId))
+	os.Remove(u.lengthPath(uploadId))
+}
+
+func (u *uploads) removeExpired() {
+	paths, _ := filepath.Glob(filepath.Join(u.dir, "*.len"))
+	for _, path := range paths {
+		uploadId := strings.TrimSuffix(filepath.Base(path), ".len")
+		stat, err := os.Stat(u.dataPath(uploadId))
+		if err != nil || time.Since(stat.ModTime()) > uploadExpiration {
+			u.remove(uploadId)
+		}
+	}
+}
+
+// state returns current offset and total size of the upload
+func (u *uploads) state(uploadId string) (offset, length int64, err error) {
+	d, err := os.ReadFile(u.lengthPath(uploadId))
+	if err != nil {
+		return 0, 0, err
+	}
+	if length, err = strconv.ParseInt(string(d), 10, 64); err != nil {
+		return 0, 0, err
+	}
+	stat, err := os.Stat(u.dataPath(uploadId))
+	if err != nil {
+		return 0, 0, err
+	}
+	return stat.Size(), length, nil
+}
+
+func isValidUploadId(uploadId string) bool {
+	_, err := hex.DecodeString(uploadId)
+	return err == nil && len(uploadId) == 32
+}
+
+func (h *Handler) serveUploads(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == uploadsPath {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.createUpload(w, r)
+		return
+	}
+	uploadId := strings.TrimPrefix(r.URL.Path, uploadsPath+"/")
+	if !isValidUploadId(uploadId) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		offset, length, err := h.uploads.state(uploadId)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+	case http.MethodPatch:
+		h.patchUpload(w, r, uploadId)
+	case http.MethodDelete:
+		if !h.uploads.lock(uploadId) {
+			http.Error(w, "upload is in progress", http.StatusConflict)
+			return
+		}
+		defer h.uploads.unlock(uploadId)
+		h.uploads.remove(uploadId)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sizeLimiter is implemented by stores that limit size of blobs
+type sizeLimiter interface {
+	MaxBlobSize() int
+}
+
+func (h *Handler) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	// don't let the client upload all of it only to find out it's too big
+	if limiter, ok := h.store.(sizeLimiter); ok {
+		if limit := limiter.MaxBlobSize(); limit > 0 && length > int64(limit) {
+			http.Error(w, ErrBlobTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+	var d [16]byte
+	rand.Read(d[:])
+	uploadId := hex.EncodeToString(d[:])
+	err = os.WriteFile(h.uploads.dataPath(uploadId), nil, 0644)
+	if err == nil {
+		err = os.WriteFile(h.uploads.lengthPath(uploadId), []byte(strconv.FormatInt(length, 10)), 0644)
+	}
+	if err != nil {
+		h.uploads.remove(uploadId)
+		h.serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", uploadsPath+"/"+uploadId)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// filePutter is implemented by stores that can store a file without
+// reading it into memory
+type filePutter interface {
+	PutFile(path string) (string, error)
+}
+
+// putUploaded stores the file with uploaded data
+func (h *Handler) putUploaded(path string) (string, error) {
+	if putter, ok := h.store.(filePutter); ok {
+		return putter.PutFile(path)
+	}
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return h.store.Put(d)
+}
+
+func (h *Handler) patchUpload(w http.ResponseWriter, r *http.Request, uploadId string) {
+	u := h.uploads
+	if !u.lock(uploadId) {
+		http.Error(w, "upload is in progress", http.StatusConflict)
+		return
+	}
+	defer u.unlock(uploadId)
+	offset, length, err := u.state(uploadId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		http.Error(w, "Upload-Offset doesn't match", http.StatusConflict)
+		return
+	}
+	file, err := os.OpenFile(u.dataPath(uploadId), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	// keep what we got even if the client disconnects, so that it can resume
+	n, copyErr := io.Copy(file, io.LimitReader(r.Body, length-offset))
+	err = file.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if copyErr != nil {
+		http.Error(w, copyErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	if offset < length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id, err := h.putUploaded(u.dataPath(uploadId))
+	if err == ErrQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err == ErrBlobTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	u.remove(uploadId)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", blobsPath+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, id)
+}
@@ -0,0 +1,151 @@
+package contentstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// VerifyOptions configures Verify()
+type VerifyOptions struct {
+	// if true, reads content of every blob and checks that it matches
+	// its sha1. Otherwise only checks that segment files exist and
+	// are big enough
+	Deep bool
+	// number of segments verified in parallel. Defaults to 1
+	Workers int
+	// if not nil, called after verifying each segment
+	Progress func(segmentsDone, segmentsTotal int)
+	// limits reading (when Deep is true) to this many bytes per second, so
+	// that verifying doesn't slow down serving. 0 means unlimited
+	MaxBytesPerSec int64
+}
+
+// VerifyResult describes problems found by Verify()
+type VerifyResult struct {
+	Blobs    int
+	Segments int
+	// blobs that can't be read or whose content doesn't match their id
+	Corrupted []string
+	// segment files that don't exist. Their blobs are in Corrupted
+	MissingSegments []int
+}
+
+// OK returns true if no problems were found
+func (res *VerifyResult) OK() bool {
+	return len(res.Corrupted) == 0
+}
+
+// Verify checks integrity of the store. It verifies blobs that were in
+// the store when it was called, without blocking other operations.
+func (store *Store) Verify(opts VerifyOptions) (*VerifyResult, error) {
+	// so that space of blobs deleted while we run isn't overwritten
+	defer store.pauseReuse()()
+	store.Lock()
+	nSegments := store.currSegmentNo + 1
+	segments := make([][]blob, nSegments)
+	store.index.forEach(func(blob *blob) {
+		if blob.nSegment < nSegments {
+			segments[blob.nSegment] = append(segments[blob.nSegment], *blob)
+		}
+	})
+	res := &VerifyResult{
+		Blobs:    store.index.count(),
+		Segments: nSegments,
+	}
+	store.Unlock()
+
+	nWorkers := opts.Workers
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+	t := newThrottle(opts.MaxBytesPerSec)
+	var mu sync.Mutex
+	var firstErr error
+	nDone := 0
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for nSegment := range work {
+				corrupted, missing, err := store.verifySegment(nSegment, segments[nSegment], opts.Deep, t)
+				mu.Lock()
+				res.Corrupted = append(res.Corrupted, corrupted...)
+				if missing {
+					res.MissingSegments = append(res.MissingSegments, nSegment)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				nDone++
+				if opts.Progress != nil {
+					opts.Progress(nDone, nSegments)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for nSegment := 0; nSegment < nSegments; nSegment++ {
+		work <- nSegment
+	}
+	close(work)
+	wg.Wait()
+	sort.Strings(res.Corrupted)
+	sort.Ints(res.MissingSegments)
+	return res, firstErr
+}
+
+// verifySegment returns ids of corrupted blobs in a segment
+func (store *Store) verifySegment(nSegment int, blobs []blob, deep bool, t *throttle) (corrupted []string, missing bool, err error) {
+	allCorrupted := func() []string {
+		for i := range blobs {
+			corrupted = append(corrupted, fmt.Sprintf("%x", blobs[i].sha1[:]))
+		}
+		return corrupted
+	}
+	file, err := openSegmentForRead(store.basePath, nSegment)
+	if err == errSegmentFileMissing {
+		// segments without blobs are removed by GC()
+		return allCorrupted(), len(blobs) > 0, nil
+	}
+	if err != nil {
+		return allCorrupted(), false, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return allCorrupted(), false, err
+	}
+	if deep && store.readaheadHint {
+		fadvise(file, 0, 0, fadvSequential)
+	}
+	// read in file order, it's much faster
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].offset < blobs[j].offset
+	})
+	h := sha1.New()
+	var sum [sha1.Size]byte
+	for i := range blobs {
+		blob := &blobs[i]
+		ok := int64(blob.offset+blob.size) <= stat.Size()
+		if ok && deep {
+			r := t.reader(io.NewSectionReader(file, int64(blob.offset), int64(blob.size)))
+			if store.aead != nil {
+				ok = store.verifyEncrypted(blob, r)
+			} else {
+				store.resetHash(h, blob.size)
+				_, err = io.Copy(h, r)
+				ok = err == nil && bytes.Equal(h.Sum(sum[:0]), blob.sha1[:])
+			}
+		}
+		if !ok {
+			corrupted = append(corrupted, fmt.Sprintf("%x", blob.sha1[:]))
+		}
+	}
+	return corrupted, false, nil
+}
@@ -0,0 +1,89 @@
+package contentstore
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// Warm reads blobs with given ids so that their content ends up in OS page
+// cache and the first Get() after starting the process doesn't have to wait
+// for the disk. If ids is nil, warms up all segment files. Unknown ids are
+// ignored.
+// Reading is done without holding the store lock so it's ok to call Warm()
+// in the background while serving requests.
+func (store *Store) Warm(ids []string) error {
+	store.Lock()
+	nSegments := store.currSegmentNo + 1
+	var blobs []blob
+	for _, id := range ids {
+		if blob, err := store.findBlob(id); err == nil {
+			blobs = append(blobs, blob)
+		}
+	}
+	store.Unlock()
+
+	if ids == nil {
+		for nSegment := 0; nSegment < nSegments; nSegment++ {
+			if err := store.warmSegment(nSegment); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return store.warmBlobs(blobs)
+}
+
+func (store *Store) warmSegment(nSegment int) error {
+	file, err := openSegmentForRead(store.basePath, nSegment)
+	if err == errSegmentFileMissing {
+		// removed by GC() because it had no blobs
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if store.readaheadHint {
+		fadvise(file, 0, 0, fadvSequential)
+	}
+	_, err = io.Copy(io.Discard, file)
+	return err
+}
+
+func (store *Store) warmBlobs(blobs []blob) error {
+	// read in disk order, to minimize seeking
+	sort.Slice(blobs, func(i, j int) bool {
+		if blobs[i].nSegment != blobs[j].nSegment {
+			return blobs[i].nSegment < blobs[j].nSegment
+		}
+		return blobs[i].offset < blobs[j].offset
+	})
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+	nSegment := -1
+	for _, blob := range blobs {
+		if blob.nSegment != nSegment {
+			if file != nil {
+				file.Close()
+			}
+			var err error
+			if file, err = openSegmentForRead(store.basePath, blob.nSegment); err != nil {
+				return err
+			}
+			nSegment = blob.nSegment
+		}
+		if store.readaheadHint {
+			fadvise(file, int64(blob.offset), int64(blob.size), fadvWillNeed)
+		}
+		r := io.NewSectionReader(file, int64(blob.offset), int64(blob.size))
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package contentstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Watch() lets callers, e.g. indexers, react to blobs being added and
+// deleted without polling Changes(). The writer sends events, after changes
+// are safely on disk, to a buffered channel of each watcher. It never waits
+// for a watcher: if one doesn't keep up and its buffer fills, its channel is
+// closed. It can catch up by calling Changes() with Generation and Seq of
+// the last event it got (Changes() doesn't return deletes) and call Watch()
+// again. If the index was rewritten since, Changes() starts from the
+// beginning.
+//
+// Tools that work on segment files (backup, moving sealed segments to
+// cheaper storage) can get a callback when a segment is created, sealed or
+// removed (see WithSegmentEvents()) instead of polling the directory.
+
+const (
+	// number of events a watcher can be behind
+	watchBufferSize = 1024
+)
+
+// BlobEvent describes a blob that was added to or deleted from the store
+type BlobEvent struct {
+	Id   string
+	Size int
+	// position in the index after the change. It grows with every change
+	// and can be passed to Changes(), as Cursor{Generation, Seq}
+	Seq     int64
+	Deleted bool
+	// generation of the index Seq is in
+	Generation int64
+}
+
+type watchers struct {
+	mu    sync.Mutex
+	chans map[chan BlobEvent]struct{}
+}
+
+// Watch returns a channel with events for blobs added to or deleted from
+// the store, in order. The channel is closed when ctx is done, when the
+// store is closed or when the receiver doesn't keep up with events. For
+// stores opened with OpenReadOnly() it's closed right away
+func (store *Store) Watch(ctx context.Context) <-chan BlobEvent {
+	ch := make(chan BlobEvent, watchBufferSize)
+	if store.readOnly {
+		close(ch)
+		return ch
+	}
+	w := &store.watchers
+	w.mu.Lock()
+	if w.chans == nil {
+		w.chans = make(map[chan BlobEvent]struct{})
+	}
+	w.chans[ch] = struct{}{}
+	w.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-store.closing:
+		}
+		w.remove(ch)
+	}()
+	return ch
+}
+
+// remove closes ch, unless it was already closed
+func (w *watchers) remove(ch chan BlobEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.chans[ch]; ok {
+		delete(w.chans, ch)
+		close(ch)
+	}
+}
+
+// watching returns true if anyone watches the store, so that we don't
+// create events nobody gets
+func (w *watchers) watching() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.chans) > 0
+}
+
+// notify sends events to all watchers. Only called by writer goroutine
+func (w *watchers) notify(events []BlobEvent) {
+	if len(events) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.chans {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+				continue
+			default:
+			}
+			// doesn't keep up
+			delete(w.chans, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// blobEvent returns event for blob, whose record ends at seq in the index
+func (store *Store) blobEvent(blob *blob, seq int64, deleted bool) BlobEvent {
+	return BlobEvent{
+		Id:         fmt.Sprintf("%x", blob.sha1[:]),
+		Size:       store.contentSize(blob),
+		Seq:        seq,
+		Deleted:    deleted,
+		Generation: store.idxGen,
+	}
+}
+
+// SegmentEventKind tells what happened to a segment file
+type SegmentEventKind int
+
+const (
+	// SegmentCreated is sent when a new segment file is created. New blobs
+	// are appended to it
+	SegmentCreated SegmentEventKind = iota
+	// SegmentSealed is sent when a segment file is full. It's not written
+	// to anymore (unless WithPunchHoles() or WithSpaceReuse() is used)
+	SegmentSealed
+	// SegmentRemoved is sent when a sealed segment file without blobs is
+	// removed by GC() or compaction
+	SegmentRemoved
+)
+
+// SegmentEvent describes a change of a segment file
+type SegmentEvent struct {
+	Kind SegmentEventKind
+	No   int
+	Path string
+	// size of the file, for SegmentSealed
+	Size int64
+}
+
+// WithSegmentEvents makes the store call fn when a segment file is created,
+// sealed or removed. fn is called after the change, from the goroutine
+// that made it (e.g. the writer goroutine), so it shouldn't block for long
+func WithSegmentEvents(fn func(SegmentEvent)) Option {
+	return func(store *Store) {
+		store.onSegmentEvent = fn
+	}
+}
+
+// segmentEvent calls the callback set with WithSegmentEvents(), if any.
+// Must be called without store locked
+func (store *Store) segmentEvent(kind SegmentEventKind, nSegment int, size int64) {
+	if store.onSegmentEvent == nil {
+		return
+	}
+	store.onSegmentEvent(SegmentEvent{
+		Kind: kind,
+		No:   nSegment,
+		Path: segmentFilePath(store.basePath, nSegment),
+		Size: size,
+	})
+}
@@ -0,0 +1,490 @@
+package contentstore
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+)
+
+// All writes are done by a single writer goroutine. Put() sends a request
+// over a channel and waits for the reply. The writer takes all requests
+// that are waiting, appends their data to the current segment and does
+// a single fsync for all of them (group commit) before writing index
+// records and replying. This way concurrent Put()s don't fight over the
+// lock and don't pay for an fsync each. Concurrent Put()s of the same
+// data are coalesced: only the first one is sent to the writer and the
+// others get its result (see follow()).
+//
+// Only the writer modifies current segment file and the index. It takes
+// the store lock when it changes state visible to readers.
+
+var (
+	errClosed   = errors.New("store is closed")
+	errReadOnly = errors.New("store is read-only")
+)
+
+const (
+	// max number of requests written with a single fsync
+	maxWriteBatch = 256
+)
+
+type putRequest struct {
+	d    []byte
+	sha1 [20]byte
+	// only calculated for stores opened with WithSha256Ids()
+	sha256 [32]byte
+	// set by PutWithSource()
+	source string
+	id     string
+	err    error
+	// closed when the request has been processed
+	done chan struct{}
+	// requests with the same data that were submitted while this one
+	// was in flight. They get the same result
+	followers []*putRequest
+	// if not empty, this is a request to delete blobs (see delete.go)
+	dels [][20]byte
+	// number of blobs deleted
+	nDeleted int
+	// if set, this is a request to move the blob, whose data is d, to the
+	// current segment (see compact.go)
+	move *blob
+	// if true, this is a request to rewrite the index (see compact.go)
+	rewriteIndex bool
+	// if set, this is a request to fill it with the state of files for
+	// a backup (see backup.go)
+	backup *backupSnapshot
+	// if set, data is read from file instead of d (see stream.go). sha1
+	// (and sha256) are calculated by the caller
+	file     *os.File
+	fileSize int
+	// stored in the index record of the blob (see PutWithExtra())
+	extra []byte
+}
+
+func newPutRequest(d []byte) *putRequest {
+	return &putRequest{
+		d:    d,
+		done: make(chan struct{}),
+	}
+}
+
+// size returns size of data of the request
+func (req *putRequest) size() int {
+	if req.file != nil {
+		return req.fileSize
+	}
+	return len(req.d)
+}
+
+func (store *Store) calcId(req *putRequest) {
+	if req.file == nil {
+		req.sha1 = store.sha1Of(req.d)
+	}
+	req.id = fmt.Sprintf("%x", req.sha1[:])
+}
+
+// accept registers request as accepted by the store, so that Sync()
+// waits for it
+func (store *Store) accept(req *putRequest) {
+	store.inFlightMu.Lock()
+	store.inFlight[req] = struct{}{}
+	store.inFlightMu.Unlock()
+}
+
+// finish marks request as processed, with err as the result
+func (store *Store) finish(req *putRequest, err error) {
+	req.err = err
+	if err != nil {
+		req.id = ""
+	}
+	req.d = nil
+	store.inFlightMu.Lock()
+	delete(store.inFlight, req)
+	if store.inFlightIds[req.sha1] == req {
+		delete(store.inFlightIds, req.sha1)
+	}
+	followers := req.followers
+	req.followers = nil
+	store.inFlightMu.Unlock()
+	close(req.done)
+	for _, f := range followers {
+		store.finish(f, err)
+	}
+}
+
+// follow makes req share the result of request with the same data that is
+// already in flight, if there is one. Returns false if there isn't
+func (store *Store) follow(req *putRequest) bool {
+	store.inFlightMu.Lock()
+	leader := store.inFlightIds[req.sha1]
+	if leader == nil {
+		store.inFlightIds[req.sha1] = req
+	} else {
+		leader.followers = append(leader.followers, req)
+	}
+	store.inFlightMu.Unlock()
+	if leader == nil {
+		return false
+	}
+	store.Lock()
+	store.countDedupHit(req)
+	store.Unlock()
+	return true
+}
+
+// countDedupHit counts Put() of content that was already in the store.
+// Must be called with store locked
+func (store *Store) countDedupHit(req *putRequest) {
+	store.dedupHits++
+	store.dedupSavedBytes += int64(req.size())
+	if req.source != "" {
+		s := store.sourceStats(req.source)
+		s.DedupHits++
+		s.DedupSavedBytes += int64(req.size())
+	}
+}
+
+// sourceStats returns statistics of source, creating them if needed. Must
+// be called with store locked
+func (store *Store) sourceStats(source string) *SourceStats {
+	if store.sources == nil {
+		store.sources = make(map[string]*SourceStats)
+	}
+	s := store.sources[source]
+	if s == nil {
+		s = &SourceStats{}
+		store.sources[source] = s
+	}
+	return s
+}
+
+func (req *putRequest) wait() (string, error) {
+	<-req.done
+	return req.id, req.err
+}
+
+// submit calculates id of the data and sends request to writer goroutine
+func (store *Store) submit(req *putRequest) error {
+	if store.readOnly {
+		return errReadOnly
+	}
+	if store.maxBlobSize > 0 && req.size() > store.maxBlobSize {
+		return ErrBlobTooLarge
+	}
+	store.calcId(req)
+	if req.source != "" {
+		store.Lock()
+		s := store.sourceStats(req.source)
+		s.Puts++
+		s.Bytes += int64(req.size())
+		store.Unlock()
+	}
+	if store.follow(req) {
+		// concurrent Put() of the same data, no need to write it again
+		return nil
+	}
+	if store.aliases != nil && req.file == nil {
+		req.sha256 = sha256.Sum256(req.d)
+	}
+	if store.aead != nil {
+		req.d = store.encrypt(req.d, req.sha1[:])
+	}
+	return store.send(req)
+}
+
+// send sends request to writer goroutine
+func (store *Store) send(req *putRequest) error {
+	select {
+	case store.putChan <- req:
+		return nil
+	case <-store.closing:
+		return errClosed
+	}
+}
+
+// writer is the only goroutine that writes to segment and index files
+func (store *Store) writer() {
+	defer close(store.writerDone)
+	store.checkSoftLimits()
+	batch := make([]*putRequest, 0, maxWriteBatch)
+	for {
+		select {
+		case req := <-store.putChan:
+			batch = append(batch[:0], req)
+		case <-store.closing:
+			return
+		}
+		// group commit: also take requests that are already waiting
+	drain:
+		for len(batch) < maxWriteBatch {
+			select {
+			case req := <-store.putChan:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		store.writeBatch(batch)
+	}
+}
+
+// writeBatch appends data of the requests to current segment file and
+// commits them
+func (store *Store) writeBatch(batch []*putRequest) {
+	// free disk space, checked once per batch if needed
+	free := int64(-1)
+	for _, req := range batch {
+		if len(req.dels) > 0 {
+			// blobs being deleted might have been added in this batch
+			store.commit()
+			err := store.deleteBlobs(req)
+			store.checkSoftLimits()
+			store.finish(req, err)
+			continue
+		}
+		if req.rewriteIndex {
+			store.commit()
+			store.finish(req, store.rewriteIndex())
+			continue
+		}
+		if req.backup != nil {
+			store.commit()
+			store.finish(req, store.takeBackupSnapshot(req.backup))
+			continue
+		}
+		if req.move != nil {
+			store.writeMove(req)
+			continue
+		}
+		store.Lock()
+		poisoned := store.poisoned
+		var exists bool
+		if poisoned == nil {
+			_, exists = store.index.find(req.sha1)
+			if exists {
+				store.countDedupHit(req)
+			}
+		}
+		store.Unlock()
+		if poisoned != nil {
+			store.finish(req, poisoned)
+			continue
+		}
+		if exists {
+			store.finish(req, nil)
+			continue
+		}
+		if store.quota > 0 && store.blobsSize+int64(store.pendingSize+req.size()) > store.quota {
+			store.finish(req, ErrQuotaExceeded)
+			continue
+		}
+		if store.reservedSpace > 0 {
+			if free < 0 {
+				free = store.freeSpace()
+			}
+			if free-int64(req.size()) < store.reservedSpace {
+				store.finish(req, ErrDiskFull)
+				continue
+			}
+			free -= int64(req.size())
+		}
+		created := time.Now().Unix()
+		if store.writeToHole(req, created) {
+			continue
+		}
+		blob := blob{
+			sha1:     req.sha1,
+			nSegment: store.currSegmentNo,
+			offset:   store.currSegmentSize + store.pendingSize,
+			size:     req.size(),
+			created:  created,
+			extra:    req.extra,
+		}
+		var n int
+		var err error
+		if req.file != nil {
+			n, err = store.writeFile(req)
+		} else {
+			n, err = store.currSegmentFile.Write(req.d)
+		}
+		store.pendingSize += n
+		if err != nil {
+			store.finish(req, err)
+			continue
+		}
+		store.addPending(req, blob)
+	}
+	store.commit()
+}
+
+// addPending adds blob, whose data was written to current segment, to
+// blobs committed by the next commit()
+func (store *Store) addPending(req *putRequest, blob blob) {
+	store.pending = append(store.pending, req)
+	store.pendingBlobs = append(store.pendingBlobs, blob)
+	if store.currSegmentSize+store.pendingSize >= store.maxSegmentSize {
+		// filled current segment => create a new one
+		store.commit()
+		store.sealSegment()
+	}
+}
+
+// writeMove appends data of a blob moved by compaction to current segment
+func (store *Store) writeMove(req *putRequest) {
+	store.Lock()
+	poisoned := store.poisoned
+	curr, ok := store.index.find(req.sha1)
+	store.Unlock()
+	if poisoned != nil {
+		store.finish(req, poisoned)
+		return
+	}
+	if !ok || curr.nSegment != req.move.nSegment || curr.offset != req.move.offset {
+		// deleted since compaction read it
+		store.finish(req, nil)
+		return
+	}
+	blob := blob{
+		sha1:     req.sha1,
+		nSegment: store.currSegmentNo,
+		offset:   store.currSegmentSize + store.pendingSize,
+		size:     len(req.d),
+		created:  req.move.created,
+		extra:    req.move.extra,
+	}
+	n, err := store.currSegmentFile.Write(req.d)
+	store.pendingSize += n
+	if err != nil {
+		store.finish(req, err)
+		return
+	}
+	store.addPending(req, blob)
+}
+
+// commit makes pending blobs durable, adds them to the index and replies
+// to pending requests
+func (store *Store) commit() {
+	if len(store.pending) == 0 && store.pendingSize == 0 {
+		return
+	}
+	err := store.currSegmentFile.Sync()
+	if syncErr := store.syncHoles(); err == nil {
+		err = syncErr
+	}
+	if err == nil && store.dropCacheAfterWrite {
+		// data is on disk so the kernel can drop it from cache
+		fadvise(store.currSegmentFile, int64(store.currSegmentSize), int64(store.pendingSize), fadvDontNeed)
+	}
+	var events []BlobEvent
+	if err == nil && len(store.pendingBlobs) > 0 {
+		watching := store.watchers.watching()
+		store.idxBuf = store.idxBuf[:0]
+		for i := range store.pendingBlobs {
+			if store.pending[i].move != nil {
+				store.idxBuf = appendMoveRecord(store.idxBuf, store.indexCodec, &store.pendingBlobs[i])
+				continue
+			}
+			store.idxBuf = appendBlobRecord(store.idxBuf, store.indexCodec, &store.pendingBlobs[i])
+			if watching {
+				seq := store.idxOffset + int64(len(store.idxBuf))
+				events = append(events, store.blobEvent(&store.pendingBlobs[i], seq, false))
+			}
+		}
+		if store.aliases != nil {
+			// before the index, so that blobs in it have aliases
+			err = store.writeAliases()
+		}
+		if err == nil {
+			err = store.writeIndex(store.idxBuf)
+		}
+	}
+	store.Lock()
+	// if we failed, the data we've written is orphaned but we still
+	// account for it so that offsets of future blobs are correct
+	store.currSegmentSize += store.pendingSize
+	if err != nil {
+		// we don't know what made it to disk. In particular, we might have
+		// written a part of index record and appending after it would
+		// corrupt the index
+		store.poison(err)
+	} else {
+		for i, blob := range store.pendingBlobs {
+			if store.pending[i].move != nil {
+				store.index.remove(blob.sha1)
+				store.blobsSize -= int64(blob.size)
+			}
+			store.index.add(blob)
+			store.blobsSize += int64(blob.size)
+		}
+		store.idxRecords += len(store.pendingBlobs)
+	}
+	if store.reuse != nil {
+		clear(store.reuse.pending)
+	}
+	store.Unlock()
+	if err == nil {
+		store.watchers.notify(events)
+		store.checkSoftLimits()
+	}
+	for _, req := range store.pending {
+		store.finish(req, err)
+	}
+	store.pending = store.pending[:0]
+	store.pendingBlobs = store.pendingBlobs[:0]
+	store.pendingSize = 0
+}
+
+// writeAliases saves sha256 aliases of pending blobs. Only called by writer
+// goroutine
+func (store *Store) writeAliases() error {
+	var sha256s [][32]byte
+	var sha1s [][20]byte
+	for _, req := range store.pending {
+		if req.move == nil {
+			sha256s = append(sha256s, req.sha256)
+			sha1s = append(sha1s, req.sha1)
+		}
+	}
+	if len(sha1s) == 0 {
+		return nil
+	}
+	return store.aliases.add(sha256s, sha1s)
+}
+
+// writeIndex appends d to index file. Only called by writer goroutine
+func (store *Store) writeIndex(d []byte) error {
+	n, err := store.idxFile.Write(d)
+	store.idxOffset += int64(n)
+	store.idxCrc = crc32.Update(store.idxCrc, crcTable, d[:n])
+	return err
+}
+
+// sealSegment closes current segment and creates a new one. If it fails,
+// the store is poisoned
+func (store *Store) sealSegment() {
+	store.Lock()
+	nSealed, size := store.currSegmentNo, int64(store.currSegmentSize)
+	err := closeFilePtr(&store.currSegmentFile)
+	if err != nil {
+		store.poison(err)
+		store.Unlock()
+		return
+	}
+	store.currSegmentNo += 1
+	store.currSegmentSize = 0
+	path := segmentFilePath(store.basePath, store.currSegmentNo)
+	store.currSegmentFile, err = openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		store.poison(err)
+	}
+	store.Unlock()
+
+	store.segmentEvent(SegmentSealed, nSealed, size)
+	if err == nil {
+		store.segmentEvent(SegmentCreated, nSealed+1, 0)
+	}
+}
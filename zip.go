@@ -0,0 +1,97 @@
+package contentstore
+
+import (
+	"archive/zip"
+	"io"
+)
+
+// Content often comes bundled in zip files. ImportZip() stores each file in
+// a zip as a blob and can record its name as a ref (see refs.go), so that
+// the blob can be found by it later.
+
+// ZipImportOptions configures ImportZip()
+type ZipImportOptions struct {
+	// if not empty, a ref named RefPrefix + name of the file in the zip
+	// is set to point to its blob
+	RefPrefix string
+}
+
+// ImportedFile is a file stored by ImportZip()
+type ImportedFile struct {
+	// name of the file in the zip
+	Name string
+	Id   string
+}
+
+const (
+	// how many PutAsync() we keep in flight when importing. More means
+	// fewer fsyncs but more memory
+	maxImportsInFlight = 64
+)
+
+// ImportZip stores every file from a zip file, read from r of a given size,
+// as a blob. Files are read one at a time and written in batches. It returns
+// names and ids of imported files, in the order they're in the zip.
+// Directories and symlinks are skipped
+func (store *Store) ImportZip(r io.ReaderAt, size int64, opts ZipImportOptions) ([]ImportedFile, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var res []ImportedFile
+	var inFlight []*PutFuture
+	done := 0
+	wait := func(n int) error {
+		for len(inFlight) > n {
+			id, err := inFlight[0].Wait()
+			if err != nil {
+				return err
+			}
+			res[done].Id = id
+			done++
+			inFlight = inFlight[1:]
+		}
+		return nil
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if store.maxBlobSize > 0 && f.UncompressedSize64 > uint64(store.maxBlobSize) {
+			// don't decompress what we won't store
+			err = ErrBlobTooLarge
+			break
+		}
+		var d []byte
+		if d, err = readZipFile(f); err != nil {
+			break
+		}
+		inFlight = append(inFlight, store.PutAsync(d))
+		res = append(res, ImportedFile{Name: f.Name})
+		if err = wait(maxImportsInFlight); err != nil {
+			break
+		}
+	}
+	if waitErr := wait(0); err == nil {
+		err = waitErr
+	}
+	res = res[:done]
+	if err != nil || opts.RefPrefix == "" {
+		return res, err
+	}
+	refs := make(map[string]string, len(res))
+	for _, f := range res {
+		refs[opts.RefPrefix+f.Name] = f.Id
+	}
+	return res, store.setRefs(refs)
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// also checks crc32 of the content
+	return io.ReadAll(r)
+}